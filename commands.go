@@ -0,0 +1,164 @@
+package main
+
+import (
+	"cloud-platform/internal/config"
+	"cloud-platform/internal/database"
+	"cloud-platform/internal/secrets"
+	"cloud-platform/internal/services"
+	"flag"
+	"fmt"
+)
+
+// runCommand runs a maintenance sub-command instead of starting the API server
+func runCommand(name string, args []string) error {
+	switch name {
+	case "generate-master-key":
+		return generateMasterKeyCommand()
+	case "reencrypt":
+		return reencryptCommand(args)
+	case "drift":
+		return driftCommand(args)
+	default:
+		return fmt.Errorf("unknown command %q (available: generate-master-key, reencrypt, drift)", name)
+	}
+}
+
+// generateMasterKeyCommand prints a new random master key for private key encryption
+func generateMasterKeyCommand() error {
+	key, err := secrets.GenerateMasterKey()
+	if err != nil {
+		return fmt.Errorf("failed to generate master key: %w", err)
+	}
+	fmt.Println(key)
+	return nil
+}
+
+// reencryptCommand re-encrypts every stored private key and preshared key under a new master key
+//
+// The current master key is loaded from config.yaml as usual and is only used for decryption.
+// After the command succeeds, point security.master_key_file (or the env var) at the new key.
+func reencryptCommand(args []string) error {
+	flags := flag.NewFlagSet("reencrypt", flag.ContinueOnError)
+	configPath := flags.String("config", "config.yaml", "path to config file")
+	newKeyFile := flags.String("new-key-file", "", "file containing the new base64 master key")
+	newKeyEnv := flags.String("new-key-env", "", "environment variable containing the new base64 master key")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *newKeyFile == "" && *newKeyEnv == "" {
+		return fmt.Errorf("either -new-key-file or -new-key-env is required")
+	}
+
+	newKey, err := secrets.LoadMasterKey(*newKeyFile, *newKeyEnv)
+	if err != nil {
+		return fmt.Errorf("failed to load new master key: %w", err)
+	}
+	if newKey == nil {
+		return fmt.Errorf("new master key is empty")
+	}
+
+	if err := config.LoadConfig(*configPath); err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	// InitDB loads the current master key into the default keyring
+	if err := database.InitDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+
+	// Keep the current key for decryption and encrypt everything with the new one
+	keyring := secrets.Default()
+	keyring.SetPrimary(newKey)
+
+	count, err := database.ReencryptSecrets(false)
+	if err != nil {
+		return fmt.Errorf("failed to re-encrypt secrets: %w", err)
+	}
+
+	fmt.Printf("Re-encrypted secrets of %d records with master key %s\n", count, newKey.ID())
+	fmt.Println("Update security.master_key_file or the master key environment variable to the new key before restarting")
+	return nil
+}
+
+// driftCommand compares the live host and namespace state with what the database describes
+//
+// It lists missing and unexpected namespaces, veth pairs, firewall chains, peer routes and
+// legacy iptables rules. With -fix it removes the unexpected items, re-applies the servers
+// that have missing ones and prints the remaining drift.
+func driftCommand(args []string) error {
+	flags := flag.NewFlagSet("drift", flag.ContinueOnError)
+	configPath := flags.String("config", "config.yaml", "path to config file")
+	fix := flags.Bool("fix", false, "remove unexpected items and re-apply servers with missing ones")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if err := config.LoadConfig(*configPath); err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	if err := database.InitDB(); err != nil {
+		return fmt.Errorf("failed to initialize database: %w", err)
+	}
+
+	networkService := services.NewUserNetworkService(database.DB, config.AppConfig.Network)
+	report, err := networkService.DetectDrift()
+	if err != nil {
+		return fmt.Errorf("failed to detect drift: %w", err)
+	}
+	printDriftReport(report)
+
+	if !*fix || report.Clean() {
+		return nil
+	}
+
+	fixErr := networkService.FixDrift(report)
+	remaining, err := networkService.DetectDrift()
+	if err != nil {
+		return fmt.Errorf("failed to detect drift after fixing: %w", err)
+	}
+	fmt.Println()
+	fmt.Println("After fixing:")
+	printDriftReport(remaining)
+
+	if fixErr != nil {
+		return fmt.Errorf("some items could not be fixed: %w", fixErr)
+	}
+	return nil
+}
+
+// printDriftReport prints one line per drift item
+func printDriftReport(report *services.DriftReport) {
+	fmt.Printf("Firewall backend: %s, %d servers checked\n", report.Firewall, report.Servers)
+	if report.Clean() {
+		fmt.Println("No drift found")
+		return
+	}
+
+	for _, group := range []struct {
+		label string
+		items []services.DriftItem
+	}{{"missing", report.Missing}, {"unexpected", report.Unexpected}} {
+		for _, item := range group.items {
+			location := item.Namespace
+			if location == "" {
+				location = "host"
+			}
+			family := "ipv4"
+			if item.IPv6 {
+				family = "ipv6"
+			}
+
+			detail := ""
+			switch item.Kind {
+			case services.DriftChain:
+				detail = " (" + family + ")"
+			case services.DriftRule:
+				detail = " (" + family + " " + item.Table + ")"
+			case services.DriftRoute:
+				detail = " dev " + item.Device
+			}
+			fmt.Printf("%-10s %-9s %-16s %s%s\n", group.label, item.Kind, location, item.Name, detail)
+		}
+	}
+}
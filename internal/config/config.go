@@ -12,6 +12,7 @@ type Config struct {
 	Database DatabaseConfig `yaml:"database"`
 	JWT      JWTConfig      `yaml:"jwt"`
 	Network  NetworkConfig  `yaml:"network"`
+	Security SecurityConfig `yaml:"security"`
 }
 
 type ServerConfig struct {
@@ -26,17 +27,55 @@ type DatabaseConfig struct {
 	Name     string `yaml:"name"`
 }
 
+// SecurityConfig 私钥加密配置
+type SecurityConfig struct {
+	MasterKeyFile string `yaml:"master_key_file"` // 主密钥文件（base64编码的32字节密钥）
+	MasterKeyEnv  string `yaml:"master_key_env"`  // 存放主密钥的环境变量名，默认 "WG_MASTER_KEY"，优先于文件
+}
+
 type JWTConfig struct {
 	Secret      string `yaml:"secret"`
 	ExpireHours int    `yaml:"expire_hours"`
 }
 
 type NetworkConfig struct {
-	ConfigDir     string `yaml:"config_dir"`     // WireGuard配置文件目录
-	BaseSubnet    string `yaml:"base_subnet"`    // 基础子网，如 "10.200"
-	BasePort      int    `yaml:"base_port"`      // WireGuard起始端口
-	OutInterface  string `yaml:"out_interface"`  // 外网接口名称
-	ServerIP      string `yaml:"server_ip"`      // 服务器公网IP地址
+	ConfigDir         string `yaml:"config_dir"`         // WireGuard配置文件目录
+	BaseSubnet        string `yaml:"base_subnet"`        // 基础子网，如 "10.200"
+	BasePort          int    `yaml:"base_port"`          // WireGuard起始端口
+	OutInterface      string `yaml:"out_interface"`      // 外网接口名称
+	ServerIP          string `yaml:"server_ip"`          // 服务器公网IP地址
+	ReconcileInterval int    `yaml:"reconcile_interval"` // 网络状态对账间隔（秒），0 表示使用默认值 300
+	VethSubnetPool    string `yaml:"veth_subnet_pool"`   // veth /30 子网地址池，默认 "<base_subnet>.0.0/16"
+	WgSubnetPool      string `yaml:"wg_subnet_pool"`     // 用户WireGuard /24 网段地址池，默认 "10.100.0.0/16"
+	SharedLinkPool    string `yaml:"shared_link_pool"`   // 共享网络中转命名空间与成员之间的 /30 子网地址池，默认 "10.101.0.0/16"
+	PortRangeEnd      int    `yaml:"port_range_end"`     // WireGuard端口池结束端口（含），默认 base_port+9999
+	IPv6Pool          string `yaml:"ipv6_pool"`          // 用户IPv6 ULA地址池（如 "fd00:100::/48"），每个用户分配一个/64，留空则不启用IPv6
+	KeyRotationGrace  int    `yaml:"key_rotation_grace"` // peer密钥轮换时旧公钥默认保留的宽限期（秒），0 表示立即移除
+	RequireClientKeys bool   `yaml:"require_client_keys"` // 强制客户端自行生成密钥，服务器只接收公钥、不保存任何peer私钥
+	ClientDNS         string `yaml:"client_dns"`         // 客户端配置的默认DNS（逗号分隔），服务器和peer未设置时使用，默认 "1.1.1.1, 8.8.8.8"
+	ServerQuota       int    `yaml:"server_quota"`       // 每个用户默认可创建的WireGuard服务器数量，默认 1（可在用户上单独覆盖）
+	Firewall          string `yaml:"firewall"`           // 防火墙后端：auto（默认，优先 nftables）/nftables/iptables
+	DNS               DNSConfig `yaml:"dns"`             // 内置DNS服务器
+	PortForward       PortForwardConfig `yaml:"port_forward"` // 公网端口转发
+}
+
+// DNSConfig 内置DNS服务器配置
+// 命名空间内发往WireGuard接口地址53端口的查询被转发到主机上的DNS服务器，
+// 服务器按查询来源（命名空间veth地址）区分用户，解析该用户的peer名称和自定义记录，其余查询转发到上游
+type DNSConfig struct {
+	Enabled    bool     `yaml:"enabled"`     // 是否启用内置DNS，启用后客户端配置默认使用它
+	ListenPort int      `yaml:"listen_port"` // 主机上的监听端口（UDP/TCP），默认 10053
+	Zone       string   `yaml:"zone"`        // 根域名，用户的域名为 <用户名>.<zone>，默认 "vpn"
+	Upstreams  []string `yaml:"upstreams"`   // 上游DNS服务器（host:port），默认 1.1.1.1:53、8.8.8.8:53
+	TTL        int      `yaml:"ttl"`         // 应答记录的TTL（秒），默认 60
+}
+
+// PortForwardConfig 公网端口转发配置
+// 用户可将端口池中的主机端口经命名空间转发到某个peer的端口（如家中服务器的SSH）
+type PortForwardConfig struct {
+	PortStart int `yaml:"port_start"` // 公网端口池起始端口，0 表示不启用端口转发
+	PortEnd   int `yaml:"port_end"`   // 公网端口池结束端口（含）
+	Quota     int `yaml:"quota"`      // 每个用户默认可使用的端口数量，默认 5（可在用户上单独覆盖）
 }
 
 var AppConfig *Config
@@ -56,6 +95,115 @@ func LoadConfig(configPath string) error {
 	return nil
 }
 
+// GetVethSubnetPool 获取veth子网地址池
+func (n *NetworkConfig) GetVethSubnetPool() string {
+	if n.VethSubnetPool != "" {
+		return n.VethSubnetPool
+	}
+	return n.BaseSubnet + ".0.0/16"
+}
+
+// GetWgSubnetPool 获取WireGuard网段地址池
+func (n *NetworkConfig) GetWgSubnetPool() string {
+	if n.WgSubnetPool != "" {
+		return n.WgSubnetPool
+	}
+	return "10.100.0.0/16"
+}
+
+// GetSharedLinkPool 获取共享网络连接子网地址池
+func (n *NetworkConfig) GetSharedLinkPool() string {
+	if n.SharedLinkPool != "" {
+		return n.SharedLinkPool
+	}
+	return "10.101.0.0/16"
+}
+
+// GetPortRange 获取WireGuard端口池范围（含两端）
+func (n *NetworkConfig) GetPortRange() (int, int) {
+	if n.PortRangeEnd > n.BasePort {
+		return n.BasePort, n.PortRangeEnd
+	}
+	return n.BasePort, n.BasePort + 9999
+}
+
+// GetClientDNS 获取客户端配置的默认DNS
+func (n *NetworkConfig) GetClientDNS() string {
+	if n.ClientDNS != "" {
+		return n.ClientDNS
+	}
+	return "1.1.1.1, 8.8.8.8"
+}
+
+// GetServerQuota 获取每个用户默认可创建的WireGuard服务器数量
+func (n *NetworkConfig) GetServerQuota() int {
+	if n.ServerQuota > 0 {
+		return n.ServerQuota
+	}
+	return 1
+}
+
+// GetFirewall 获取防火墙后端，默认 auto（nft 可用且主机 FORWARD 链策略不是 DROP 时使用 nftables，否则回退到 iptables）
+func (n *NetworkConfig) GetFirewall() string {
+	if n.Firewall != "" {
+		return n.Firewall
+	}
+	return "auto"
+}
+
+// GetListenPort 获取内置DNS服务器的监听端口
+func (d *DNSConfig) GetListenPort() int {
+	if d.ListenPort > 0 {
+		return d.ListenPort
+	}
+	return 10053
+}
+
+// GetZone 获取内置DNS的根域名
+func (d *DNSConfig) GetZone() string {
+	if d.Zone != "" {
+		return d.Zone
+	}
+	return "vpn"
+}
+
+// GetUpstreams 获取上游DNS服务器
+func (d *DNSConfig) GetUpstreams() []string {
+	if len(d.Upstreams) > 0 {
+		return d.Upstreams
+	}
+	return []string{"1.1.1.1:53", "8.8.8.8:53"}
+}
+
+// GetTTL 获取应答记录的TTL（秒）
+func (d *DNSConfig) GetTTL() int {
+	if d.TTL > 0 {
+		return d.TTL
+	}
+	return 60
+}
+
+// Enabled 是否配置了公网端口池
+func (p *PortForwardConfig) Enabled() bool {
+	return p.PortStart > 0 && p.PortEnd >= p.PortStart
+}
+
+// GetQuota 获取每个用户默认可使用的端口数量
+func (p *PortForwardConfig) GetQuota() int {
+	if p.Quota > 0 {
+		return p.Quota
+	}
+	return 5
+}
+
+// GetMasterKeyEnv 获取存放主密钥的环境变量名
+func (s *SecurityConfig) GetMasterKeyEnv() string {
+	if s.MasterKeyEnv != "" {
+		return s.MasterKeyEnv
+	}
+	return "WG_MASTER_KEY"
+}
+
 func (c *Config) GetDSN() string {
 	return fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
 		c.Database.Host, c.Database.Port, c.Database.User, c.Database.Password, c.Database.Name)
@@ -3,8 +3,11 @@ package database
 import (
 	"cloud-platform/internal/config"
 	"cloud-platform/internal/models"
+	"cloud-platform/internal/secrets"
 	"cloud-platform/internal/services"
 	"fmt"
+	"hash/fnv"
+	"strings"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
@@ -22,17 +25,61 @@ func InitDB() error {
 
 	DB = db
 
+	// 加载私钥加密主密钥（必须在读写任何私钥之前）
+	masterKey, err := secrets.LoadMasterKey(config.AppConfig.Security.MasterKeyFile, config.AppConfig.Security.GetMasterKeyEnv())
+	if err != nil {
+		return fmt.Errorf("failed to load master key: %w", err)
+	}
+	if masterKey != nil {
+		secrets.Default().SetPrimary(masterKey)
+	} else {
+		fmt.Println("Warning: No master key configured, WireGuard private keys are stored unencrypted")
+	}
+
+	// 旧版本每个用户只能有一个服务器（user_id 唯一索引），迁移前删除该索引
+	if db.Migrator().HasIndex(&models.WireguardServer{}, "idx_wireguard_servers_user_id") {
+		if err := db.Migrator().DropIndex(&models.WireguardServer{}, "idx_wireguard_servers_user_id"); err != nil {
+			return fmt.Errorf("failed to drop unique server index: %w", err)
+		}
+	}
+
 	// Auto migrate the schema
 	err = db.AutoMigrate(
 		&models.User{},
 		&models.WireguardServer{},
 		&models.WireguardPeer{},
 		&models.MonitoringRecord{},
+		&models.IPAllocation{},
+		&models.PortAllocation{},
+		&models.WireguardPeerKeyRotation{},
+		&models.WireguardACL{},
+		&models.WireguardPeerLink{},
+		&models.DNSRecord{},
+		&models.PortForward{},
+		&models.SharedNetwork{},
+		&models.SharedNetworkMember{},
+		&models.SharedNetworkPeer{},
 	)
 	if err != nil {
 		return fmt.Errorf("failed to migrate database: %w", err)
 	}
 
+	// 为旧版本创建的服务器补齐IPAM分配记录
+	if err := backfillNetworkAllocations(); err != nil {
+		return fmt.Errorf("failed to backfill network allocations: %w", err)
+	}
+
+	// 配置主密钥后，加密旧版本遗留的明文私钥
+	if secrets.Default().Enabled() {
+		count, err := ReencryptSecrets(true)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt plaintext secrets: %w", err)
+		}
+		if count > 0 {
+			fmt.Printf("Encrypted secrets of %d records\n", count)
+		}
+	}
+
 	// Create default platform admin if not exists
 	if err := createDefaultPlatformAdmin(); err != nil {
 		return fmt.Errorf("failed to create default platform admin: %w", err)
@@ -62,12 +109,7 @@ func createDefaultPlatformAdmin() error {
 		// 为管理员配置网络环境
 		DB.First(&defaultAdmin, defaultAdmin.ID)
 		
-		networkService := services.NewUserNetworkService(
-			config.AppConfig.Network.ConfigDir,
-			config.AppConfig.Network.BaseSubnet,
-			config.AppConfig.Network.BasePort,
-			config.AppConfig.Network.OutInterface,
-		)
+		networkService := services.NewUserNetworkService(DB, config.AppConfig.Network)
 
 		wgServer, err := networkService.ProvisionUserNetwork(&defaultAdmin)
 		if err != nil {
@@ -75,10 +117,13 @@ func createDefaultPlatformAdmin() error {
 			fmt.Println("Default admin created: admin@platform.com / password (without network)")
 		} else {
 			// 保存管理员的网络配置信息到数据库
-			if err := DB.Create(wgServer).Error; err != nil {
+			err := DB.Create(wgServer).Error
+			if err != nil {
 				fmt.Printf("Warning: Failed to save admin network info: %v\n", err)
 				networkService.DestroyUserNetwork(wgServer, defaultAdmin.UserUID)
-			} else {
+			}
+			networkService.FinishProvisioning(wgServer)
+			if err == nil {
 				fmt.Println("Default admin created: admin@platform.com / password (with network)")
 			}
 		}
@@ -86,3 +131,97 @@ func createDefaultPlatformAdmin() error {
 
 	return nil
 }
+
+// backfillNetworkAllocations 为旧版本（基于UserUID哈希分配地址和端口）创建的服务器
+// 补齐veth子网字段，并将其正在使用的子网和端口登记到IPAM，避免新分配与之冲突
+func backfillNetworkAllocations() error {
+	var servers []models.WireguardServer
+	if err := DB.Preload("User").Find(&servers).Error; err != nil {
+		return err
+	}
+
+	networkService := services.NewUserNetworkService(DB, config.AppConfig.Network)
+	for i := range servers {
+		server := &servers[i]
+		if server.VethSubnet == "" {
+			server.VethSubnet = legacyVethSubnet(server.User.UserUID)
+			if err := DB.Model(server).Update("veth_subnet", server.VethSubnet).Error; err != nil {
+				return err
+			}
+		}
+
+		if err := networkService.ReserveExistingAllocation(server); err != nil {
+			// 旧版本的哈希分配本身可能已经冲突，仅记录警告，由管理员处理
+			fmt.Printf("Warning: Failed to reserve network allocation for server %d: %v\n", server.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// legacyVethSubnet 旧版本基于UserUID哈希计算的veth子网
+func legacyVethSubnet(userUID string) string {
+	h := fnv.New32a()
+	h.Write([]byte(userUID))
+	userSubnetID := (int(h.Sum32()) % 254) + 1
+	return fmt.Sprintf("%s.%d.0/30", config.AppConfig.Network.BaseSubnet, userSubnetID)
+}
+
+// ReencryptSecrets 使用当前主密钥重新加密数据库中的所有私钥和预共享密钥
+// onlyPlaintext 为 true 时只处理尚未加密的旧数据；返回处理的记录数
+func ReencryptSecrets(onlyPlaintext bool) (int, error) {
+	count := 0
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		// 1. 服务器私钥
+		var servers []models.WireguardServer
+		if err := secretsQuery(tx, onlyPlaintext, "wg_private_key").Find(&servers).Error; err != nil {
+			return err
+		}
+		for i := range servers {
+			if err := tx.Model(&servers[i]).Select("wg_private_key").UpdateColumns(&servers[i]).Error; err != nil {
+				return err
+			}
+		}
+		count += len(servers)
+
+		// 2. peer私钥和预共享密钥
+		var peers []models.WireguardPeer
+		if err := secretsQuery(tx, onlyPlaintext, "private_key", "preshared_key").Find(&peers).Error; err != nil {
+			return err
+		}
+		for i := range peers {
+			if err := tx.Model(&peers[i]).Select("private_key", "preshared_key").UpdateColumns(&peers[i]).Error; err != nil {
+				return err
+			}
+		}
+		count += len(peers)
+
+		// 3. 密钥轮换宽限期内保留的旧预共享密钥
+		var rotations []models.WireguardPeerKeyRotation
+		if err := secretsQuery(tx, onlyPlaintext, "old_preshared_key").Find(&rotations).Error; err != nil {
+			return err
+		}
+		for i := range rotations {
+			if err := tx.Model(&rotations[i]).Select("old_preshared_key").UpdateColumns(&rotations[i]).Error; err != nil {
+				return err
+			}
+		}
+		count += len(rotations)
+
+		return nil
+	})
+	return count, err
+}
+
+// secretsQuery onlyPlaintext 为 true 时只查询任一加密列仍为明文的记录
+func secretsQuery(tx *gorm.DB, onlyPlaintext bool, columns ...string) *gorm.DB {
+	if !onlyPlaintext {
+		return tx
+	}
+
+	conditions := make([]string, 0, len(columns))
+	for _, column := range columns {
+		conditions = append(conditions, fmt.Sprintf("(%s <> '' AND %s NOT LIKE '%s%%')", column, column, secrets.EncryptedPrefix))
+	}
+	return tx.Where(strings.Join(conditions, " OR "))
+}
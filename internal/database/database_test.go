@@ -0,0 +1,153 @@
+package database
+
+import (
+	"cloud-platform/internal/models"
+	"cloud-platform/internal/secrets"
+	"strings"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// useTestDB 将全局 DB 替换为内存SQLite数据库，测试结束后恢复
+func useTestDB(t *testing.T) {
+	t.Helper()
+
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("open test database: %v", err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("open test database: %v", err)
+	}
+	// 每个连接都是独立的内存数据库，只保留一个连接
+	sqlDB.SetMaxOpenConns(1)
+	if err := db.AutoMigrate(&models.User{}, &models.WireguardServer{}, &models.WireguardPeer{}, &models.WireguardPeerKeyRotation{}); err != nil {
+		t.Fatalf("migrate test database: %v", err)
+	}
+
+	previous := DB
+	DB = db
+	t.Cleanup(func() {
+		DB = previous
+		sqlDB.Close()
+	})
+}
+
+// useMasterKey 设置全局密钥环的加密主密钥，测试结束后关闭加密
+func useMasterKey(t *testing.T, encoded string) *secrets.MasterKey {
+	t.Helper()
+	key, err := secrets.ParseMasterKey(encoded)
+	if err != nil {
+		t.Fatalf("parse master key: %v", err)
+	}
+	secrets.Default().SetPrimary(key)
+	t.Cleanup(func() { secrets.Default().SetPrimary(nil) })
+	return key
+}
+
+// storedValue 读取列在数据库中的原始值（不经过序列化器）
+func storedValue(t *testing.T, table, column string, id uint) string {
+	t.Helper()
+	var value string
+	if err := DB.Raw("SELECT "+column+" FROM "+table+" WHERE id = ?", id).Scan(&value).Error; err != nil {
+		t.Fatalf("read %s.%s: %v", table, column, err)
+	}
+	return value
+}
+
+func TestReencryptSecrets(t *testing.T) {
+	useTestDB(t)
+
+	// 未配置主密钥时写入的是旧版本的明文数据
+	user := models.User{Email: "alice@example.com", PasswordHash: "x", Name: "alice"}
+	if err := DB.Create(&user).Error; err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	server := models.WireguardServer{
+		UserID: user.ID, Namespace: "wg_alice", WgInterface: "wg0", WgPort: 51820,
+		WgPublicKey: "server-pub", WgPrivateKey: "server-priv", WgAddress: "10.100.0.1/24",
+	}
+	if err := DB.Create(&server).Error; err != nil {
+		t.Fatalf("create server: %v", err)
+	}
+	withPSK := models.WireguardPeer{ServerID: server.ID, PublicKey: "peer1-pub", PrivateKey: "peer1-priv", PresharedKey: "peer1-psk", PeerAddress: "10.100.0.2", AllowedIPs: "10.100.0.2/32"}
+	clientKey := models.WireguardPeer{ServerID: server.ID, PublicKey: "peer2-pub", PeerAddress: "10.100.0.3", AllowedIPs: "10.100.0.3/32"}
+	for _, peer := range []*models.WireguardPeer{&withPSK, &clientKey} {
+		if err := DB.Create(peer).Error; err != nil {
+			t.Fatalf("create peer: %v", err)
+		}
+	}
+	rotation := models.WireguardPeerKeyRotation{PeerID: withPSK.ID, OldPublicKey: "old-pub", OldPresharedKey: "old-psk", NewPublicKey: "peer1-pub"}
+	if err := DB.Create(&rotation).Error; err != nil {
+		t.Fatalf("create rotation: %v", err)
+	}
+	if value := storedValue(t, "wireguard_servers", "wg_private_key", server.ID); value != "server-priv" {
+		t.Fatalf("private key stored without a master key = %q, want plaintext", value)
+	}
+
+	// 启动时配置了主密钥：只加密仍为明文的记录
+	firstKey := useMasterKey(t, "YWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWE=")
+	count, err := ReencryptSecrets(true)
+	if err != nil {
+		t.Fatalf("encrypt plaintext secrets: %v", err)
+	}
+	// 没有任何密钥的peer不需要处理
+	if count != 3 {
+		t.Errorf("encrypted %d records, want 3", count)
+	}
+	assertEncryptedWith(t, firstKey, server.ID, withPSK.ID, rotation.ID)
+	if value := storedValue(t, "wireguard_peers", "private_key", clientKey.ID); value != "" {
+		t.Errorf("empty private key stored as %q, want empty", value)
+	}
+
+	if count, err := ReencryptSecrets(true); err != nil || count != 0 {
+		t.Errorf("second pass = %d, %v, want nothing left to encrypt", count, err)
+	}
+
+	// 更换主密钥：旧主密钥仍用于解密，所有记录使用新主密钥重新加密
+	secondKey := useMasterKey(t, "YmJiYmJiYmJiYmJiYmJiYmJiYmJiYmJiYmJiYmJiYmI=")
+	if count, err := ReencryptSecrets(false); err != nil || count != 4 {
+		t.Errorf("re-encrypt with a new key = %d, %v, want all 4 records", count, err)
+	}
+	assertEncryptedWith(t, secondKey, server.ID, withPSK.ID, rotation.ID)
+
+	// 通过序列化器读取得到原始明文
+	var loadedServer models.WireguardServer
+	var loadedPeer models.WireguardPeer
+	var loadedRotation models.WireguardPeerKeyRotation
+	DB.First(&loadedServer, server.ID)
+	DB.First(&loadedPeer, withPSK.ID)
+	DB.First(&loadedRotation, rotation.ID)
+	if loadedServer.WgPrivateKey != "server-priv" || loadedPeer.PrivateKey != "peer1-priv" ||
+		loadedPeer.PresharedKey != "peer1-psk" || loadedRotation.OldPresharedKey != "old-psk" {
+		t.Errorf("decrypted secrets = %q, %q, %q, %q", loadedServer.WgPrivateKey, loadedPeer.PrivateKey,
+			loadedPeer.PresharedKey, loadedRotation.OldPresharedKey)
+	}
+	// 其他列不受影响
+	if loadedServer.WgPublicKey != "server-pub" || loadedPeer.PublicKey != "peer1-pub" {
+		t.Errorf("public keys changed to %q, %q", loadedServer.WgPublicKey, loadedPeer.PublicKey)
+	}
+}
+
+// assertEncryptedWith 确认服务器私钥、peer私钥和预共享密钥、旧预共享密钥都由 key 加密
+func assertEncryptedWith(t *testing.T, key *secrets.MasterKey, serverID, peerID, rotationID uint) {
+	t.Helper()
+	prefix := secrets.EncryptedPrefix + key.ID() + ":"
+	for _, column := range []struct {
+		table, name string
+		id          uint
+	}{
+		{"wireguard_servers", "wg_private_key", serverID},
+		{"wireguard_peers", "private_key", peerID},
+		{"wireguard_peers", "preshared_key", peerID},
+		{"wireguard_peer_key_rotations", "old_preshared_key", rotationID},
+	} {
+		if value := storedValue(t, column.table, column.name, column.id); !strings.HasPrefix(value, prefix) {
+			t.Errorf("%s.%s = %q, want encrypted with key %s", column.table, column.name, value, key.ID())
+		}
+	}
+}
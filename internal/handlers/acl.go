@@ -0,0 +1,282 @@
+package handlers
+
+import (
+	"cloud-platform/internal/config"
+	"cloud-platform/internal/database"
+	"cloud-platform/internal/models"
+	"cloud-platform/internal/response"
+	"cloud-platform/internal/services"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// defaultACLPriority 未指定优先级时的默认值
+const defaultACLPriority = 100
+
+// CreateACLRequest 创建ACL规则请求
+type CreateACLRequest struct {
+	PeerID      uint   `json:"peer_id" binding:"required"`
+	Destination string `json:"destination" binding:"required"` // 目标IP或CIDR
+	Protocol    string `json:"protocol"`                       // all/tcp/udp/icmp，默认all
+	Port        int    `json:"port"`                           // 目标端口（仅tcp/udp，0表示所有端口）
+	Action      string `json:"action" binding:"required"`      // allow/deny
+	Priority    *int   `json:"priority"`                       // 匹配顺序，数值越小越先匹配，默认100
+	Comment     string `json:"comment"`
+}
+
+// UpdateACLRequest 更新ACL规则请求（只更新提供的字段）
+type UpdateACLRequest struct {
+	Destination *string `json:"destination"`
+	Protocol    *string `json:"protocol"`
+	Port        *int    `json:"port"`
+	Action      *string `json:"action"`
+	Priority    *int    `json:"priority"`
+	Comment     *string `json:"comment"`
+}
+
+// GetMyACLs 获取当前用户服务器的ACL规则（可通过 peer_id 过滤），按匹配顺序排列
+func GetMyACLs(c *gin.Context) {
+	user, _ := c.Get("user")
+	u := user.(*models.User)
+
+	// 获取用户的 WireGuard 服务器
+	wgServer, ok := loadMyServer(c, u)
+	if !ok {
+		return
+	}
+
+	query := database.DB.Where("server_id = ?", wgServer.ID)
+	if peerIDStr := c.Query("peer_id"); peerIDStr != "" {
+		peerID, err := strconv.ParseUint(peerIDStr, 10, 32)
+		if err != nil {
+			response.BadRequest(c, "Invalid peer ID", nil)
+			return
+		}
+		query = query.Where("peer_id = ?", peerID)
+	}
+
+	var acls []models.WireguardACL
+	if err := query.Order("peer_id, priority, id").Find(&acls).Error; err != nil {
+		response.InternalError(c, "Failed to retrieve ACL rules")
+		return
+	}
+
+	response.Success(c, "ACL rules retrieved successfully", acls)
+}
+
+// CreateACL 为peer添加ACL规则
+func CreateACL(c *gin.Context) {
+	user, _ := c.Get("user")
+	u := user.(*models.User)
+
+	var req CreateACLRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.ValidationError(c, err.Error())
+		return
+	}
+
+	// 获取用户的 WireGuard 服务器
+	wgServer, ok := loadMyServer(c, u)
+	if !ok {
+		return
+	}
+
+	unlock, ok := lockServer(c, &wgServer)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	// 服务器已被管理员禁用
+	if !wgServer.Enabled {
+		response.ServerDisabled(c)
+		return
+	}
+
+	var peer models.WireguardPeer
+	if err := database.DB.First(&peer, req.PeerID).Error; err != nil {
+		response.NotFound(c, "Peer not found")
+		return
+	}
+
+	// 确保peer属于当前用户的服务器
+	if peer.ServerID != wgServer.ID {
+		response.Forbidden(c, "You don't have permission to modify this peer")
+		return
+	}
+
+	acl := models.WireguardACL{
+		ServerID:    wgServer.ID,
+		PeerID:      peer.ID,
+		Destination: req.Destination,
+		Protocol:    req.Protocol,
+		Port:        req.Port,
+		Action:      req.Action,
+		Priority:    defaultACLPriority,
+		Comment:     req.Comment,
+	}
+	if req.Priority != nil {
+		acl.Priority = *req.Priority
+	}
+	if err := services.NormalizeACL(&acl); err != nil {
+		response.BadRequest(c, err.Error(), nil)
+		return
+	}
+
+	if err := applyACLChange(&wgServer, func(tx *gorm.DB) error {
+		return tx.Create(&acl).Error
+	}); err != nil {
+		response.InternalError(c, "Failed to apply ACL rules: "+err.Error())
+		return
+	}
+
+	response.Created(c, "ACL rule created successfully", acl)
+}
+
+// UpdateACL 更新ACL规则
+func UpdateACL(c *gin.Context) {
+	user, _ := c.Get("user")
+	u := user.(*models.User)
+
+	aclID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		response.BadRequest(c, "Invalid ACL ID", nil)
+		return
+	}
+
+	var req UpdateACLRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.ValidationError(c, err.Error())
+		return
+	}
+
+	wgServer, acl, ok := loadOwnedACL(c, u, uint(aclID))
+	if !ok {
+		return
+	}
+
+	unlock, ok := lockServer(c, &wgServer)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	if req.Destination != nil {
+		acl.Destination = *req.Destination
+	}
+	if req.Protocol != nil {
+		acl.Protocol = *req.Protocol
+		// 改为不支持端口的协议时清除端口
+		if req.Port == nil && acl.Protocol != models.ACLProtocolTCP && acl.Protocol != models.ACLProtocolUDP {
+			acl.Port = 0
+		}
+	}
+	if req.Port != nil {
+		acl.Port = *req.Port
+	}
+	if req.Action != nil {
+		acl.Action = *req.Action
+	}
+	if req.Priority != nil {
+		acl.Priority = *req.Priority
+	}
+	if req.Comment != nil {
+		acl.Comment = *req.Comment
+	}
+	if err := services.NormalizeACL(&acl); err != nil {
+		response.BadRequest(c, err.Error(), nil)
+		return
+	}
+
+	if err := applyACLChange(&wgServer, func(tx *gorm.DB) error {
+		return tx.Model(&acl).
+			Select("destination", "protocol", "port", "action", "priority", "comment").
+			Updates(&acl).Error
+	}); err != nil {
+		response.InternalError(c, "Failed to apply ACL rules: "+err.Error())
+		return
+	}
+
+	response.Success(c, "ACL rule updated successfully", acl)
+}
+
+// DeleteACL 删除ACL规则
+func DeleteACL(c *gin.Context) {
+	user, _ := c.Get("user")
+	u := user.(*models.User)
+
+	aclID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		response.BadRequest(c, "Invalid ACL ID", nil)
+		return
+	}
+
+	wgServer, acl, ok := loadOwnedACL(c, u, uint(aclID))
+	if !ok {
+		return
+	}
+
+	unlock, ok := lockServer(c, &wgServer)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	if err := applyACLChange(&wgServer, func(tx *gorm.DB) error {
+		return tx.Delete(&acl).Error
+	}); err != nil {
+		response.InternalError(c, "Failed to apply ACL rules: "+err.Error())
+		return
+	}
+
+	response.Success(c, "ACL rule deleted successfully", nil)
+}
+
+// loadOwnedACL 加载属于当前用户服务器的ACL规则，失败时已写入响应
+func loadOwnedACL(c *gin.Context, u *models.User, aclID uint) (models.WireguardServer, models.WireguardACL, bool) {
+	var acl models.WireguardACL
+
+	// 获取用户的 WireGuard 服务器
+	wgServer, ok := loadMyServer(c, u)
+	if !ok {
+		return wgServer, acl, false
+	}
+
+	// 服务器已被管理员禁用
+	if !wgServer.Enabled {
+		response.ServerDisabled(c)
+		return wgServer, acl, false
+	}
+
+	if err := database.DB.First(&acl, aclID).Error; err != nil {
+		response.NotFound(c, "ACL rule not found")
+		return wgServer, acl, false
+	}
+
+	// 确保规则属于当前用户的服务器
+	if acl.ServerID != wgServer.ID {
+		response.Forbidden(c, "You don't have permission to modify this ACL rule")
+		return wgServer, acl, false
+	}
+
+	return wgServer, acl, true
+}
+
+// applyACLChange 在事务中修改ACL规则并重新编译命名空间内的ACL链
+// 应用失败时事务回滚，并按数据库中原有的规则恢复ACL链
+func applyACLChange(wgServer *models.WireguardServer, change func(tx *gorm.DB) error) error {
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := change(tx); err != nil {
+			return err
+		}
+		networkService := services.NewUserNetworkService(tx, config.AppConfig.Network)
+		return networkService.ApplyACLs(wgServer)
+	})
+	if err != nil {
+		networkService := services.NewUserNetworkService(database.DB, config.AppConfig.Network)
+		networkService.ApplyACLs(wgServer)
+	}
+	return err
+}
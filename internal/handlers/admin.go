@@ -13,10 +13,12 @@ import (
 )
 
 type UpdateUserRequest struct {
-	Name     string          `json:"name,omitempty"`
-	Email    string          `json:"email,omitempty"`
-	Password string          `json:"password,omitempty"`
-	Role     models.UserRole `json:"role,omitempty"`
+	Name             string          `json:"name,omitempty"`
+	Email            string          `json:"email,omitempty"`
+	Password         string          `json:"password,omitempty"`
+	Role             models.UserRole `json:"role,omitempty"`
+	PortForwardQuota *int            `json:"port_forward_quota,omitempty"` // 公网端口转发配额，负数表示恢复全局默认值
+	ServerQuota      *int            `json:"server_quota,omitempty"`       // WireGuard服务器数量配额，负数表示恢复全局默认值
 }
 
 func GetAllUsers(c *gin.Context) {
@@ -63,24 +65,12 @@ func DeleteUser(c *gin.Context) {
 		return
 	}
 
-	// 清理用户的网络资源
-	var wgServer models.WireguardServer
-	if err := database.DB.Where("user_id = ?", targetUser.ID).First(&wgServer).Error; err == nil {
-		networkService := services.NewUserNetworkService(
-			config.AppConfig.Network.ConfigDir,
-			config.AppConfig.Network.BaseSubnet,
-			config.AppConfig.Network.BasePort,
-			config.AppConfig.Network.OutInterface,
-		)
-		
-		// 删除所有peers
-		database.DB.Where("server_id = ?", wgServer.ID).Delete(&models.WireguardPeer{})
-		
-		// 清理网络环境（忽略错误）
-		networkService.DestroyUserNetwork(&wgServer, targetUser.UserUID)
-		
-		// 删除服务器记录
-		database.DB.Delete(&wgServer)
+	// 清理用户的网络资源（用户的所有服务器）
+	var wgServers []models.WireguardServer
+	database.DB.Where("user_id = ?", targetUser.ID).Find(&wgServers)
+	networkService := services.NewUserNetworkService(database.DB, config.AppConfig.Network)
+	for i := range wgServers {
+		deleteUserServer(networkService, &wgServers[i], targetUser.UserUID)
 	}
 
 	if err := database.DB.Delete(&targetUser).Error; err != nil {
@@ -91,6 +81,24 @@ func DeleteUser(c *gin.Context) {
 	response.Success(c, "User deleted successfully", nil)
 }
 
+// deleteUserServer 持有服务器的锁删除其peer和记录并清理网络环境（忽略错误）
+func deleteUserServer(networkService *services.UserNetworkService, wgServer *models.WireguardServer, userUID string) {
+	unlock, err := networkService.LockServer(wgServer)
+	if err != nil {
+		return
+	}
+	defer unlock()
+
+	// 删除所有peers
+	database.DB.Where("server_id = ?", wgServer.ID).Delete(&models.WireguardPeer{})
+
+	// 清理网络环境（忽略错误）
+	networkService.DestroyUserNetwork(wgServer, userUID)
+
+	// 删除服务器记录
+	database.DB.Delete(wgServer)
+}
+
 func UpdateUser(c *gin.Context) {
 	userIDStr := c.Param("id")
 	userID, err := strconv.ParseUint(userIDStr, 10, 32)
@@ -149,6 +157,22 @@ func UpdateUser(c *gin.Context) {
 		updates["role"] = req.Role
 	}
 
+	if req.PortForwardQuota != nil {
+		if *req.PortForwardQuota < 0 {
+			updates["port_forward_quota"] = nil
+		} else {
+			updates["port_forward_quota"] = *req.PortForwardQuota
+		}
+	}
+
+	if req.ServerQuota != nil {
+		if *req.ServerQuota < 0 {
+			updates["server_quota"] = nil
+		} else {
+			updates["server_quota"] = *req.ServerQuota
+		}
+	}
+
 	if len(updates) == 0 {
 		response.BadRequest(c, "No valid fields to update", nil)
 		return
@@ -65,12 +65,7 @@ func Register(c *gin.Context) {
 	database.DB.First(&user, user.ID)
 
 	// 为用户配置网络环境（命名空间 + WireGuard）
-	networkService := services.NewUserNetworkService(
-		config.AppConfig.Network.ConfigDir,
-		config.AppConfig.Network.BaseSubnet,
-		config.AppConfig.Network.BasePort,
-		config.AppConfig.Network.OutInterface,
-	)
+	networkService := services.NewUserNetworkService(database.DB, config.AppConfig.Network)
 
 	wgServer, err := networkService.ProvisionUserNetwork(&user)
 	if err != nil {
@@ -80,7 +75,8 @@ func Register(c *gin.Context) {
 		return
 	}
 
-	// 保存 WireGuard 服务器配置到数据库
+	// 保存 WireGuard 服务器配置到数据库（保存或清理后命名空间按数据库记录参与对账）
+	defer networkService.FinishProvisioning(wgServer)
 	if err := database.DB.Create(wgServer).Error; err != nil {
 		// 清理网络环境
 		networkService.DestroyUserNetwork(wgServer, user.UserUID)
@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"cloud-platform/internal/database"
+	"cloud-platform/internal/models"
+	"cloud-platform/internal/response"
+	"cloud-platform/internal/services"
+	"fmt"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// UpdateClientRoutingRequest 更新服务器默认客户端路由请求（只更新提供的字段）
+type UpdateClientRoutingRequest struct {
+	ClientRouteMode  *string `json:"client_route_mode"`  // full/exclude_private/subnet/custom
+	ClientAllowedIPs *string `json:"client_allowed_ips"` // custom 模式下的网段列表（逗号分隔）
+	ClientDNS        *string `json:"client_dns"`         // DNS服务器列表（逗号分隔，空字符串表示使用全局默认值）
+}
+
+// UpdateMyClientRouting 更新当前用户服务器的默认客户端路由和DNS
+func UpdateMyClientRouting(c *gin.Context) {
+	user, _ := c.Get("user")
+	u := user.(*models.User)
+
+	var req UpdateClientRoutingRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.ValidationError(c, err.Error())
+		return
+	}
+
+	// 获取用户的 WireGuard 服务器
+	wgServer, ok := loadMyServer(c, u)
+	if !ok {
+		return
+	}
+
+	// 服务器已被管理员禁用
+	if !wgServer.Enabled {
+		response.ServerDisabled(c)
+		return
+	}
+
+	updateClientRouting(c, &wgServer, &req)
+}
+
+// AdminUpdateClientRouting 更新指定服务器的默认客户端路由和DNS（管理员）
+func AdminUpdateClientRouting(c *gin.Context) {
+	serverIDStr := c.Param("id")
+	serverID, err := strconv.ParseUint(serverIDStr, 10, 32)
+	if err != nil {
+		response.BadRequest(c, "Invalid server ID", nil)
+		return
+	}
+
+	var req UpdateClientRoutingRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.ValidationError(c, err.Error())
+		return
+	}
+
+	var server models.WireguardServer
+	if err := database.DB.First(&server, serverID).Error; err != nil {
+		response.NotFound(c, "Server not found")
+		return
+	}
+
+	updateClientRouting(c, &server, &req)
+}
+
+// updateClientRouting 保存服务器的默认客户端路由，并标记继承该设置的peer需要重新下载配置
+func updateClientRouting(c *gin.Context, server *models.WireguardServer, req *UpdateClientRoutingRequest) {
+	mode, allowedIPs, dns := server.ClientRouteModeOrDefault(), server.ClientAllowedIPs, server.ClientDNS
+	if req.ClientRouteMode != nil {
+		mode = *req.ClientRouteMode
+	}
+	if req.ClientAllowedIPs != nil {
+		allowedIPs = *req.ClientAllowedIPs
+	}
+	if req.ClientDNS != nil {
+		dns = *req.ClientDNS
+	}
+
+	// 服务器必须有明确的路由模式，不能为空（继承）
+	if mode == "" {
+		response.BadRequest(c, "Client route mode must not be empty", nil)
+		return
+	}
+	allowedIPs, dns, err := normalizeClientRouting(mode, allowedIPs, dns)
+	if err != nil {
+		response.BadRequest(c, err.Error(), nil)
+		return
+	}
+
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		updates := map[string]interface{}{
+			"client_route_mode":  mode,
+			"client_allowed_ips": allowedIPs,
+			"client_dns":         dns,
+		}
+		if err := tx.Model(server).Updates(updates).Error; err != nil {
+			return err
+		}
+
+		// 继承服务器设置的peer，客户端配置随之变化
+		return tx.Model(&models.WireguardPeer{}).
+			Where("server_id = ? AND (client_route_mode = '' OR client_route_mode IS NULL OR client_dns = '' OR client_dns IS NULL)", server.ID).
+			Update("config_outdated", true).Error
+	})
+	if err != nil {
+		response.InternalError(c, "Failed to update client routing")
+		return
+	}
+
+	response.Success(c, "Client routing updated successfully", server.ToResponse())
+}
+
+// normalizeClientRouting 校验客户端路由模式、网段列表和DNS，返回规范化后的网段列表和DNS
+// mode 为空表示继承服务器设置（仅peer可用）
+func normalizeClientRouting(mode, allowedIPs, dns string) (string, string, error) {
+	if err := services.ValidateClientRouteMode(mode); err != nil {
+		return "", "", err
+	}
+
+	allowedIPs, err := services.NormalizeCIDRList(allowedIPs)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid client allowed IPs: %v", err)
+	}
+	if mode == models.ClientRouteCustom && allowedIPs == "" {
+		return "", "", fmt.Errorf("custom client route mode requires client_allowed_ips")
+	}
+
+	dns, err = services.NormalizeDNSList(dns)
+	if err != nil {
+		return "", "", err
+	}
+	return allowedIPs, dns, nil
+}
+
+// markRoutedSubnetsChanged peer背后的路由网段变化后，标记按隧道网段计算 AllowedIPs 的其他peer需要重新下载配置
+// （subnet/exclude_private 模式下，其他peer的路由网段会自动加入客户端配置）
+func markRoutedSubnetsChanged(db *gorm.DB, server *models.WireguardServer, exceptPeerID uint) error {
+	modes := []string{models.ClientRouteSubnet, models.ClientRouteExcludePrivate}
+	query := db.Model(&models.WireguardPeer{}).Where("server_id = ? AND id <> ?", server.ID, exceptPeerID)
+
+	serverMode := server.ClientRouteModeOrDefault()
+	if serverMode == models.ClientRouteSubnet || serverMode == models.ClientRouteExcludePrivate {
+		// 继承服务器设置的peer同样受影响
+		query = query.Where("client_route_mode IN ? OR client_route_mode = '' OR client_route_mode IS NULL", modes)
+	} else {
+		query = query.Where("client_route_mode IN ?", modes)
+	}
+	return query.Update("config_outdated", true).Error
+}
@@ -0,0 +1,197 @@
+package handlers
+
+import (
+	"cloud-platform/internal/config"
+	"cloud-platform/internal/database"
+	"cloud-platform/internal/models"
+	"cloud-platform/internal/response"
+	"cloud-platform/internal/services"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DNSRecordRequest 创建/更新自定义DNS记录请求
+type DNSRecordRequest struct {
+	Name    string `json:"name" binding:"required"`  // 相对于用户域名的名称（如 nas）
+	Type    string `json:"type"`                     // A/AAAA，留空按地址推断
+	Value   string `json:"value" binding:"required"` // IP地址
+	Comment string `json:"comment"`
+}
+
+// DNSOverviewResponse 用户DNS信息
+type DNSOverviewResponse struct {
+	Enabled bool               `json:"enabled"`
+	Zone    string             `json:"zone"`    // 用户域名（如 alice.vpn）
+	Names   []models.DNSName   `json:"names"`   // 为服务器和peer自动生成的记录
+	Records []models.DNSRecord `json:"records"` // 用户自定义记录
+}
+
+// GetMyDNS 获取当前用户的DNS域名、自动生成的peer记录和自定义记录
+func GetMyDNS(c *gin.Context) {
+	user, _ := c.Get("user")
+	u := user.(*models.User)
+
+	// 获取用户的 WireGuard 服务器
+	wgServer, ok := loadMyServer(c, u)
+	if !ok {
+		return
+	}
+
+	var peers []models.WireguardPeer
+	if err := database.DB.Where("server_id = ?", wgServer.ID).Order("id").Find(&peers).Error; err != nil {
+		response.InternalError(c, "Failed to retrieve peers")
+		return
+	}
+
+	records := []models.DNSRecord{}
+	if err := database.DB.Where("server_id = ?", wgServer.ID).Order("name, id").Find(&records).Error; err != nil {
+		response.InternalError(c, "Failed to retrieve DNS records")
+		return
+	}
+
+	dnsCfg := config.AppConfig.Network.DNS
+	zone := services.UserDNSZone(u, dnsCfg)
+	response.Success(c, "DNS retrieved successfully", DNSOverviewResponse{
+		Enabled: dnsCfg.Enabled,
+		Zone:    zone,
+		Names:   services.GeneratedDNSNames(&wgServer, peers, zone),
+		Records: records,
+	})
+}
+
+// CreateDNSRecord 添加自定义DNS记录（如peer背后的实验室主机）
+func CreateDNSRecord(c *gin.Context) {
+	user, _ := c.Get("user")
+	u := user.(*models.User)
+
+	var req DNSRecordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.ValidationError(c, err.Error())
+		return
+	}
+
+	// 获取用户的 WireGuard 服务器
+	wgServer, ok := loadMyServer(c, u)
+	if !ok {
+		return
+	}
+
+	// 服务器已被管理员禁用
+	if !wgServer.Enabled {
+		response.ServerDisabled(c)
+		return
+	}
+
+	record := models.DNSRecord{
+		ServerID: wgServer.ID,
+		Name:     req.Name,
+		Type:     req.Type,
+		Value:    req.Value,
+		Comment:  req.Comment,
+	}
+	if err := services.NormalizeDNSRecord(&record); err != nil {
+		response.BadRequest(c, err.Error(), nil)
+		return
+	}
+
+	if err := database.DB.Create(&record).Error; err != nil {
+		response.InternalError(c, "Failed to create DNS record")
+		return
+	}
+
+	response.Created(c, "DNS record created successfully", record)
+}
+
+// UpdateDNSRecord 更新自定义DNS记录
+func UpdateDNSRecord(c *gin.Context) {
+	user, _ := c.Get("user")
+	u := user.(*models.User)
+
+	recordID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		response.BadRequest(c, "Invalid record ID", nil)
+		return
+	}
+
+	var req DNSRecordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.ValidationError(c, err.Error())
+		return
+	}
+
+	record, ok := loadOwnedDNSRecord(c, u, uint(recordID))
+	if !ok {
+		return
+	}
+
+	record.Name = req.Name
+	record.Type = req.Type
+	record.Value = req.Value
+	record.Comment = req.Comment
+	if err := services.NormalizeDNSRecord(&record); err != nil {
+		response.BadRequest(c, err.Error(), nil)
+		return
+	}
+
+	if err := database.DB.Model(&record).Select("name", "type", "value", "comment").Updates(&record).Error; err != nil {
+		response.InternalError(c, "Failed to update DNS record")
+		return
+	}
+
+	response.Success(c, "DNS record updated successfully", record)
+}
+
+// DeleteDNSRecord 删除自定义DNS记录
+func DeleteDNSRecord(c *gin.Context) {
+	user, _ := c.Get("user")
+	u := user.(*models.User)
+
+	recordID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		response.BadRequest(c, "Invalid record ID", nil)
+		return
+	}
+
+	record, ok := loadOwnedDNSRecord(c, u, uint(recordID))
+	if !ok {
+		return
+	}
+
+	if err := database.DB.Delete(&record).Error; err != nil {
+		response.InternalError(c, "Failed to delete DNS record")
+		return
+	}
+
+	response.Success(c, "DNS record deleted successfully", nil)
+}
+
+// loadOwnedDNSRecord 加载属于当前用户服务器的DNS记录，失败时已写入响应
+func loadOwnedDNSRecord(c *gin.Context, u *models.User, recordID uint) (models.DNSRecord, bool) {
+	var record models.DNSRecord
+
+	// 获取用户的 WireGuard 服务器
+	wgServer, ok := loadMyServer(c, u)
+	if !ok {
+		return record, false
+	}
+
+	// 服务器已被管理员禁用
+	if !wgServer.Enabled {
+		response.ServerDisabled(c)
+		return record, false
+	}
+
+	if err := database.DB.First(&record, recordID).Error; err != nil {
+		response.NotFound(c, "DNS record not found")
+		return record, false
+	}
+
+	// 确保记录属于当前用户的服务器
+	if record.ServerID != wgServer.ID {
+		response.Forbidden(c, "You don't have permission to modify this DNS record")
+		return record, false
+	}
+
+	return record, true
+}
@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"cloud-platform/internal/config"
+	"cloud-platform/internal/database"
+	"cloud-platform/internal/models"
+	"cloud-platform/internal/response"
+	"cloud-platform/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// UpdateExitPeerRequest 设置出口peer请求
+type UpdateExitPeerRequest struct {
+	ExitPeerID *uint  `json:"exit_peer_id"` // 出口peer，null或0表示不使用出口peer
+	PeerIDs    []uint `json:"peer_ids"`     // 经出口peer访问外网的peer（整体替换）
+}
+
+// ExitPeerResponse 出口peer设置响应
+type ExitPeerResponse struct {
+	ExitPeerID *uint  `json:"exit_peer_id"`
+	PeerIDs    []uint `json:"peer_ids"`
+	Active     bool   `json:"active"` // 出口peer当前是否在使用（握手超时时回退到服务器出口）
+}
+
+// GetMyExitPeer 获取当前用户服务器的出口peer设置
+func GetMyExitPeer(c *gin.Context) {
+	user, _ := c.Get("user")
+	u := user.(*models.User)
+
+	// 获取用户的 WireGuard 服务器
+	wgServer, ok := loadMyServer(c, u)
+	if !ok {
+		return
+	}
+
+	respondExitPeer(c, &wgServer)
+}
+
+// UpdateMyExitPeer 设置当前用户服务器的出口peer和使用它的peer
+func UpdateMyExitPeer(c *gin.Context) {
+	user, _ := c.Get("user")
+	u := user.(*models.User)
+
+	var req UpdateExitPeerRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.ValidationError(c, err.Error())
+		return
+	}
+
+	// 获取用户的 WireGuard 服务器
+	wgServer, ok := loadMyServer(c, u)
+	if !ok {
+		return
+	}
+
+	unlock, ok := lockServer(c, &wgServer)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	// 服务器已被管理员禁用
+	if !wgServer.Enabled {
+		response.ServerDisabled(c)
+		return
+	}
+
+	var exitPeerID *uint
+	peerIDs := req.PeerIDs
+	if req.ExitPeerID != nil && *req.ExitPeerID != 0 {
+		exitPeerID = req.ExitPeerID
+
+		var peers []models.WireguardPeer
+		if err := database.DB.Where("server_id = ?", wgServer.ID).Find(&peers).Error; err != nil {
+			response.InternalError(c, "Failed to retrieve peers")
+			return
+		}
+		if err := services.ValidateExitPeer(*exitPeerID, peerIDs, peers); err != nil {
+			response.BadRequest(c, err.Error(), nil)
+			return
+		}
+	} else {
+		// 不使用出口peer时清空选中的peer
+		peerIDs = nil
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&wgServer).Update("exit_peer_id", exitPeerID).Error; err != nil {
+			return err
+		}
+		wgServer.ExitPeerID = exitPeerID
+
+		if err := tx.Model(&models.WireguardPeer{}).Where("server_id = ?", wgServer.ID).Update("use_exit_peer", false).Error; err != nil {
+			return err
+		}
+		if len(peerIDs) > 0 {
+			if err := tx.Model(&models.WireguardPeer{}).Where("server_id = ? AND id IN ?", wgServer.ID, peerIDs).Update("use_exit_peer", true).Error; err != nil {
+				return err
+			}
+		}
+
+		// 出口peer的 allowed-ips、互访策略和策略路由都随设置变化
+		networkService := services.NewUserNetworkService(tx, config.AppConfig.Network)
+		return networkService.SyncPeers(&wgServer, u.UserUID)
+	})
+	if err != nil {
+		// 事务已回滚，按数据库中的原有设置恢复
+		database.DB.First(&wgServer, wgServer.ID)
+		networkService := services.NewUserNetworkService(database.DB, config.AppConfig.Network)
+		networkService.SyncPeers(&wgServer, u.UserUID)
+		response.InternalError(c, "Failed to apply exit peer: "+err.Error())
+		return
+	}
+
+	respondExitPeer(c, &wgServer)
+}
+
+// respondExitPeer 返回服务器的出口peer、使用它的peer和当前状态
+func respondExitPeer(c *gin.Context, server *models.WireguardServer) {
+	peerIDs := []uint{}
+	if err := database.DB.Model(&models.WireguardPeer{}).
+		Where("server_id = ? AND use_exit_peer = ?", server.ID, true).
+		Order("id").Pluck("id", &peerIDs).Error; err != nil {
+		response.InternalError(c, "Failed to retrieve peers")
+		return
+	}
+
+	networkService := services.NewUserNetworkService(database.DB, config.AppConfig.Network)
+	active, _ := networkService.ExitPeerActive(server)
+
+	response.Success(c, "Exit peer retrieved successfully", ExitPeerResponse{
+		ExitPeerID: server.ExitPeerID,
+		PeerIDs:    peerIDs,
+		Active:     active,
+	})
+}
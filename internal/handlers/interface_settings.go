@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"cloud-platform/internal/config"
+	"cloud-platform/internal/database"
+	"cloud-platform/internal/models"
+	"cloud-platform/internal/response"
+	"cloud-platform/internal/services"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// UpdateServerInterfaceRequest 更新服务器接口设置请求（只更新提供的字段）
+type UpdateServerInterfaceRequest struct {
+	MTU           *int    `json:"mtu"`            // 接口MTU（0表示自动）
+	FwMark        *uint32 `json:"fwmark"`         // 加密报文的防火墙标记（0表示不标记）
+	RouteTable    *string `json:"route_table"`    // 存放peer背后网段路由的路由表（空字符串或 off 表示主路由表）
+	ListenAddress *string `json:"listen_address"` // 接受WireGuard连接的主机地址（空字符串表示所有地址）
+}
+
+// AdminUpdateServerInterface 更新指定服务器的MTU、FwMark、路由表和监听地址，并应用到运行中的接口（管理员）
+func AdminUpdateServerInterface(c *gin.Context) {
+	serverIDStr := c.Param("id")
+	serverID, err := strconv.ParseUint(serverIDStr, 10, 32)
+	if err != nil {
+		response.BadRequest(c, "Invalid server ID", nil)
+		return
+	}
+
+	var req UpdateServerInterfaceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.ValidationError(c, err.Error())
+		return
+	}
+
+	var server models.WireguardServer
+	if err := database.DB.Preload("User").First(&server, serverID).Error; err != nil {
+		response.NotFound(c, "Server not found")
+		return
+	}
+
+	unlock, ok := lockServer(c, &server)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	updates := map[string]interface{}{}
+	if req.MTU != nil {
+		if err := services.ValidateMTU(*req.MTU); err != nil {
+			response.BadRequest(c, err.Error(), nil)
+			return
+		}
+		updates["mtu"] = *req.MTU
+	}
+	if req.FwMark != nil {
+		updates["fw_mark"] = *req.FwMark
+	}
+	if req.RouteTable != nil {
+		table, err := services.NormalizeRouteTable(*req.RouteTable)
+		if err != nil {
+			response.BadRequest(c, err.Error(), nil)
+			return
+		}
+		updates["route_table"] = table
+	}
+	if req.ListenAddress != nil {
+		address, err := services.NormalizeListenAddress(*req.ListenAddress)
+		if err != nil {
+			response.BadRequest(c, err.Error(), nil)
+			return
+		}
+		updates["listen_address"] = address
+	}
+	if len(updates) == 0 {
+		response.BadRequest(c, "No valid fields to update", nil)
+		return
+	}
+
+	if err := saveServerSettings(&server, server.User.UserUID, updates); err != nil {
+		response.InternalError(c, "Failed to apply interface settings: "+err.Error())
+		return
+	}
+
+	response.Success(c, "Interface settings updated successfully", server.ToResponse())
+}
+
+// saveServerSettings 在事务中保存服务器设置并应用接口设置的变化，失败时按数据库中的原有设置恢复
+// MTU 和监听地址会写入客户端配置，变化后标记该服务器所有peer需要重新下载配置
+func saveServerSettings(server *models.WireguardServer, userUID string, updates map[string]interface{}) error {
+	previous := *server
+	cfg := config.AppConfig.Network
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(server).Updates(updates).Error; err != nil {
+			return err
+		}
+
+		if server.MTU != previous.MTU || server.ListenAddress != previous.ListenAddress {
+			if err := tx.Model(&models.WireguardPeer{}).Where("server_id = ?", server.ID).
+				Update("config_outdated", true).Error; err != nil {
+				return err
+			}
+		}
+
+		networkService := services.NewUserNetworkService(tx, cfg)
+		return networkService.ApplyInterfaceSettings(server, &previous, userUID)
+	})
+	if err != nil {
+		// 事务已回滚，按原有设置恢复配置文件和运行中的接口（gorm 已将新值回写到模型字段）
+		attempted := *server
+		*server = previous
+		networkService := services.NewUserNetworkService(database.DB, cfg)
+		networkService.ApplyInterfaceSettings(server, &attempted, userUID)
+		return err
+	}
+	return nil
+}
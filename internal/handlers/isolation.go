@@ -0,0 +1,215 @@
+package handlers
+
+import (
+	"cloud-platform/internal/config"
+	"cloud-platform/internal/database"
+	"cloud-platform/internal/models"
+	"cloud-platform/internal/response"
+	"cloud-platform/internal/services"
+	"fmt"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// PeerPair 一对允许互访的peer
+type PeerPair struct {
+	PeerAID uint `json:"peer_a_id" binding:"required"`
+	PeerBID uint `json:"peer_b_id" binding:"required"`
+}
+
+// UpdatePeerIsolationRequest 更新peer互访策略请求
+type UpdatePeerIsolationRequest struct {
+	Mode  string      `json:"mode" binding:"required"` // allow/deny/pairs
+	Pairs *[]PeerPair `json:"pairs"`                   // 允许互访的peer对（提供时整体替换，不提供时保留原有列表）
+}
+
+// PeerIsolationResponse peer互访策略响应
+type PeerIsolationResponse struct {
+	Mode  string                     `json:"mode"`
+	Pairs []models.WireguardPeerLink `json:"pairs"`
+}
+
+// GetMyPeerIsolation 获取当前用户服务器的peer互访策略
+func GetMyPeerIsolation(c *gin.Context) {
+	user, _ := c.Get("user")
+	u := user.(*models.User)
+
+	// 获取用户的 WireGuard 服务器
+	wgServer, ok := loadMyServer(c, u)
+	if !ok {
+		return
+	}
+
+	respondPeerIsolation(c, &wgServer)
+}
+
+// UpdateMyPeerIsolation 更新当前用户服务器的peer互访策略
+func UpdateMyPeerIsolation(c *gin.Context) {
+	user, _ := c.Get("user")
+	u := user.(*models.User)
+
+	var req UpdatePeerIsolationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.ValidationError(c, err.Error())
+		return
+	}
+
+	// 获取用户的 WireGuard 服务器
+	wgServer, ok := loadMyServer(c, u)
+	if !ok {
+		return
+	}
+
+	unlock, ok := lockServer(c, &wgServer)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	// 服务器已被管理员禁用
+	if !wgServer.Enabled {
+		response.ServerDisabled(c)
+		return
+	}
+
+	updatePeerIsolation(c, &wgServer, &req)
+}
+
+// AdminGetPeerIsolation 获取指定服务器的peer互访策略（管理员）
+func AdminGetPeerIsolation(c *gin.Context) {
+	serverIDStr := c.Param("id")
+	serverID, err := strconv.ParseUint(serverIDStr, 10, 32)
+	if err != nil {
+		response.BadRequest(c, "Invalid server ID", nil)
+		return
+	}
+
+	var server models.WireguardServer
+	if err := database.DB.First(&server, serverID).Error; err != nil {
+		response.NotFound(c, "Server not found")
+		return
+	}
+
+	respondPeerIsolation(c, &server)
+}
+
+// AdminUpdatePeerIsolation 更新指定服务器的peer互访策略（管理员）
+func AdminUpdatePeerIsolation(c *gin.Context) {
+	serverIDStr := c.Param("id")
+	serverID, err := strconv.ParseUint(serverIDStr, 10, 32)
+	if err != nil {
+		response.BadRequest(c, "Invalid server ID", nil)
+		return
+	}
+
+	var req UpdatePeerIsolationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.ValidationError(c, err.Error())
+		return
+	}
+
+	var server models.WireguardServer
+	if err := database.DB.First(&server, serverID).Error; err != nil {
+		response.NotFound(c, "Server not found")
+		return
+	}
+
+	unlock, ok := lockServer(c, &server)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	updatePeerIsolation(c, &server, &req)
+}
+
+// respondPeerIsolation 返回服务器的互访策略和允许互访的peer对
+func respondPeerIsolation(c *gin.Context, server *models.WireguardServer) {
+	links := []models.WireguardPeerLink{}
+	if err := database.DB.Where("server_id = ?", server.ID).Order("id").Find(&links).Error; err != nil {
+		response.InternalError(c, "Failed to retrieve peer links")
+		return
+	}
+
+	response.Success(c, "Peer isolation retrieved successfully", PeerIsolationResponse{
+		Mode:  server.PeerIsolationMode(),
+		Pairs: links,
+	})
+}
+
+// updatePeerIsolation 校验并保存互访策略，在事务中重新应用命名空间规则，失败时整体回滚
+func updatePeerIsolation(c *gin.Context, server *models.WireguardServer, req *UpdatePeerIsolationRequest) {
+	switch req.Mode {
+	case models.PeerIsolationAllow, models.PeerIsolationDeny, models.PeerIsolationPairs:
+	default:
+		response.BadRequest(c, "Mode must be one of allow, deny, pairs", nil)
+		return
+	}
+
+	// 校验peer对：不能是同一个peer，且都属于该服务器
+	var links []models.WireguardPeerLink
+	if req.Pairs != nil {
+		var peers []models.WireguardPeer
+		if err := database.DB.Where("server_id = ?", server.ID).Find(&peers).Error; err != nil {
+			response.InternalError(c, "Failed to retrieve peers")
+			return
+		}
+		owned := make(map[uint]bool, len(peers))
+		for _, peer := range peers {
+			owned[peer.ID] = true
+		}
+
+		seen := make(map[[2]uint]bool)
+		for _, pair := range *req.Pairs {
+			a, b := pair.PeerAID, pair.PeerBID
+			if a == b {
+				response.BadRequest(c, fmt.Sprintf("Peer %d cannot be paired with itself", a), nil)
+				return
+			}
+			if !owned[a] || !owned[b] {
+				response.BadRequest(c, fmt.Sprintf("Peer pair %d-%d does not belong to this server", a, b), nil)
+				return
+			}
+			if a > b {
+				a, b = b, a
+			}
+			if seen[[2]uint{a, b}] {
+				continue
+			}
+			seen[[2]uint{a, b}] = true
+			links = append(links, models.WireguardPeerLink{ServerID: server.ID, PeerAID: a, PeerBID: b})
+		}
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(server).Update("peer_isolation", req.Mode).Error; err != nil {
+			return err
+		}
+
+		if req.Pairs != nil {
+			if err := tx.Where("server_id = ?", server.ID).Delete(&models.WireguardPeerLink{}).Error; err != nil {
+				return err
+			}
+			if len(links) > 0 {
+				if err := tx.Create(&links).Error; err != nil {
+					return err
+				}
+			}
+		}
+
+		networkService := services.NewUserNetworkService(tx, config.AppConfig.Network)
+		return networkService.ApplyPeerIsolation(server)
+	})
+	if err != nil {
+		// 事务已回滚，按数据库中的原有策略恢复命名空间规则
+		database.DB.First(server, server.ID)
+		networkService := services.NewUserNetworkService(database.DB, config.AppConfig.Network)
+		networkService.ApplyPeerIsolation(server)
+		response.InternalError(c, "Failed to apply peer isolation: "+err.Error())
+		return
+	}
+
+	respondPeerIsolation(c, server)
+}
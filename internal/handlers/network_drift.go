@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"cloud-platform/internal/config"
+	"cloud-platform/internal/database"
+	"cloud-platform/internal/response"
+	"cloud-platform/internal/services"
+	"fmt"
+	"log"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DriftFixResponse 修复前后的网络状态偏差报告
+type DriftFixResponse struct {
+	Before *services.DriftReport `json:"before"`
+	After  *services.DriftReport `json:"after"`
+	Error  string                `json:"error,omitempty"` // 未能修复的项目
+}
+
+// AdminGetNetworkDrift 对比数据库推导出的期望网络状态与主机实际状态，列出缺失和多余的命名空间、veth、规则链和路由（管理员）
+func AdminGetNetworkDrift(c *gin.Context) {
+	networkService := services.NewUserNetworkService(database.DB, config.AppConfig.Network)
+	report, err := networkService.DetectDrift()
+	if err != nil {
+		response.InternalError(c, "Failed to detect network drift: "+err.Error())
+		return
+	}
+
+	response.Success(c, fmt.Sprintf("Found %d missing and %d unexpected items", len(report.Missing), len(report.Unexpected)), report)
+}
+
+// AdminFixNetworkDrift 修复网络状态偏差：删除多余的资源，重新应用缺失资源所属的服务器，返回修复前后的报告（管理员）
+func AdminFixNetworkDrift(c *gin.Context) {
+	networkService := services.NewUserNetworkService(database.DB, config.AppConfig.Network)
+	before, err := networkService.DetectDrift()
+	if err != nil {
+		response.InternalError(c, "Failed to detect network drift: "+err.Error())
+		return
+	}
+
+	result := DriftFixResponse{Before: before, After: before}
+	if before.Clean() {
+		response.Success(c, "No network drift found", result)
+		return
+	}
+
+	if err := networkService.FixDrift(before); err != nil {
+		log.Printf("Failed to fix network drift: %v", err)
+		result.Error = err.Error()
+	}
+
+	if result.After, err = networkService.DetectDrift(); err != nil {
+		response.InternalError(c, "Failed to detect network drift: "+err.Error())
+		return
+	}
+
+	response.Success(c, fmt.Sprintf("%d missing and %d unexpected items remaining", len(result.After.Missing), len(result.After.Unexpected)), result)
+}
@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"cloud-platform/internal/services"
+	"fmt"
+	"time"
+)
+
+// parseExpiresAt 解析peer的过期时间（RFC3339格式，空字符串表示永不过期），过期时间必须晚于当前时间
+func parseExpiresAt(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	expiresAt, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expires_at %q: expected RFC3339 time", value)
+	}
+	if !expiresAt.After(time.Now()) {
+		return nil, fmt.Errorf("expires_at must be in the future")
+	}
+	return &expiresAt, nil
+}
+
+// normalizePeerAccess 校验peer的过期时间和访问时间段，返回解析后的过期时间和规范化的时间段
+func normalizePeerAccess(expiresAt, schedule string) (*time.Time, string, error) {
+	expires, err := parseExpiresAt(expiresAt)
+	if err != nil {
+		return nil, "", err
+	}
+	schedule, err = services.NormalizeAccessSchedule(schedule)
+	if err != nil {
+		return nil, "", err
+	}
+	return expires, schedule, nil
+}
@@ -0,0 +1,380 @@
+package handlers
+
+import (
+	"cloud-platform/internal/config"
+	"cloud-platform/internal/database"
+	"cloud-platform/internal/models"
+	"cloud-platform/internal/response"
+	"cloud-platform/internal/services"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// errPortForwardQuota 用户的公网端口转发已达到配额
+var errPortForwardQuota = errors.New("port forward quota exceeded")
+
+// CreatePortForwardRequest 创建公网端口转发请求（公网端口从端口池中自动分配）
+type CreatePortForwardRequest struct {
+	PeerID     uint   `json:"peer_id" binding:"required"`
+	Protocol   string `json:"protocol"`                       // tcp/udp，默认tcp
+	TargetPort int    `json:"target_port" binding:"required"` // peer上的目标端口
+	Comment    string `json:"comment"`
+}
+
+// UpdatePortForwardRequest 更新公网端口转发请求（只更新提供的字段，协议和公网端口不可修改）
+type UpdatePortForwardRequest struct {
+	PeerID     *uint   `json:"peer_id"`
+	TargetPort *int    `json:"target_port"`
+	Comment    *string `json:"comment"`
+}
+
+// PortForwardOverviewResponse 用户的公网端口转发信息
+type PortForwardOverviewResponse struct {
+	Enabled  bool                 `json:"enabled"`   // 是否配置了公网端口池
+	PublicIP string               `json:"public_ip"` // 公网端口所在的服务器地址
+	Quota    int                  `json:"quota"`     // 可使用的端口数量
+	Used     int64                `json:"used"`      // 已使用的端口数量
+	Forwards []models.PortForward `json:"forwards"`
+}
+
+// GetMyPortForwards 获取当前用户的公网端口转发和配额
+func GetMyPortForwards(c *gin.Context) {
+	user, _ := c.Get("user")
+	u := user.(*models.User)
+
+	// 获取用户的 WireGuard 服务器
+	wgServer, ok := loadMyServer(c, u)
+	if !ok {
+		return
+	}
+
+	forwards := []models.PortForward{}
+	if err := database.DB.Where("server_id = ?", wgServer.ID).Order("public_port").Find(&forwards).Error; err != nil {
+		response.InternalError(c, "Failed to retrieve port forwards")
+		return
+	}
+
+	used, err := countUserPortForwards(database.DB, u.ID)
+	if err != nil {
+		response.InternalError(c, "Failed to retrieve port forwards")
+		return
+	}
+
+	cfg := config.AppConfig.Network
+	response.Success(c, "Port forwards retrieved successfully", PortForwardOverviewResponse{
+		Enabled:  cfg.PortForward.Enabled(),
+		PublicIP: cfg.ServerIP,
+		Quota:    services.PortForwardQuota(u, cfg.PortForward),
+		Used:     used,
+		Forwards: forwards,
+	})
+}
+
+// CreatePortForward 从端口池分配公网端口，转发到指定peer的端口
+func CreatePortForward(c *gin.Context) {
+	user, _ := c.Get("user")
+	u := user.(*models.User)
+
+	var req CreatePortForwardRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.ValidationError(c, err.Error())
+		return
+	}
+
+	cfg := config.AppConfig.Network
+	if !cfg.PortForward.Enabled() {
+		response.BadRequest(c, "Port forwarding is not enabled", nil)
+		return
+	}
+
+	// 获取用户的 WireGuard 服务器
+	wgServer, ok := loadMyServer(c, u)
+	if !ok {
+		return
+	}
+
+	unlock, ok := lockServer(c, &wgServer)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	// 服务器已被管理员禁用
+	if !wgServer.Enabled {
+		response.ServerDisabled(c)
+		return
+	}
+
+	if !loadOwnedPeer(c, &wgServer, req.PeerID) {
+		return
+	}
+
+	forward := models.PortForward{
+		ServerID:   wgServer.ID,
+		PeerID:     req.PeerID,
+		Protocol:   req.Protocol,
+		TargetPort: req.TargetPort,
+		Comment:    req.Comment,
+	}
+	if err := services.NormalizePortForward(&forward); err != nil {
+		response.BadRequest(c, err.Error(), nil)
+		return
+	}
+
+	quota := services.PortForwardQuota(u, cfg.PortForward)
+	err := applyPortForwardChange(&wgServer, func(tx *gorm.DB) error {
+		// 锁定用户记录，避免并发创建超出配额
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&models.User{}, u.ID).Error; err != nil {
+			return err
+		}
+
+		used, err := countUserPortForwards(tx, u.ID)
+		if err != nil {
+			return err
+		}
+		if used >= int64(quota) {
+			return errPortForwardQuota
+		}
+
+		networkService := services.NewUserNetworkService(tx, cfg)
+		if forward.PublicPort, err = networkService.AllocatePublicPort(&wgServer); err != nil {
+			return err
+		}
+		return tx.Create(&forward).Error
+	})
+	if err != nil {
+		// 分配的端口随事务回滚，主机上的DNAT链已按数据库中原有的记录整体替换
+		switch {
+		case errors.Is(err, errPortForwardQuota):
+			response.QuotaExceeded(c, fmt.Sprintf("Port forward quota of %d reached", quota))
+		case errors.Is(err, services.ErrPoolExhausted):
+			response.BadRequest(c, "No free public port available", nil)
+		default:
+			response.InternalError(c, "Failed to apply port forward: "+err.Error())
+		}
+		return
+	}
+
+	response.Created(c, "Port forward created successfully", forward)
+}
+
+// UpdatePortForward 更新公网端口转发的目标peer、目标端口或备注
+func UpdatePortForward(c *gin.Context) {
+	user, _ := c.Get("user")
+	u := user.(*models.User)
+
+	forwardID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		response.BadRequest(c, "Invalid port forward ID", nil)
+		return
+	}
+
+	var req UpdatePortForwardRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.ValidationError(c, err.Error())
+		return
+	}
+
+	wgServer, forward, ok := loadOwnedPortForward(c, u, uint(forwardID))
+	if !ok {
+		return
+	}
+
+	unlock, ok := lockServer(c, &wgServer)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	if req.PeerID != nil {
+		if !loadOwnedPeer(c, &wgServer, *req.PeerID) {
+			return
+		}
+		forward.PeerID = *req.PeerID
+	}
+	if req.TargetPort != nil {
+		forward.TargetPort = *req.TargetPort
+	}
+	if req.Comment != nil {
+		forward.Comment = *req.Comment
+	}
+	if err := services.NormalizePortForward(&forward); err != nil {
+		response.BadRequest(c, err.Error(), nil)
+		return
+	}
+
+	if err := applyPortForwardChange(&wgServer, func(tx *gorm.DB) error {
+		return tx.Model(&forward).Select("peer_id", "target_port", "comment").Updates(&forward).Error
+	}); err != nil {
+		response.InternalError(c, "Failed to apply port forward: "+err.Error())
+		return
+	}
+
+	response.Success(c, "Port forward updated successfully", forward)
+}
+
+// DeletePortForward 删除公网端口转发并释放公网端口
+func DeletePortForward(c *gin.Context) {
+	user, _ := c.Get("user")
+	u := user.(*models.User)
+
+	forwardID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		response.BadRequest(c, "Invalid port forward ID", nil)
+		return
+	}
+
+	wgServer, forward, ok := loadOwnedPortForward(c, u, uint(forwardID))
+	if !ok {
+		return
+	}
+
+	unlock, ok := lockServer(c, &wgServer)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	if err := applyPortForwardChange(&wgServer, func(tx *gorm.DB) error {
+		return tx.Delete(&forward).Error
+	}); err != nil {
+		response.InternalError(c, "Failed to apply port forward: "+err.Error())
+		return
+	}
+
+	response.Success(c, "Port forward deleted successfully", nil)
+}
+
+// AdminGetPortForwards 获取所有公网端口转发（管理员，可通过 server_id 过滤）
+func AdminGetPortForwards(c *gin.Context) {
+	query := database.DB.Model(&models.PortForward{})
+	if serverIDStr := c.Query("server_id"); serverIDStr != "" {
+		serverID, err := strconv.ParseUint(serverIDStr, 10, 32)
+		if err != nil {
+			response.BadRequest(c, "Invalid server ID", nil)
+			return
+		}
+		query = query.Where("server_id = ?", serverID)
+	}
+
+	forwards := []models.PortForward{}
+	if err := query.Order("public_port").Find(&forwards).Error; err != nil {
+		response.InternalError(c, "Failed to retrieve port forwards")
+		return
+	}
+
+	response.Success(c, "Port forwards retrieved successfully", forwards)
+}
+
+// AdminDeletePortForward 删除指定的公网端口转发（管理员）
+func AdminDeletePortForward(c *gin.Context) {
+	forwardID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		response.BadRequest(c, "Invalid port forward ID", nil)
+		return
+	}
+
+	var forward models.PortForward
+	if err := database.DB.First(&forward, forwardID).Error; err != nil {
+		response.NotFound(c, "Port forward not found")
+		return
+	}
+
+	var wgServer models.WireguardServer
+	if err := database.DB.First(&wgServer, forward.ServerID).Error; err != nil {
+		response.NotFound(c, "Server not found")
+		return
+	}
+
+	unlock, ok := lockServer(c, &wgServer)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	if err := applyPortForwardChange(&wgServer, func(tx *gorm.DB) error {
+		return tx.Delete(&forward).Error
+	}); err != nil {
+		response.InternalError(c, "Failed to apply port forward: "+err.Error())
+		return
+	}
+
+	response.Success(c, "Port forward deleted successfully", nil)
+}
+
+// loadOwnedPortForward 加载属于当前用户服务器的端口转发，失败时已写入响应
+func loadOwnedPortForward(c *gin.Context, u *models.User, forwardID uint) (models.WireguardServer, models.PortForward, bool) {
+	var forward models.PortForward
+
+	// 获取用户的 WireGuard 服务器
+	wgServer, ok := loadMyServer(c, u)
+	if !ok {
+		return wgServer, forward, false
+	}
+
+	// 服务器已被管理员禁用
+	if !wgServer.Enabled {
+		response.ServerDisabled(c)
+		return wgServer, forward, false
+	}
+
+	if err := database.DB.First(&forward, forwardID).Error; err != nil {
+		response.NotFound(c, "Port forward not found")
+		return wgServer, forward, false
+	}
+
+	// 确保端口转发属于当前用户的服务器
+	if forward.ServerID != wgServer.ID {
+		response.Forbidden(c, "You don't have permission to modify this port forward")
+		return wgServer, forward, false
+	}
+
+	return wgServer, forward, true
+}
+
+// loadOwnedPeer 确认peer存在且属于指定服务器，失败时已写入响应
+func loadOwnedPeer(c *gin.Context, wgServer *models.WireguardServer, peerID uint) bool {
+	var peer models.WireguardPeer
+	if err := database.DB.First(&peer, peerID).Error; err != nil {
+		response.NotFound(c, "Peer not found")
+		return false
+	}
+
+	// 确保peer属于当前用户的服务器
+	if peer.ServerID != wgServer.ID {
+		response.Forbidden(c, "You don't have permission to modify this peer")
+		return false
+	}
+	return true
+}
+
+// countUserPortForwards 统计用户所有服务器上的公网端口转发数量
+func countUserPortForwards(db *gorm.DB, userID uint) (int64, error) {
+	var count int64
+	err := db.Model(&models.PortForward{}).
+		Where("server_id IN (?)", db.Model(&models.WireguardServer{}).Select("id").Where("user_id = ?", userID)).
+		Count(&count).Error
+	return count, err
+}
+
+// applyPortForwardChange 在事务中修改端口转发记录并重新应用服务器的端口转发规则
+// 应用失败时事务回滚，并按数据库中原有的记录恢复规则
+func applyPortForwardChange(wgServer *models.WireguardServer, change func(tx *gorm.DB) error) error {
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := change(tx); err != nil {
+			return err
+		}
+		networkService := services.NewUserNetworkService(tx, config.AppConfig.Network)
+		return networkService.ApplyPortForwards(wgServer)
+	})
+	if err != nil {
+		networkService := services.NewUserNetworkService(database.DB, config.AppConfig.Network)
+		networkService.ApplyPortForwards(wgServer)
+	}
+	return err
+}
@@ -0,0 +1,319 @@
+package handlers
+
+import (
+	"cloud-platform/internal/config"
+	"cloud-platform/internal/database"
+	"cloud-platform/internal/models"
+	"cloud-platform/internal/response"
+	"cloud-platform/internal/services"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// errServerQuota 用户的WireGuard服务器已达到配额
+var errServerQuota = errors.New("server quota exceeded")
+
+// errLastServer 不能删除用户的最后一个服务器
+var errLastServer = errors.New("cannot delete the last server")
+
+// CreateServerRequest 创建WireGuard服务器请求
+type CreateServerRequest struct {
+	Name string `json:"name"`
+}
+
+// UpdateServerRequest 更新WireGuard服务器请求
+type UpdateServerRequest struct {
+	Name *string `json:"name"`
+	MTU  *int    `json:"mtu"` // 接口MTU（0表示自动），其余接口设置只能由管理员修改
+}
+
+// ServerListResponse 用户的WireGuard服务器列表和配额
+type ServerListResponse struct {
+	Quota   int                              `json:"quota"` // 可创建的服务器数量
+	Servers []models.WireguardServerResponse `json:"servers"`
+}
+
+// GetMyServers 获取当前用户的所有WireGuard服务器
+func GetMyServers(c *gin.Context) {
+	user, _ := c.Get("user")
+	u := user.(*models.User)
+
+	var servers []models.WireguardServer
+	if err := database.DB.Where("user_id = ?", u.ID).Order("id").Find(&servers).Error; err != nil {
+		response.InternalError(c, "Failed to retrieve servers")
+		return
+	}
+
+	serverResponses := make([]models.WireguardServerResponse, 0, len(servers))
+	for _, server := range servers {
+		serverResponses = append(serverResponses, server.ToResponse())
+	}
+
+	response.Success(c, "Servers retrieved successfully", ServerListResponse{
+		Quota:   services.ServerQuota(u, config.AppConfig.Network),
+		Servers: serverResponses,
+	})
+}
+
+// GetMyServer 获取当前用户的指定WireGuard服务器
+func GetMyServer(c *gin.Context) {
+	user, _ := c.Get("user")
+	u := user.(*models.User)
+
+	wgServer, ok := loadMyServer(c, u)
+	if !ok {
+		return
+	}
+
+	response.Success(c, "Server retrieved successfully", wgServer.ToResponse())
+}
+
+// CreateMyServer 在配额内为当前用户创建新的WireGuard服务器（独立的命名空间、端口、网段和peer）
+func CreateMyServer(c *gin.Context) {
+	user, _ := c.Get("user")
+	u := user.(*models.User)
+
+	var req CreateServerRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		response.ValidationError(c, err.Error())
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if len(name) > 64 {
+		response.BadRequest(c, "Name must be at most 64 characters", nil)
+		return
+	}
+
+	cfg := config.AppConfig.Network
+	quota := services.ServerQuota(u, cfg)
+	networkService := services.NewUserNetworkService(database.DB, cfg)
+
+	var wgServer *models.WireguardServer
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		// 锁定用户记录，避免并发创建超出配额或分配到相同的序号
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&models.User{}, u.ID).Error; err != nil {
+			return err
+		}
+
+		var count int64
+		if err := tx.Model(&models.WireguardServer{}).Where("user_id = ?", u.ID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count >= int64(quota) {
+			return errServerQuota
+		}
+
+		txService := services.NewUserNetworkService(tx, cfg)
+		index, err := txService.NextServerIndex(u.ID)
+		if err != nil {
+			return err
+		}
+
+		// 分配的地址和端口在事务外持久化，创建失败时由 DestroyUserNetwork 释放
+		if wgServer, err = networkService.ProvisionServer(u, index); err != nil {
+			return err
+		}
+		wgServer.Name = name
+		if wgServer.Name == "" {
+			wgServer.Name = wgServer.WgInterface
+		}
+
+		if err := tx.Create(wgServer).Error; err != nil {
+			networkService.DestroyUserNetwork(wgServer, u.UserUID)
+			return err
+		}
+		return nil
+	})
+	// 记录已提交（或创建失败、网络已清理），此后命名空间按数据库记录参与对账
+	if wgServer != nil {
+		networkService.FinishProvisioning(wgServer)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, errServerQuota):
+			response.QuotaExceeded(c, fmt.Sprintf("Server quota of %d reached", quota))
+		default:
+			response.InternalError(c, "Failed to create server: "+err.Error())
+		}
+		return
+	}
+
+	response.Created(c, "Server created successfully", wgServer.ToResponse())
+}
+
+// UpdateMyServer 更新当前用户服务器的名称和MTU
+func UpdateMyServer(c *gin.Context) {
+	user, _ := c.Get("user")
+	u := user.(*models.User)
+
+	var req UpdateServerRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.ValidationError(c, err.Error())
+		return
+	}
+
+	wgServer, ok := loadMyServer(c, u)
+	if !ok {
+		return
+	}
+
+	unlock, ok := lockServer(c, &wgServer)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	if req.Name == nil && req.MTU == nil {
+		response.BadRequest(c, "No valid fields to update", nil)
+		return
+	}
+	updates := map[string]interface{}{}
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" || len(name) > 64 {
+			response.BadRequest(c, "Name must be 1-64 characters", nil)
+			return
+		}
+		updates["name"] = name
+	}
+	if req.MTU != nil {
+		// 修改接口设置需要服务器处于启用状态
+		if !wgServer.Enabled {
+			response.ServerDisabled(c)
+			return
+		}
+		if err := services.ValidateMTU(*req.MTU); err != nil {
+			response.BadRequest(c, err.Error(), nil)
+			return
+		}
+		updates["mtu"] = *req.MTU
+	}
+
+	if err := saveServerSettings(&wgServer, u.UserUID, updates); err != nil {
+		response.InternalError(c, "Failed to update server: "+err.Error())
+		return
+	}
+
+	response.Success(c, "Server updated successfully", wgServer.ToResponse())
+}
+
+// DeleteMyServer 删除当前用户的服务器及其全部peer（不能删除最后一个服务器）
+func DeleteMyServer(c *gin.Context) {
+	user, _ := c.Get("user")
+	u := user.(*models.User)
+
+	wgServer, ok := loadMyServer(c, u)
+	if !ok {
+		return
+	}
+
+	unlock, ok := lockServer(c, &wgServer)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	var sharedNetworks []uint
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		// 锁定用户记录，避免并发删除最后两个服务器时都通过检查
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&models.User{}, u.ID).Error; err != nil {
+			return err
+		}
+
+		var count int64
+		if err := tx.Model(&models.WireguardServer{}).Where("user_id = ?", u.ID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count <= 1 {
+			return errLastServer
+		}
+
+		var err error
+		if sharedNetworks, err = detachSharedNetworkServer(tx, wgServer.ID); err != nil {
+			return err
+		}
+		if err := tx.Where("server_id = ?", wgServer.ID).Delete(&models.WireguardPeer{}).Error; err != nil {
+			return fmt.Errorf("failed to delete peers: %v", err)
+		}
+		if err := tx.Delete(&wgServer).Error; err != nil {
+			return fmt.Errorf("failed to delete server: %v", err)
+		}
+		return nil
+	})
+	if errors.Is(err, errLastServer) {
+		response.BadRequest(c, "Cannot delete the last server", nil)
+		return
+	}
+	if err != nil {
+		response.InternalError(c, fmt.Sprintf("Failed to delete server: %v", err))
+		return
+	}
+
+	// 清理网络环境（即使失败也继续，因为数据库记录已删除）
+	networkService := services.NewUserNetworkService(database.DB, config.AppConfig.Network)
+	if err := networkService.DestroyUserNetwork(&wgServer, u.UserUID); err != nil {
+		log.Printf("Warning: Failed to cleanup network resources for server %d: %v", wgServer.ID, err)
+	}
+	// 成员已恢复为已邀请，中转命名空间不再连接该服务器
+	if err := networkService.ApplySharedNetworksByID(sharedNetworks); err != nil {
+		log.Printf("Warning: Failed to apply shared networks after deleting server %d: %v", wgServer.ID, err)
+	}
+
+	response.Success(c, "Server and all associated peers deleted successfully", nil)
+}
+
+// loadMyServer 获取当前请求操作的服务器，失败时已写入响应
+// 路由带 :server_id 时加载该服务器（必须属于当前用户），否则使用用户的第一个服务器（兼容旧接口）
+func loadMyServer(c *gin.Context, u *models.User) (models.WireguardServer, bool) {
+	var serverID uint64
+	if serverIDStr := c.Param("server_id"); serverIDStr != "" {
+		var err error
+		if serverID, err = strconv.ParseUint(serverIDStr, 10, 32); err != nil || serverID == 0 {
+			response.BadRequest(c, "Invalid server ID", nil)
+			return models.WireguardServer{}, false
+		}
+	}
+	return loadUserServer(c, u, uint(serverID))
+}
+
+// loadUserServer 加载当前用户的指定服务器，serverID 为0时使用用户的第一个服务器，失败时已写入响应
+func loadUserServer(c *gin.Context, u *models.User, serverID uint) (models.WireguardServer, bool) {
+	var wgServer models.WireguardServer
+	if serverID == 0 {
+		if err := database.DB.Where("user_id = ?", u.ID).Order("id").First(&wgServer).Error; err != nil {
+			response.BadRequest(c, "User has no WireGuard server configured", nil)
+			return wgServer, false
+		}
+		return wgServer, true
+	}
+
+	if err := database.DB.Where("id = ? AND user_id = ?", serverID, u.ID).First(&wgServer).Error; err != nil {
+		response.NotFound(c, "Server not found")
+		return wgServer, false
+	}
+	return wgServer, true
+}
+
+// lockServer 获取服务器的锁并重新读取服务器记录，失败时已写入响应（服务器已被删除时返回404）
+// 请求在锁内按最新的记录修改服务器网络，不与后台服务和其他请求交错；调用方负责释放锁
+func lockServer(c *gin.Context, wgServer *models.WireguardServer) (func(), bool) {
+	networkService := services.NewUserNetworkService(database.DB, config.AppConfig.Network)
+	unlock, err := networkService.LockServer(wgServer)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		response.NotFound(c, "Server not found")
+		return nil, false
+	}
+	if err != nil {
+		response.InternalError(c, "Failed to load server")
+		return nil, false
+	}
+	return unlock, true
+}
@@ -0,0 +1,688 @@
+package handlers
+
+import (
+	"cloud-platform/internal/config"
+	"cloud-platform/internal/database"
+	"cloud-platform/internal/models"
+	"cloud-platform/internal/response"
+	"cloud-platform/internal/services"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// CreateSharedNetworkRequest 创建共享网络请求（创建者自动以自己的服务器加入）
+type CreateSharedNetworkRequest struct {
+	Name     string `json:"name" binding:"required"`
+	ServerID uint   `json:"server_id"` // 接入共享网络的服务器，不指定时使用第一个服务器
+}
+
+// JoinSharedNetworkRequest 接受共享网络邀请请求
+type JoinSharedNetworkRequest struct {
+	ServerID uint `json:"server_id"` // 接入共享网络的服务器，不指定时使用第一个服务器
+}
+
+// InviteSharedNetworkMemberRequest 邀请用户加入共享网络请求
+type InviteSharedNetworkMemberRequest struct {
+	Email string `json:"email" binding:"required"`
+}
+
+// UpdateSharedNetworkPeersRequest 设置接入共享网络的peer请求（整体替换）
+type UpdateSharedNetworkPeersRequest struct {
+	PeerIDs []uint `json:"peer_ids"`
+}
+
+// SharedNetworkPeerResponse 成员接入共享网络的peer
+type SharedNetworkPeerResponse struct {
+	PeerID  uint   `json:"peer_id"`
+	Comment string `json:"comment"`
+	Address string `json:"address"`
+}
+
+// SharedNetworkMemberResponse 共享网络成员
+type SharedNetworkMemberResponse struct {
+	UserID   uint                        `json:"user_id"`
+	Name     string                      `json:"name"`
+	Email    string                      `json:"email"`
+	Role     string                      `json:"role"`
+	Status   string                      `json:"status"`
+	WgSubnet string                      `json:"wg_subnet,omitempty"` // 成员的WireGuard网段（已加入时）
+	Peers    []SharedNetworkPeerResponse `json:"peers"`
+	JoinedAt *time.Time                  `json:"joined_at"`
+}
+
+// SharedNetworkResponse 共享网络及其成员
+type SharedNetworkResponse struct {
+	ID        uint                          `json:"id"`
+	Name      string                        `json:"name"`
+	OwnerID   uint                          `json:"owner_id"`
+	Role      string                        `json:"role,omitempty"`   // 当前用户的角色（管理员查看时为空）
+	Status    string                        `json:"status,omitempty"` // 当前用户的状态（管理员查看时为空）
+	Members   []SharedNetworkMemberResponse `json:"members"`
+	CreatedAt time.Time                     `json:"created_at"`
+}
+
+// errSharedNetworkName 共享网络名称已被使用
+var errSharedNetworkName = errors.New("shared network name already in use")
+
+// GetMySharedNetworks 获取当前用户加入或被邀请的共享网络
+func GetMySharedNetworks(c *gin.Context) {
+	user, _ := c.Get("user")
+	u := user.(*models.User)
+
+	var networks []models.SharedNetwork
+	if err := database.DB.
+		Where("id IN (?)", database.DB.Model(&models.SharedNetworkMember{}).Select("network_id").Where("user_id = ?", u.ID)).
+		Order("id").Find(&networks).Error; err != nil {
+		response.InternalError(c, "Failed to retrieve shared networks")
+		return
+	}
+
+	result := []SharedNetworkResponse{}
+	for i := range networks {
+		resp, err := buildSharedNetworkResponse(&networks[i], u.ID)
+		if err != nil {
+			response.InternalError(c, "Failed to retrieve shared networks")
+			return
+		}
+		result = append(result, resp)
+	}
+
+	response.Success(c, "Shared networks retrieved successfully", result)
+}
+
+// CreateSharedNetwork 创建共享网络，创建者以自己的服务器加入并成为所有者
+func CreateSharedNetwork(c *gin.Context) {
+	user, _ := c.Get("user")
+	u := user.(*models.User)
+
+	var req CreateSharedNetworkRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.ValidationError(c, err.Error())
+		return
+	}
+	name := strings.TrimSpace(req.Name)
+	if name == "" || len(name) > 64 {
+		response.BadRequest(c, "Name must be 1-64 characters", nil)
+		return
+	}
+
+	wgServer, ok := loadSharedNetworkServer(c, u, req.ServerID)
+	if !ok {
+		return
+	}
+
+	network := models.SharedNetwork{Name: name, OwnerID: u.ID}
+	err := applySharedNetworkChange(&network.ID, func(tx *gorm.DB, networkService *services.UserNetworkService) error {
+		var count int64
+		if err := tx.Model(&models.SharedNetwork{}).Where("name = ?", name).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return errSharedNetworkName
+		}
+		if err := tx.Create(&network).Error; err != nil {
+			return err
+		}
+
+		now := time.Now()
+		member := models.SharedNetworkMember{
+			NetworkID:   network.ID,
+			UserID:      u.ID,
+			ServerID:    &wgServer.ID,
+			Role:        models.SharedNetworkRoleOwner,
+			Status:      models.SharedNetworkStatusJoined,
+			InvitedByID: u.ID,
+			JoinedAt:    &now,
+		}
+		return joinSharedNetwork(tx, networkService, &member)
+	})
+	if err != nil {
+		if errors.Is(err, errSharedNetworkName) {
+			response.BadRequest(c, "Shared network name already in use", nil)
+			return
+		}
+		response.InternalError(c, "Failed to create shared network: "+err.Error())
+		return
+	}
+
+	respondSharedNetwork(c, "Shared network created successfully", &network, u.ID)
+}
+
+// DeleteSharedNetwork 删除共享网络（仅所有者），所有成员断开连接
+func DeleteSharedNetwork(c *gin.Context) {
+	user, _ := c.Get("user")
+	u := user.(*models.User)
+
+	network, member, ok := loadSharedNetworkMembership(c, u)
+	if !ok {
+		return
+	}
+	if member.Role != models.SharedNetworkRoleOwner {
+		response.Forbidden(c, "Only the owner can delete this shared network")
+		return
+	}
+
+	if err := deleteSharedNetwork(&network); err != nil {
+		response.InternalError(c, "Failed to delete shared network: "+err.Error())
+		return
+	}
+
+	response.Success(c, "Shared network deleted successfully", nil)
+}
+
+// InviteSharedNetworkMember 邀请用户加入共享网络（仅所有者），被邀请的用户接受后才会接入
+func InviteSharedNetworkMember(c *gin.Context) {
+	user, _ := c.Get("user")
+	u := user.(*models.User)
+
+	var req InviteSharedNetworkMemberRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.ValidationError(c, err.Error())
+		return
+	}
+
+	network, member, ok := loadSharedNetworkMembership(c, u)
+	if !ok {
+		return
+	}
+	if member.Role != models.SharedNetworkRoleOwner {
+		response.Forbidden(c, "Only the owner can invite members")
+		return
+	}
+
+	var invitee models.User
+	if err := database.DB.Where("email = ?", strings.TrimSpace(req.Email)).First(&invitee).Error; err != nil {
+		response.NotFound(c, "User not found")
+		return
+	}
+
+	var count int64
+	if err := database.DB.Model(&models.SharedNetworkMember{}).
+		Where("network_id = ? AND user_id = ?", network.ID, invitee.ID).Count(&count).Error; err != nil {
+		response.InternalError(c, "Failed to invite member")
+		return
+	}
+	if count > 0 {
+		response.BadRequest(c, "User is already a member or has been invited", nil)
+		return
+	}
+
+	invitation := models.SharedNetworkMember{
+		NetworkID:   network.ID,
+		UserID:      invitee.ID,
+		Role:        models.SharedNetworkRoleMember,
+		Status:      models.SharedNetworkStatusInvited,
+		InvitedByID: u.ID,
+	}
+	if err := database.DB.Create(&invitation).Error; err != nil {
+		response.InternalError(c, "Failed to invite member")
+		return
+	}
+
+	respondSharedNetwork(c, "Member invited successfully", &network, u.ID)
+}
+
+// JoinSharedNetwork 接受邀请，以当前用户的服务器加入共享网络
+func JoinSharedNetwork(c *gin.Context) {
+	user, _ := c.Get("user")
+	u := user.(*models.User)
+
+	network, member, ok := loadSharedNetworkMembership(c, u)
+	if !ok {
+		return
+	}
+	// 服务器已删除的成员（server_id 被置空）可以用其他服务器重新加入
+	if member.Joined() {
+		response.BadRequest(c, "You have already joined this shared network", nil)
+		return
+	}
+
+	var req JoinSharedNetworkRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		response.ValidationError(c, err.Error())
+		return
+	}
+
+	wgServer, ok := loadSharedNetworkServer(c, u, req.ServerID)
+	if !ok {
+		return
+	}
+
+	// 共享网络内按WireGuard网段路由，成员之间的网段不能重叠
+	if err := validateSharedNetworkSubnet(network.ID, &wgServer); err != nil {
+		response.BadRequest(c, err.Error(), nil)
+		return
+	}
+
+	err := applySharedNetworkChange(&network.ID, func(tx *gorm.DB, networkService *services.UserNetworkService) error {
+		now := time.Now()
+		member.ServerID = &wgServer.ID
+		member.Status = models.SharedNetworkStatusJoined
+		member.JoinedAt = &now
+		return joinSharedNetwork(tx, networkService, &member)
+	})
+	if err != nil {
+		response.InternalError(c, "Failed to join shared network: "+err.Error())
+		return
+	}
+
+	// 其他成员的网段加入了客户端配置
+	markSharedNetworkChanged(database.DB, network.ID)
+
+	respondSharedNetwork(c, "Joined shared network successfully", &network, u.ID)
+}
+
+// RemoveSharedNetworkMember 移除共享网络成员或撤销邀请（所有者），或者当前用户离开/拒绝邀请
+func RemoveSharedNetworkMember(c *gin.Context) {
+	user, _ := c.Get("user")
+	u := user.(*models.User)
+
+	targetUserID, err := strconv.ParseUint(c.Param("user_id"), 10, 32)
+	if err != nil {
+		response.BadRequest(c, "Invalid user ID", nil)
+		return
+	}
+
+	network, member, ok := loadSharedNetworkMembership(c, u)
+	if !ok {
+		return
+	}
+
+	target := member
+	if uint(targetUserID) == u.ID {
+		// 所有者不能离开，只能删除整个共享网络
+		if member.Role == models.SharedNetworkRoleOwner {
+			response.BadRequest(c, "The owner cannot leave; delete the shared network instead", nil)
+			return
+		}
+	} else {
+		if member.Role != models.SharedNetworkRoleOwner {
+			response.Forbidden(c, "Only the owner can remove members")
+			return
+		}
+		if err := database.DB.Where("network_id = ? AND user_id = ?", network.ID, targetUserID).First(&target).Error; err != nil {
+			response.NotFound(c, "Member not found")
+			return
+		}
+	}
+
+	// 离开成员的peer和其他成员的peer的客户端配置都会变化
+	markSharedNetworkChanged(database.DB, network.ID)
+
+	err = applySharedNetworkChange(&network.ID, func(tx *gorm.DB, networkService *services.UserNetworkService) error {
+		if target.ServerID != nil {
+			if err := tx.Where("network_id = ? AND peer_id IN (?)", network.ID,
+				tx.Model(&models.WireguardPeer{}).Select("id").Where("server_id = ?", *target.ServerID)).
+				Delete(&models.SharedNetworkPeer{}).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Delete(&target).Error; err != nil {
+			return err
+		}
+		return networkService.ApplySharedNetwork(network.ID)
+	})
+	if err != nil {
+		response.InternalError(c, "Failed to remove member: "+err.Error())
+		return
+	}
+
+	response.Success(c, "Member removed successfully", nil)
+}
+
+// UpdateMySharedNetworkPeers 设置当前用户接入共享网络的peer
+func UpdateMySharedNetworkPeers(c *gin.Context) {
+	user, _ := c.Get("user")
+	u := user.(*models.User)
+
+	var req UpdateSharedNetworkPeersRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		response.ValidationError(c, err.Error())
+		return
+	}
+
+	network, member, ok := loadSharedNetworkMembership(c, u)
+	if !ok {
+		return
+	}
+	if !member.Joined() {
+		response.BadRequest(c, "You have not joined this shared network", nil)
+		return
+	}
+
+	var peers []models.WireguardPeer
+	if err := database.DB.Where("server_id = ?", *member.ServerID).Find(&peers).Error; err != nil {
+		response.InternalError(c, "Failed to retrieve peers")
+		return
+	}
+	owned := make(map[uint]bool, len(peers))
+	for _, peer := range peers {
+		owned[peer.ID] = true
+	}
+
+	selected := make(map[uint]bool, len(req.PeerIDs))
+	var entries []models.SharedNetworkPeer
+	for _, peerID := range req.PeerIDs {
+		if !owned[peerID] {
+			response.BadRequest(c, fmt.Sprintf("Peer %d does not belong to your server", peerID), nil)
+			return
+		}
+		if selected[peerID] {
+			continue
+		}
+		selected[peerID] = true
+		entries = append(entries, models.SharedNetworkPeer{NetworkID: network.ID, PeerID: peerID})
+	}
+
+	var previous []uint
+	if err := database.DB.Model(&models.SharedNetworkPeer{}).Where("network_id = ? AND peer_id IN ?", network.ID, peerIDs(peers)).
+		Pluck("peer_id", &previous).Error; err != nil {
+		response.InternalError(c, "Failed to retrieve shared network peers")
+		return
+	}
+
+	err := applySharedNetworkChange(&network.ID, func(tx *gorm.DB, networkService *services.UserNetworkService) error {
+		if len(peers) > 0 {
+			if err := tx.Where("network_id = ? AND peer_id IN ?", network.ID, peerIDs(peers)).Delete(&models.SharedNetworkPeer{}).Error; err != nil {
+				return err
+			}
+		}
+		if len(entries) > 0 {
+			if err := tx.Create(&entries).Error; err != nil {
+				return err
+			}
+		}
+		return networkService.ApplySharedNetwork(network.ID)
+	})
+	if err != nil {
+		response.InternalError(c, "Failed to apply shared network peers: "+err.Error())
+		return
+	}
+
+	// 加入或移出共享网络的peer，客户端配置中其他成员的网段随之变化
+	var changed []uint
+	for _, peerID := range previous {
+		if !selected[peerID] {
+			changed = append(changed, peerID)
+		}
+		delete(selected, peerID)
+	}
+	for peerID := range selected {
+		changed = append(changed, peerID)
+	}
+	if len(changed) > 0 {
+		database.DB.Model(&models.WireguardPeer{}).Where("id IN ?", changed).Update("config_outdated", true)
+	}
+
+	respondSharedNetwork(c, "Shared network peers updated successfully", &network, u.ID)
+}
+
+// AdminGetSharedNetworks 获取所有共享网络及其成员（管理员）
+func AdminGetSharedNetworks(c *gin.Context) {
+	var networks []models.SharedNetwork
+	if err := database.DB.Order("id").Find(&networks).Error; err != nil {
+		response.InternalError(c, "Failed to retrieve shared networks")
+		return
+	}
+
+	result := []SharedNetworkResponse{}
+	for i := range networks {
+		resp, err := buildSharedNetworkResponse(&networks[i], 0)
+		if err != nil {
+			response.InternalError(c, "Failed to retrieve shared networks")
+			return
+		}
+		result = append(result, resp)
+	}
+
+	response.Success(c, "Shared networks retrieved successfully", result)
+}
+
+// AdminDeleteSharedNetwork 删除指定的共享网络（管理员）
+func AdminDeleteSharedNetwork(c *gin.Context) {
+	networkID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		response.BadRequest(c, "Invalid shared network ID", nil)
+		return
+	}
+
+	var network models.SharedNetwork
+	if err := database.DB.First(&network, networkID).Error; err != nil {
+		response.NotFound(c, "Shared network not found")
+		return
+	}
+
+	if err := deleteSharedNetwork(&network); err != nil {
+		response.InternalError(c, "Failed to delete shared network: "+err.Error())
+		return
+	}
+
+	response.Success(c, "Shared network deleted successfully", nil)
+}
+
+// loadSharedNetworkServer 获取当前用户用于加入共享网络的服务器，失败时已写入响应
+func loadSharedNetworkServer(c *gin.Context, u *models.User, serverID uint) (models.WireguardServer, bool) {
+	wgServer, ok := loadUserServer(c, u, serverID)
+	if !ok {
+		return wgServer, false
+	}
+
+	// 服务器已被管理员禁用
+	if !wgServer.Enabled {
+		response.ServerDisabled(c)
+		return wgServer, false
+	}
+	return wgServer, true
+}
+
+// loadSharedNetworkMembership 加载共享网络及当前用户的成员记录（包括邀请），失败时已写入响应
+func loadSharedNetworkMembership(c *gin.Context, u *models.User) (models.SharedNetwork, models.SharedNetworkMember, bool) {
+	var network models.SharedNetwork
+	var member models.SharedNetworkMember
+
+	networkID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		response.BadRequest(c, "Invalid shared network ID", nil)
+		return network, member, false
+	}
+
+	if err := database.DB.First(&network, networkID).Error; err != nil {
+		response.NotFound(c, "Shared network not found")
+		return network, member, false
+	}
+
+	// 不是成员也没有被邀请时不暴露共享网络
+	if err := database.DB.Where("network_id = ? AND user_id = ?", network.ID, u.ID).First(&member).Error; err != nil {
+		response.NotFound(c, "Shared network not found")
+		return network, member, false
+	}
+
+	return network, member, true
+}
+
+// validateSharedNetworkSubnet 确认服务器的WireGuard网段与共享网络中已加入成员的网段不重叠
+func validateSharedNetworkSubnet(networkID uint, wgServer *models.WireguardServer) error {
+	subnet, err := netip.ParsePrefix(wgServer.WgAddress)
+	if err != nil {
+		return fmt.Errorf("invalid wireguard address %s", wgServer.WgAddress)
+	}
+
+	var servers []models.WireguardServer
+	if err := database.DB.Where("id IN (?)", database.DB.Model(&models.SharedNetworkMember{}).Select("server_id").
+		Where("network_id = ? AND status = ?", networkID, models.SharedNetworkStatusJoined)).Find(&servers).Error; err != nil {
+		return fmt.Errorf("failed to retrieve shared network members")
+	}
+	for _, server := range servers {
+		if other, err := netip.ParsePrefix(server.WgAddress); err == nil && other.Masked().Overlaps(subnet.Masked()) {
+			return fmt.Errorf("your WireGuard subnet %s overlaps %s of another member", subnet.Masked(), other.Masked())
+		}
+	}
+	return nil
+}
+
+// joinSharedNetwork 保存已加入的成员记录并分配连接子网（在事务中调用）
+func joinSharedNetwork(tx *gorm.DB, networkService *services.UserNetworkService, member *models.SharedNetworkMember) error {
+	if err := tx.Save(member).Error; err != nil {
+		return err
+	}
+	// 服务器被删除前加入的成员可能还占用着旧的连接子网
+	if err := networkService.ReleaseSharedLink(member); err != nil {
+		return err
+	}
+	if err := networkService.AllocateSharedLink(member); err != nil {
+		return err
+	}
+	if err := tx.Model(member).Update("link_subnet", member.LinkSubnet).Error; err != nil {
+		return err
+	}
+	return networkService.ApplySharedNetwork(member.NetworkID)
+}
+
+// deleteSharedNetwork 删除共享网络记录（成员和选中的peer级联删除），并删除中转命名空间
+func deleteSharedNetwork(network *models.SharedNetwork) error {
+	// 成员peer的客户端配置中不再包含其他成员的网段
+	markSharedNetworkChanged(database.DB, network.ID)
+
+	return applySharedNetworkChange(&network.ID, func(tx *gorm.DB, networkService *services.UserNetworkService) error {
+		if err := tx.Delete(network).Error; err != nil {
+			return err
+		}
+		return networkService.DestroySharedNetwork(network.ID)
+	})
+}
+
+// detachSharedNetworkServer 删除服务器之前（在事务中调用）将以该服务器加入共享网络的成员恢复为已邀请，
+// 成员可以用其他服务器重新加入；其他成员选中的peer需要重新下载配置。
+// 返回受影响的共享网络，事务提交后需要重新应用
+func detachSharedNetworkServer(tx *gorm.DB, serverID uint) ([]uint, error) {
+	var networkIDs []uint
+	if err := tx.Model(&models.SharedNetworkMember{}).Where("server_id = ?", serverID).Order("network_id").
+		Pluck("network_id", &networkIDs).Error; err != nil {
+		return nil, fmt.Errorf("failed to load shared networks: %v", err)
+	}
+	if len(networkIDs) == 0 {
+		return nil, nil
+	}
+
+	for _, networkID := range networkIDs {
+		if err := markSharedNetworkChanged(tx, networkID); err != nil {
+			return nil, fmt.Errorf("failed to mark shared network peers: %v", err)
+		}
+	}
+	if err := tx.Where("network_id IN ? AND peer_id IN (?)", networkIDs,
+		tx.Model(&models.WireguardPeer{}).Select("id").Where("server_id = ?", serverID)).
+		Delete(&models.SharedNetworkPeer{}).Error; err != nil {
+		return nil, fmt.Errorf("failed to delete shared network peers: %v", err)
+	}
+	if err := tx.Model(&models.SharedNetworkMember{}).Where("server_id = ?", serverID).Updates(map[string]interface{}{
+		"server_id":   nil,
+		"status":      models.SharedNetworkStatusInvited,
+		"link_subnet": "",
+		"joined_at":   nil,
+	}).Error; err != nil {
+		return nil, fmt.Errorf("failed to detach shared network members: %v", err)
+	}
+	return networkIDs, nil
+}
+
+// applySharedNetworkChange 在事务中修改共享网络记录并重新应用（change 负责调用 ApplySharedNetwork 等）
+// 失败时事务回滚，并按数据库中原有的记录恢复共享网络
+func applySharedNetworkChange(networkID *uint, change func(tx *gorm.DB, networkService *services.UserNetworkService) error) error {
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		return change(tx, services.NewUserNetworkService(tx, config.AppConfig.Network))
+	})
+	if err != nil && *networkID != 0 {
+		networkService := services.NewUserNetworkService(database.DB, config.AppConfig.Network)
+		networkService.ApplySharedNetwork(*networkID)
+	}
+	return err
+}
+
+// markSharedNetworkChanged 标记共享网络中所有接入的peer需要重新下载配置（成员网段变化时）
+func markSharedNetworkChanged(db *gorm.DB, networkID uint) error {
+	return db.Model(&models.WireguardPeer{}).
+		Where("id IN (?)", db.Model(&models.SharedNetworkPeer{}).Select("peer_id").Where("network_id = ?", networkID)).
+		Update("config_outdated", true).Error
+}
+
+// respondSharedNetwork 返回共享网络详情
+func respondSharedNetwork(c *gin.Context, message string, network *models.SharedNetwork, userID uint) {
+	resp, err := buildSharedNetworkResponse(network, userID)
+	if err != nil {
+		response.InternalError(c, "Failed to retrieve shared network")
+		return
+	}
+	response.Success(c, message, resp)
+}
+
+// buildSharedNetworkResponse 组装共享网络的成员和接入的peer；userID 不为0时填写该用户的角色和状态
+func buildSharedNetworkResponse(network *models.SharedNetwork, userID uint) (SharedNetworkResponse, error) {
+	resp := SharedNetworkResponse{
+		ID:        network.ID,
+		Name:      network.Name,
+		OwnerID:   network.OwnerID,
+		Members:   []SharedNetworkMemberResponse{},
+		CreatedAt: network.CreatedAt,
+	}
+
+	var members []models.SharedNetworkMember
+	if err := database.DB.Preload("User").Preload("Server").Where("network_id = ?", network.ID).Order("id").Find(&members).Error; err != nil {
+		return resp, err
+	}
+
+	var selected []models.SharedNetworkPeer
+	if err := database.DB.Preload("Peer").Where("network_id = ?", network.ID).Order("peer_id").Find(&selected).Error; err != nil {
+		return resp, err
+	}
+	peersByServer := make(map[uint][]SharedNetworkPeerResponse)
+	for _, entry := range selected {
+		peersByServer[entry.Peer.ServerID] = append(peersByServer[entry.Peer.ServerID], SharedNetworkPeerResponse{
+			PeerID:  entry.PeerID,
+			Comment: entry.Peer.Comment,
+			Address: entry.Peer.PeerAddress,
+		})
+	}
+
+	for _, member := range members {
+		if member.UserID == userID {
+			resp.Role, resp.Status = member.Role, member.Status
+		}
+
+		item := SharedNetworkMemberResponse{
+			UserID:   member.UserID,
+			Name:     member.User.Name,
+			Email:    member.User.Email,
+			Role:     member.Role,
+			Status:   member.Status,
+			Peers:    []SharedNetworkPeerResponse{},
+			JoinedAt: member.JoinedAt,
+		}
+		if member.Joined() && member.Server != nil {
+			if prefix, err := netip.ParsePrefix(member.Server.WgAddress); err == nil {
+				item.WgSubnet = prefix.Masked().String()
+			}
+			if peers, ok := peersByServer[member.Server.ID]; ok {
+				item.Peers = peers
+			}
+		}
+		resp.Members = append(resp.Members, item)
+	}
+	return resp, nil
+}
+
+// peerIDs 提取peer的ID列表
+func peerIDs(peers []models.WireguardPeer) []uint {
+	ids := make([]uint, 0, len(peers))
+	for _, peer := range peers {
+		ids = append(ids, peer.ID)
+	}
+	return ids
+}
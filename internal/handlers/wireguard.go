@@ -6,10 +6,15 @@ import (
 	"cloud-platform/internal/models"
 	"cloud-platform/internal/response"
 	"cloud-platform/internal/services"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net/netip"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"gorm.io/gorm"
@@ -21,17 +26,20 @@ func GetMyTrafficStats(c *gin.Context) {
 	u := user.(*models.User)
 
 	// 查询用户的 WireGuard 服务器
-	var wgServer models.WireguardServer
-	if err := database.DB.Where("user_id = ?", u.ID).First(&wgServer).Error; err != nil {
-		response.BadRequest(c, "User has no WireGuard server configured", nil)
+	wgServer, ok := loadMyServer(c, u)
+	if !ok {
 		return
 	}
 
-	// 创建WireGuard服务
-	wgService := services.NewWireguardService(config.AppConfig.Network.ConfigDir)
+	// 服务器已被管理员禁用
+	if !wgServer.Enabled {
+		response.ServerDisabled(c)
+		return
+	}
 
 	// 获取流量统计
-	stats, err := wgService.GetDetailedStats(wgServer.Namespace, wgServer.WgInterface)
+	networkService := services.NewUserNetworkService(database.DB, config.AppConfig.Network)
+	stats, err := networkService.GetServerStats(&wgServer)
 	if err != nil {
 		response.InternalError(c, "Failed to get traffic stats: "+err.Error())
 		return
@@ -72,17 +80,20 @@ func GetMyTrafficSummary(c *gin.Context) {
 	u := user.(*models.User)
 
 	// 查询用户的 WireGuard 服务器
-	var wgServer models.WireguardServer
-	if err := database.DB.Where("user_id = ?", u.ID).First(&wgServer).Error; err != nil {
-		response.BadRequest(c, "User has no WireGuard server configured", nil)
+	wgServer, ok := loadMyServer(c, u)
+	if !ok {
 		return
 	}
 
-	// 创建WireGuard服务
-	wgService := services.NewWireguardService(config.AppConfig.Network.ConfigDir)
+	// 服务器已被管理员禁用
+	if !wgServer.Enabled {
+		response.ServerDisabled(c)
+		return
+	}
 
 	// 获取流量统计
-	stats, err := wgService.GetDetailedStats(wgServer.Namespace, wgServer.WgInterface)
+	networkService := services.NewUserNetworkService(database.DB, config.AppConfig.Network)
+	stats, err := networkService.GetServerStats(&wgServer)
 	if err != nil {
 		response.InternalError(c, "Failed to get traffic stats: "+err.Error())
 		return
@@ -131,14 +142,18 @@ func GetAdminTrafficStats(c *gin.Context) {
 		return
 	}
 
-	wgService := services.NewWireguardService(config.AppConfig.Network.ConfigDir)
+	networkService := services.NewUserNetworkService(database.DB, config.AppConfig.Network)
 
 	var adminTraffic []models.AdminUserTraffic
 	for _, server := range servers {
-		stats, err := wgService.GetDetailedStats(server.Namespace, server.WgInterface)
-		if err != nil {
-			// 记录错误但继续处理其他用户
-			continue
+		stats := &models.WireguardServerStats{}
+		if server.Enabled {
+			var err error
+			stats, err = networkService.GetServerStats(&server)
+			if err != nil {
+				// 记录错误但继续处理其他用户
+				continue
+			}
 		}
 
 		adminTraffic = append(adminTraffic, models.AdminUserTraffic{
@@ -155,6 +170,7 @@ func GetAdminTrafficStats(c *gin.Context) {
 			Enabled:      server.Enabled,
 			DownloadRate: server.DownloadRate,
 			UploadRate:   server.UploadRate,
+			PeerIsolation: server.PeerIsolationMode(),
 		})
 	}
 
@@ -176,15 +192,26 @@ func GetUserTrafficStats(c *gin.Context) {
 		return
 	}
 
+	// 可通过 server_id 指定用户的某个服务器，默认使用第一个服务器
+	query := database.DB.Where("user_id = ?", user.ID)
+	if serverIDStr := c.Query("server_id"); serverIDStr != "" {
+		serverID, err := strconv.ParseUint(serverIDStr, 10, 32)
+		if err != nil {
+			response.BadRequest(c, "Invalid server ID", nil)
+			return
+		}
+		query = query.Where("id = ?", serverID)
+	}
+
 	var wgServer models.WireguardServer
-	if err := database.DB.Where("user_id = ?", user.ID).First(&wgServer).Error; err != nil {
+	if err := query.Order("id").First(&wgServer).Error; err != nil {
 		response.BadRequest(c, "User has no WireGuard server configured", nil)
 		return
 	}
 
-	wgService := services.NewWireguardService(config.AppConfig.Network.ConfigDir)
+	networkService := services.NewUserNetworkService(database.DB, config.AppConfig.Network)
 
-	stats, err := wgService.GetDetailedStats(wgServer.Namespace, wgServer.WgInterface)
+	stats, err := networkService.GetServerStats(&wgServer)
 	if err != nil {
 		response.InternalError(c, "Failed to get traffic stats: "+err.Error())
 		return
@@ -223,9 +250,8 @@ func GetMyPeers(c *gin.Context) {
 	u := user.(*models.User)
 
 	// 获取用户的 WireGuard 服务器
-	var wgServer models.WireguardServer
-	if err := database.DB.Where("user_id = ?", u.ID).First(&wgServer).Error; err != nil {
-		response.BadRequest(c, "User has no WireGuard server configured", nil)
+	wgServer, ok := loadMyServer(c, u)
+	if !ok {
 		return
 	}
 
@@ -236,9 +262,13 @@ func GetMyPeers(c *gin.Context) {
 	}
 
 	// 转换为响应格式
+	// 访问状态按当前时间计算，不必等待后台调度更新数据库中的状态
+	now := time.Now()
 	var peerResponses []models.WireguardPeerResponse
 	for _, peer := range peers {
-		peerResponses = append(peerResponses, peer.ToResponse())
+		peerResponse := peer.ToResponse()
+		peerResponse.AccessStatus = services.PeerAccessStatus(&peer, now)
+		peerResponses = append(peerResponses, peerResponse)
 	}
 
 	response.Success(c, "Peers retrieved successfully", peerResponses)
@@ -246,11 +276,18 @@ func GetMyPeers(c *gin.Context) {
 
 // AddPeerRequest 添加peer请求
 type AddPeerRequest struct {
-	AllowedIPs          string `json:"allowed_ips"` // peer可以访问的IP地址或网段，留空则默认为peer自己的IP
+	AllowedIPs          string `json:"allowed_ips"` // peer可以访问的IP地址或网段，留空则默认为peer自己的IP；WireGuard网段以外的网段视为peer背后的局域网（站点到站点）
 	PersistentKeepalive int    `json:"persistent_keepalive"`
 	Comment             string `json:"comment"`
 	EnableForwarding    bool   `json:"enable_forwarding"`    // 是否启用转发（作为网关）
 	ForwardInterface    string `json:"forward_interface"`    // 转发接口名称（如 eth0）
+	DisablePresharedKey bool   `json:"disable_preshared_key"` // 不使用预共享密钥（默认自动生成）
+	PublicKey           string `json:"public_key"`            // 客户端生成的公钥，提交后服务器不生成也不保存私钥
+	ClientRouteMode     string `json:"client_route_mode"`     // 客户端路由模式（full/exclude_private/subnet/custom），留空继承服务器设置
+	ClientAllowedIPs    string `json:"client_allowed_ips"`    // custom 模式下客户端配置的 AllowedIPs
+	ClientDNS           string `json:"client_dns"`            // 客户端DNS，留空继承服务器设置
+	ExpiresAt           string `json:"expires_at"`            // 过期时间（RFC3339），留空永不过期
+	AccessSchedule      string `json:"access_schedule"`       // 每周重复的访问时间段（如 "mon-fri 09:00-18:00"），留空不限制
 }
 
 // AddPeer 添加新的peer
@@ -265,24 +302,59 @@ func AddPeer(c *gin.Context) {
 	}
 
 	// 获取用户的 WireGuard 服务器
-	var wgServer models.WireguardServer
-	if err := database.DB.Where("user_id = ?", u.ID).First(&wgServer).Error; err != nil {
-		response.BadRequest(c, "User has no WireGuard server configured", nil)
+	wgServer, ok := loadMyServer(c, u)
+	if !ok {
+		return
+	}
+
+	unlock, ok := lockServer(c, &wgServer)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	// 服务器已被管理员禁用
+	if !wgServer.Enabled {
+		response.ServerDisabled(c)
 		return
 	}
 
-	// 创建WireGuard服务实例
-	wgService := services.NewWireguardService(config.AppConfig.Network.ConfigDir)
+	clientAllowedIPs, clientDNS, err := normalizeClientRouting(req.ClientRouteMode, req.ClientAllowedIPs, req.ClientDNS)
+	if err != nil {
+		response.BadRequest(c, err.Error(), nil)
+		return
+	}
+	expiresAt, accessSchedule, err := normalizePeerAccess(req.ExpiresAt, req.AccessSchedule)
+	if err != nil {
+		response.BadRequest(c, err.Error(), nil)
+		return
+	}
+
+	networkService := services.NewUserNetworkService(database.DB, config.AppConfig.Network)
 
-	// 1. 自动生成peer的密钥对
-	privateKey, publicKey, err := wgService.GenerateKeys()
+	// 1. 确定peer的密钥对（客户端提交公钥，或由服务器生成）
+	privateKey, publicKey, err := resolvePeerKeys(networkService, req.PublicKey, config.AppConfig.Network.RequireClientKeys)
 	if err != nil {
+		if errors.Is(err, errClientKeyRequired) || errors.Is(err, errInvalidPublicKey) {
+			response.BadRequest(c, err.Error(), nil)
+			return
+		}
 		response.InternalError(c, "Failed to generate peer keys: "+err.Error())
 		return
 	}
 
+	// 默认为每个peer生成预共享密钥，提供额外的抗量子保护
+	presharedKey := ""
+	if !req.DisablePresharedKey {
+		presharedKey, err = networkService.GeneratePresharedKey()
+		if err != nil {
+			response.InternalError(c, "Failed to generate preshared key: "+err.Error())
+			return
+		}
+	}
+
 	// 2. 自动分配peer IP地址（从服务器网段中分配）
-	peerIP, err := allocatePeerIP(wgServer.ID, wgServer.WgAddress)
+	peerIP, peerIP6, err := allocatePeerIP(wgServer.ID, wgServer.WgAddress, wgServer.WgAddress6)
 	if err != nil {
 		response.InternalError(c, "Failed to allocate peer IP: "+err.Error())
 		return
@@ -299,12 +371,31 @@ func AddPeer(c *gin.Context) {
 		ServerID:            wgServer.ID,
 		PublicKey:           publicKey,
 		PrivateKey:          privateKey,
+		PresharedKey:        presharedKey,
 		PeerAddress:         peerIP,
+		PeerAddress6:        peerIP6,
 		AllowedIPs:          allowedIPs,
 		PersistentKeepalive: req.PersistentKeepalive,
 		Comment:             req.Comment,
 		EnableForwarding:    req.EnableForwarding,
 		ForwardInterface:    req.ForwardInterface,
+		ClientRouteMode:     req.ClientRouteMode,
+		ClientAllowedIPs:    clientAllowedIPs,
+		ClientDNS:           clientDNS,
+		ExpiresAt:           expiresAt,
+		AccessSchedule:      accessSchedule,
+	}
+	peer.AccessStatus = services.PeerAccessStatus(&peer, time.Now())
+
+	// peer背后的路由网段不能与其他peer的路由网段重叠
+	var existingPeers []models.WireguardPeer
+	if err := database.DB.Where("server_id = ?", wgServer.ID).Find(&existingPeers).Error; err != nil {
+		response.InternalError(c, "Failed to retrieve peers")
+		return
+	}
+	if err := services.ValidateRoutedSubnets(&wgServer, &peer, existingPeers); err != nil {
+		response.BadRequest(c, err.Error(), nil)
+		return
 	}
 
 	if err := database.DB.Create(&peer).Error; err != nil {
@@ -312,76 +403,130 @@ func AddPeer(c *gin.Context) {
 		return
 	}
 
-	// 5. 添加到WireGuard配置（使用peer的IP地址作为allowed-ips）
-	if err := wgService.AddPeer(wgServer.Namespace, wgServer.WgInterface, publicKey, peerIP+"/32", ""); err != nil {
-		// 回滚数据库记录
+	// 5. 重写服务器配置文件并同步到WireGuard接口（使用peer的IP地址作为allowed-ips）
+	// 同时为peer指定的网段添加路由和转发规则
+	// 注意：如果allowedIPs就是peer自己的IP，不需要额外的路由规则（WireGuard已经处理）
+	if err := networkService.SyncPeers(&wgServer, u.UserUID); err != nil {
+		// 回滚数据库记录并恢复配置，清理可能已添加的peer网段路由
 		database.DB.Delete(&peer)
+		networkService.RemovePeerRoutes(&wgServer, &peer)
+		networkService.SyncPeers(&wgServer, u.UserUID)
 		response.InternalError(c, "Failed to add peer to WireGuard: "+err.Error())
 		return
 	}
 
-	// 6. 同步路由规则：确保命名空间知道如何访问peer指定的网段
-	// 注意：如果allowedIPs就是peer自己的IP，不需要额外的路由规则（WireGuard已经处理）
-	netnsService := services.NewNetnsService()
-	if allowedIPs != peerIP+"/32" && allowedIPs != "0.0.0.0/0" {
-		if err := netnsService.AddRouteForPeer(wgServer.Namespace, wgServer.WgInterface, allowedIPs); err != nil {
-			// 路由添加失败，回滚WireGuard配置和数据库
-			wgService.RemovePeer(wgServer.Namespace, wgServer.WgInterface, publicKey)
-			database.DB.Delete(&peer)
-			response.InternalError(c, "Failed to add route for peer: "+err.Error())
-			return
+	// 新peer背后的网段需要加入其他peer的客户端配置
+	if len(services.PeerRoutedSubnets(&wgServer, &peer)) > 0 {
+		if err := markRoutedSubnetsChanged(database.DB, &wgServer, peer.ID); err != nil {
+			log.Printf("Warning: Failed to mark peer configs outdated for server %d: %v", wgServer.ID, err)
 		}
+	}
 
-		// 7. 同步iptables规则：允许转发peer网段的流量
-		if err := netnsService.AddIptablesRuleForPeer(wgServer.Namespace, allowedIPs); err != nil {
-			// iptables失败，回滚所有配置
-			netnsService.DeleteRouteForPeer(wgServer.Namespace, wgServer.WgInterface, allowedIPs)
-			wgService.RemovePeer(wgServer.Namespace, wgServer.WgInterface, publicKey)
-			database.DB.Delete(&peer)
-			response.InternalError(c, "Failed to add iptables rule for peer: "+err.Error())
-			return
+	response.Created(c, "Peer added successfully", peer.ToResponse())
+}
+
+var (
+	// errClientKeyRequired 服务器策略要求客户端自行生成密钥
+	errClientKeyRequired = errors.New("server policy requires a client-generated public key")
+	// errInvalidPublicKey 客户端提交的公钥无效或已被使用
+	errInvalidPublicKey = errors.New("invalid public key")
+)
+
+// resolvePeerKeys 确定peer的密钥对
+// 客户端提交公钥时只校验并使用该公钥，私钥返回为空（服务器不保存）；
+// 否则由服务器生成密钥对，requireClientKey 为 true 时拒绝服务器生成
+func resolvePeerKeys(networkService *services.UserNetworkService, clientPublicKey string, requireClientKey bool) (string, string, error) {
+	if clientPublicKey == "" {
+		if requireClientKey {
+			return "", "", errClientKeyRequired
 		}
+		return networkService.GeneratePeerKeys()
 	}
 
-	response.Created(c, "Peer added successfully", peer.ToResponse())
+	clientPublicKey = strings.TrimSpace(clientPublicKey)
+	if err := services.ValidateWireguardKey(clientPublicKey); err != nil {
+		return "", "", fmt.Errorf("%w: %v", errInvalidPublicKey, err)
+	}
+
+	// 公钥在整个系统中必须唯一（包括服务器公钥和宽限期内的旧公钥）
+	var count int64
+	database.DB.Model(&models.WireguardPeer{}).Where("public_key = ?", clientPublicKey).Count(&count)
+	if count == 0 {
+		database.DB.Model(&models.WireguardServer{}).Where("wg_public_key = ?", clientPublicKey).Count(&count)
+	}
+	if count == 0 {
+		database.DB.Model(&models.WireguardPeerKeyRotation{}).Where("old_public_key = ? AND retired_at IS NULL", clientPublicKey).Count(&count)
+	}
+	if count > 0 {
+		return "", "", fmt.Errorf("%w: key is already in use", errInvalidPublicKey)
+	}
+
+	return "", clientPublicKey, nil
 }
 
 // allocatePeerIP 为peer分配IP地址
-func allocatePeerIP(serverID uint, serverAddress string) (string, error) {
+// 服务器启用双栈时，IPv6地址与IPv4地址使用相同的主机号（如 10.100.1.5 对应 fd00::5）
+func allocatePeerIP(serverID uint, serverAddress, serverAddress6 string) (string, string, error) {
 	// 解析服务器地址（如 10.100.1.1/24）
-	parts := strings.Split(serverAddress, "/")
-	if len(parts) != 2 {
-		return "", fmt.Errorf("invalid server address format")
-	}
-
-	ipParts := strings.Split(parts[0], ".")
-	if len(ipParts) != 4 {
-		return "", fmt.Errorf("invalid IP address format")
+	serverPrefix, err := netip.ParsePrefix(serverAddress)
+	if err != nil || !serverPrefix.Addr().Is4() {
+		return "", "", fmt.Errorf("invalid server address format")
 	}
 
 	// 获取该服务器已分配的所有peer IP
 	var peers []models.WireguardPeer
 	if err := database.DB.Where("server_id = ?", serverID).Find(&peers).Error; err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	// 构建已使用的IP集合
 	usedIPs := make(map[string]bool)
-	usedIPs[parts[0]] = true // 服务器IP本身
+	usedIPs[serverPrefix.Addr().String()] = true // 服务器IP本身
 	for _, peer := range peers {
 		usedIPs[peer.PeerAddress] = true
 	}
 
-	// 从 .2 开始分配（.1 是服务器）
-	baseIP := fmt.Sprintf("%s.%s.%s", ipParts[0], ipParts[1], ipParts[2])
-	for i := 2; i <= 254; i++ {
-		candidateIP := fmt.Sprintf("%s.%d", baseIP, i)
-		if !usedIPs[candidateIP] {
-			return candidateIP, nil
+	// 从 .2 开始分配（.1 是服务器），跳过广播地址
+	network := serverPrefix.Masked()
+	hostCount := uint32(1) << (32 - network.Bits())
+	base := network.Addr().As4()
+	baseNum := uint32(base[0])<<24 | uint32(base[1])<<16 | uint32(base[2])<<8 | uint32(base[3])
+
+	for i := uint32(2); i < hostCount-1; i++ {
+		n := baseNum + i
+		candidate := netip.AddrFrom4([4]byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)})
+		if usedIPs[candidate.String()] {
+			continue
+		}
+
+		if serverAddress6 == "" {
+			return candidate.String(), "", nil
+		}
+
+		candidate6, err := peerAddress6(serverAddress6, i)
+		if err != nil {
+			return "", "", err
 		}
+		return candidate.String(), candidate6, nil
 	}
 
-	return "", fmt.Errorf("no available IP addresses in the subnet")
+	return "", "", fmt.Errorf("no available IP addresses in the subnet")
+}
+
+// peerAddress6 计算IPv6网段中第 n 个主机地址
+func peerAddress6(serverAddress6 string, n uint32) (string, error) {
+	prefix, err := netip.ParsePrefix(serverAddress6)
+	if err != nil || !prefix.Addr().Is6() {
+		return "", fmt.Errorf("invalid server IPv6 address format")
+	}
+
+	addr := prefix.Masked().Addr().As16()
+	addr[12] |= byte(n >> 24)
+	addr[13] |= byte(n >> 16)
+	addr[14] |= byte(n >> 8)
+	addr[15] |= byte(n)
+
+	return netip.AddrFrom16(addr).String(), nil
 }
 
 // DeletePeer 删除peer
@@ -397,9 +542,20 @@ func DeletePeer(c *gin.Context) {
 	}
 
 	// 获取用户的 WireGuard 服务器
-	var wgServer models.WireguardServer
-	if err := database.DB.Where("user_id = ?", u.ID).First(&wgServer).Error; err != nil {
-		response.BadRequest(c, "User has no WireGuard server configured", nil)
+	wgServer, ok := loadMyServer(c, u)
+	if !ok {
+		return
+	}
+
+	unlock, ok := lockServer(c, &wgServer)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	// 服务器已被管理员禁用
+	if !wgServer.Enabled {
+		response.ServerDisabled(c)
 		return
 	}
 
@@ -415,17 +571,26 @@ func DeletePeer(c *gin.Context) {
 		return
 	}
 
-	// 清理iptables规则
-	netnsService := services.NewNetnsService()
-	netnsService.DeleteIptablesRuleForPeer(wgServer.Namespace, peer.AllowedIPs)
+	// 转发规则在peer删除后由 SyncPeers 整体替换
+	networkService := services.NewUserNetworkService(database.DB, config.AppConfig.Network)
+	routedSubnets := services.PeerRoutedSubnets(&wgServer, &peer)
 
 	// 清理路由规则
-	netnsService.DeleteRouteForPeer(wgServer.Namespace, wgServer.WgInterface, peer.AllowedIPs)
+	networkService.RemovePeerRoutes(&wgServer, &peer)
 
-	// 从WireGuard配置中删除
-	wgService := services.NewWireguardService(config.AppConfig.Network.ConfigDir)
-	if err := wgService.RemovePeer(wgServer.Namespace, wgServer.WgInterface, peer.PublicKey); err != nil {
-		response.InternalError(c, "Failed to remove peer from WireGuard: "+err.Error())
+	// 删除出口peer时取消出口设置，使用它的peer回到服务器出口
+	if wgServer.ExitPeerID != nil && *wgServer.ExitPeerID == peer.ID {
+		if err := database.DB.Model(&wgServer).Update("exit_peer_id", nil).Error; err != nil {
+			response.InternalError(c, "Failed to clear exit peer")
+			return
+		}
+		wgServer.ExitPeerID = nil
+	}
+
+	// 选中记录随peer级联删除，先记下选中了该peer的共享网络
+	sharedNetworks, err := networkService.PeerSharedNetworks(&peer)
+	if err != nil {
+		response.InternalError(c, "Failed to retrieve shared networks")
 		return
 	}
 
@@ -435,6 +600,25 @@ func DeletePeer(c *gin.Context) {
 		return
 	}
 
+	// 重写配置文件并同步到WireGuard接口（peer随之移除）
+	if err := networkService.SyncPeers(&wgServer, u.UserUID); err != nil {
+		response.InternalError(c, "Failed to remove peer from WireGuard: "+err.Error())
+		return
+	}
+
+	// 共享网络不再放行被删除的peer
+	if err := networkService.ApplySharedNetworksByID(sharedNetworks); err != nil {
+		response.InternalError(c, "Failed to update shared networks: "+err.Error())
+		return
+	}
+
+	// 被删除peer背后的网段需要从其他peer的客户端配置中移除
+	if len(routedSubnets) > 0 {
+		if err := markRoutedSubnetsChanged(database.DB, &wgServer, peer.ID); err != nil {
+			log.Printf("Warning: Failed to mark peer configs outdated for server %d: %v", wgServer.ID, err)
+		}
+	}
+
 	response.Success(c, "Peer deleted successfully", nil)
 }
 
@@ -445,6 +629,11 @@ type UpdatePeerRequest struct {
 	Comment             string `json:"comment"`
 	EnableForwarding    *bool  `json:"enable_forwarding"`
 	ForwardInterface    string `json:"forward_interface"`
+	ClientRouteMode     *string `json:"client_route_mode"`  // 空字符串表示改为继承服务器设置
+	ClientAllowedIPs    *string `json:"client_allowed_ips"`
+	ClientDNS           *string `json:"client_dns"`         // 空字符串表示改为继承服务器设置
+	ExpiresAt           *string `json:"expires_at"`         // 过期时间（RFC3339），空字符串表示永不过期
+	AccessSchedule      *string `json:"access_schedule"`    // 访问时间段，空字符串表示不限制
 }
 
 // UpdatePeer 更新peer信息
@@ -466,9 +655,20 @@ func UpdatePeer(c *gin.Context) {
 	}
 
 	// 获取用户的 WireGuard 服务器
-	var wgServer models.WireguardServer
-	if err := database.DB.Where("user_id = ?", u.ID).First(&wgServer).Error; err != nil {
-		response.BadRequest(c, "User has no WireGuard server configured", nil)
+	wgServer, ok := loadMyServer(c, u)
+	if !ok {
+		return
+	}
+
+	unlock, ok := lockServer(c, &wgServer)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	// 服务器已被管理员禁用
+	if !wgServer.Enabled {
+		response.ServerDisabled(c)
 		return
 	}
 
@@ -488,6 +688,19 @@ func UpdatePeer(c *gin.Context) {
 
 	needWgUpdate := false
 	if req.AllowedIPs != "" && req.AllowedIPs != peer.AllowedIPs {
+		// peer背后的路由网段不能与其他peer的路由网段重叠
+		var peers []models.WireguardPeer
+		if err := database.DB.Where("server_id = ?", wgServer.ID).Find(&peers).Error; err != nil {
+			response.InternalError(c, "Failed to retrieve peers")
+			return
+		}
+		updated := peer
+		updated.AllowedIPs = req.AllowedIPs
+		if err := services.ValidateRoutedSubnets(&wgServer, &updated, peers); err != nil {
+			response.BadRequest(c, err.Error(), nil)
+			return
+		}
+
 		updates["allowed_ips"] = req.AllowedIPs
 		needWgUpdate = true
 	}
@@ -508,48 +721,58 @@ func UpdatePeer(c *gin.Context) {
 		updates["forward_interface"] = req.ForwardInterface
 	}
 
-	if len(updates) == 0 {
-		response.BadRequest(c, "No valid fields to update", nil)
-		return
-	}
-
-	// 如果需要更新WireGuard配置（AllowedIPs变化）
-	// 注意：AllowedIPs 是 peer 可以访问的网段，不影响 WireGuard 配置中的 allowed-ips
-	// WireGuard 配置中的 allowed-ips 始终是 peer 的 IP 地址
-	if needWgUpdate {
-		netnsService := services.NewNetnsService()
-		
-		// 1. 清理旧的路由和iptables规则
-		if peer.AllowedIPs != "" && peer.AllowedIPs != "0.0.0.0/0" {
-			netnsService.DeleteIptablesRuleForPeer(wgServer.Namespace, peer.AllowedIPs)
-			netnsService.DeleteRouteForPeer(wgServer.Namespace, wgServer.WgInterface, peer.AllowedIPs)
-		}
-		
-		// 2. 添加新的路由和iptables规则
-		if req.AllowedIPs != "" && req.AllowedIPs != "0.0.0.0/0" {
-			if err := netnsService.AddRouteForPeer(wgServer.Namespace, wgServer.WgInterface, req.AllowedIPs); err != nil {
-				// 尝试恢复旧规则
-				if peer.AllowedIPs != "" && peer.AllowedIPs != "0.0.0.0/0" {
-					netnsService.AddRouteForPeer(wgServer.Namespace, wgServer.WgInterface, peer.AllowedIPs)
-					netnsService.AddIptablesRuleForPeer(wgServer.Namespace, peer.AllowedIPs)
-				}
-				response.InternalError(c, "Failed to add route for peer: "+err.Error())
+	// 客户端路由和DNS只影响客户端配置，变更后需要重新下载
+	if req.ClientRouteMode != nil || req.ClientAllowedIPs != nil || req.ClientDNS != nil {
+		mode, allowedIPs, dns := peer.ClientRouteMode, peer.ClientAllowedIPs, peer.ClientDNS
+		if req.ClientRouteMode != nil {
+			mode = *req.ClientRouteMode
+		}
+		if req.ClientAllowedIPs != nil {
+			allowedIPs = *req.ClientAllowedIPs
+		}
+		if req.ClientDNS != nil {
+			dns = *req.ClientDNS
+		}
+		allowedIPs, dns, err := normalizeClientRouting(mode, allowedIPs, dns)
+		if err != nil {
+			response.BadRequest(c, err.Error(), nil)
+			return
+		}
+		updates["client_route_mode"] = mode
+		updates["client_allowed_ips"] = allowedIPs
+		updates["client_dns"] = dns
+		updates["config_outdated"] = true
+	}
+
+	// 过期时间和访问时间段决定peer是否出现在接口上，同步时生效
+	if req.ExpiresAt != nil || req.AccessSchedule != nil {
+		updated := peer
+		if req.ExpiresAt != nil {
+			if updated.ExpiresAt, err = parseExpiresAt(*req.ExpiresAt); err != nil {
+				response.BadRequest(c, err.Error(), nil)
 				return
 			}
-			
-			if err := netnsService.AddIptablesRuleForPeer(wgServer.Namespace, req.AllowedIPs); err != nil {
-				// 回滚
-				netnsService.DeleteRouteForPeer(wgServer.Namespace, wgServer.WgInterface, req.AllowedIPs)
-				if peer.AllowedIPs != "" && peer.AllowedIPs != "0.0.0.0/0" {
-					netnsService.AddRouteForPeer(wgServer.Namespace, wgServer.WgInterface, peer.AllowedIPs)
-					netnsService.AddIptablesRuleForPeer(wgServer.Namespace, peer.AllowedIPs)
-				}
-				response.InternalError(c, "Failed to add iptables rule for peer: "+err.Error())
+		}
+		if req.AccessSchedule != nil {
+			if updated.AccessSchedule, err = services.NormalizeAccessSchedule(*req.AccessSchedule); err != nil {
+				response.BadRequest(c, err.Error(), nil)
 				return
 			}
 		}
+		updates["expires_at"] = updated.ExpiresAt
+		updates["access_schedule"] = updated.AccessSchedule
+		updates["access_status"] = services.PeerAccessStatus(&updated, time.Now())
 	}
 
+	if len(updates) == 0 {
+		response.BadRequest(c, "No valid fields to update", nil)
+		return
+	}
+
+	// AllowedIPs 中peer背后的路由网段会加入 WireGuard 配置中该peer的 allowed-ips（由 SyncPeers 写入）
+	before := peer
+	routedBefore := services.PeerRoutedSubnets(&wgServer, &before)
+
 	// 更新数据库
 	if err := database.DB.Model(&peer).Updates(updates).Error; err != nil {
 		response.InternalError(c, "Failed to update peer")
@@ -559,9 +782,284 @@ func UpdatePeer(c *gin.Context) {
 	// 重新加载peer
 	database.DB.First(&peer, peer.ID)
 
+	// AllowedIPs变化时清理旧网段的路由，新网段的路由由 SyncPeers 添加（转发规则在同步时整体替换）
+	networkService := services.NewUserNetworkService(database.DB, config.AppConfig.Network)
+	if needWgUpdate {
+		networkService.RemovePeerRoutes(&wgServer, &before)
+	}
+
+	// 重写配置文件并同步到WireGuard接口（保活间隔、备注等写入配置）
+	if err := networkService.SyncPeers(&wgServer, u.UserUID); err != nil {
+		response.InternalError(c, "Failed to sync peer to WireGuard: "+err.Error())
+		return
+	}
+
+	// 路由网段变化后，其他peer的客户端配置随之变化（共享网络只使用peer地址，不受影响）
+	if needWgUpdate && !slices.Equal(routedBefore, services.PeerRoutedSubnets(&wgServer, &peer)) {
+		if err := markRoutedSubnetsChanged(database.DB, &wgServer, peer.ID); err != nil {
+			log.Printf("Warning: Failed to mark peer configs outdated for server %d: %v", wgServer.ID, err)
+		}
+	}
+
 	response.Success(c, "Peer updated successfully", peer.ToResponse())
 }
 
+// RotatePeerPresharedKey 轮换peer的预共享密钥
+// 轮换后旧的客户端配置立即失效，需要重新下载配置
+func RotatePeerPresharedKey(c *gin.Context) {
+	user, _ := c.Get("user")
+	u := user.(*models.User)
+
+	peerIDStr := c.Param("id")
+	peerID, err := strconv.ParseUint(peerIDStr, 10, 32)
+	if err != nil {
+		response.BadRequest(c, "Invalid peer ID", nil)
+		return
+	}
+
+	// 获取用户的 WireGuard 服务器
+	wgServer, ok := loadMyServer(c, u)
+	if !ok {
+		return
+	}
+
+	unlock, ok := lockServer(c, &wgServer)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	// 服务器已被管理员禁用
+	if !wgServer.Enabled {
+		response.ServerDisabled(c)
+		return
+	}
+
+	var peer models.WireguardPeer
+	if err := database.DB.First(&peer, peerID).Error; err != nil {
+		response.NotFound(c, "Peer not found")
+		return
+	}
+
+	// 确保peer属于当前用户的服务器
+	if peer.ServerID != wgServer.ID {
+		response.Forbidden(c, "You don't have permission to modify this peer")
+		return
+	}
+
+	networkService := services.NewUserNetworkService(database.DB, config.AppConfig.Network)
+	presharedKey, err := networkService.GeneratePresharedKey()
+	if err != nil {
+		response.InternalError(c, "Failed to generate preshared key: "+err.Error())
+		return
+	}
+
+	// 使用结构体更新，保证加密字段经过序列化器加密
+	oldPresharedKey := peer.PresharedKey
+	peer.PresharedKey = presharedKey
+	peer.ConfigOutdated = true
+	if err := database.DB.Model(&peer).Select("preshared_key", "config_outdated").Updates(&peer).Error; err != nil {
+		response.InternalError(c, "Failed to update peer")
+		return
+	}
+
+	// 重写配置文件并同步到WireGuard接口，失败时恢复旧密钥
+	if err := networkService.SyncPeers(&wgServer, u.UserUID); err != nil {
+		peer.PresharedKey = oldPresharedKey
+		database.DB.Model(&peer).Select("preshared_key").Updates(&peer)
+		networkService.SyncPeers(&wgServer, u.UserUID)
+		response.InternalError(c, "Failed to sync peer to WireGuard: "+err.Error())
+		return
+	}
+
+	response.Success(c, "Preshared key rotated successfully", peer.ToResponse())
+}
+
+// maxKeyRotationGrace peer密钥轮换允许的最长宽限期（7天）
+const maxKeyRotationGrace = 7 * 24 * 3600
+
+// RotatePeerKeysRequest 轮换peer密钥请求
+type RotatePeerKeysRequest struct {
+	GracePeriod *int   `json:"grace_period"` // 旧公钥保留的宽限期（秒），不传则使用系统默认值，0 表示立即移除
+	PublicKey   string `json:"public_key"`   // 客户端生成的新公钥（客户端生成密钥的peer必须提交）
+}
+
+// RotatePeerKeys 轮换peer的密钥对（以及预共享密钥），保留peer地址和备注
+// 宽限期内旧公钥仍然有效，新密钥完成握手或宽限期结束后旧公钥被移除
+func RotatePeerKeys(c *gin.Context) {
+	user, _ := c.Get("user")
+	u := user.(*models.User)
+
+	peerIDStr := c.Param("id")
+	peerID, err := strconv.ParseUint(peerIDStr, 10, 32)
+	if err != nil {
+		response.BadRequest(c, "Invalid peer ID", nil)
+		return
+	}
+
+	// 请求体可选
+	var req RotatePeerKeysRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		response.ValidationError(c, err.Error())
+		return
+	}
+
+	gracePeriod := config.AppConfig.Network.KeyRotationGrace
+	if req.GracePeriod != nil {
+		gracePeriod = *req.GracePeriod
+	}
+	if gracePeriod < 0 || gracePeriod > maxKeyRotationGrace {
+		response.BadRequest(c, fmt.Sprintf("Grace period must be between 0 and %d seconds", maxKeyRotationGrace), nil)
+		return
+	}
+
+	// 获取用户的 WireGuard 服务器
+	wgServer, ok := loadMyServer(c, u)
+	if !ok {
+		return
+	}
+
+	unlock, ok := lockServer(c, &wgServer)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	// 服务器已被管理员禁用
+	if !wgServer.Enabled {
+		response.ServerDisabled(c)
+		return
+	}
+
+	var peer models.WireguardPeer
+	if err := database.DB.First(&peer, peerID).Error; err != nil {
+		response.NotFound(c, "Peer not found")
+		return
+	}
+
+	// 确保peer属于当前用户的服务器
+	if peer.ServerID != wgServer.ID {
+		response.Forbidden(c, "You don't have permission to modify this peer")
+		return
+	}
+
+	// 1. 确定新的密钥对（客户端生成密钥的peer保持该模式），原来使用预共享密钥的peer同时生成新的预共享密钥
+	networkService := services.NewUserNetworkService(database.DB, config.AppConfig.Network)
+	requireClientKey := config.AppConfig.Network.RequireClientKeys || peer.ClientGeneratedKey()
+	privateKey, publicKey, err := resolvePeerKeys(networkService, req.PublicKey, requireClientKey)
+	if err != nil {
+		if errors.Is(err, errClientKeyRequired) || errors.Is(err, errInvalidPublicKey) {
+			response.BadRequest(c, err.Error(), nil)
+			return
+		}
+		response.InternalError(c, "Failed to generate peer keys: "+err.Error())
+		return
+	}
+
+	presharedKey := ""
+	if peer.PresharedKey != "" {
+		presharedKey, err = networkService.GeneratePresharedKey()
+		if err != nil {
+			response.InternalError(c, "Failed to generate preshared key: "+err.Error())
+			return
+		}
+	}
+
+	// 2. 在事务中记录轮换并更新peer，同步WireGuard接口失败时整体回滚
+	now := time.Now()
+	rotation := models.WireguardPeerKeyRotation{
+		PeerID:          peer.ID,
+		OldPublicKey:    peer.PublicKey,
+		OldPresharedKey: peer.PresharedKey,
+		NewPublicKey:    publicKey,
+		GraceUntil:      now.Add(time.Duration(gracePeriod) * time.Second),
+	}
+	if gracePeriod == 0 {
+		rotation.RetiredAt = &now
+	}
+
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		// 上一次轮换尚未结束时，直接移除更早的旧公钥
+		if err := tx.Model(&models.WireguardPeerKeyRotation{}).
+			Where("peer_id = ? AND retired_at IS NULL", peer.ID).
+			Update("retired_at", now).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Create(&rotation).Error; err != nil {
+			return err
+		}
+
+		// 使用结构体更新，保证加密字段经过序列化器加密
+		peer.PublicKey = publicKey
+		peer.PrivateKey = privateKey
+		peer.PresharedKey = presharedKey
+		peer.KeyRotatedAt = &now
+		peer.ConfigOutdated = true
+		if err := tx.Model(&peer).
+			Select("public_key", "private_key", "preshared_key", "key_rotated_at", "config_outdated").
+			Updates(&peer).Error; err != nil {
+			return err
+		}
+
+		// 使用事务中的数据重写配置文件并同步到WireGuard接口
+		return services.NewUserNetworkService(tx, config.AppConfig.Network).SyncPeers(&wgServer, u.UserUID)
+	})
+	if err != nil {
+		// 事务已回滚，按数据库中的原有数据恢复配置文件和接口
+		networkService.SyncPeers(&wgServer, u.UserUID)
+		response.InternalError(c, "Failed to rotate peer keys: "+err.Error())
+		return
+	}
+
+	// 重新加载peer
+	database.DB.First(&peer, peer.ID)
+
+	response.Success(c, "Peer keys rotated successfully", peer.ToResponse())
+}
+
+// GetPeerKeyRotations 获取peer的密钥轮换记录（按时间倒序）
+func GetPeerKeyRotations(c *gin.Context) {
+	user, _ := c.Get("user")
+	u := user.(*models.User)
+
+	peerIDStr := c.Param("id")
+	peerID, err := strconv.ParseUint(peerIDStr, 10, 32)
+	if err != nil {
+		response.BadRequest(c, "Invalid peer ID", nil)
+		return
+	}
+
+	// 获取用户的 WireGuard 服务器
+	wgServer, ok := loadMyServer(c, u)
+	if !ok {
+		return
+	}
+
+	var peer models.WireguardPeer
+	if err := database.DB.First(&peer, peerID).Error; err != nil {
+		response.NotFound(c, "Peer not found")
+		return
+	}
+
+	// 确保peer属于当前用户的服务器
+	if peer.ServerID != wgServer.ID {
+		response.Forbidden(c, "You don't have permission to access this peer")
+		return
+	}
+
+	var rotations []models.WireguardPeerKeyRotation
+	if err := database.DB.Where("peer_id = ?", peer.ID).Order("created_at DESC").Find(&rotations).Error; err != nil {
+		response.InternalError(c, "Failed to retrieve key rotations")
+		return
+	}
+
+	response.Success(c, "Key rotations retrieved successfully", rotations)
+}
+
+// clientPrivateKeyPlaceholder 客户端自行生成密钥时，配置模板中私钥的占位符
+const clientPrivateKeyPlaceholder = "<YOUR_PRIVATE_KEY>"
+
 // GetPeerConfig 获取peer的WireGuard配置（统一接口，返回JSON格式）
 func GetPeerConfig(c *gin.Context) {
 	user, _ := c.Get("user")
@@ -575,9 +1073,14 @@ func GetPeerConfig(c *gin.Context) {
 	}
 
 	// 获取用户的 WireGuard 服务器
-	var wgServer models.WireguardServer
-	if err := database.DB.Where("user_id = ?", u.ID).First(&wgServer).Error; err != nil {
-		response.BadRequest(c, "User has no WireGuard server configured", nil)
+	wgServer, ok := loadMyServer(c, u)
+	if !ok {
+		return
+	}
+
+	// 服务器已被管理员禁用
+	if !wgServer.Enabled {
+		response.ServerDisabled(c)
 		return
 	}
 
@@ -594,21 +1097,60 @@ func GetPeerConfig(c *gin.Context) {
 		return
 	}
 
-	// 生成服务器端点地址（从配置文件获取服务器IP）
-	serverEndpoint := fmt.Sprintf("%s:%d", config.AppConfig.Network.ServerIP, wgServer.WgPort)
+	// 生成服务器端点地址（服务器未设置监听地址时从配置文件获取服务器IP）
+	serverEndpoint := services.ClientEndpoint(&wgServer, config.AppConfig.Network.ServerIP)
+
+	// 客户端路由（AllowedIPs）和DNS：peer未设置时继承服务器设置
+	var peers []models.WireguardPeer
+	if err := database.DB.Where("server_id = ?", wgServer.ID).Find(&peers).Error; err != nil {
+		response.InternalError(c, "Failed to retrieve peers")
+		return
+	}
+	// 启用内置DNS时默认使用它（可解析peer名称），否则使用配置中的公共DNS
+	defaultDNS := config.AppConfig.Network.GetClientDNS()
+	if config.AppConfig.Network.DNS.Enabled {
+		defaultDNS = services.BuiltinDNSServers(&wgServer, u, config.AppConfig.Network.DNS)
+	}
+	// 经共享网络可以访问的其他用户网段
+	networkService := services.NewUserNetworkService(database.DB, config.AppConfig.Network)
+	shared, err := networkService.SharedNetworkPrefixes(&peer)
+	if err != nil {
+		response.InternalError(c, "Failed to retrieve shared networks")
+		return
+	}
+	allowedIPs, dns, err := services.ResolveClientRouting(&wgServer, &peer, peers, shared, defaultDNS)
+	if err != nil {
+		response.InternalError(c, "Failed to compute client routing: "+err.Error())
+		return
+	}
+
+	// 双栈时peer同时配置IPv4和IPv6地址
+	peerAddress := peer.PeerAddress + "/32"
+	if peer.PeerAddress6 != "" {
+		peerAddress += ", " + peer.PeerAddress6 + "/128"
+	}
+
+	// 客户端自行生成密钥的peer，私钥位置使用占位符，由客户端填入
+	privateKey := peer.PrivateKey
+	if peer.ClientGeneratedKey() {
+		privateKey = clientPrivateKeyPlaceholder
+	}
 
-	// 默认 AllowedIPs 为所有流量（全局代理）
-	allowedIPs := "0.0.0.0/0, ::/0"
-	
 	// 基础配置内容
 	configContent := fmt.Sprintf(`[Interface]
 PrivateKey = %s
 Address = %s
-DNS = 1.1.1.1, 8.8.8.8
 `,
-		peer.PrivateKey,
-		peer.PeerAddress+"/32",
+		privateKey,
+		peerAddress,
 	)
+	if dns != "" {
+		configContent += fmt.Sprintf("DNS = %s\n", dns)
+	}
+	// 客户端与服务器使用相同的MTU（如PPPoE、移动网络下需要降低MTU）
+	if wgServer.MTU > 0 {
+		configContent += fmt.Sprintf("MTU = %d\n", wgServer.MTU)
+	}
 
 	// 如果启用转发，添加 PostUp 和 PreDown 脚本
 	if peer.EnableForwarding && peer.ForwardInterface != "" {
@@ -622,23 +1164,38 @@ PreDown = iptables -t nat -D POSTROUTING -o %s -j MASQUERADE; iptables -D FORWAR
 	}
 
 	// 添加 Peer 配置
+	presharedKeyLine := ""
+	if peer.PresharedKey != "" {
+		presharedKeyLine = fmt.Sprintf("PresharedKey = %s\n", peer.PresharedKey)
+	}
+
 	configContent += fmt.Sprintf(`
 [Peer]
 PublicKey = %s
-Endpoint = %s
+%sEndpoint = %s
 AllowedIPs = %s
 PersistentKeepalive = %d
 `,
 		wgServer.WgPublicKey,
+		presharedKeyLine,
 		serverEndpoint,
 		allowedIPs,
 		peer.PersistentKeepalive,
 	)
 
-	// 返回JSON格式的配置文本
-	response.Success(c, "Config retrieved successfully", map[string]string{
+	// 配置已重新下载，清除"需要重新下载"标记
+	if peer.ConfigOutdated {
+		database.DB.Model(&peer).Update("config_outdated", false)
+	}
+
+	// 返回JSON格式的配置文本（模板配置额外返回占位符，便于客户端替换）
+	result := map[string]string{
 		"config": configContent,
-	})
+	}
+	if peer.ClientGeneratedKey() {
+		result["private_key_placeholder"] = clientPrivateKeyPlaceholder
+	}
+	response.Success(c, "Config retrieved successfully", result)
 }
 
 // AdminDeleteWireguardServer 删除用户的 WireGuard 服务器（管理员）
@@ -656,8 +1213,21 @@ func AdminDeleteWireguardServer(c *gin.Context) {
 		return
 	}
 
+	unlock, ok := lockServer(c, &server)
+	if !ok {
+		return
+	}
+	defer unlock()
+
 	// 使用事务确保数据一致性
+	var sharedNetworks []uint
 	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		// 0. 以该服务器加入的共享网络成员恢复为已邀请
+		var err error
+		if sharedNetworks, err = detachSharedNetworkServer(tx, server.ID); err != nil {
+			return err
+		}
+
 		// 1. 先删除所有关联的 peers
 		if err := tx.Where("server_id = ?", serverID).Delete(&models.WireguardPeer{}).Error; err != nil {
 			return fmt.Errorf("failed to delete peers: %v", err)
@@ -668,21 +1238,6 @@ func AdminDeleteWireguardServer(c *gin.Context) {
 			return fmt.Errorf("failed to delete server: %v", err)
 		}
 
-		// 3. 清理网络资源（命名空间、veth、iptables规则等）
-		// 使用 UserNetworkService 清理网络环境
-		networkService := services.NewUserNetworkService(
-			config.AppConfig.Network.ConfigDir,
-			config.AppConfig.Network.BaseSubnet,
-			config.AppConfig.Network.BasePort,
-			config.AppConfig.Network.OutInterface,
-		)
-
-		// 清理网络环境（即使失败也继续，因为数据库记录已删除）
-		if err := networkService.DestroyUserNetwork(&server, server.User.UserUID); err != nil {
-			// 记录错误但不回滚事务
-			log.Printf("Warning: Failed to cleanup network resources for server %d: %v", serverID, err)
-		}
-
 		return nil
 	})
 
@@ -691,6 +1246,18 @@ func AdminDeleteWireguardServer(c *gin.Context) {
 		return
 	}
 
+	// 3. 记录删除提交后再清理网络资源（命名空间、veth、防火墙规则）并释放地址和端口，
+	// 提交失败时服务器保持原样，已分配的资源不会被其他服务器重用（即使清理失败也继续，因为数据库记录已删除）
+	networkService := services.NewUserNetworkService(database.DB, config.AppConfig.Network)
+	if err := networkService.DestroyUserNetwork(&server, server.User.UserUID); err != nil {
+		log.Printf("Warning: Failed to cleanup network resources for server %d: %v", serverID, err)
+	}
+
+	// 中转命名空间不再连接该服务器（失败时由对账服务重新应用）
+	if err := networkService.ApplySharedNetworksByID(sharedNetworks); err != nil {
+		log.Printf("Warning: Failed to apply shared networks after deleting server %d: %v", serverID, err)
+	}
+
 	response.Success(c, "Server and all associated peers deleted successfully", nil)
 }
 
@@ -712,20 +1279,47 @@ func AdminToggleWireguardServer(c *gin.Context) {
 	}
 
 	var server models.WireguardServer
-	if err := database.DB.First(&server, serverID).Error; err != nil {
+	if err := database.DB.Preload("User").First(&server, serverID).Error; err != nil {
 		response.NotFound(c, "Server not found")
 		return
 	}
 
+	unlock, ok := lockServer(c, &server)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	// 启用/禁用命名空间内的WireGuard服务（状态未变化时跳过）
+	networkService := services.NewUserNetworkService(database.DB, config.AppConfig.Network)
+	changed := server.Enabled != req.Enabled
+	if changed {
+		if req.Enabled {
+			err = networkService.EnableUserNetwork(&server, server.User.UserUID)
+		} else {
+			err = networkService.DisableUserNetwork(&server, server.User.UserUID)
+		}
+		if err != nil {
+			response.InternalError(c, "Failed to update server network: "+err.Error())
+			return
+		}
+	}
+
 	// 更新状态
 	if err := database.DB.Model(&server).Update("enabled", req.Enabled).Error; err != nil {
+		// 数据库更新失败，恢复原来的网络状态，保持与数据库一致
+		if changed {
+			server.Enabled = !req.Enabled
+			if req.Enabled {
+				networkService.DisableUserNetwork(&server, server.User.UserUID)
+			} else {
+				networkService.EnableUserNetwork(&server, server.User.UserUID)
+			}
+		}
 		response.InternalError(c, "Failed to update server status")
 		return
 	}
 
-	// TODO: 实现启用/禁用命名空间网络的逻辑
-	// 可以通过 iptables 规则来实现禁用功能
-
 	message := "Server enabled successfully"
 	if !req.Enabled {
 		message = "Server disabled successfully"
@@ -752,24 +1346,163 @@ func AdminSetRateLimit(c *gin.Context) {
 		return
 	}
 
+	if req.DownloadRate < 0 || req.UploadRate < 0 {
+		response.BadRequest(c, "Rate limit must not be negative", nil)
+		return
+	}
+
 	var server models.WireguardServer
 	if err := database.DB.First(&server, serverID).Error; err != nil {
 		response.NotFound(c, "Server not found")
 		return
 	}
 
-	// 更新速率限制
+	unlock, ok := lockServer(c, &server)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	// 在命名空间中应用 tc 限速（0 表示清除限速）
+	// 服务器禁用时接口不存在，仅保存设置，重新启用时会自动应用
+	networkService := services.NewUserNetworkService(database.DB, config.AppConfig.Network)
+	limited := server
+	limited.DownloadRate, limited.UploadRate = req.DownloadRate, req.UploadRate
+	if server.Enabled {
+		if err := networkService.ApplyRateLimit(&limited); err != nil {
+			response.InternalError(c, "Failed to apply rate limit: "+err.Error())
+			return
+		}
+	}
+
+	// 更新速率限制（gorm 会回写模型字段，先保存旧值用于回滚）
+	original := server
 	updates := map[string]interface{}{
 		"download_rate": req.DownloadRate,
 		"upload_rate":   req.UploadRate,
 	}
 	if err := database.DB.Model(&server).Updates(updates).Error; err != nil {
+		// 数据库更新失败，恢复旧的限速设置
+		if server.Enabled {
+			networkService.ApplyRateLimit(&original)
+		}
 		response.InternalError(c, "Failed to update rate limit")
 		return
 	}
 
-	// TODO: 实现 tc (traffic control) 命令来设置实际的速率限制
-	// 需要在命名空间中执行 tc 命令
-
 	response.Success(c, "Rate limit set successfully", nil)
 }
+
+// RotateMyServerKeys 轮换当前用户WireGuard服务器的密钥对
+// 轮换后所有peer的客户端配置都需要重新下载
+func RotateMyServerKeys(c *gin.Context) {
+	user, _ := c.Get("user")
+	u := user.(*models.User)
+
+	// 获取用户的 WireGuard 服务器
+	wgServer, ok := loadMyServer(c, u)
+	if !ok {
+		return
+	}
+
+	unlock, ok := lockServer(c, &wgServer)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	// 服务器已被管理员禁用
+	if !wgServer.Enabled {
+		response.ServerDisabled(c)
+		return
+	}
+
+	networkService := services.NewUserNetworkService(database.DB, config.AppConfig.Network)
+	if err := networkService.RotateServerKeys(&wgServer, u.UserUID); err != nil {
+		response.InternalError(c, "Failed to rotate server keys: "+err.Error())
+		return
+	}
+
+	response.Success(c, "Server keys rotated successfully", wgServer.ToResponse())
+}
+
+// AdminRotateServerKeys 轮换指定用户WireGuard服务器的密钥对（管理员）
+func AdminRotateServerKeys(c *gin.Context) {
+	serverIDStr := c.Param("id")
+	serverID, err := strconv.ParseUint(serverIDStr, 10, 32)
+	if err != nil {
+		response.BadRequest(c, "Invalid server ID", nil)
+		return
+	}
+
+	var server models.WireguardServer
+	if err := database.DB.Preload("User").First(&server, serverID).Error; err != nil {
+		response.NotFound(c, "Server not found")
+		return
+	}
+
+	unlock, ok := lockServer(c, &server)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	networkService := services.NewUserNetworkService(database.DB, config.AppConfig.Network)
+	if err := networkService.RotateServerKeys(&server, server.User.UserUID); err != nil {
+		response.InternalError(c, "Failed to rotate server keys: "+err.Error())
+		return
+	}
+
+	response.Success(c, "Server keys rotated successfully", server.ToResponse())
+}
+
+// ServerKeyRotationResult 批量轮换服务器密钥的单个结果
+type ServerKeyRotationResult struct {
+	ServerID uint   `json:"server_id"`
+	UserID   uint   `json:"user_id"`
+	Success  bool   `json:"success"`
+	Error    string `json:"error,omitempty"`
+}
+
+// AdminRotateAllServerKeys 轮换所有用户WireGuard服务器的密钥对（管理员，用于疑似密钥泄露后）
+// 单个服务器失败不影响其他服务器，结果中逐一列出
+func AdminRotateAllServerKeys(c *gin.Context) {
+	var servers []models.WireguardServer
+	if err := database.DB.Preload("User").Order("id").Find(&servers).Error; err != nil {
+		response.InternalError(c, "Failed to retrieve servers")
+		return
+	}
+
+	networkService := services.NewUserNetworkService(database.DB, config.AppConfig.Network)
+	results := make([]ServerKeyRotationResult, 0, len(servers))
+	failed := 0
+
+	for i := range servers {
+		server := &servers[i]
+		result := ServerKeyRotationResult{
+			ServerID: server.ID,
+			UserID:   server.UserID,
+			Success:  true,
+		}
+
+		if err := rotateServerKeysLocked(networkService, server); err != nil {
+			log.Printf("Failed to rotate keys of server %d: %v", server.ID, err)
+			result.Success = false
+			result.Error = err.Error()
+			failed++
+		}
+		results = append(results, result)
+	}
+
+	response.Success(c, fmt.Sprintf("Rotated keys of %d servers, %d failed", len(servers)-failed, failed), results)
+}
+
+// rotateServerKeysLocked 持有服务器的锁轮换其密钥；批量轮换期间已被删除的服务器视为失败
+func rotateServerKeysLocked(networkService *services.UserNetworkService, server *models.WireguardServer) error {
+	unlock, err := networkService.LockServer(server)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return networkService.RotateServerKeys(server, server.User.UserUID)
+}
@@ -0,0 +1,37 @@
+package models
+
+import "time"
+
+// ACL动作
+const (
+	ACLActionAllow = "allow" // 放行（不再匹配后续ACL规则）
+	ACLActionDeny  = "deny"  // 丢弃
+)
+
+// ACL协议
+const (
+	ACLProtocolAll  = "all"
+	ACLProtocolTCP  = "tcp"
+	ACLProtocolUDP  = "udp"
+	ACLProtocolICMP = "icmp"
+)
+
+// WireguardACL peer访问控制规则
+// 同一peer的规则按 Priority 从小到大依次匹配，第一条匹配的规则生效；
+// 没有规则匹配的流量保持默认行为（放行）。
+// 例如只允许访问NAS的某个端口：allow 192.168.1.10/32 tcp 445，再加一条 deny 0.0.0.0/0
+type WireguardACL struct {
+	ID          uint            `json:"id" gorm:"primaryKey"`
+	ServerID    uint            `json:"server_id" gorm:"index;not null"`
+	Server      WireguardServer `json:"-" gorm:"foreignKey:ServerID;constraint:OnDelete:CASCADE"`
+	PeerID      uint            `json:"peer_id" gorm:"index;not null"` // 规则作用的peer（流量来源）
+	Peer        WireguardPeer   `json:"-" gorm:"foreignKey:PeerID;constraint:OnDelete:CASCADE"`
+	Destination string          `json:"destination" gorm:"not null"` // 目标地址或网段（CIDR格式）
+	Protocol    string          `json:"protocol" gorm:"default:all"` // all/tcp/udp/icmp
+	Port        int             `json:"port" gorm:"default:0"`       // 目标端口（仅tcp/udp，0表示所有端口）
+	Action      string          `json:"action" gorm:"not null"`      // allow/deny
+	Priority    int             `json:"priority" gorm:"default:100"` // 匹配顺序，数值越小越先匹配
+	Comment     string          `json:"comment" gorm:""`             // 备注
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+}
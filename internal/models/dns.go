@@ -0,0 +1,30 @@
+package models
+
+import "time"
+
+// DNS记录类型
+const (
+	DNSRecordA    = "A"
+	DNSRecordAAAA = "AAAA"
+)
+
+// DNSRecord 用户自定义DNS记录（由内置DNS服务器解析）
+// Name 是相对于用户域名的名称，例如用户域名为 alice.vpn 时，"nas" 解析为 nas.alice.vpn
+type DNSRecord struct {
+	ID        uint            `json:"id" gorm:"primaryKey"`
+	ServerID  uint            `json:"server_id" gorm:"index;not null"`
+	Server    WireguardServer `json:"-" gorm:"foreignKey:ServerID;constraint:OnDelete:CASCADE"`
+	Name      string          `json:"name" gorm:"not null"`  // 相对名称（如 nas、printer.lab）
+	Type      string          `json:"type" gorm:"not null"`  // A/AAAA
+	Value     string          `json:"value" gorm:"not null"` // IP地址
+	Comment   string          `json:"comment" gorm:""`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+// DNSName 内置DNS为peer或服务器生成的记录（只读）
+type DNSName struct {
+	Name  string `json:"name"` // 完整域名
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
@@ -0,0 +1,31 @@
+package models
+
+import "time"
+
+// IP地址池名称
+const (
+	PoolVethSubnet      = "veth"       // 主机与命名空间之间的veth /30 子网
+	PoolWireguardSubnet = "wireguard"  // 用户WireGuard网段
+	PoolWireguardIPv6   = "wireguard6" // 用户WireGuard IPv6网段
+	PoolSharedLink      = "shared"     // 共享网络中转命名空间与成员命名空间之间的 /30 子网
+	PoolWireguardPort   = "wireguard"  // WireGuard监听端口
+	PoolPublicForward   = "forward"    // 公网端口转发
+)
+
+// IPAllocation 子网分配记录（同一地址池内子网唯一）
+type IPAllocation struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	Pool      string    `json:"pool" gorm:"uniqueIndex:idx_ip_allocation_pool_subnet;size:32;not null"`   // 地址池名称
+	Subnet    string    `json:"subnet" gorm:"uniqueIndex:idx_ip_allocation_pool_subnet;size:64;not null"` // 已分配的子网（CIDR格式）
+	Owner     string    `json:"owner" gorm:"index;not null"`                                              // 占用者（命名空间/接口名）
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// PortAllocation 主机端口分配记录（端口在所有地址池之间唯一）
+type PortAllocation struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	Pool      string    `json:"pool" gorm:"index;size:32;not null"` // 端口池名称
+	Port      int       `json:"port" gorm:"uniqueIndex;not null"`   // 已分配的主机端口
+	Owner     string    `json:"owner" gorm:"index;not null"`        // 占用者（命名空间/接口名）
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// 端口转发协议
+const (
+	PortForwardTCP = "tcp"
+	PortForwardUDP = "udp"
+)
+
+// PortForward 公网端口转发：主机的公网端口经用户命名空间转发到某个peer的端口
+// PublicPort 从管理员配置的端口池中分配（记录在 PortAllocation 中），删除记录时一并释放
+type PortForward struct {
+	ID         uint            `json:"id" gorm:"primaryKey"`
+	ServerID   uint            `json:"server_id" gorm:"index;not null"`
+	Server     WireguardServer `json:"-" gorm:"foreignKey:ServerID;constraint:OnDelete:CASCADE"`
+	PeerID     uint            `json:"peer_id" gorm:"index;not null"`
+	Peer       WireguardPeer   `json:"-" gorm:"foreignKey:PeerID;constraint:OnDelete:CASCADE"`
+	Protocol   string          `json:"protocol" gorm:"default:tcp;not null"`    // tcp/udp
+	PublicPort int             `json:"public_port" gorm:"uniqueIndex;not null"` // 主机上的公网端口
+	TargetPort int             `json:"target_port" gorm:"not null"`             // peer上的目标端口
+	Comment    string          `json:"comment" gorm:""`
+	CreatedAt  time.Time       `json:"created_at"`
+	UpdatedAt  time.Time       `json:"updated_at"`
+}
@@ -0,0 +1,61 @@
+package models
+
+import "time"
+
+// 共享网络成员角色
+const (
+	SharedNetworkRoleOwner  = "owner"  // 创建者，管理邀请和成员
+	SharedNetworkRoleMember = "member" // 普通成员
+)
+
+// 共享网络成员状态
+const (
+	SharedNetworkStatusInvited = "invited" // 已邀请，等待接受
+	SharedNetworkStatusJoined  = "joined"  // 已加入，命名空间已接入共享网络
+)
+
+// SharedNetwork 跨用户共享网络：多个用户的命名空间经各自的veth接入同一个中转命名空间，
+// 成员选中的peer之间可以互访（只转发选中peer之间的流量）。只支持IPv4
+type SharedNetwork struct {
+	ID        uint                  `json:"id" gorm:"primaryKey"`
+	Name      string                `json:"name" gorm:"uniqueIndex;size:64;not null"`
+	OwnerID   uint                  `json:"owner_id" gorm:"index;not null"`
+	Owner     User                  `json:"-" gorm:"foreignKey:OwnerID;constraint:OnDelete:CASCADE"`
+	Members   []SharedNetworkMember `json:"members,omitempty" gorm:"foreignKey:NetworkID"`
+	CreatedAt time.Time             `json:"created_at"`
+	UpdatedAt time.Time             `json:"updated_at"`
+}
+
+// SharedNetworkMember 共享网络成员（包括待接受的邀请）
+// 加入时记录成员接入的服务器，并从共享网络连接地址池（shared_link_pool）分配连接中转命名空间的 /30 子网
+type SharedNetworkMember struct {
+	ID          uint             `json:"id" gorm:"primaryKey"`
+	NetworkID   uint             `json:"network_id" gorm:"uniqueIndex:idx_shared_network_member;not null"`
+	Network     SharedNetwork    `json:"-" gorm:"foreignKey:NetworkID;constraint:OnDelete:CASCADE"`
+	UserID      uint             `json:"user_id" gorm:"uniqueIndex:idx_shared_network_member;not null"`
+	User        User             `json:"-" gorm:"foreignKey:UserID;constraint:OnDelete:CASCADE"`
+	ServerID    *uint            `json:"server_id" gorm:""` // 接入的服务器（加入后设置）
+	Server      *WireguardServer `json:"-" gorm:"foreignKey:ServerID;constraint:OnDelete:SET NULL"`
+	Role        string           `json:"role" gorm:"default:member;not null"`    // owner/member
+	Status      string           `json:"status" gorm:"default:invited;not null"` // invited/joined
+	InvitedByID uint             `json:"invited_by_id" gorm:""`
+	LinkSubnet  string           `json:"link_subnet" gorm:""` // 与中转命名空间之间的 /30 子网（.1 中转端，.2 成员端）
+	JoinedAt    *time.Time       `json:"joined_at" gorm:""`
+	CreatedAt   time.Time        `json:"created_at"`
+	UpdatedAt   time.Time        `json:"updated_at"`
+}
+
+// Joined 成员是否已加入并接入了服务器
+func (m *SharedNetworkMember) Joined() bool {
+	return m.Status == SharedNetworkStatusJoined && m.ServerID != nil
+}
+
+// SharedNetworkPeer 成员选中接入共享网络的peer
+type SharedNetworkPeer struct {
+	ID        uint          `json:"id" gorm:"primaryKey"`
+	NetworkID uint          `json:"network_id" gorm:"uniqueIndex:idx_shared_network_peer;not null"`
+	Network   SharedNetwork `json:"-" gorm:"foreignKey:NetworkID;constraint:OnDelete:CASCADE"`
+	PeerID    uint          `json:"peer_id" gorm:"uniqueIndex:idx_shared_network_peer;not null"`
+	Peer      WireguardPeer `json:"-" gorm:"foreignKey:PeerID;constraint:OnDelete:CASCADE"`
+	CreatedAt time.Time     `json:"created_at"`
+}
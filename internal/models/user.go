@@ -16,33 +16,39 @@ const (
 )
 
 type User struct {
-	ID           uint      `json:"id" gorm:"primaryKey"`
-	UserUID      string    `json:"user_uid" gorm:"uniqueIndex;size:16;not null"` // 用户唯一短ID
-	Email        string    `json:"email" gorm:"uniqueIndex;not null"`
-	PasswordHash string    `json:"-" gorm:"not null"`
-	Name         string    `json:"name" gorm:"not null"`
-	Role         UserRole  `json:"role" gorm:"default:'normal_user'"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
+	ID               uint      `json:"id" gorm:"primaryKey"`
+	UserUID          string    `json:"user_uid" gorm:"uniqueIndex;size:16;not null"` // 用户唯一短ID
+	Email            string    `json:"email" gorm:"uniqueIndex;not null"`
+	PasswordHash     string    `json:"-" gorm:"not null"`
+	Name             string    `json:"name" gorm:"not null"`
+	Role             UserRole  `json:"role" gorm:"default:'normal_user'"`
+	PortForwardQuota *int      `json:"port_forward_quota" gorm:""` // 公网端口转发配额，为空时使用全局默认值
+	ServerQuota      *int      `json:"server_quota" gorm:""`       // WireGuard服务器数量配额，为空时使用全局默认值
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
 }
 
 type UserResponse struct {
-	ID        uint      `json:"id"`
-	UserUID   string    `json:"user_uid"`
-	Email     string    `json:"email"`
-	Name      string    `json:"name"`
-	Role      UserRole  `json:"role"`
-	CreatedAt time.Time `json:"created_at"`
+	ID               uint      `json:"id"`
+	UserUID          string    `json:"user_uid"`
+	Email            string    `json:"email"`
+	Name             string    `json:"name"`
+	Role             UserRole  `json:"role"`
+	PortForwardQuota *int      `json:"port_forward_quota,omitempty"`
+	ServerQuota      *int      `json:"server_quota,omitempty"`
+	CreatedAt        time.Time `json:"created_at"`
 }
 
 func (u *User) ToResponse() UserResponse {
 	return UserResponse{
-		ID:        u.ID,
-		UserUID:   u.UserUID,
-		Email:     u.Email,
-		Name:      u.Name,
-		Role:      u.Role,
-		CreatedAt: u.CreatedAt,
+		ID:               u.ID,
+		UserUID:          u.UserUID,
+		Email:            u.Email,
+		Name:             u.Name,
+		Role:             u.Role,
+		PortForwardQuota: u.PortForwardQuota,
+		ServerQuota:      u.ServerQuota,
+		CreatedAt:        u.CreatedAt,
 	}
 }
 
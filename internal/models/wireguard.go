@@ -6,21 +6,56 @@ import (
 	"gorm.io/gorm"
 )
 
+// peer之间互访策略（同一WireGuard接口内 wg0 -> wg0 的转发）
+const (
+	PeerIsolationAllow = "allow" // 允许所有peer互访（全互联）
+	PeerIsolationDeny  = "deny"  // 禁止peer互访
+	PeerIsolationPairs = "pairs" // 只允许 WireguardPeerLink 中列出的peer对互访
+)
+
+// 客户端路由模式（决定客户端配置中的 AllowedIPs）
+const (
+	ClientRouteFull           = "full"            // 全局代理：所有流量经过隧道
+	ClientRouteExcludePrivate = "exclude_private" // 全局代理，但局域网/私有地址段不经过隧道
+	ClientRouteSubnet         = "subnet"          // 只有用户的WireGuard网段（及peer背后的路由网段）经过隧道
+	ClientRouteCustom         = "custom"          // 自定义网段列表
+)
+
+// peer访问状态（由过期时间和访问时间段决定，不处于 active 状态的peer不会出现在接口上）
+const (
+	PeerAccessActive        = "active"         // 可以连接
+	PeerAccessOutsideWindow = "outside_window" // 当前不在允许的访问时间段内
+	PeerAccessExpired       = "expired"        // 已过期
+)
+
 // WireguardServer WireGuard服务器配置
 type WireguardServer struct {
 	ID              uint      `json:"id" gorm:"primaryKey"`
-	UserID          uint      `json:"user_id" gorm:"uniqueIndex;not null"`
+	UserID          uint      `json:"user_id" gorm:"index:idx_wireguard_servers_user;not null"` // 一个用户可以有多个服务器（受服务器配额限制）
 	User            User      `json:"user,omitempty" gorm:"foreignKey:UserID"`
+	Name            string    `json:"name" gorm:"size:64"`                   // 服务器名称（用户自定义，便于区分多个服务器）
 	Namespace       string    `json:"namespace" gorm:"uniqueIndex;not null"` // 网络命名空间名称
 	WgInterface     string    `json:"wg_interface" gorm:"not null"`          // WireGuard接口名称（如wg0）
 	WgPort          int       `json:"wg_port" gorm:"not null"`               // WireGuard监听端口
 	WgPublicKey     string    `json:"wg_public_key" gorm:"not null"`         // WireGuard服务器公钥
-	WgPrivateKey    string    `json:"-" gorm:"not null"`                     // WireGuard服务器私钥（不返回）
+	WgPrivateKey    string    `json:"-" gorm:"not null;serializer:encrypted"` // WireGuard服务器私钥（不返回，配置主密钥后加密存储）
 	WgAddress       string    `json:"wg_address" gorm:"not null"`            // WireGuard接口IP地址
+	WgAddress6      string    `json:"wg_address6" gorm:""`                   // WireGuard接口IPv6地址（ULA，未启用IPv6时为空）
 	ServerEndpoint  string    `json:"server_endpoint" gorm:""`               // 服务器外部访问地址（IP:Port）
+	VethSubnet      string    `json:"veth_subnet" gorm:""`                   // 主机与命名空间之间veth对的/30子网（由IPAM分配）
 	Enabled         bool      `json:"enabled" gorm:"default:true"`           // 是否启用
 	DownloadRate    int       `json:"download_rate" gorm:"default:0"`        // 下载速率限制（Mbps，0表示不限速）
 	UploadRate      int       `json:"upload_rate" gorm:"default:0"`          // 上传速率限制（Mbps，0表示不限速）
+	KeysRotatedAt   *time.Time `json:"keys_rotated_at" gorm:""`              // 服务器密钥对最近一次轮换时间（从未轮换为空）
+	PeerIsolation   string    `json:"peer_isolation" gorm:"default:allow"`   // peer之间互访策略（allow/deny/pairs）
+	ClientRouteMode  string    `json:"client_route_mode" gorm:"default:full"` // 客户端默认路由模式（peer未单独设置时使用）
+	ClientAllowedIPs string    `json:"client_allowed_ips" gorm:""`            // custom 模式下的客户端 AllowedIPs（逗号分隔）
+	ClientDNS        string    `json:"client_dns" gorm:""`                    // 客户端默认DNS（逗号分隔，为空时使用全局默认值）
+	ExitPeerID       *uint     `json:"exit_peer_id" gorm:""`                  // 出口peer（为空表示不启用），选中peer的外网流量经它转发
+	MTU              int       `json:"mtu" gorm:"default:0"`                  // 接口MTU（0表示由 wg-quick 自动计算），同时写入客户端配置
+	FwMark           uint32    `json:"fwmark" gorm:"default:0"`               // WireGuard发出的加密报文的防火墙标记（0表示不标记）
+	RouteTable       string    `json:"route_table" gorm:""`                   // 存放peer背后网段路由的路由表（为空表示主路由表），命名空间内添加查询该表的策略路由规则
+	ListenAddress    string    `json:"listen_address" gorm:""`                // 接受WireGuard连接的主机地址（为空表示所有地址），同时作为客户端配置中的端点地址
 	CreatedAt       time.Time `json:"created_at"`
 	UpdatedAt       time.Time `json:"updated_at"`
 }
@@ -29,12 +64,24 @@ type WireguardServer struct {
 type WireguardServerResponse struct {
 	ID             uint      `json:"id"`
 	UserID         uint      `json:"user_id"`
+	Name           string    `json:"name"`
 	Namespace      string    `json:"namespace"`
 	WgInterface    string    `json:"wg_interface"`
 	WgPort         int       `json:"wg_port"`
 	WgPublicKey    string    `json:"wg_public_key"`
 	WgAddress      string    `json:"wg_address"`
+	WgAddress6     string    `json:"wg_address6,omitempty"`
 	ServerEndpoint string    `json:"server_endpoint,omitempty"`
+	KeysRotatedAt  *time.Time `json:"keys_rotated_at,omitempty"`
+	PeerIsolation  string    `json:"peer_isolation"`
+	ClientRouteMode  string    `json:"client_route_mode"`
+	ClientAllowedIPs string    `json:"client_allowed_ips,omitempty"`
+	ClientDNS        string    `json:"client_dns,omitempty"`
+	ExitPeerID       *uint     `json:"exit_peer_id,omitempty"`
+	MTU              int       `json:"mtu"`
+	FwMark           uint32    `json:"fwmark"`
+	RouteTable       string    `json:"route_table,omitempty"`
+	ListenAddress    string    `json:"listen_address,omitempty"`
 	CreatedAt      time.Time `json:"created_at"`
 }
 
@@ -43,31 +90,81 @@ func (s *WireguardServer) ToResponse() WireguardServerResponse {
 	return WireguardServerResponse{
 		ID:             s.ID,
 		UserID:         s.UserID,
+		Name:           s.Name,
 		Namespace:      s.Namespace,
 		WgInterface:    s.WgInterface,
 		WgPort:         s.WgPort,
 		WgPublicKey:    s.WgPublicKey,
 		WgAddress:      s.WgAddress,
+		WgAddress6:     s.WgAddress6,
 		ServerEndpoint: s.ServerEndpoint,
+		KeysRotatedAt:  s.KeysRotatedAt,
+		PeerIsolation:  s.PeerIsolationMode(),
+		ClientRouteMode:  s.ClientRouteModeOrDefault(),
+		ClientAllowedIPs: s.ClientAllowedIPs,
+		ClientDNS:        s.ClientDNS,
+		ExitPeerID:       s.ExitPeerID,
+		MTU:              s.MTU,
+		FwMark:           s.FwMark,
+		RouteTable:       s.RouteTable,
+		ListenAddress:    s.ListenAddress,
 		CreatedAt:      s.CreatedAt,
 	}
 }
 
+// PeerIsolationMode peer互访策略，旧记录未设置时视为允许互访
+func (s *WireguardServer) PeerIsolationMode() string {
+	if s.PeerIsolation == "" {
+		return PeerIsolationAllow
+	}
+	return s.PeerIsolation
+}
+
+// ClientRouteModeOrDefault 客户端默认路由模式，旧记录未设置时为全局代理
+func (s *WireguardServer) ClientRouteModeOrDefault() string {
+	if s.ClientRouteMode == "" {
+		return ClientRouteFull
+	}
+	return s.ClientRouteMode
+}
+
+// WireguardPeerLink 允许互访的peer对（双向，仅在 pairs 策略下生效）
+// 保存时 PeerAID 总是小于 PeerBID，保证同一对peer只有一条记录
+type WireguardPeerLink struct {
+	ID        uint          `json:"id" gorm:"primaryKey"`
+	ServerID  uint          `json:"server_id" gorm:"index;not null"`
+	PeerAID   uint          `json:"peer_a_id" gorm:"uniqueIndex:idx_peer_link_pair;not null"`
+	PeerA     WireguardPeer `json:"-" gorm:"foreignKey:PeerAID;constraint:OnDelete:CASCADE"`
+	PeerBID   uint          `json:"peer_b_id" gorm:"uniqueIndex:idx_peer_link_pair;not null"`
+	PeerB     WireguardPeer `json:"-" gorm:"foreignKey:PeerBID;constraint:OnDelete:CASCADE"`
+	CreatedAt time.Time     `json:"created_at"`
+}
+
 // WireguardPeer WireGuard peer信息
 type WireguardPeer struct {
 	ID                  uint      `json:"id" gorm:"primaryKey"`
 	ServerID            uint      `json:"server_id" gorm:"index;not null"`
 	Server              WireguardServer `json:"server,omitempty" gorm:"foreignKey:ServerID;constraint:OnDelete:CASCADE"`
 	PublicKey           string    `json:"public_key" gorm:"uniqueIndex;not null"`
-	PrivateKey          string    `json:"-" gorm:"not null"` // peer私钥，不返回给客户端
-	PresharedKey        string    `json:"-" gorm:""` // 不返回给客户端
+	PrivateKey          string    `json:"-" gorm:"not null;serializer:encrypted"` // peer私钥，不返回给客户端（客户端自行生成密钥时为空）
+	PresharedKey        string    `json:"-" gorm:"serializer:encrypted"` // 预共享密钥（为空表示未启用），仅通过peer响应和客户端配置下发
 	PeerAddress         string    `json:"peer_address" gorm:"not null"` // peer在WireGuard网段中的IP地址
-	AllowedIPs          string    `json:"allowed_ips" gorm:"not null"` // peer可以访问的IP地址或网段
+	PeerAddress6        string    `json:"peer_address6" gorm:""` // peer在WireGuard IPv6网段中的地址（未启用IPv6时为空）
+	AllowedIPs          string    `json:"allowed_ips" gorm:"not null"` // peer可以访问的IP地址或网段（WireGuard网段以外的网段为peer背后的路由网段）
 	Endpoint            string    `json:"endpoint" gorm:""`
 	PersistentKeepalive int       `json:"persistent_keepalive" gorm:"default:0"`
 	Comment             string    `json:"comment" gorm:""` // 备注，如设备名称
 	EnableForwarding    bool      `json:"enable_forwarding" gorm:"default:false"` // 是否启用转发（作为网关）
 	ForwardInterface    string    `json:"forward_interface" gorm:""` // 转发接口名称（如 eth0）
+	KeyRotatedAt        *time.Time `json:"key_rotated_at" gorm:""` // 最近一次密钥轮换时间（从未轮换为空）
+	ConfigOutdated      bool      `json:"config_outdated" gorm:"default:false"` // 密钥变更后客户端配置已失效，需要重新下载
+	ClientRouteMode     string    `json:"client_route_mode" gorm:""` // 客户端路由模式（为空时继承服务器设置）
+	ClientAllowedIPs    string    `json:"client_allowed_ips" gorm:""` // custom 模式下的客户端 AllowedIPs（逗号分隔）
+	ClientDNS           string    `json:"client_dns" gorm:""` // 客户端DNS（逗号分隔，为空时继承服务器设置）
+	UseExitPeer         bool      `json:"use_exit_peer" gorm:"default:false"` // 外网流量是否经服务器的出口peer转发
+	ExpiresAt           *time.Time `json:"expires_at" gorm:""` // 过期时间（为空表示永不过期），过期后从接口移除
+	AccessSchedule      string    `json:"access_schedule" gorm:""` // 每周重复的访问时间段（如 "mon-fri 09:00-18:00; sat 10:00-14:00"，为空表示不限制）
+	AccessStatus        string    `json:"access_status" gorm:"default:active"` // 访问状态（active/outside_window/expired），由后台调度维护
 	CreatedAt           time.Time `json:"created_at"`
 	UpdatedAt           time.Time `json:"updated_at"`
 }
@@ -76,14 +173,26 @@ type WireguardPeer struct {
 type WireguardPeerResponse struct {
 	ID                  uint      `json:"id"`
 	PublicKey           string    `json:"public_key"`
-	PrivateKey          string    `json:"private_key"` // 返回私钥供客户端配置使用
+	PrivateKey          string    `json:"private_key,omitempty"` // 返回私钥供客户端配置使用（客户端自行生成密钥时为空）
+	ClientGeneratedKey  bool      `json:"client_generated_key"` // 密钥由客户端生成，服务器不持有私钥
+	PresharedKey        string    `json:"preshared_key,omitempty"` // 预共享密钥，客户端配置需要
 	PeerAddress         string    `json:"peer_address"` // peer的WireGuard IP地址
+	PeerAddress6        string    `json:"peer_address6,omitempty"` // peer的WireGuard IPv6地址
 	AllowedIPs          string    `json:"allowed_ips"`
 	Endpoint            string    `json:"endpoint,omitempty"`
 	PersistentKeepalive int       `json:"persistent_keepalive"`
 	Comment             string    `json:"comment,omitempty"`
 	EnableForwarding    bool      `json:"enable_forwarding"`
 	ForwardInterface    string    `json:"forward_interface,omitempty"`
+	KeyRotatedAt        *time.Time `json:"key_rotated_at,omitempty"` // 最近一次密钥轮换时间
+	ConfigOutdated      bool      `json:"config_outdated"` // 客户端配置需要重新下载
+	ClientRouteMode     string    `json:"client_route_mode,omitempty"` // 为空表示继承服务器设置
+	ClientAllowedIPs    string    `json:"client_allowed_ips,omitempty"`
+	ClientDNS           string    `json:"client_dns,omitempty"`
+	UseExitPeer         bool      `json:"use_exit_peer"`
+	ExpiresAt           *time.Time `json:"expires_at,omitempty"`
+	AccessSchedule      string    `json:"access_schedule,omitempty"`
+	AccessStatus        string    `json:"access_status"`
 	CreatedAt           time.Time `json:"created_at"`
 }
 
@@ -151,6 +260,7 @@ type AdminUserTraffic struct {
 	Enabled      bool   `json:"enabled"`
 	DownloadRate int    `json:"download_rate"` // Mbps
 	UploadRate   int    `json:"upload_rate"`   // Mbps
+	PeerIsolation string `json:"peer_isolation"` // peer之间互访策略
 }
 
 // ToResponse 转换为响应格式
@@ -159,21 +269,60 @@ func (p *WireguardPeer) ToResponse() WireguardPeerResponse {
 		ID:                  p.ID,
 		PublicKey:           p.PublicKey,
 		PrivateKey:          p.PrivateKey,
+		ClientGeneratedKey:  p.ClientGeneratedKey(),
+		PresharedKey:        p.PresharedKey,
 		PeerAddress:         p.PeerAddress,
+		PeerAddress6:        p.PeerAddress6,
 		AllowedIPs:          p.AllowedIPs,
 		Endpoint:            p.Endpoint,
 		PersistentKeepalive: p.PersistentKeepalive,
 		Comment:             p.Comment,
 		EnableForwarding:    p.EnableForwarding,
 		ForwardInterface:    p.ForwardInterface,
+		KeyRotatedAt:        p.KeyRotatedAt,
+		ConfigOutdated:      p.ConfigOutdated,
+		ClientRouteMode:     p.ClientRouteMode,
+		ClientAllowedIPs:    p.ClientAllowedIPs,
+		ClientDNS:           p.ClientDNS,
+		UseExitPeer:         p.UseExitPeer,
+		ExpiresAt:           p.ExpiresAt,
+		AccessSchedule:      p.AccessSchedule,
+		AccessStatus:        p.AccessStatus,
 		CreatedAt:           p.CreatedAt,
 	}
 }
 
+// ClientGeneratedKey 密钥是否由客户端生成（服务器只保存公钥）
+func (p *WireguardPeer) ClientGeneratedKey() bool {
+	return p.PrivateKey == ""
+}
+
 // BeforeCreate Hook
 func (p *WireguardPeer) BeforeCreate(tx *gorm.DB) error {
 	if p.PersistentKeepalive == 0 {
 		p.PersistentKeepalive = 25 // 默认25秒
 	}
+	if p.AccessStatus == "" {
+		p.AccessStatus = PeerAccessActive
+	}
 	return nil
 }
+
+// WireguardPeerKeyRotation peer密钥轮换记录
+// 宽限期内旧公钥仍保留在接口上，直到新密钥完成握手或宽限期结束后才被移除
+type WireguardPeerKeyRotation struct {
+	ID              uint          `json:"id" gorm:"primaryKey"`
+	PeerID          uint          `json:"peer_id" gorm:"index;not null"`
+	Peer            WireguardPeer `json:"-" gorm:"foreignKey:PeerID;constraint:OnDelete:CASCADE"`
+	OldPublicKey    string        `json:"old_public_key" gorm:"not null"`
+	OldPresharedKey string        `json:"-" gorm:"serializer:encrypted"` // 宽限期内旧设备仍需使用旧的预共享密钥
+	NewPublicKey    string        `json:"new_public_key" gorm:"not null"`
+	GraceUntil      time.Time     `json:"grace_until"`            // 旧公钥最晚保留到该时间
+	RetiredAt       *time.Time    `json:"retired_at" gorm:"index"` // 旧公钥被移除的时间（为空表示仍在宽限期内）
+	CreatedAt       time.Time     `json:"created_at"`
+}
+
+// InGracePeriod 旧公钥是否仍在宽限期内
+func (r *WireguardPeerKeyRotation) InGracePeriod(now time.Time) bool {
+	return r.RetiredAt == nil && now.Before(r.GraceUntil)
+}
@@ -70,6 +70,10 @@ const (
 	// 权限相关错误
 	ErrInsufficientPermission = "INSUFFICIENT_PERMISSION"
 	ErrAPIAccessDenied        = "API_ACCESS_DENIED"
+
+	// WireGuard相关错误
+	ErrServerDisabled = "SERVER_DISABLED"
+	ErrQuotaExceeded  = "QUOTA_EXCEEDED"
 )
 
 // 成功响应
@@ -186,6 +190,14 @@ func APIAccessDenied(c *gin.Context) {
 	Error(c, http.StatusForbidden, ErrAPIAccessDenied, "Access to this API is disabled for your account", nil)
 }
 
+func ServerDisabled(c *gin.Context) {
+	Error(c, http.StatusForbidden, ErrServerDisabled, "Your WireGuard server has been disabled", nil)
+}
+
+func QuotaExceeded(c *gin.Context, message string) {
+	Error(c, http.StatusForbidden, ErrQuotaExceeded, message, nil)
+}
+
 // 获取请求ID（如果有的话）
 func getRequestID(c *gin.Context) string {
 	if requestID := c.GetHeader("X-Request-ID"); requestID != "" {
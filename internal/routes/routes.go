@@ -25,15 +25,40 @@ func SetupRoutes(r *gin.Engine) {
 	// WireGuard routes
 	wg := protected.Group("/wireguard")
 	{
-		// 流量统计
-		wg.GET("/traffic", handlers.GetMyTrafficSummary) // 用户流量摘要（用于轮询）
-		
-		// Peer管理
-		wg.GET("/peers", handlers.GetMyPeers)
-		wg.POST("/peers", handlers.AddPeer)
-		wg.PATCH("/peers/:id", handlers.UpdatePeer)
-		wg.DELETE("/peers/:id", handlers.DeletePeer)
-		wg.GET("/peers/:id/config", handlers.GetPeerConfig)
+		// 用户的WireGuard服务器（受服务器配额限制）
+		wg.GET("/servers", handlers.GetMyServers)
+		wg.POST("/servers", handlers.CreateMyServer)
+
+		// 旧接口：操作用户的第一个服务器
+		wg.POST("/server/rotate-keys", handlers.RotateMyServerKeys)
+		wg.GET("/server/isolation", handlers.GetMyPeerIsolation)
+		wg.PUT("/server/isolation", handlers.UpdateMyPeerIsolation)
+		wg.PATCH("/server/client-routing", handlers.UpdateMyClientRouting)
+		wg.GET("/server/exit-peer", handlers.GetMyExitPeer)
+		wg.PUT("/server/exit-peer", handlers.UpdateMyExitPeer)
+		registerServerResourceRoutes(wg)
+
+		// 指定服务器：/servers/:server_id/...
+		server := wg.Group("/servers/:server_id")
+		server.GET("", handlers.GetMyServer)
+		server.PATCH("", handlers.UpdateMyServer)
+		server.DELETE("", handlers.DeleteMyServer)
+		server.POST("/rotate-keys", handlers.RotateMyServerKeys)
+		server.GET("/isolation", handlers.GetMyPeerIsolation)
+		server.PUT("/isolation", handlers.UpdateMyPeerIsolation)
+		server.PATCH("/client-routing", handlers.UpdateMyClientRouting)
+		server.GET("/exit-peer", handlers.GetMyExitPeer)
+		server.PUT("/exit-peer", handlers.UpdateMyExitPeer)
+		registerServerResourceRoutes(server)
+
+		// 跨用户共享网络
+		wg.GET("/shared-networks", handlers.GetMySharedNetworks)
+		wg.POST("/shared-networks", handlers.CreateSharedNetwork)
+		wg.DELETE("/shared-networks/:id", handlers.DeleteSharedNetwork)
+		wg.POST("/shared-networks/:id/members", handlers.InviteSharedNetworkMember)
+		wg.DELETE("/shared-networks/:id/members/:user_id", handlers.RemoveSharedNetworkMember)
+		wg.POST("/shared-networks/:id/join", handlers.JoinSharedNetwork)
+		wg.PUT("/shared-networks/:id/peers", handlers.UpdateMySharedNetworkPeers)
 	}
 
 	// Admin routes
@@ -52,6 +77,18 @@ func SetupRoutes(r *gin.Engine) {
 		admin.DELETE("/wireguard/servers/:id", handlers.AdminDeleteWireguardServer) // 删除服务器
 		admin.PATCH("/wireguard/servers/:id/toggle", handlers.AdminToggleWireguardServer) // 启用/禁用服务器
 		admin.PATCH("/wireguard/servers/:id/ratelimit", handlers.AdminSetRateLimit) // 设置速率限制
+		admin.POST("/wireguard/servers/:id/rotate-keys", handlers.AdminRotateServerKeys) // 轮换服务器密钥
+		admin.POST("/wireguard/servers/rotate-keys", handlers.AdminRotateAllServerKeys)  // 轮换所有服务器密钥
+		admin.GET("/wireguard/servers/:id/isolation", handlers.AdminGetPeerIsolation)    // 查看peer互访策略
+		admin.PUT("/wireguard/servers/:id/isolation", handlers.AdminUpdatePeerIsolation) // 设置peer互访策略
+		admin.PATCH("/wireguard/servers/:id/client-routing", handlers.AdminUpdateClientRouting) // 设置客户端默认路由和DNS
+		admin.PATCH("/wireguard/servers/:id/interface", handlers.AdminUpdateServerInterface)    // 设置MTU、FwMark、路由表和监听地址
+		admin.GET("/wireguard/port-forwards", handlers.AdminGetPortForwards)           // 查看公网端口转发
+		admin.DELETE("/wireguard/port-forwards/:id", handlers.AdminDeletePortForward) // 删除公网端口转发
+		admin.GET("/wireguard/shared-networks", handlers.AdminGetSharedNetworks)          // 查看共享网络
+		admin.DELETE("/wireguard/shared-networks/:id", handlers.AdminDeleteSharedNetwork) // 删除共享网络
+		admin.GET("/wireguard/drift", handlers.AdminGetNetworkDrift)                      // 对比数据库与主机的网络状态
+		admin.POST("/wireguard/drift/fix", handlers.AdminFixNetworkDrift)                 // 修复网络状态偏差
 		
 		// 系统监控
 		admin.GET("/monitoring/system", handlers.GetSystemStats)        // 获取系统整体统计
@@ -64,3 +101,38 @@ func SetupRoutes(r *gin.Engine) {
 		admin.GET("/monitoring/stats", handlers.GetMonitoringStats)     // 获取聚合统计数据（完整版）
 	}
 }
+
+// registerServerResourceRoutes 注册属于某个服务器的资源路由（流量、peer、ACL、DNS、端口转发）
+// 同时挂在 /wireguard（第一个服务器）和 /wireguard/servers/:server_id 下
+func registerServerResourceRoutes(g *gin.RouterGroup) {
+	// 流量统计
+	g.GET("/traffic", handlers.GetMyTrafficSummary) // 用户流量摘要（用于轮询）
+
+	// Peer管理
+	g.GET("/peers", handlers.GetMyPeers)
+	g.POST("/peers", handlers.AddPeer)
+	g.PATCH("/peers/:id", handlers.UpdatePeer)
+	g.DELETE("/peers/:id", handlers.DeletePeer)
+	g.GET("/peers/:id/config", handlers.GetPeerConfig)
+	g.POST("/peers/:id/psk/rotate", handlers.RotatePeerPresharedKey)
+	g.POST("/peers/:id/rotate", handlers.RotatePeerKeys)
+	g.GET("/peers/:id/rotations", handlers.GetPeerKeyRotations)
+
+	// Peer访问控制规则
+	g.GET("/acls", handlers.GetMyACLs)
+	g.POST("/acls", handlers.CreateACL)
+	g.PATCH("/acls/:id", handlers.UpdateACL)
+	g.DELETE("/acls/:id", handlers.DeleteACL)
+
+	// 内置DNS
+	g.GET("/dns", handlers.GetMyDNS)
+	g.POST("/dns/records", handlers.CreateDNSRecord)
+	g.PUT("/dns/records/:id", handlers.UpdateDNSRecord)
+	g.DELETE("/dns/records/:id", handlers.DeleteDNSRecord)
+
+	// 公网端口转发
+	g.GET("/port-forwards", handlers.GetMyPortForwards)
+	g.POST("/port-forwards", handlers.CreatePortForward)
+	g.PATCH("/port-forwards/:id", handlers.UpdatePortForward)
+	g.DELETE("/port-forwards/:id", handlers.DeletePortForward)
+}
@@ -0,0 +1,249 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// 信封加密：每个值使用随机生成的数据密钥（DEK）做 AES-256-GCM 加密，
+// 数据密钥再用主密钥加密后与密文一起保存。
+// 存储格式：enc:v1:<主密钥ID>:<base64(加密后的数据密钥)>:<base64(密文)>
+const (
+	// EncryptedPrefix 加密值的前缀，不带该前缀的值视为旧版本的明文数据
+	EncryptedPrefix = "enc:v1:"
+	keySize         = 32
+)
+
+var (
+	// ErrNoMasterKey 未配置主密钥，无法解密已加密的数据
+	ErrNoMasterKey = errors.New("master key is not configured")
+	// ErrUnknownMasterKey 数据由未加载的主密钥加密
+	ErrUnknownMasterKey = errors.New("data was encrypted with an unknown master key")
+)
+
+// MasterKey 主密钥
+type MasterKey struct {
+	id  string
+	key []byte
+}
+
+// ID 主密钥标识（密钥SHA-256的前8字节），用于识别数据由哪个主密钥加密
+func (k *MasterKey) ID() string {
+	return k.id
+}
+
+// Keyring 主密钥集合：primary 用于加密，所有密钥都可用于解密（用于更换主密钥期间）
+type Keyring struct {
+	mu      sync.RWMutex
+	primary *MasterKey
+	keys    map[string]*MasterKey
+}
+
+// defaultKeyring 全局密钥环，由 GORM 序列化器使用
+var defaultKeyring = &Keyring{keys: make(map[string]*MasterKey)}
+
+// Default 获取全局密钥环
+func Default() *Keyring {
+	return defaultKeyring
+}
+
+// NewMasterKey 从32字节原始密钥创建主密钥
+func NewMasterKey(key []byte) (*MasterKey, error) {
+	if len(key) != keySize {
+		return nil, fmt.Errorf("master key must be %d bytes, got %d", keySize, len(key))
+	}
+	sum := sha256.Sum256(key)
+	return &MasterKey{
+		id:  hex.EncodeToString(sum[:8]),
+		key: append([]byte{}, key...),
+	}, nil
+}
+
+// ParseMasterKey 解析base64编码的主密钥
+func ParseMasterKey(encoded string) (*MasterKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("master key must be base64 encoded: %w", err)
+	}
+	return NewMasterKey(key)
+}
+
+// LoadMasterKey 按优先级加载主密钥：环境变量 envName，其次文件 keyFile
+// 两者都未配置时返回 nil, nil（不启用加密）
+func LoadMasterKey(keyFile, envName string) (*MasterKey, error) {
+	if envName != "" {
+		if value := os.Getenv(envName); value != "" {
+			return ParseMasterKey(value)
+		}
+	}
+
+	if keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read master key file: %w", err)
+		}
+		return ParseMasterKey(string(data))
+	}
+
+	return nil, nil
+}
+
+// GenerateMasterKey 生成新的base64编码主密钥
+func GenerateMasterKey() (string, error) {
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// SetPrimary 设置用于加密的主密钥（同时可用于解密）
+func (k *Keyring) SetPrimary(key *MasterKey) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.primary = key
+	if key != nil {
+		k.keys[key.id] = key
+	}
+}
+
+// AddDecryptionKey 添加仅用于解密的主密钥（如更换前的旧主密钥）
+func (k *Keyring) AddDecryptionKey(key *MasterKey) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[key.id] = key
+}
+
+// Enabled 是否配置了加密主密钥
+func (k *Keyring) Enabled() bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.primary != nil
+}
+
+// IsEncrypted 判断值是否为加密格式
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, EncryptedPrefix)
+}
+
+// Encrypt 使用主密钥信封加密明文
+// 空字符串原样返回；未配置主密钥时返回明文（兼容未启用加密的部署）
+func (k *Keyring) Encrypt(plaintext string) (string, error) {
+	k.mu.RLock()
+	primary := k.primary
+	k.mu.RUnlock()
+
+	if plaintext == "" || primary == nil {
+		return plaintext, nil
+	}
+
+	// 1. 生成随机数据密钥并加密数据
+	dataKey := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", err
+	}
+	ciphertext, err := seal(dataKey, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+
+	// 2. 使用主密钥加密数据密钥
+	wrappedKey, err := seal(primary.key, dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	return EncryptedPrefix + primary.id + ":" +
+		base64.StdEncoding.EncodeToString(wrappedKey) + ":" +
+		base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// Decrypt 解密信封加密的值，非加密格式的值（旧版本明文数据）原样返回
+func (k *Keyring) Decrypt(value string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+
+	parts := strings.Split(strings.TrimPrefix(value, EncryptedPrefix), ":")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("malformed encrypted value")
+	}
+
+	k.mu.RLock()
+	empty := len(k.keys) == 0
+	masterKey := k.keys[parts[0]]
+	k.mu.RUnlock()
+
+	if empty {
+		return "", ErrNoMasterKey
+	}
+	if masterKey == nil {
+		return "", fmt.Errorf("%w (key id %s)", ErrUnknownMasterKey, parts[0])
+	}
+
+	wrappedKey, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("malformed encrypted value: %w", err)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("malformed encrypted value: %w", err)
+	}
+
+	dataKey, err := open(masterKey.key, wrappedKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	plaintext, err := open(dataKey, ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt value: %w", err)
+	}
+	return string(plaintext), nil
+}
+
+// seal 使用 AES-256-GCM 加密，返回 nonce||密文
+func seal(key, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// open 解密 seal 的输出
+func open(key, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+// newGCM 创建 AES-GCM 实例
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
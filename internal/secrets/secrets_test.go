@@ -0,0 +1,256 @@
+package secrets
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testKey 生成测试用主密钥，fill 决定密钥内容
+func testKey(t *testing.T, fill byte) *MasterKey {
+	t.Helper()
+	key, err := NewMasterKey([]byte(strings.Repeat(string(rune(fill)), keySize)))
+	if err != nil {
+		t.Fatalf("new master key: %v", err)
+	}
+	return key
+}
+
+// newTestKeyring 创建以 primary 为加密密钥的独立密钥环
+func newTestKeyring(primary *MasterKey) *Keyring {
+	keyring := &Keyring{keys: make(map[string]*MasterKey)}
+	keyring.SetPrimary(primary)
+	return keyring
+}
+
+func TestEncryptDecryptRoundTrip(t *testing.T) {
+	keyring := newTestKeyring(testKey(t, 'a'))
+
+	for _, plaintext := range []string{"x", "WIREGUARD+private/key=", "包含:冒号:的值", strings.Repeat("k", 4096)} {
+		encrypted, err := keyring.Encrypt(plaintext)
+		if err != nil {
+			t.Fatalf("encrypt %q: %v", plaintext, err)
+		}
+		if !IsEncrypted(encrypted) || (len(plaintext) >= 8 && strings.Contains(encrypted, plaintext)) {
+			t.Errorf("encrypted value %q leaks the plaintext", encrypted)
+		}
+		decrypted, err := keyring.Decrypt(encrypted)
+		if err != nil || decrypted != plaintext {
+			t.Errorf("Decrypt(Encrypt(%q)) = %q, %v", plaintext, decrypted, err)
+		}
+	}
+}
+
+func TestEncryptFormat(t *testing.T) {
+	key := testKey(t, 'a')
+	keyring := newTestKeyring(key)
+
+	encrypted, err := keyring.Encrypt("secret")
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	if !IsEncrypted(encrypted) {
+		t.Fatalf("%q does not start with %q", encrypted, EncryptedPrefix)
+	}
+
+	// enc:v1:<主密钥ID>:<base64(加密后的数据密钥)>:<base64(密文)>
+	parts := strings.Split(strings.TrimPrefix(encrypted, EncryptedPrefix), ":")
+	if len(parts) != 3 {
+		t.Fatalf("%q has %d fields after the prefix, want 3", encrypted, len(parts))
+	}
+	if parts[0] != key.ID() || len(key.ID()) != 16 {
+		t.Errorf("key id = %q, want %q (16 hex characters)", parts[0], key.ID())
+	}
+	for i, field := range parts[1:] {
+		if _, err := base64.StdEncoding.DecodeString(field); err != nil {
+			t.Errorf("field %d %q is not base64: %v", i+1, field, err)
+		}
+	}
+
+	// 每次加密使用新的数据密钥和nonce
+	again, err := keyring.Encrypt("secret")
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	if again == encrypted {
+		t.Error("encrypting the same value twice produced identical output")
+	}
+}
+
+func TestEncryptWithoutMasterKey(t *testing.T) {
+	keyring := newTestKeyring(nil)
+
+	for _, plaintext := range []string{"", "secret"} {
+		value, err := keyring.Encrypt(plaintext)
+		if err != nil || value != plaintext {
+			t.Errorf("Encrypt(%q) without master key = %q, %v, want the plaintext", plaintext, value, err)
+		}
+	}
+
+	// 配置主密钥后空字符串也不加密
+	keyring.SetPrimary(testKey(t, 'a'))
+	if value, err := keyring.Encrypt(""); err != nil || value != "" {
+		t.Errorf("Encrypt(\"\") = %q, %v, want empty", value, err)
+	}
+}
+
+func TestDecryptLegacyPlaintext(t *testing.T) {
+	for _, keyring := range []*Keyring{newTestKeyring(nil), newTestKeyring(testKey(t, 'a'))} {
+		for _, value := range []string{"", "oK8Zk3Zr4sZf5yq0oJ9N8z8QyY2oKpZ5X1Gx0Hn6dE4=", "enc:v2:not-our-format"} {
+			decrypted, err := keyring.Decrypt(value)
+			if err != nil || decrypted != value {
+				t.Errorf("Decrypt(%q) = %q, %v, want the value unchanged", value, decrypted, err)
+			}
+		}
+	}
+}
+
+func TestDecryptWrongKey(t *testing.T) {
+	encrypted, err := newTestKeyring(testKey(t, 'a')).Encrypt("secret")
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+
+	if _, err := newTestKeyring(nil).Decrypt(encrypted); !errors.Is(err, ErrNoMasterKey) {
+		t.Errorf("decrypt without keys: error = %v, want ErrNoMasterKey", err)
+	}
+	if _, err := newTestKeyring(testKey(t, 'b')).Decrypt(encrypted); !errors.Is(err, ErrUnknownMasterKey) {
+		t.Errorf("decrypt with another key: error = %v, want ErrUnknownMasterKey", err)
+	}
+
+	// 密钥ID相同但密钥内容不同：无法解开数据密钥
+	impostor := testKey(t, 'b')
+	impostor.id = testKey(t, 'a').ID()
+	if _, err := newTestKeyring(impostor).Decrypt(encrypted); err == nil || !strings.Contains(err.Error(), "unwrap data key") {
+		t.Errorf("decrypt with a mismatched key: error = %v, want an unwrap failure", err)
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+	keyring := newTestKeyring(testKey(t, 'a'))
+	encrypted, err := keyring.Encrypt("secret")
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	parts := strings.Split(strings.TrimPrefix(encrypted, EncryptedPrefix), ":")
+
+	// flip 翻转base64字段中最后一个字节的一位
+	flip := func(field string) string {
+		raw, _ := base64.StdEncoding.DecodeString(field)
+		raw[len(raw)-1] ^= 0x01
+		return base64.StdEncoding.EncodeToString(raw)
+	}
+	join := func(fields ...string) string {
+		return EncryptedPrefix + strings.Join(fields, ":")
+	}
+
+	tests := []struct {
+		name    string
+		value   string
+		wantErr string
+	}{
+		{"ciphertext", join(parts[0], parts[1], flip(parts[2])), "failed to decrypt value"},
+		{"wrapped key", join(parts[0], flip(parts[1]), parts[2]), "failed to unwrap data key"},
+		{"swapped fields", join(parts[0], parts[2], parts[1]), "failed to unwrap data key"},
+		{"truncated ciphertext", join(parts[0], parts[1], "AAAA"), "ciphertext too short"},
+		{"missing field", join(parts[0], parts[1]), "malformed encrypted value"},
+		{"extra field", join(parts[0], parts[1], parts[2], "x"), "malformed encrypted value"},
+		{"invalid base64", join(parts[0], parts[1], "!!!"), "malformed encrypted value"},
+	}
+
+	for _, tt := range tests {
+		if _, err := keyring.Decrypt(tt.value); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestDecryptAfterKeyRotation(t *testing.T) {
+	oldKey, newKey := testKey(t, 'a'), testKey(t, 'b')
+	keyring := newTestKeyring(oldKey)
+	oldValue, err := keyring.Encrypt("secret")
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+
+	// 更换主密钥后旧主密钥仍可解密，新数据使用新主密钥加密
+	keyring.SetPrimary(newKey)
+	if decrypted, err := keyring.Decrypt(oldValue); err != nil || decrypted != "secret" {
+		t.Errorf("decrypt with the previous key = %q, %v", decrypted, err)
+	}
+	newValue, err := keyring.Encrypt("secret")
+	if err != nil {
+		t.Fatalf("encrypt: %v", err)
+	}
+	if !strings.HasPrefix(newValue, EncryptedPrefix+newKey.ID()+":") {
+		t.Errorf("%q was not encrypted with the new key %s", newValue, newKey.ID())
+	}
+
+	// 只加载新主密钥时旧数据无法解密
+	if _, err := newTestKeyring(newKey).Decrypt(oldValue); !errors.Is(err, ErrUnknownMasterKey) {
+		t.Errorf("decrypt without the previous key: error = %v, want ErrUnknownMasterKey", err)
+	}
+
+	decryptOnly := newTestKeyring(nil)
+	decryptOnly.AddDecryptionKey(oldKey)
+	if decryptOnly.Enabled() {
+		t.Error("keyring with only a decryption key reports encryption as enabled")
+	}
+	if decrypted, err := decryptOnly.Decrypt(oldValue); err != nil || decrypted != "secret" {
+		t.Errorf("decrypt with a decryption-only key = %q, %v", decrypted, err)
+	}
+}
+
+func TestParseMasterKey(t *testing.T) {
+	encoded, err := GenerateMasterKey()
+	if err != nil {
+		t.Fatalf("generate master key: %v", err)
+	}
+	key, err := ParseMasterKey(" " + encoded + "\n")
+	if err != nil {
+		t.Fatalf("parse generated key: %v", err)
+	}
+	raw, _ := base64.StdEncoding.DecodeString(encoded)
+	if want, _ := NewMasterKey(raw); key.ID() != want.ID() {
+		t.Errorf("key id = %s, want %s", key.ID(), want.ID())
+	}
+
+	if _, err := ParseMasterKey("not base64!"); err == nil {
+		t.Error("invalid base64 was accepted")
+	}
+	if _, err := ParseMasterKey(base64.StdEncoding.EncodeToString([]byte("short"))); err == nil {
+		t.Error("short key was accepted")
+	}
+}
+
+func TestLoadMasterKey(t *testing.T) {
+	fileKey, _ := GenerateMasterKey()
+	envKey, _ := GenerateMasterKey()
+	keyFile := filepath.Join(t.TempDir(), "master.key")
+	if err := os.WriteFile(keyFile, []byte(fileKey+"\n"), 0600); err != nil {
+		t.Fatalf("write key file: %v", err)
+	}
+	t.Setenv("TEST_MASTER_KEY", envKey)
+
+	idOf := func(encoded string) string {
+		key, _ := ParseMasterKey(encoded)
+		return key.ID()
+	}
+
+	// 环境变量优先于文件
+	if key, err := LoadMasterKey(keyFile, "TEST_MASTER_KEY"); err != nil || key.ID() != idOf(envKey) {
+		t.Errorf("LoadMasterKey with env and file = %v, %v, want the env key", key, err)
+	}
+	if key, err := LoadMasterKey(keyFile, "TEST_MASTER_KEY_UNSET"); err != nil || key.ID() != idOf(fileKey) {
+		t.Errorf("LoadMasterKey with file = %v, %v, want the file key", key, err)
+	}
+	if key, err := LoadMasterKey("", ""); err != nil || key != nil {
+		t.Errorf("LoadMasterKey without configuration = %v, %v, want nil, nil", key, err)
+	}
+	if _, err := LoadMasterKey(filepath.Join(t.TempDir(), "missing"), ""); err == nil {
+		t.Error("missing key file was accepted")
+	}
+}
@@ -0,0 +1,52 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"gorm.io/gorm/schema"
+)
+
+// EncryptedSerializer GORM序列化器：写入时使用全局密钥环加密，读取时解密
+// 在字段上使用 `gorm:"serializer:encrypted"` 启用
+//
+// 注意：序列化器只作用于基于结构体的写入（Create/Save/Updates(struct)），
+// 使用 map 或 Update(column, value) 更新加密字段会绕过序列化器写入明文，
+// 更新这些字段时应使用 Select(...).Updates(struct)
+type EncryptedSerializer struct{}
+
+func init() {
+	schema.RegisterSerializer("encrypted", EncryptedSerializer{})
+}
+
+// Scan 从数据库读取并解密
+func (EncryptedSerializer) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue interface{}) error {
+	var value string
+	switch v := dbValue.(type) {
+	case nil:
+		value = ""
+	case string:
+		value = v
+	case []byte:
+		value = string(v)
+	default:
+		return fmt.Errorf("unsupported data type for encrypted field %s: %T", field.Name, dbValue)
+	}
+
+	plaintext, err := defaultKeyring.Decrypt(value)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt field %s: %w", field.Name, err)
+	}
+	field.ReflectValueOf(ctx, dst).SetString(plaintext)
+	return nil
+}
+
+// Value 加密后写入数据库
+func (EncryptedSerializer) Value(ctx context.Context, field *schema.Field, dst reflect.Value, fieldValue interface{}) (interface{}, error) {
+	plaintext, ok := fieldValue.(string)
+	if !ok {
+		return nil, fmt.Errorf("encrypted field %s must be a string, got %T", field.Name, fieldValue)
+	}
+	return defaultKeyring.Encrypt(plaintext)
+}
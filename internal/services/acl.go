@@ -0,0 +1,141 @@
+package services
+
+import (
+	"cloud-platform/internal/models"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// ACLChain 命名空间内存放peer访问控制规则的自定义链，由 FORWARD 链首跳转
+const ACLChain = "WG_ACL"
+
+// NormalizeACL 校验ACL规则并规范化各字段（单个IP补全为/32或/128，协议和动作转为小写）
+func NormalizeACL(acl *models.WireguardACL) error {
+	destination := strings.TrimSpace(acl.Destination)
+	prefix, err := netip.ParsePrefix(destination)
+	if err != nil {
+		addr, addrErr := netip.ParseAddr(destination)
+		if addrErr != nil {
+			return fmt.Errorf("invalid destination %q: must be an IP address or CIDR", acl.Destination)
+		}
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	acl.Destination = prefix.Masked().String()
+
+	acl.Protocol = strings.ToLower(strings.TrimSpace(acl.Protocol))
+	if acl.Protocol == "" {
+		acl.Protocol = models.ACLProtocolAll
+	}
+	switch acl.Protocol {
+	case models.ACLProtocolAll, models.ACLProtocolTCP, models.ACLProtocolUDP, models.ACLProtocolICMP:
+	default:
+		return fmt.Errorf("invalid protocol %q: must be one of all, tcp, udp, icmp", acl.Protocol)
+	}
+
+	if acl.Port < 0 || acl.Port > 65535 {
+		return fmt.Errorf("invalid port %d", acl.Port)
+	}
+	if acl.Port != 0 && acl.Protocol != models.ACLProtocolTCP && acl.Protocol != models.ACLProtocolUDP {
+		return fmt.Errorf("port can only be set for tcp or udp rules")
+	}
+
+	acl.Action = strings.ToLower(strings.TrimSpace(acl.Action))
+	if acl.Action != models.ACLActionAllow && acl.Action != models.ACLActionDeny {
+		return fmt.Errorf("invalid action %q: must be allow or deny", acl.Action)
+	}
+	return nil
+}
+
+// ApplyACLs 将服务器的全部ACL规则编译后原子替换到命名空间的 WG_ACL 链
+// 规则变更、peer增删以及命名空间重建后都需要重新应用
+func (s *UserNetworkService) ApplyACLs(server *models.WireguardServer) error {
+	var acls []models.WireguardACL
+	if server.ID != 0 {
+		if err := s.db.Where("server_id = ?", server.ID).Order("priority, id").Find(&acls).Error; err != nil {
+			return fmt.Errorf("failed to load acls: %v", err)
+		}
+	}
+
+	peers, err := s.loadPeers(server)
+	if err != nil {
+		return err
+	}
+	peerByID := make(map[uint]models.WireguardPeer, len(peers))
+	for _, peer := range peers {
+		peerByID[peer.ID] = peer
+	}
+
+	rules4, rules6 := compileACLRules(server, acls, peerByID)
+
+	return s.applyForwardChain(server, ACLChain, rules4, rules6, "-i", server.WgInterface)
+}
+
+// applyForwardChain 替换命名空间内自定义链的规则（IPv4，双栈时同时替换IPv6），
+// 并确保 FORWARD 链首按 match 条件跳转到该链
+func (s *UserNetworkService) applyForwardChain(server *models.WireguardServer, chain string, rules4, rules6 [][]string, match ...string) error {
+	forwardChain := FirewallChain{Table: "filter", Hook: "FORWARD", Name: chain, Match: match}
+	if err := s.firewall.ApplyChain(server.Namespace, false, forwardChain, rules4); err != nil {
+		return err
+	}
+
+	if server.WgAddress6 == "" {
+		return nil
+	}
+	return s.firewall.ApplyChain(server.Namespace, true, forwardChain, rules6)
+}
+
+// compileACLRules 将ACL规则编译为 iptables 规则参数，IPv4 和 IPv6 分别返回
+// allow 编译为 RETURN：放行的流量回到 FORWARD 链继续按原有规则处理
+func compileACLRules(server *models.WireguardServer, acls []models.WireguardACL, peers map[uint]models.WireguardPeer) (rules4, rules6 [][]string) {
+	// 已建立的连接（如其他peer主动发起连接后的回包）不受ACL限制
+	established := []string{"-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "RETURN"}
+	rules4 = [][]string{established}
+	rules6 = [][]string{established}
+
+	for _, acl := range acls {
+		peer, ok := peers[acl.PeerID]
+		if !ok {
+			continue
+		}
+
+		// 规则同时适用于peer自身地址和其背后的路由网段（站点到站点）
+		is6 := strings.Contains(acl.Destination, ":")
+		sources4, sources6 := peerSources(server, &peer)
+		sources := sources4
+		if is6 {
+			sources = sources6
+		}
+
+		var match []string
+		switch acl.Protocol {
+		case models.ACLProtocolTCP, models.ACLProtocolUDP:
+			match = append(match, "-p", acl.Protocol)
+			if acl.Port != 0 {
+				match = append(match, "--dport", strconv.Itoa(acl.Port))
+			}
+		case models.ACLProtocolICMP:
+			if is6 {
+				match = append(match, "-p", "ipv6-icmp")
+			} else {
+				match = append(match, "-p", "icmp")
+			}
+		}
+
+		target := "DROP"
+		if acl.Action == models.ACLActionAllow {
+			target = "RETURN"
+		}
+
+		for _, source := range sources {
+			rule := append(append([]string{"-s", source, "-d", acl.Destination}, match...), "-j", target)
+			if is6 {
+				rules6 = append(rules6, rule)
+			} else {
+				rules4 = append(rules4, rule)
+			}
+		}
+	}
+	return rules4, rules6
+}
@@ -0,0 +1,154 @@
+package services
+
+import (
+	"cloud-platform/internal/models"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// aclEstablished 每条 WG_ACL 链首放行已建立连接的规则
+var aclEstablished = []string{"-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "RETURN"}
+
+func TestNormalizeACL(t *testing.T) {
+	tests := []struct {
+		name    string
+		acl     models.WireguardACL
+		want    models.WireguardACL
+		wantErr string
+	}{
+		{
+			name: "single address",
+			acl:  models.WireguardACL{Destination: " 192.168.1.10 ", Protocol: "TCP", Port: 445, Action: "Allow"},
+			want: models.WireguardACL{Destination: "192.168.1.10/32", Protocol: "tcp", Port: 445, Action: "allow"},
+		},
+		{
+			name: "masked ipv6 network, default protocol",
+			acl:  models.WireguardACL{Destination: "fd00:1::1/64", Action: "deny"},
+			want: models.WireguardACL{Destination: "fd00:1::/64", Protocol: "all", Action: "deny"},
+		},
+		{
+			name: "udp port",
+			acl:  models.WireguardACL{Destination: "10.0.0.0/8", Protocol: "udp", Port: 53, Action: "allow"},
+			want: models.WireguardACL{Destination: "10.0.0.0/8", Protocol: "udp", Port: 53, Action: "allow"},
+		},
+		{name: "port on icmp", acl: models.WireguardACL{Destination: "10.0.0.1", Protocol: "icmp", Port: 7, Action: "deny"}, wantErr: "only be set for tcp or udp"},
+		{name: "port on all", acl: models.WireguardACL{Destination: "10.0.0.1", Port: 80, Action: "deny"}, wantErr: "only be set for tcp or udp"},
+		{name: "port out of range", acl: models.WireguardACL{Destination: "10.0.0.1", Protocol: "tcp", Port: 65536, Action: "deny"}, wantErr: "invalid port"},
+		{name: "unknown protocol", acl: models.WireguardACL{Destination: "10.0.0.1", Protocol: "sctp", Action: "deny"}, wantErr: "invalid protocol"},
+		{name: "unknown action", acl: models.WireguardACL{Destination: "10.0.0.1", Action: "reject"}, wantErr: "invalid action"},
+		{name: "invalid destination", acl: models.WireguardACL{Destination: "nas.local", Action: "deny"}, wantErr: "invalid destination"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acl := tt.acl
+			err := NormalizeACL(&acl)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("NormalizeACL error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || acl != tt.want {
+				t.Errorf("NormalizeACL = %+v, %v, want %+v", acl, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileACLRules(t *testing.T) {
+	server := &models.WireguardServer{WgAddress: "10.100.0.1/24", WgAddress6: "fd00:100::1/64"}
+	peers := map[uint]models.WireguardPeer{
+		1: {ID: 1, PeerAddress: "10.100.0.2", PeerAddress6: "fd00:100::2"},
+		2: {ID: 2, PeerAddress: "10.100.0.3", AllowedIPs: "10.100.0.3/32, 192.168.50.0/24"},
+	}
+
+	tests := []struct {
+		name           string
+		acls           []models.WireguardACL
+		rules4, rules6 [][]string
+	}{
+		{
+			name: "tcp and udp ports",
+			acls: []models.WireguardACL{
+				{PeerID: 1, Destination: "192.168.1.10/32", Protocol: "tcp", Port: 445, Action: "allow"},
+				{PeerID: 1, Destination: "192.168.1.1/32", Protocol: "udp", Port: 53, Action: "allow"},
+				{PeerID: 1, Destination: "192.168.1.1/32", Protocol: "tcp", Action: "deny"},
+			},
+			rules4: [][]string{
+				{"-s", "10.100.0.2/32", "-d", "192.168.1.10/32", "-p", "tcp", "--dport", "445", "-j", "RETURN"},
+				{"-s", "10.100.0.2/32", "-d", "192.168.1.1/32", "-p", "udp", "--dport", "53", "-j", "RETURN"},
+				{"-s", "10.100.0.2/32", "-d", "192.168.1.1/32", "-p", "tcp", "-j", "DROP"},
+			},
+		},
+		{
+			name: "icmp per family",
+			acls: []models.WireguardACL{
+				{PeerID: 1, Destination: "10.100.0.0/24", Protocol: "icmp", Action: "deny"},
+				{PeerID: 1, Destination: "fd00:100::/64", Protocol: "icmp", Action: "deny"},
+			},
+			rules4: [][]string{{"-s", "10.100.0.2/32", "-d", "10.100.0.0/24", "-p", "icmp", "-j", "DROP"}},
+			rules6: [][]string{{"-s", "fd00:100::2/128", "-d", "fd00:100::/64", "-p", "ipv6-icmp", "-j", "DROP"}},
+		},
+		{
+			name: "routed subnets are sources too",
+			acls: []models.WireguardACL{{PeerID: 2, Destination: "0.0.0.0/0", Protocol: "all", Action: "deny"}},
+			rules4: [][]string{
+				{"-s", "10.100.0.3/32", "-d", "0.0.0.0/0", "-j", "DROP"},
+				{"-s", "192.168.50.0/24", "-d", "0.0.0.0/0", "-j", "DROP"},
+			},
+		},
+		{
+			name: "unknown peer skipped",
+			acls: []models.WireguardACL{{PeerID: 9, Destination: "0.0.0.0/0", Protocol: "all", Action: "deny"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules4, rules6 := compileACLRules(server, tt.acls, peers)
+			want4 := append([][]string{aclEstablished}, tt.rules4...)
+			want6 := append([][]string{aclEstablished}, tt.rules6...)
+			if !reflect.DeepEqual(rules4, want4) {
+				t.Errorf("ipv4 rules = %q, want %q", rules4, want4)
+			}
+			if !reflect.DeepEqual(rules6, want6) {
+				t.Errorf("ipv6 rules = %q, want %q", rules6, want6)
+			}
+		})
+	}
+}
+
+func TestApplyACLsPriorityOrder(t *testing.T) {
+	s, _, runner, user := newTestUserNetwork(t)
+	server := provisionTestServer(t, s, user, 0)
+	peer := createTestPeer(t, s, server, "10.100.0.2")
+
+	// 先创建优先级低的 deny，allow 的优先级数值更小，应排在前面
+	acls := []models.WireguardACL{
+		{ServerID: server.ID, PeerID: peer.ID, Destination: "0.0.0.0/0", Protocol: "all", Action: "deny", Priority: 200},
+		{ServerID: server.ID, PeerID: peer.ID, Destination: "192.168.1.10/32", Protocol: "tcp", Port: 445, Action: "allow", Priority: 10},
+		{ServerID: server.ID, PeerID: peer.ID, Destination: "192.168.1.20/32", Protocol: "all", Action: "allow", Priority: 200},
+	}
+	for i := range acls {
+		if err := s.db.Create(&acls[i]).Error; err != nil {
+			t.Fatalf("create acl: %v", err)
+		}
+	}
+
+	if err := s.ApplyACLs(server); err != nil {
+		t.Fatalf("ApplyACLs: %v", err)
+	}
+
+	// 相同优先级按创建顺序匹配
+	want := []string{
+		strings.Join(aclEstablished, " "),
+		"-s 10.100.0.2/32 -d 192.168.1.10/32 -p tcp --dport 445 -j RETURN",
+		"-s 10.100.0.2/32 -d 0.0.0.0/0 -j DROP",
+		"-s 10.100.0.2/32 -d 192.168.1.20/32 -j RETURN",
+	}
+	if got := runner.Rules(server.Namespace, "iptables", "filter", ACLChain); !reflect.DeepEqual(got, want) {
+		t.Errorf("%s rules = %q, want %q", ACLChain, got, want)
+	}
+}
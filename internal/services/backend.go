@@ -0,0 +1,71 @@
+package services
+
+import (
+	"net/netip"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// 网络接口类型
+const (
+	LinkVeth      = "veth"
+	LinkIfb       = "ifb"
+	LinkWireguard = "wireguard"
+)
+
+// Link 要创建的网络接口
+type Link struct {
+	Name          string
+	Kind          string // LinkVeth、LinkIfb 或 LinkWireguard
+	PeerName      string // veth 对端接口名
+	PeerNamespace string // veth 对端所在的命名空间，为空表示与本端相同
+}
+
+// Route 路由
+type Route struct {
+	Destination netip.Prefix // 目标网段，默认路由为 0.0.0.0/0 或 ::/0
+	Gateway     netip.Addr   // 网关，零值表示直连路由
+	Device      string       // 出接口
+	Table       int          // 路由表编号，0 表示主路由表
+}
+
+// PolicyRule 策略路由规则
+type PolicyRule struct {
+	Priority        int
+	Source          netip.Prefix // 源地址，零值表示所有地址
+	IPv6            bool         // 没有源地址时规则属于IPv6（有源地址时按源地址确定）
+	Table           int          // 查询的路由表编号，0 表示主路由表
+	SuppressDefault bool         // 忽略该表中的默认路由（suppress_prefixlength 0）
+}
+
+// NetworkBackend 网络命名空间、接口、路由和 WireGuard 设备的内核操作
+//
+// nsName 为空表示主机。对象已存在时返回的错误满足 errors.Is(err, os.ErrExist)，
+// 命名空间、接口、路由或规则不存在时满足 errors.Is(err, os.ErrNotExist)。
+// 生产环境使用 NewNetlinkBackend，测试使用内存中的实现
+type NetworkBackend interface {
+	CreateNamespace(name string) error
+	DeleteNamespace(name string) error
+	ListNamespaces() ([]string, error)
+
+	AddLink(nsName string, link Link) error
+	SetLinkUp(nsName, name string) error
+	SetLinkMTU(nsName, name string, mtu int) error
+	DeleteLink(nsName, name string) error
+	ListLinks(nsName string) ([]string, error)
+
+	// ReplaceAddress 为接口添加地址，地址已存在时保持不变；noDAD 跳过IPv6重复地址检测
+	ReplaceAddress(nsName, device string, address netip.Prefix, noDAD bool) error
+	AddRoute(nsName string, route Route) error
+	ReplaceRoute(nsName string, route Route) error
+	DeleteRoute(nsName string, route Route) error
+	// ListRoutes 列出路由表 table（0 表示主路由表）中经 device 的静态路由（不包括内核自动添加的直连路由）
+	ListRoutes(nsName, device string, table int) ([]Route, error)
+
+	AddPolicyRule(nsName string, rule PolicyRule) error
+	DeletePolicyRule(nsName string, rule PolicyRule) error
+	ListPolicyRules(nsName string) ([]PolicyRule, error)
+
+	ConfigureDevice(nsName, name string, cfg wgtypes.Config) error
+	Device(nsName, name string) (*wgtypes.Device, error)
+}
@@ -0,0 +1,465 @@
+//go:build linux
+
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"runtime"
+	"sort"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// netnsRunDir 命名网络命名空间的挂载目录（与 ip netns 和 netns 库一致）
+const netnsRunDir = "/run/netns"
+
+// netlinkBackend 通过 netlink 和 wgctrl 直接调用内核接口的网络后端，生产环境默认使用
+type netlinkBackend struct{}
+
+// NewNetlinkBackend 创建基于 netlink/wgctrl 的网络后端
+func NewNetlinkBackend() NetworkBackend {
+	return &netlinkBackend{}
+}
+
+// onLockedThread 在专用的 goroutine 上锁定线程执行 fn，fn 可以切换线程所在的网络命名空间
+// fn 返回后切换回原命名空间；切换失败时不解锁线程，goroutine 结束时线程随之退出，
+// 不会有其他 goroutine 被调度到处于错误命名空间的线程上
+func onLockedThread(fn func() error) error {
+	result := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+
+		origin, err := netns.Get()
+		if err != nil {
+			runtime.UnlockOSThread()
+			result <- err
+			return
+		}
+		defer origin.Close()
+
+		err = fn()
+		if setErr := netns.Set(origin); setErr != nil {
+			result <- fmt.Errorf("failed to return to the original namespace: %w", setErr)
+			return
+		}
+		runtime.UnlockOSThread()
+		result <- err
+	}()
+	return <-result
+}
+
+// inNamespace 在命名空间 nsName 内执行 fn（见 onLockedThread）
+func inNamespace(nsName string, fn func() error) error {
+	return onLockedThread(func() error {
+		target, err := openNamespace(nsName)
+		if err != nil {
+			return err
+		}
+		defer target.Close()
+
+		if err := netns.Set(target); err != nil {
+			return err
+		}
+		return fn()
+	})
+}
+
+// openNamespace 打开命名网络命名空间
+func openNamespace(name string) (netns.NsHandle, error) {
+	handle, err := netns.GetFromName(name)
+	if err != nil {
+		return handle, fmt.Errorf("network namespace %s: %w", name, err)
+	}
+	return handle, nil
+}
+
+// notExistError 对象不存在：保留内核返回的错误信息，同时满足 errors.Is(err, os.ErrNotExist)
+type notExistError struct {
+	err error
+}
+
+func (e *notExistError) Error() string {
+	return e.err.Error()
+}
+
+func (e *notExistError) Unwrap() []error {
+	return []error{e.err, os.ErrNotExist}
+}
+
+// kernelError 统一内核返回的错误：接口、路由和规则不存在时的各种错误码都满足 errors.Is(err, os.ErrNotExist)
+func kernelError(err error) error {
+	var notFound netlink.LinkNotFoundError
+	switch {
+	case err == nil, errors.Is(err, os.ErrNotExist):
+		return err
+	case errors.As(err, &notFound), errors.Is(err, syscall.ESRCH), errors.Is(err, syscall.ENODEV):
+		return &notExistError{err: err}
+	}
+	return err
+}
+
+// withHandle 在命名空间 nsName（为空表示主机）的 netlink 句柄上执行操作
+// 句柄的套接字属于创建时线程所在的命名空间，创建后可以在任意线程上使用
+func withHandle(nsName string, fn func(h *netlink.Handle) error) error {
+	var handle *netlink.Handle
+	var err error
+	if nsName == "" {
+		handle, err = netlink.NewHandle(unix.NETLINK_ROUTE)
+	} else {
+		err = inNamespace(nsName, func() error {
+			var err error
+			handle, err = netlink.NewHandle(unix.NETLINK_ROUTE)
+			return err
+		})
+	}
+	if err != nil {
+		if handle != nil {
+			handle.Close()
+		}
+		return kernelError(err)
+	}
+	defer handle.Close()
+	return kernelError(fn(handle))
+}
+
+// withLink 在命名空间内按名称查找接口并执行操作
+func withLink(nsName, name string, fn func(h *netlink.Handle, link netlink.Link) error) error {
+	return withHandle(nsName, func(h *netlink.Handle) error {
+		link, err := h.LinkByName(name)
+		if err != nil {
+			return fmt.Errorf("link %s: %w", name, kernelError(err))
+		}
+		return fn(h, link)
+	})
+}
+
+// CreateNamespace 创建命名网络命名空间，同名命名空间已存在时返回 os.ErrExist
+func (b *netlinkBackend) CreateNamespace(name string) error {
+	// NewNamed 将当前线程切换到新命名空间
+	return onLockedThread(func() error {
+		created, err := netns.NewNamed(name)
+		if err != nil {
+			return err
+		}
+		return created.Close()
+	})
+}
+
+// DeleteNamespace 删除命名网络命名空间
+func (b *netlinkBackend) DeleteNamespace(name string) error {
+	return netns.DeleteNamed(name)
+}
+
+// ListNamespaces 列出主机上的命名网络命名空间
+func (b *netlinkBackend) ListNamespaces() ([]string, error) {
+	entries, err := os.ReadDir(netnsRunDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// AddLink 创建网络接口；veth 的对端可以直接创建在另一个命名空间中
+func (b *netlinkBackend) AddLink(nsName string, link Link) error {
+	return withHandle(nsName, func(h *netlink.Handle) error {
+		attrs := netlink.LinkAttrs{Name: link.Name}
+		switch link.Kind {
+		case LinkVeth:
+			veth := &netlink.Veth{LinkAttrs: attrs, PeerName: link.PeerName}
+			if link.PeerNamespace != "" {
+				target, err := openNamespace(link.PeerNamespace)
+				if err != nil {
+					return err
+				}
+				defer target.Close()
+				veth.PeerNamespace = netlink.NsFd(int(target))
+			}
+			return h.LinkAdd(veth)
+		case LinkIfb:
+			return h.LinkAdd(&netlink.Ifb{LinkAttrs: attrs})
+		case LinkWireguard:
+			return h.LinkAdd(&netlink.Wireguard{LinkAttrs: attrs})
+		}
+		return fmt.Errorf("unsupported link type %q", link.Kind)
+	})
+}
+
+// SetLinkUp 启动网络接口
+func (b *netlinkBackend) SetLinkUp(nsName, name string) error {
+	return withLink(nsName, name, func(h *netlink.Handle, link netlink.Link) error {
+		return h.LinkSetUp(link)
+	})
+}
+
+// SetLinkMTU 修改网络接口的MTU
+func (b *netlinkBackend) SetLinkMTU(nsName, name string, mtu int) error {
+	return withLink(nsName, name, func(h *netlink.Handle, link netlink.Link) error {
+		return h.LinkSetMTU(link, mtu)
+	})
+}
+
+// DeleteLink 删除网络接口（veth对的另一端由内核一并删除）
+func (b *netlinkBackend) DeleteLink(nsName, name string) error {
+	return withLink(nsName, name, func(h *netlink.Handle, link netlink.Link) error {
+		return h.LinkDel(link)
+	})
+}
+
+// ListLinks 列出命名空间内的网络接口名称
+func (b *netlinkBackend) ListLinks(nsName string) ([]string, error) {
+	var names []string
+	err := withHandle(nsName, func(h *netlink.Handle) error {
+		links, err := h.LinkList()
+		if err != nil {
+			return err
+		}
+		for _, link := range links {
+			names = append(names, link.Attrs().Name)
+		}
+		return nil
+	})
+	return names, err
+}
+
+// ReplaceAddress 为接口添加地址，地址已存在时保持不变
+func (b *netlinkBackend) ReplaceAddress(nsName, device string, address netip.Prefix, noDAD bool) error {
+	return withLink(nsName, device, func(h *netlink.Handle, link netlink.Link) error {
+		addr := &netlink.Addr{IPNet: prefixIPNet(address)}
+		if noDAD {
+			addr.Flags = unix.IFA_F_NODAD
+		}
+		return h.AddrReplace(link, addr)
+	})
+}
+
+// AddRoute 添加静态路由，路由已存在时返回 os.ErrExist
+func (b *netlinkBackend) AddRoute(nsName string, route Route) error {
+	return withHandle(nsName, func(h *netlink.Handle) error {
+		r, err := netlinkRoute(h, route, false)
+		if err != nil {
+			return err
+		}
+		return h.RouteAdd(r)
+	})
+}
+
+// ReplaceRoute 添加或替换静态路由
+func (b *netlinkBackend) ReplaceRoute(nsName string, route Route) error {
+	return withHandle(nsName, func(h *netlink.Handle) error {
+		r, err := netlinkRoute(h, route, false)
+		if err != nil {
+			return err
+		}
+		return h.RouteReplace(r)
+	})
+}
+
+// DeleteRoute 删除路由，未指定的网关和接口不参与匹配
+func (b *netlinkBackend) DeleteRoute(nsName string, route Route) error {
+	return withHandle(nsName, func(h *netlink.Handle) error {
+		r, err := netlinkRoute(h, route, true)
+		if err != nil {
+			return err
+		}
+		return h.RouteDel(r)
+	})
+}
+
+// ListRoutes 列出路由表中经 device 的静态路由（proto boot，与 ip route add 添加的路由一致）
+func (b *netlinkBackend) ListRoutes(nsName, device string, table int) ([]Route, error) {
+	if table == 0 {
+		table = unix.RT_TABLE_MAIN
+	}
+	var routes []Route
+	err := withLink(nsName, device, func(h *netlink.Handle, link netlink.Link) error {
+		filter := &netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Table:     table,
+			Protocol:  netlink.RouteProtocol(unix.RTPROT_BOOT),
+		}
+		list, err := h.RouteListFiltered(netlink.FAMILY_ALL, filter,
+			netlink.RT_FILTER_OIF|netlink.RT_FILTER_TABLE|netlink.RT_FILTER_PROTOCOL)
+		if err != nil {
+			return err
+		}
+		for _, r := range list {
+			route := Route{Device: device, Destination: ipNetPrefix(r.Dst, r.Family)}
+			if table != unix.RT_TABLE_MAIN {
+				route.Table = table
+			}
+			if gateway, ok := netip.AddrFromSlice(r.Gw); ok {
+				route.Gateway = gateway.Unmap()
+			}
+			routes = append(routes, route)
+		}
+		return nil
+	})
+	return routes, err
+}
+
+// netlinkRoute 转换为 netlink 路由；没有网关的路由为直连路由，删除时与 iproute2 一致不限定作用域
+func netlinkRoute(h *netlink.Handle, route Route, forDelete bool) (*netlink.Route, error) {
+	r := &netlink.Route{Dst: prefixIPNet(route.Destination.Masked()), Table: route.Table}
+	if route.Gateway.IsValid() {
+		r.Gw = net.IP(route.Gateway.AsSlice())
+	}
+	switch {
+	case forDelete:
+		r.Scope = netlink.SCOPE_NOWHERE
+	case r.Gw == nil:
+		r.Scope = netlink.SCOPE_LINK
+	}
+	if !forDelete {
+		r.Protocol = netlink.RouteProtocol(unix.RTPROT_BOOT)
+	}
+	if route.Device != "" {
+		link, err := h.LinkByName(route.Device)
+		if err != nil {
+			return nil, fmt.Errorf("link %s: %w", route.Device, kernelError(err))
+		}
+		r.LinkIndex = link.Attrs().Index
+	}
+	return r, nil
+}
+
+// AddPolicyRule 添加策略路由规则
+func (b *netlinkBackend) AddPolicyRule(nsName string, rule PolicyRule) error {
+	return withHandle(nsName, func(h *netlink.Handle) error {
+		return h.RuleAdd(netlinkRule(rule))
+	})
+}
+
+// DeletePolicyRule 删除策略路由规则
+func (b *netlinkBackend) DeletePolicyRule(nsName string, rule PolicyRule) error {
+	return withHandle(nsName, func(h *netlink.Handle) error {
+		return h.RuleDel(netlinkRule(rule))
+	})
+}
+
+// ListPolicyRules 列出命名空间内的全部策略路由规则
+func (b *netlinkBackend) ListPolicyRules(nsName string) ([]PolicyRule, error) {
+	var rules []PolicyRule
+	err := withHandle(nsName, func(h *netlink.Handle) error {
+		list, err := h.RuleList(netlink.FAMILY_ALL)
+		if err != nil {
+			return err
+		}
+		for _, r := range list {
+			rule := PolicyRule{Priority: r.Priority, Table: r.Table, SuppressDefault: r.SuppressPrefixlen == 0, IPv6: r.Family == netlink.FAMILY_V6}
+			if r.Table == unix.RT_TABLE_MAIN {
+				rule.Table = 0
+			}
+			if r.Src != nil {
+				rule.Source = ipNetPrefix(r.Src, r.Family)
+			}
+			rules = append(rules, rule)
+		}
+		return nil
+	})
+	return rules, err
+}
+
+// netlinkRule 转换为 netlink 规则；没有源地址的规则按 IPv6 字段确定地址族
+func netlinkRule(rule PolicyRule) *netlink.Rule {
+	r := netlink.NewRule()
+	r.Priority = rule.Priority
+	r.Family = netlink.FAMILY_V4
+	if rule.IPv6 {
+		r.Family = netlink.FAMILY_V6
+	}
+	r.Table = unix.RT_TABLE_MAIN
+	if rule.Table != 0 {
+		r.Table = rule.Table
+	}
+	if rule.Source.IsValid() {
+		r.Src = prefixIPNet(rule.Source.Masked())
+		if rule.Source.Addr().Is6() {
+			r.Family = netlink.FAMILY_V6
+		}
+	}
+	if rule.SuppressDefault {
+		r.SuppressPrefixlen = 0
+	}
+	return r
+}
+
+// ConfigureDevice 配置命名空间内的 WireGuard 接口
+func (b *netlinkBackend) ConfigureDevice(nsName, name string, cfg wgtypes.Config) error {
+	return withWgClient(nsName, func(client *wgctrl.Client) error {
+		return client.ConfigureDevice(name, cfg)
+	})
+}
+
+// Device 读取命名空间内 WireGuard 接口的配置和peer统计
+func (b *netlinkBackend) Device(nsName, name string) (*wgtypes.Device, error) {
+	var device *wgtypes.Device
+	err := withWgClient(nsName, func(client *wgctrl.Client) error {
+		var err error
+		device, err = client.Device(name)
+		return err
+	})
+	return device, err
+}
+
+// withWgClient 创建属于命名空间 nsName（为空表示主机）的 wgctrl 客户端并执行操作
+// 客户端的 netlink 套接字属于创建时线程所在的命名空间，创建后可以在任意线程上使用
+func withWgClient(nsName string, fn func(client *wgctrl.Client) error) error {
+	var client *wgctrl.Client
+	var err error
+	if nsName == "" {
+		client, err = wgctrl.New()
+	} else {
+		err = inNamespace(nsName, func() error {
+			var err error
+			client, err = wgctrl.New()
+			return err
+		})
+	}
+	if err != nil {
+		if client != nil {
+			client.Close()
+		}
+		return kernelError(err)
+	}
+	defer client.Close()
+	return kernelError(fn(client))
+}
+
+// prefixIPNet 将 netip.Prefix 转换为 net.IPNet（保留主机位，用于接口地址）
+func prefixIPNet(prefix netip.Prefix) *net.IPNet {
+	addr := prefix.Addr()
+	return &net.IPNet{
+		IP:   net.IP(addr.AsSlice()),
+		Mask: net.CIDRMask(prefix.Bits(), addr.BitLen()),
+	}
+}
+
+// ipNetPrefix 将 net.IPNet 转换为 netip.Prefix，nil 表示该地址族的默认路由
+func ipNetPrefix(ipNet *net.IPNet, family int) netip.Prefix {
+	if ipNet == nil {
+		if family == netlink.FAMILY_V6 {
+			return netip.MustParsePrefix("::/0")
+		}
+		return netip.MustParsePrefix("0.0.0.0/0")
+	}
+	addr, _ := netip.AddrFromSlice(ipNet.IP)
+	bits, _ := ipNet.Mask.Size()
+	return netip.PrefixFrom(addr.Unmap(), bits)
+}
@@ -0,0 +1,169 @@
+//go:build linux
+
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// newTestNamespace 创建测试用的命名空间，没有权限时跳过测试
+func newTestNamespace(t *testing.T, backend NetworkBackend) string {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("netlink backend tests require root")
+	}
+	name := fmt.Sprintf("wgtest_%d", time.Now().UnixNano()%1000000)
+	if err := backend.CreateNamespace(name); err != nil {
+		t.Skipf("cannot create network namespace: %v", err)
+	}
+	t.Cleanup(func() { backend.DeleteNamespace(name) })
+	return name
+}
+
+func TestNetlinkBackendNamespaceLifecycle(t *testing.T) {
+	backend := NewNetlinkBackend()
+	nsName := newTestNamespace(t, backend)
+
+	if err := backend.CreateNamespace(nsName); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("duplicate namespace: got %v, want os.ErrExist", err)
+	}
+	names, err := backend.ListNamespaces()
+	if err != nil || !slices.Contains(names, nsName) {
+		t.Fatalf("ListNamespaces = %v, %v; want it to contain %s", names, err, nsName)
+	}
+
+	// veth 对的一端在主机，另一端直接创建在命名空间中
+	host, peer := nsName+"h", nsName+"n"
+	if err := backend.AddLink("", Link{Name: host, Kind: LinkVeth, PeerName: peer, PeerNamespace: nsName}); err != nil {
+		t.Fatalf("AddLink veth: %v", err)
+	}
+	t.Cleanup(func() { backend.DeleteLink("", host) })
+
+	links, err := backend.ListLinks(nsName)
+	if err != nil || !slices.Contains(links, peer) || !slices.Contains(links, "lo") {
+		t.Fatalf("ListLinks = %v, %v; want lo and %s", links, err, peer)
+	}
+
+	for _, step := range []func() error{
+		func() error { return backend.SetLinkUp(nsName, "lo") },
+		func() error { return backend.SetLinkUp(nsName, peer) },
+		func() error { return backend.SetLinkMTU(nsName, peer, 1400) },
+		func() error {
+			return backend.ReplaceAddress(nsName, peer, netip.MustParsePrefix("10.254.0.2/30"), false)
+		},
+		// 重复添加同一地址不报错
+		func() error {
+			return backend.ReplaceAddress(nsName, peer, netip.MustParsePrefix("10.254.0.2/30"), false)
+		},
+	} {
+		if err := step(); err != nil {
+			t.Fatalf("configure veth: %v", err)
+		}
+	}
+
+	route := Route{Destination: netip.MustParsePrefix("192.0.2.0/24"), Device: peer}
+	if err := backend.AddRoute(nsName, route); err != nil {
+		t.Fatalf("AddRoute: %v", err)
+	}
+	if err := backend.AddRoute(nsName, route); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("duplicate route: got %v, want os.ErrExist", err)
+	}
+	gateway := Route{Destination: netip.MustParsePrefix("0.0.0.0/0"), Gateway: netip.MustParseAddr("10.254.0.1"), Device: peer}
+	if err := backend.ReplaceRoute(nsName, gateway); err != nil {
+		t.Fatalf("ReplaceRoute: %v", err)
+	}
+	routes, err := backend.ListRoutes(nsName, peer, 0)
+	if err != nil {
+		t.Fatalf("ListRoutes: %v", err)
+	}
+	if !slices.Contains(routes, route) || !slices.Contains(routes, gateway) {
+		t.Fatalf("ListRoutes = %+v; want %+v and %+v", routes, route, gateway)
+	}
+	if err := backend.DeleteRoute(nsName, Route{Destination: route.Destination}); err != nil {
+		t.Fatalf("DeleteRoute: %v", err)
+	}
+	if err := backend.DeleteRoute(nsName, Route{Destination: route.Destination}); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("delete missing route: got %v, want os.ErrNotExist", err)
+	}
+
+	rule := PolicyRule{Priority: 1000, Source: netip.MustParsePrefix("10.254.1.0/24"), Table: 200}
+	if err := backend.AddPolicyRule(nsName, rule); err != nil {
+		t.Fatalf("AddPolicyRule: %v", err)
+	}
+	rules, err := backend.ListPolicyRules(nsName)
+	if err != nil || !slices.Contains(rules, rule) {
+		t.Fatalf("ListPolicyRules = %+v, %v; want %+v", rules, err, rule)
+	}
+	if err := backend.DeletePolicyRule(nsName, rule); err != nil {
+		t.Fatalf("DeletePolicyRule: %v", err)
+	}
+
+	// 删除一端后对端随之删除
+	if err := backend.DeleteLink("", host); err != nil {
+		t.Fatalf("DeleteLink: %v", err)
+	}
+	if err := backend.SetLinkUp(nsName, peer); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("veth peer after delete: got %v, want os.ErrNotExist", err)
+	}
+
+	if err := backend.DeleteNamespace(nsName); err != nil {
+		t.Fatalf("DeleteNamespace: %v", err)
+	}
+	if err := backend.SetLinkUp(nsName, "lo"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("deleted namespace: got %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestNetlinkBackendWireguardDevice(t *testing.T) {
+	backend := NewNetlinkBackend()
+	nsName := newTestNamespace(t, backend)
+
+	if err := backend.AddLink(nsName, Link{Name: "wg0", Kind: LinkWireguard}); err != nil {
+		t.Skipf("wireguard link not supported: %v", err)
+	}
+
+	serverKey, _ := wgtypes.GeneratePrivateKey()
+	peerKey, _ := wgtypes.GeneratePrivateKey()
+	port := 51999
+	cfg := wgtypes.Config{
+		PrivateKey:   &serverKey,
+		ListenPort:   &port,
+		ReplacePeers: true,
+		Peers: []wgtypes.PeerConfig{{
+			PublicKey:         peerKey.PublicKey(),
+			ReplaceAllowedIPs: true,
+			AllowedIPs:        []net.IPNet{*prefixIPNet(netip.MustParsePrefix("10.254.2.2/32"))},
+		}},
+	}
+	if err := backend.ConfigureDevice(nsName, "wg0", cfg); err != nil {
+		t.Fatalf("ConfigureDevice: %v", err)
+	}
+
+	device, err := backend.Device(nsName, "wg0")
+	if err != nil {
+		t.Fatalf("Device: %v", err)
+	}
+	if device.PublicKey != serverKey.PublicKey() || device.ListenPort != port {
+		t.Fatalf("device = %s:%d; want %s:%d", device.PublicKey, device.ListenPort, serverKey.PublicKey(), port)
+	}
+	if len(device.Peers) != 1 || device.Peers[0].PublicKey != peerKey.PublicKey() {
+		t.Fatalf("device peers = %+v; want %s", device.Peers, peerKey.PublicKey())
+	}
+	// 从未握手的peer由 deviceStats 处理为没有握手时间
+	if stats := deviceStats(device); !stats.Peers[0].LatestHandshake.IsZero() {
+		t.Fatalf("peer without handshake reported %v", stats.Peers[0].LatestHandshake)
+	}
+
+	if _, err := backend.Device(nsName, "wg1"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("missing device: got %v, want os.ErrNotExist", err)
+	}
+}
@@ -0,0 +1,53 @@
+//go:build !linux
+
+package services
+
+import (
+	"errors"
+	"net/netip"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// errUnsupportedPlatform 网络命名空间只在Linux上可用
+var errUnsupportedPlatform = errors.New("network namespaces are only supported on linux")
+
+// unsupportedBackend 非Linux平台的网络后端，所有操作都返回 errUnsupportedPlatform
+type unsupportedBackend struct{}
+
+// NewNetlinkBackend 非Linux平台没有 netlink，返回的后端所有操作都失败
+func NewNetlinkBackend() NetworkBackend {
+	return unsupportedBackend{}
+}
+
+func (unsupportedBackend) CreateNamespace(string) error         { return errUnsupportedPlatform }
+func (unsupportedBackend) DeleteNamespace(string) error         { return errUnsupportedPlatform }
+func (unsupportedBackend) ListNamespaces() ([]string, error)    { return nil, errUnsupportedPlatform }
+func (unsupportedBackend) AddLink(string, Link) error           { return errUnsupportedPlatform }
+func (unsupportedBackend) SetLinkUp(string, string) error       { return errUnsupportedPlatform }
+func (unsupportedBackend) SetLinkMTU(string, string, int) error { return errUnsupportedPlatform }
+func (unsupportedBackend) DeleteLink(string, string) error      { return errUnsupportedPlatform }
+func (unsupportedBackend) ListLinks(string) ([]string, error)   { return nil, errUnsupportedPlatform }
+
+func (unsupportedBackend) ReplaceAddress(string, string, netip.Prefix, bool) error {
+	return errUnsupportedPlatform
+}
+func (unsupportedBackend) AddRoute(string, Route) error     { return errUnsupportedPlatform }
+func (unsupportedBackend) ReplaceRoute(string, Route) error { return errUnsupportedPlatform }
+func (unsupportedBackend) DeleteRoute(string, Route) error  { return errUnsupportedPlatform }
+func (unsupportedBackend) ListRoutes(string, string, int) ([]Route, error) {
+	return nil, errUnsupportedPlatform
+}
+
+func (unsupportedBackend) AddPolicyRule(string, PolicyRule) error    { return errUnsupportedPlatform }
+func (unsupportedBackend) DeletePolicyRule(string, PolicyRule) error { return errUnsupportedPlatform }
+func (unsupportedBackend) ListPolicyRules(string) ([]PolicyRule, error) {
+	return nil, errUnsupportedPlatform
+}
+
+func (unsupportedBackend) ConfigureDevice(string, string, wgtypes.Config) error {
+	return errUnsupportedPlatform
+}
+func (unsupportedBackend) Device(string, string) (*wgtypes.Device, error) {
+	return nil, errUnsupportedPlatform
+}
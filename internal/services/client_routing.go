@@ -0,0 +1,230 @@
+package services
+
+import (
+	"cloud-platform/internal/models"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+)
+
+// privatePrefixes exclude_private 模式下不经过隧道的局域网/私有地址段
+var privatePrefixes = []netip.Prefix{
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+}
+
+// ValidateClientRouteMode 校验客户端路由模式，空字符串表示继承服务器设置
+func ValidateClientRouteMode(mode string) error {
+	switch mode {
+	case "", models.ClientRouteFull, models.ClientRouteExcludePrivate, models.ClientRouteSubnet, models.ClientRouteCustom:
+		return nil
+	}
+	return fmt.Errorf("invalid client route mode %q: must be one of full, exclude_private, subnet, custom", mode)
+}
+
+// NormalizeCIDRList 校验并规范化逗号分隔的网段列表（单个IP补全为/32或/128）
+func NormalizeCIDRList(list string) (string, error) {
+	prefixes, err := parsePrefixList(list)
+	if err != nil {
+		return "", err
+	}
+	return joinPrefixes(prefixes), nil
+}
+
+// NormalizeDNSList 校验并规范化逗号分隔的DNS服务器地址列表
+func NormalizeDNSList(list string) (string, error) {
+	var servers []string
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		addr, err := netip.ParseAddr(item)
+		if err != nil {
+			return "", fmt.Errorf("invalid DNS server %q", item)
+		}
+		servers = append(servers, addr.String())
+	}
+	return strings.Join(servers, ", "), nil
+}
+
+// ResolveClientRouting 计算peer客户端配置中的 AllowedIPs 和 DNS
+// peer未设置的项继承服务器设置，服务器也未设置DNS时使用 defaultDNS。
+// peers 为同一服务器的全部peer，其背后的路由网段在 subnet/exclude_private 模式下同样经过隧道；
+// shared 为peer经共享网络可以访问的其他用户网段（见 SharedNetworkPrefixes），同样经过隧道
+func ResolveClientRouting(server *models.WireguardServer, peer *models.WireguardPeer, peers []models.WireguardPeer, shared []netip.Prefix, defaultDNS string) (allowedIPs, dns string, err error) {
+	dns = peer.ClientDNS
+	if dns == "" {
+		dns = server.ClientDNS
+	}
+	if dns == "" {
+		dns = defaultDNS
+	}
+
+	mode, customIPs := peer.ClientRouteMode, peer.ClientAllowedIPs
+	if mode == "" {
+		mode, customIPs = server.ClientRouteModeOrDefault(), server.ClientAllowedIPs
+	}
+
+	switch mode {
+	case models.ClientRouteCustom:
+		prefixes, err := parsePrefixList(customIPs)
+		if err != nil {
+			return "", "", err
+		}
+		if len(prefixes) == 0 {
+			return "", "", fmt.Errorf("custom client route mode requires at least one CIDR")
+		}
+		return joinPrefixes(prefixes), dns, nil
+
+	case models.ClientRouteSubnet:
+		tunnel, err := tunnelPrefixes(server, peer, peers)
+		if err != nil {
+			return "", "", err
+		}
+		tunnel = dedupePrefixes(append(tunnel, shared...))
+		return joinPrefixes(tunnel), dns, nil
+
+	case models.ClientRouteExcludePrivate:
+		tunnel, err := tunnelPrefixes(server, peer, peers)
+		if err != nil {
+			return "", "", err
+		}
+		tunnel = dedupePrefixes(append(tunnel, shared...))
+		all := []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")}
+		// 私有地址段之外的全部地址，再加回用户自己的隧道网段
+		public := excludePrefixes(all, privatePrefixes)
+		return joinPrefixes(append(public, excludePrefixes(tunnel, public)...)), dns, nil
+
+	default:
+		return "0.0.0.0/0, ::/0", dns, nil
+	}
+}
+
+// tunnelPrefixes 用户的WireGuard网段（双栈时包含IPv6网段）以及其他peer背后的路由网段
+func tunnelPrefixes(server *models.WireguardServer, peer *models.WireguardPeer, peers []models.WireguardPeer) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, address := range []string{server.WgAddress, server.WgAddress6} {
+		if address == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid wireguard address %s: %v", address, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	for _, other := range peers {
+		if other.ID == peer.ID {
+			continue
+		}
+		prefixes = append(prefixes, PeerRoutedSubnets(server, &other)...)
+	}
+	return dedupePrefixes(prefixes), nil
+}
+
+// parsePrefixList 解析逗号分隔的网段列表
+func parsePrefixList(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(item)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid CIDR %q", item)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return dedupePrefixes(prefixes), nil
+}
+
+// excludePrefixes 从 base 中去掉 exclude 覆盖的地址，返回剩余地址的最小网段集合
+// 与 exclude 部分重叠的网段被一分为二后递归处理
+func excludePrefixes(base, exclude []netip.Prefix) []netip.Prefix {
+	var result []netip.Prefix
+	var walk func(prefix netip.Prefix)
+	walk = func(prefix netip.Prefix) {
+		split := false
+		for _, ex := range exclude {
+			if !ex.Overlaps(prefix) {
+				continue
+			}
+			if ex.Bits() <= prefix.Bits() {
+				// 整个网段都被排除
+				return
+			}
+			split = true
+		}
+		if !split {
+			result = append(result, prefix)
+			return
+		}
+
+		low, high := splitPrefix(prefix)
+		walk(low)
+		walk(high)
+	}
+
+	for _, prefix := range base {
+		walk(prefix.Masked())
+	}
+	return result
+}
+
+// splitPrefix 将网段平分为两个前缀长度加一的子网段
+func splitPrefix(prefix netip.Prefix) (netip.Prefix, netip.Prefix) {
+	bits := prefix.Bits() + 1
+	low := netip.PrefixFrom(prefix.Addr(), bits)
+
+	// 高半段：将第 bits 位（从1开始计数）置1
+	raw := prefix.Addr().AsSlice()
+	raw[(bits-1)/8] |= 0x80 >> ((bits - 1) % 8)
+	highAddr, _ := netip.AddrFromSlice(raw)
+	if prefix.Addr().Is4() {
+		highAddr = highAddr.Unmap()
+	}
+	return low, netip.PrefixFrom(highAddr, bits)
+}
+
+// dedupePrefixes 去重并排序（IPv4在前）
+func dedupePrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	seen := make(map[netip.Prefix]bool, len(prefixes))
+	result := make([]netip.Prefix, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		if !seen[prefix] {
+			seen[prefix] = true
+			result = append(result, prefix)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Addr().Is4() != result[j].Addr().Is4() {
+			return result[i].Addr().Is4()
+		}
+		if cmp := result[i].Addr().Compare(result[j].Addr()); cmp != 0 {
+			return cmp < 0
+		}
+		return result[i].Bits() < result[j].Bits()
+	})
+	return result
+}
+
+// joinPrefixes 将网段列表格式化为客户端配置中的 AllowedIPs
+func joinPrefixes(prefixes []netip.Prefix) string {
+	items := make([]string, 0, len(prefixes))
+	for _, prefix := range dedupePrefixes(prefixes) {
+		items = append(items, prefix.String())
+	}
+	return strings.Join(items, ", ")
+}
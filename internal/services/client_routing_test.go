@@ -0,0 +1,115 @@
+package services
+
+import (
+	"cloud-platform/internal/models"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// prefixList 解析逗号分隔的网段列表（测试用）
+func prefixList(t *testing.T, list string) []netip.Prefix {
+	t.Helper()
+	prefixes, err := parsePrefixList(list)
+	if err != nil {
+		t.Fatalf("parse %q: %v", list, err)
+	}
+	return prefixes
+}
+
+func TestSplitPrefix(t *testing.T) {
+	tests := []struct {
+		prefix    string
+		low, high string
+	}{
+		{"0.0.0.0/0", "0.0.0.0/1", "128.0.0.0/1"},
+		{"10.0.0.0/8", "10.0.0.0/9", "10.128.0.0/9"},
+		{"10.100.0.0/23", "10.100.0.0/24", "10.100.1.0/24"},
+		{"10.100.0.2/31", "10.100.0.2/32", "10.100.0.3/32"},
+		{"::/0", "::/1", "8000::/1"},
+		{"fe80::/10", "fe80::/11", "fea0::/11"},
+	}
+
+	for _, tt := range tests {
+		low, high := splitPrefix(netip.MustParsePrefix(tt.prefix))
+		if low.String() != tt.low || high.String() != tt.high {
+			t.Errorf("splitPrefix(%s) = %s, %s, want %s, %s", tt.prefix, low, high, tt.low, tt.high)
+		}
+	}
+}
+
+func TestExcludePrefixes(t *testing.T) {
+	public4 := "0.0.0.0/5, 8.0.0.0/7, 11.0.0.0/8, 12.0.0.0/6, 16.0.0.0/4, 32.0.0.0/3, 64.0.0.0/2, 128.0.0.0/3, " +
+		"160.0.0.0/5, 168.0.0.0/8, 169.0.0.0/9, 169.128.0.0/10, 169.192.0.0/11, 169.224.0.0/12, 169.240.0.0/13, " +
+		"169.248.0.0/14, 169.252.0.0/15, 169.255.0.0/16, 170.0.0.0/7, 172.0.0.0/12, 172.32.0.0/11, 172.64.0.0/10, " +
+		"172.128.0.0/9, 173.0.0.0/8, 174.0.0.0/7, 176.0.0.0/4, 192.0.0.0/9, 192.128.0.0/11, 192.160.0.0/13, " +
+		"192.169.0.0/16, 192.170.0.0/15, 192.172.0.0/14, 192.176.0.0/12, 192.192.0.0/10, 193.0.0.0/8, 194.0.0.0/7, " +
+		"196.0.0.0/6, 200.0.0.0/5, 208.0.0.0/4, 224.0.0.0/3"
+	public6 := "::/1, 8000::/2, c000::/3, e000::/4, f000::/5, f800::/6, fe00::/9, fec0::/10, ff00::/8"
+
+	tests := []struct {
+		name    string
+		base    string
+		exclude []netip.Prefix
+		want    string
+	}{
+		{"ipv4 minus private", "0.0.0.0/0", privatePrefixes, public4},
+		{"ipv6 minus private", "::/0", privatePrefixes, public6},
+		{"ipv6 minus link-local", "::/0", prefixList(t, "fe80::/10"),
+			"::/1, 8000::/2, c000::/3, e000::/4, f000::/5, f800::/6, fc00::/7, fe00::/9, fec0::/10, ff00::/8"},
+		{"link-local minus part of itself", "fe80::/10", prefixList(t, "fe80::/12"), "fe90::/12, fea0::/11"},
+		{"link-local fully excluded", "fe80::/10", privatePrefixes, ""},
+		{"unrelated family untouched", "10.100.0.0/24", prefixList(t, "::/0"), "10.100.0.0/24"},
+		{"no exclusions", "0.0.0.0/0, ::/0", nil, "0.0.0.0/0, ::/0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := joinPrefixes(excludePrefixes(prefixList(t, tt.base), tt.exclude))
+			if got != tt.want {
+				t.Errorf("excludePrefixes(%s) = %q, want %q", tt.base, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveClientRoutingExcludePrivate(t *testing.T) {
+	server := &models.WireguardServer{
+		WgAddress: "10.100.0.1/24", WgAddress6: "fd00:100::1/64", ClientRouteMode: models.ClientRouteExcludePrivate,
+	}
+	peer := &models.WireguardPeer{ID: 1, PeerAddress: "10.100.0.2"}
+
+	allowedIPs, _, err := ResolveClientRouting(server, peer, []models.WireguardPeer{*peer}, nil, "")
+	if err != nil {
+		t.Fatalf("ResolveClientRouting: %v", err)
+	}
+	got := prefixList(t, allowedIPs)
+
+	// 私有地址段中只有用户自己的隧道网段被加回
+	for _, want := range []string{"10.100.0.0/24", "fd00:100::/64", "11.0.0.0/8", "fe00::/9"} {
+		if !containsPrefix(got, netip.MustParsePrefix(want)) {
+			t.Errorf("AllowedIPs %q missing %s", allowedIPs, want)
+		}
+	}
+	for _, private := range []string{"10.0.0.1", "10.100.1.1", "192.168.1.1", "fd00:200::1", "fe80::1"} {
+		addr := netip.MustParseAddr(private)
+		for _, prefix := range got {
+			if prefix.Contains(addr) {
+				t.Errorf("AllowedIPs %q routes private address %s through %s", allowedIPs, private, prefix)
+			}
+		}
+	}
+	if strings.Contains(allowedIPs, "0.0.0.0/0") || strings.Contains(allowedIPs, "::/0") {
+		t.Errorf("AllowedIPs %q contains a default route", allowedIPs)
+	}
+}
+
+// containsPrefix 网段列表中是否有该网段
+func containsPrefix(prefixes []netip.Prefix, prefix netip.Prefix) bool {
+	for _, p := range prefixes {
+		if p == prefix {
+			return true
+		}
+	}
+	return false
+}
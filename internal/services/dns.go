@@ -0,0 +1,123 @@
+package services
+
+import (
+	"cloud-platform/internal/config"
+	"cloud-platform/internal/models"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DNSLabel 将任意文本（如peer备注）转换为合法的DNS标签：小写字母、数字和连字符，最长63个字符
+// 无法转换出任何有效字符时返回空字符串
+func DNSLabel(text string) string {
+	var b strings.Builder
+	lastHyphen := true // 去掉开头的连字符
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+			lastHyphen = false
+		case !lastHyphen:
+			b.WriteByte('-')
+			lastHyphen = true
+		}
+	}
+
+	label := strings.TrimRight(b.String(), "-")
+	if len(label) > 63 {
+		label = strings.TrimRight(label[:63], "-")
+	}
+	return label
+}
+
+// UserDNSZone 用户的域名（不带末尾的点），如 alice.vpn
+// 用户名无法转换为DNS标签时使用 UserUID
+func UserDNSZone(user *models.User, dnsCfg config.DNSConfig) string {
+	label := DNSLabel(user.Name)
+	if label == "" {
+		label = strings.ToLower(user.UserUID)
+	}
+	return label + "." + strings.Trim(strings.ToLower(dnsCfg.GetZone()), ".")
+}
+
+// BuiltinDNSServers 启用内置DNS时客户端配置中的DNS：服务器WireGuard地址和用户域名（作为搜索域）
+func BuiltinDNSServers(server *models.WireguardServer, user *models.User, dnsCfg config.DNSConfig) string {
+	return addressWithoutPrefix(server.WgAddress) + ", " + UserDNSZone(user, dnsCfg)
+}
+
+// NormalizeDNSRecord 校验并规范化自定义DNS记录：名称转为小写，类型未指定时按地址族推断
+func NormalizeDNSRecord(record *models.DNSRecord) error {
+	name := strings.Trim(strings.ToLower(strings.TrimSpace(record.Name)), ".")
+	if name == "" || len(name) > 200 {
+		return fmt.Errorf("invalid record name %q", record.Name)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || DNSLabel(label) != label {
+			return fmt.Errorf("invalid record name %q: labels may only contain letters, digits and hyphens", record.Name)
+		}
+	}
+	record.Name = name
+
+	addr, err := netip.ParseAddr(strings.TrimSpace(record.Value))
+	if err != nil {
+		return fmt.Errorf("invalid record value %q: must be an IP address", record.Value)
+	}
+	addr = addr.Unmap()
+	record.Value = addr.String()
+
+	expected := models.DNSRecordA
+	if addr.Is6() {
+		expected = models.DNSRecordAAAA
+	}
+	record.Type = strings.ToUpper(strings.TrimSpace(record.Type))
+	if record.Type == "" {
+		record.Type = expected
+	}
+	if record.Type != expected {
+		return fmt.Errorf("record type %s does not match value %s", record.Type, record.Value)
+	}
+	return nil
+}
+
+// GeneratedDNSNames 内置DNS为服务器和peer自动生成的记录
+//   - server.<用户域名>：服务器的WireGuard地址
+//   - peer-<ID>.<用户域名>：每个peer的地址
+//   - <备注>.<用户域名>：按peer备注生成（重名时追加 -<ID>）
+func GeneratedDNSNames(server *models.WireguardServer, peers []models.WireguardPeer, userZone string) []models.DNSName {
+	var names []models.DNSName
+	add := func(label, v4, v6 string) {
+		fqdn := label + "." + userZone
+		if v4 != "" {
+			names = append(names, models.DNSName{Name: fqdn, Type: models.DNSRecordA, Value: v4})
+		}
+		if v6 != "" {
+			names = append(names, models.DNSName{Name: fqdn, Type: models.DNSRecordAAAA, Value: v6})
+		}
+	}
+
+	add("server", addressWithoutPrefix(server.WgAddress), addressWithoutPrefix(server.WgAddress6))
+
+	sorted := append([]models.WireguardPeer{}, peers...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+
+	used := map[string]bool{"server": true}
+	for _, peer := range sorted {
+		idLabel := "peer-" + strconv.FormatUint(uint64(peer.ID), 10)
+		used[idLabel] = true
+		add(idLabel, peer.PeerAddress, peer.PeerAddress6)
+
+		label := DNSLabel(peer.Comment)
+		if label == "" {
+			continue
+		}
+		if used[label] {
+			label = DNSLabel(label + "-" + strconv.FormatUint(uint64(peer.ID), 10))
+		}
+		used[label] = true
+		add(label, peer.PeerAddress, peer.PeerAddress6)
+	}
+	return names
+}
@@ -0,0 +1,460 @@
+package services
+
+import (
+	"cloud-platform/internal/config"
+	"cloud-platform/internal/models"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"gorm.io/gorm"
+)
+
+const (
+	// dnsReloadInterval 从数据库重建记录索引的间隔
+	dnsReloadInterval = 30 * time.Second
+	// dnsMissReloadAge 用户区域内查询未命中时触发重新加载所需的最小索引时长，
+	// 使新增的peer和记录无需等待下一个间隔即可解析
+	dnsMissReloadAge = 2 * time.Second
+	// dnsUpstreamTimeout 每次上游查询的超时时间
+	dnsUpstreamTimeout = 3 * time.Second
+	// dnsUDPWorkers 同时处理的UDP查询数上限，超出时暂停读取，多余的数据报由内核丢弃
+	dnsUDPWorkers = 256
+)
+
+// DNSServer 所有用户命名空间共用的内置DNS解析器
+//
+// 命名空间内发往WireGuard接口地址53端口的查询被DNAT到veth对主机一侧的本服务，
+// 源地址经伪装后为命名空间的veth地址，据此识别用户：每个源地址只能看到自己的区域
+// （<user>.<zone>），其中包含自动生成的peer名称和用户的自定义记录。根区域以外的名称转发给上游解析器
+type DNSServer struct {
+	db        *gorm.DB
+	dnsCfg    config.DNSConfig
+	zone      string // 以点结尾的根区域，如 "vpn."
+	ttl       uint32
+	upstreams []string
+
+	mu       sync.RWMutex
+	views    map[netip.Addr]*dnsView // 以命名空间veth地址为键
+	loadedAt time.Time
+	reloadMu sync.Mutex
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// dnsView 一个命名空间可见的名称集合
+type dnsView struct {
+	records map[string][]netip.Addr // 以点结尾的小写FQDN -> 地址列表
+}
+
+// NewDNSServer 创建内置DNS服务器实例
+func NewDNSServer(db *gorm.DB, dnsCfg config.DNSConfig) *DNSServer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &DNSServer{
+		db:        db,
+		dnsCfg:    dnsCfg,
+		zone:      strings.Trim(strings.ToLower(dnsCfg.GetZone()), ".") + ".",
+		ttl:       uint32(dnsCfg.GetTTL()),
+		upstreams: dnsCfg.GetUpstreams(),
+		views:     make(map[netip.Addr]*dnsView),
+		ctx:       ctx,
+		cancel:    cancel,
+	}
+}
+
+// Start 监听UDP和TCP并定期刷新记录索引，直到调用 Stop
+func (s *DNSServer) Start() {
+	address := fmt.Sprintf(":%d", s.dnsCfg.GetListenPort())
+	log.Printf("Starting DNS server on %s (zone %s)", address, s.zone)
+
+	if err := s.Reload(); err != nil {
+		log.Printf("DNS: failed to load records: %v", err)
+	}
+
+	udpConn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		log.Printf("DNS: failed to listen on udp %s: %v", address, err)
+		return
+	}
+	tcpListener, err := net.Listen("tcp", address)
+	if err != nil {
+		udpConn.Close()
+		log.Printf("DNS: failed to listen on tcp %s: %v", address, err)
+		return
+	}
+	go s.serveUDP(udpConn)
+	go s.serveTCP(tcpListener)
+
+	ticker := time.NewTicker(dnsReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Reload(); err != nil {
+				log.Printf("DNS: failed to reload records: %v", err)
+			}
+		case <-s.ctx.Done():
+			udpConn.Close()
+			tcpListener.Close()
+			log.Println("DNS server stopped")
+			return
+		}
+	}
+}
+
+// Stop 停止DNS服务器
+func (s *DNSServer) Stop() {
+	log.Println("Stopping DNS server...")
+	s.cancel()
+}
+
+// Reload 从数据库重建每个命名空间的记录索引
+func (s *DNSServer) Reload() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	return s.reload()
+}
+
+// reloadIfStale 记录索引已建立超过 maxAge 时重建
+// 并发的未命中查询在等待 reloadMu 后会看到刚完成的重建而直接返回，不会逐个重复加载
+func (s *DNSServer) reloadIfStale(maxAge time.Duration) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	if s.indexAge() <= maxAge {
+		return nil
+	}
+	return s.reload()
+}
+
+// reload 重建记录索引（调用方持有 reloadMu）
+// peer只加载生成名称需要的列，避免解密每个peer的私钥和预共享密钥
+func (s *DNSServer) reload() error {
+	var servers []models.WireguardServer
+	if err := s.db.Preload("User").Find(&servers).Error; err != nil {
+		return fmt.Errorf("failed to load servers: %v", err)
+	}
+	var peers []models.WireguardPeer
+	if err := s.db.Select("id", "server_id", "comment", "peer_address", "peer_address6").Order("id").Find(&peers).Error; err != nil {
+		return fmt.Errorf("failed to load peers: %v", err)
+	}
+	var records []models.DNSRecord
+	if err := s.db.Order("id").Find(&records).Error; err != nil {
+		return fmt.Errorf("failed to load dns records: %v", err)
+	}
+
+	peersByServer := make(map[uint][]models.WireguardPeer)
+	for _, peer := range peers {
+		peersByServer[peer.ServerID] = append(peersByServer[peer.ServerID], peer)
+	}
+	recordsByServer := make(map[uint][]models.DNSRecord)
+	for _, record := range records {
+		recordsByServer[record.ServerID] = append(recordsByServer[record.ServerID], record)
+	}
+
+	views := make(map[netip.Addr]*dnsView, len(servers))
+	for i := range servers {
+		server := &servers[i]
+		nsIP, err := subnetHost(server.VethSubnet, 2)
+		if err != nil {
+			continue
+		}
+		source, err := netip.ParseAddr(addressWithoutPrefix(nsIP))
+		if err != nil {
+			continue
+		}
+
+		userZone := UserDNSZone(&server.User, s.dnsCfg)
+		view := &dnsView{records: make(map[string][]netip.Addr)}
+		for _, name := range GeneratedDNSNames(server, peersByServer[server.ID], userZone) {
+			view.add(name.Name, name.Value)
+		}
+		for _, record := range recordsByServer[server.ID] {
+			view.add(record.Name+"."+userZone, record.Value)
+		}
+		views[source] = view
+	}
+
+	s.mu.Lock()
+	s.views = views
+	s.loadedAt = time.Now()
+	s.mu.Unlock()
+	return nil
+}
+
+// add 为名称添加一个地址，忽略无法解析的值
+func (v *dnsView) add(name, value string) {
+	addr, err := netip.ParseAddr(value)
+	if err != nil {
+		return
+	}
+	fqdn := strings.ToLower(name) + "."
+	v.records[fqdn] = append(v.records[fqdn], addr.Unmap())
+}
+
+// HandleQuery 应答从 source 经 network（"udp" 或 "tcp"）收到的原始DNS查询
+// 消息无法解析、应当丢弃时返回nil
+func (s *DNSServer) HandleQuery(source netip.Addr, query []byte, network string) []byte {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil || header.Response {
+		return nil
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return s.reply(header, nil, dnsmessage.RCodeFormatError, nil)
+	}
+
+	view := s.view(source.Unmap())
+	if view == nil {
+		// 只有本后端管理的命名空间可以使用解析器
+		return s.reply(header, &question, dnsmessage.RCodeRefused, nil)
+	}
+
+	name := strings.ToLower(question.Name.String())
+	if name == s.zone || strings.HasSuffix(name, "."+s.zone) {
+		return s.answerLocal(header, question, source.Unmap(), view, name)
+	}
+
+	response, err := s.forward(query, network)
+	if err != nil {
+		log.Printf("DNS: failed to forward query for %s: %v", name, err)
+		return s.reply(header, &question, dnsmessage.RCodeServerFailure, nil)
+	}
+	return response
+}
+
+// answerLocal 按命名空间的视图应答根区域内的查询
+func (s *DNSServer) answerLocal(header dnsmessage.Header, question dnsmessage.Question, source netip.Addr, view *dnsView, name string) []byte {
+	addrs, ok := view.records[name]
+	if !ok && s.indexAge() > dnsMissReloadAge {
+		if err := s.reloadIfStale(dnsMissReloadAge); err != nil {
+			log.Printf("DNS: failed to reload records: %v", err)
+		} else if refreshed := s.view(source); refreshed != nil {
+			addrs, ok = refreshed.records[name]
+		}
+	}
+	if !ok {
+		return s.reply(header, &question, dnsmessage.RCodeNameError, nil)
+	}
+
+	var answers []netip.Addr
+	for _, addr := range addrs {
+		if (question.Type == dnsmessage.TypeA && addr.Is4()) ||
+			(question.Type == dnsmessage.TypeAAAA && addr.Is6()) ||
+			question.Type == dnsmessage.TypeALL {
+			answers = append(answers, addr)
+		}
+	}
+	// 名称存在但没有所查询类型的记录时返回空的NOERROR应答
+	return s.reply(header, &question, dnsmessage.RCodeSuccess, answers)
+}
+
+// reply 构造查询的应答消息
+func (s *DNSServer) reply(query dnsmessage.Header, question *dnsmessage.Question, rcode dnsmessage.RCode, answers []netip.Addr) []byte {
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:                 query.ID,
+		Response:           true,
+		OpCode:             query.OpCode,
+		Authoritative:      rcode == dnsmessage.RCodeSuccess || rcode == dnsmessage.RCodeNameError,
+		RecursionDesired:   query.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	builder.EnableCompression()
+
+	if question != nil {
+		if err := builder.StartQuestions(); err != nil {
+			return nil
+		}
+		if err := builder.Question(*question); err != nil {
+			return nil
+		}
+	}
+
+	if err := builder.StartAnswers(); err != nil {
+		return nil
+	}
+	for _, addr := range answers {
+		header := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: s.ttl}
+		var err error
+		if addr.Is4() {
+			err = builder.AResource(header, dnsmessage.AResource{A: addr.As4()})
+		} else {
+			err = builder.AAAAResource(header, dnsmessage.AAAAResource{AAAA: addr.As16()})
+		}
+		if err != nil {
+			return nil
+		}
+	}
+
+	message, err := builder.Finish()
+	if err != nil {
+		return nil
+	}
+	return message
+}
+
+// forward 依次将查询转发给上游解析器，返回第一个应答
+func (s *DNSServer) forward(query []byte, network string) ([]byte, error) {
+	var lastErr error
+	for _, upstream := range s.upstreams {
+		response, err := exchange(network, upstream, query)
+		if err == nil {
+			return response, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no upstream resolvers configured")
+	}
+	return nil, lastErr
+}
+
+// exchange 向一个上游解析器发送查询并读取对应的应答
+func exchange(network, upstream string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout(network, upstream, dnsUpstreamTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsUpstreamTimeout))
+
+	if network == "tcp" {
+		if err := writeTCPMessage(conn, query); err != nil {
+			return nil, err
+		}
+		return readTCPMessage(conn)
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// 忽略不属于本次查询的数据报
+		if n >= 2 && buf[0] == query[0] && buf[1] == query[1] {
+			return append([]byte{}, buf[:n]...), nil
+		}
+	}
+}
+
+// view 返回命名空间源地址对应的视图
+func (s *DNSServer) view(source netip.Addr) *dnsView {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.views[source]
+}
+
+// indexAge 返回记录索引已建立的时长
+func (s *DNSServer) indexAge() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return time.Since(s.loadedAt)
+}
+
+// serveUDP 应答数据报直到套接字关闭，同时处理的查询数不超过 dnsUDPWorkers
+func (s *DNSServer) serveUDP(conn net.PacketConn) {
+	workers := make(chan struct{}, dnsUDPWorkers)
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if s.ctx.Err() == nil {
+				log.Printf("DNS: udp read failed: %v", err)
+			}
+			return
+		}
+
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		source, _ := netip.AddrFromSlice(udpAddr.IP)
+		query := append([]byte{}, buf[:n]...)
+
+		workers <- struct{}{}
+		go func() {
+			defer func() { <-workers }()
+			if response := s.HandleQuery(source, query, "udp"); response != nil {
+				conn.WriteTo(response, addr)
+			}
+		}()
+	}
+}
+
+// serveTCP 接受连接直到监听器关闭
+func (s *DNSServer) serveTCP(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.ctx.Err() == nil {
+				log.Printf("DNS: tcp accept failed: %v", err)
+			}
+			return
+		}
+		go s.handleTCPConn(conn)
+	}
+}
+
+// handleTCPConn 应答一个连接上带长度前缀的查询
+func (s *DNSServer) handleTCPConn(conn net.Conn) {
+	defer conn.Close()
+
+	tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return
+	}
+	source, _ := netip.AddrFromSlice(tcpAddr.IP)
+
+	for {
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		query, err := readTCPMessage(conn)
+		if err != nil {
+			return
+		}
+		response := s.HandleQuery(source, query, "tcp")
+		if response == nil {
+			return
+		}
+		if err := writeTCPMessage(conn, response); err != nil {
+			return
+		}
+	}
+}
+
+// readTCPMessage 读取一条带2字节长度前缀的DNS消息
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	message := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// writeTCPMessage 写入一条带2字节长度前缀的DNS消息
+func writeTCPMessage(w io.Writer, message []byte) error {
+	framed := make([]byte, 2+len(message))
+	binary.BigEndian.PutUint16(framed, uint16(len(message)))
+	copy(framed[2:], message)
+	_, err := w.Write(framed)
+	return err
+}
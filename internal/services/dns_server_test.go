@@ -0,0 +1,331 @@
+package services
+
+import (
+	"cloud-platform/internal/config"
+	"cloud-platform/internal/models"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"gorm.io/gorm"
+)
+
+var (
+	// aliceSource/bobSource 两个用户命名空间的veth地址（查询经伪装后的源地址）
+	aliceSource = netip.MustParseAddr("10.200.0.2")
+	bobSource   = netip.MustParseAddr("10.200.0.6")
+)
+
+// newTestDNSServer 创建两个用户各有一台服务器的DNS服务器：alice 有一个peer和一条自定义记录
+func newTestDNSServer(t *testing.T, upstreams ...string) *DNSServer {
+	t.Helper()
+	db := newTestDB(t)
+
+	alice := models.User{UserUID: "alice01", Email: "alice@example.com", PasswordHash: "x", Name: "alice"}
+	bob := models.User{UserUID: "bob01", Email: "bob@example.com", PasswordHash: "x", Name: "bob"}
+	for _, user := range []*models.User{&alice, &bob} {
+		if err := db.Create(user).Error; err != nil {
+			t.Fatalf("create user: %v", err)
+		}
+	}
+
+	aliceServer := models.WireguardServer{
+		UserID: alice.ID, Namespace: "wg_alice01", WgInterface: "wg0", WgPort: 51820,
+		WgPublicKey: "alice-server-pub", WgPrivateKey: "alice-server-priv",
+		WgAddress: "10.100.0.1/24", WgAddress6: "fd00:100::1/64", VethSubnet: "10.200.0.0/30",
+	}
+	bobServer := models.WireguardServer{
+		UserID: bob.ID, Namespace: "wg_bob01", WgInterface: "wg0", WgPort: 51821,
+		WgPublicKey: "bob-server-pub", WgPrivateKey: "bob-server-priv",
+		WgAddress: "10.100.1.1/24", VethSubnet: "10.200.0.4/30",
+	}
+	for _, server := range []*models.WireguardServer{&aliceServer, &bobServer} {
+		if err := db.Create(server).Error; err != nil {
+			t.Fatalf("create server: %v", err)
+		}
+	}
+
+	peer := models.WireguardPeer{
+		ServerID: aliceServer.ID, PublicKey: "laptop-pub", PrivateKey: "laptop-priv",
+		PeerAddress: "10.100.0.2", PeerAddress6: "fd00:100::2", AllowedIPs: "10.100.0.2/32", Comment: "Laptop",
+	}
+	if err := db.Create(&peer).Error; err != nil {
+		t.Fatalf("create peer: %v", err)
+	}
+	record := models.DNSRecord{ServerID: aliceServer.ID, Name: "nas", Type: models.DNSRecordA, Value: "192.168.1.10"}
+	if err := db.Create(&record).Error; err != nil {
+		t.Fatalf("create dns record: %v", err)
+	}
+
+	server := NewDNSServer(db, config.DNSConfig{Zone: "vpn", Upstreams: upstreams})
+	if err := server.Reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	return server
+}
+
+// buildDNSQuery 构造一条单问题的DNS查询
+func buildDNSQuery(t *testing.T, id uint16, name string, qtype dnsmessage.Type) []byte {
+	t.Helper()
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	builder.StartQuestions()
+	builder.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET})
+	query, err := builder.Finish()
+	if err != nil {
+		t.Fatalf("build query: %v", err)
+	}
+	return query
+}
+
+// parseDNSResponse 解析应答，返回头部和A/AAAA记录中的地址
+func parseDNSResponse(t *testing.T, response []byte) (dnsmessage.Header, []netip.Addr) {
+	t.Helper()
+	var msg dnsmessage.Message
+	if err := msg.Unpack(response); err != nil {
+		t.Fatalf("unpack response: %v", err)
+	}
+	var addrs []netip.Addr
+	for _, answer := range msg.Answers {
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			addrs = append(addrs, netip.AddrFrom4(body.A))
+		case *dnsmessage.AAAAResource:
+			addrs = append(addrs, netip.AddrFrom16(body.AAAA))
+		}
+	}
+	return msg.Header, addrs
+}
+
+func TestDNSServerLocalNames(t *testing.T) {
+	server := newTestDNSServer(t)
+
+	tests := []struct {
+		name   string
+		source netip.Addr
+		query  string
+		qtype  dnsmessage.Type
+		rcode  dnsmessage.RCode
+		want   []string
+	}{
+		{"server A", aliceSource, "server.alice.vpn.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"10.100.0.1"}},
+		{"server AAAA", aliceSource, "server.alice.vpn.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, []string{"fd00:100::1"}},
+		{"peer by comment", aliceSource, "laptop.alice.vpn.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"10.100.0.2"}},
+		{"peer by id", aliceSource, "peer-1.alice.vpn.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, []string{"fd00:100::2"}},
+		{"case insensitive", aliceSource, "LAPTOP.Alice.VPN.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"10.100.0.2"}},
+		{"custom record", aliceSource, "nas.alice.vpn.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"192.168.1.10"}},
+		{"wrong type", aliceSource, "nas.alice.vpn.", dnsmessage.TypeAAAA, dnsmessage.RCodeSuccess, nil},
+		{"unknown name", aliceSource, "missing.alice.vpn.", dnsmessage.TypeA, dnsmessage.RCodeNameError, nil},
+		{"own zone", bobSource, "server.bob.vpn.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"10.100.1.1"}},
+		{"other user's peer", bobSource, "laptop.alice.vpn.", dnsmessage.TypeA, dnsmessage.RCodeNameError, nil},
+		{"other user's record", bobSource, "nas.alice.vpn.", dnsmessage.TypeA, dnsmessage.RCodeNameError, nil},
+		{"ipv4-mapped source", netip.AddrFrom16(aliceSource.As16()), "nas.alice.vpn.", dnsmessage.TypeA, dnsmessage.RCodeSuccess, []string{"192.168.1.10"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := server.HandleQuery(tt.source, buildDNSQuery(t, 42, tt.query, tt.qtype), "udp")
+			if response == nil {
+				t.Fatal("query was dropped")
+			}
+			header, addrs := parseDNSResponse(t, response)
+			if header.ID != 42 || !header.Response {
+				t.Errorf("header = %+v, want a response to query 42", header)
+			}
+			if header.RCode != tt.rcode {
+				t.Errorf("rcode = %v, want %v", header.RCode, tt.rcode)
+			}
+			if len(addrs) != len(tt.want) {
+				t.Fatalf("answers = %v, want %v", addrs, tt.want)
+			}
+			for i, want := range tt.want {
+				if addrs[i] != netip.MustParseAddr(want) {
+					t.Errorf("answer %d = %s, want %s", i, addrs[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestDNSServerRefusesUnknownSource(t *testing.T) {
+	server := newTestDNSServer(t)
+
+	for _, name := range []string{"server.alice.vpn.", "example.com."} {
+		response := server.HandleQuery(netip.MustParseAddr("192.0.2.1"), buildDNSQuery(t, 7, name, dnsmessage.TypeA), "udp")
+		header, addrs := parseDNSResponse(t, response)
+		if header.RCode != dnsmessage.RCodeRefused || len(addrs) != 0 {
+			t.Errorf("%s from unknown source: rcode = %v, answers = %v, want REFUSED", name, header.RCode, addrs)
+		}
+	}
+}
+
+func TestDNSServerDropsInvalidQueries(t *testing.T) {
+	server := newTestDNSServer(t)
+
+	if response := server.HandleQuery(aliceSource, []byte{0x01}, "udp"); response != nil {
+		t.Error("truncated message was answered")
+	}
+	query := buildDNSQuery(t, 7, "server.alice.vpn.", dnsmessage.TypeA)
+	query[2] |= 0x80 // QR 位：这是一条应答
+	if response := server.HandleQuery(aliceSource, query, "udp"); response != nil {
+		t.Error("response message was answered")
+	}
+}
+
+func TestDNSServerMissReloadsOnce(t *testing.T) {
+	server := newTestDNSServer(t)
+
+	var reloads int32
+	server.db.Callback().Query().After("gorm:query").Register("test:count_peer_loads", func(db *gorm.DB) {
+		if db.Statement.Table == "wireguard_peers" {
+			atomic.AddInt32(&reloads, 1)
+		}
+	})
+	server.mu.Lock()
+	server.loadedAt = time.Now().Add(-2 * dnsMissReloadAge)
+	server.mu.Unlock()
+
+	// 并发的未命中查询都在等待进行中的重建，之后只触发一次重建
+	query := buildDNSQuery(t, 7, "missing.alice.vpn.", dnsmessage.TypeA)
+	server.reloadMu.Lock()
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			server.HandleQuery(aliceSource, query, "udp")
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	server.reloadMu.Unlock()
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&reloads); got != 1 {
+		t.Errorf("reloads = %d, want 1", got)
+	}
+}
+
+// upstreamAnswer 假上游解析器对所有查询返回的地址
+var upstreamAnswer = netip.MustParseAddr("203.0.113.7")
+
+// fakeUpstreamReply 按查询构造假上游的应答
+func fakeUpstreamReply(query []byte) []byte {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return nil
+	}
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: header.ID, Response: true, RecursionAvailable: true})
+	builder.StartQuestions()
+	builder.Question(question)
+	builder.StartAnswers()
+	builder.AResource(dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 300},
+		dnsmessage.AResource{A: upstreamAnswer.As4()})
+	response, _ := builder.Finish()
+	return response
+}
+
+// startFakeUpstream 在本地随机端口启动UDP或TCP假上游，返回其地址
+func startFakeUpstream(t *testing.T, network string) string {
+	t.Helper()
+
+	if network == "udp" {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen udp: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		go func() {
+			buf := make([]byte, 65535)
+			for {
+				n, addr, err := conn.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				conn.WriteTo(fakeUpstreamReply(buf[:n]), addr)
+			}
+		}()
+		return conn.LocalAddr().String()
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen tcp: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				query, err := readTCPMessage(conn)
+				if err != nil {
+					return
+				}
+				writeTCPMessage(conn, fakeUpstreamReply(query))
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// closedAddress 返回一个当前没有监听的本地地址
+func closedAddress(t *testing.T, network string) string {
+	t.Helper()
+	if network == "udp" {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen udp: %v", err)
+		}
+		defer conn.Close()
+		return conn.LocalAddr().String()
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen tcp: %v", err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func TestDNSServerForward(t *testing.T) {
+	for _, network := range []string{"udp", "tcp"} {
+		t.Run(network, func(t *testing.T) {
+			// 第一个上游不可用时依次尝试下一个
+			server := newTestDNSServer(t, closedAddress(t, network), startFakeUpstream(t, network))
+
+			response := server.HandleQuery(aliceSource, buildDNSQuery(t, 99, "example.com.", dnsmessage.TypeA), network)
+			header, addrs := parseDNSResponse(t, response)
+			if header.ID != 99 || header.RCode != dnsmessage.RCodeSuccess {
+				t.Errorf("header = %+v, want a NOERROR response to query 99", header)
+			}
+			if len(addrs) != 1 || addrs[0] != upstreamAnswer {
+				t.Errorf("answers = %v, want [%s]", addrs, upstreamAnswer)
+			}
+		})
+	}
+}
+
+func TestDNSServerForwardUpstreamDown(t *testing.T) {
+	for _, network := range []string{"udp", "tcp"} {
+		t.Run(network, func(t *testing.T) {
+			server := newTestDNSServer(t, closedAddress(t, network))
+
+			response := server.HandleQuery(aliceSource, buildDNSQuery(t, 5, "example.com.", dnsmessage.TypeA), network)
+			header, addrs := parseDNSResponse(t, response)
+			if header.RCode != dnsmessage.RCodeServerFailure || len(addrs) != 0 {
+				t.Errorf("rcode = %v, answers = %v, want SERVFAIL", header.RCode, addrs)
+			}
+		})
+	}
+}
@@ -0,0 +1,472 @@
+package services
+
+import (
+	"cloud-platform/internal/models"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 偏差项类型
+const (
+	DriftNamespace = "namespace" // 网络命名空间
+	DriftLink      = "link"      // 网络接口（veth、WireGuard接口）
+	DriftChain     = "chain"     // 本系统维护的防火墙链
+	DriftRoute     = "route"     // 命名空间内到peer背后网段的路由
+	DriftRule      = "rule"      // 直接追加到内置链的 iptables 规则（旧版本遗留）
+)
+
+// builtinChains iptables 的内置链，旧版本的规则直接追加在这些链中
+var builtinChains = map[string]bool{
+	"INPUT": true, "OUTPUT": true, "FORWARD": true, "PREROUTING": true, "POSTROUTING": true,
+}
+
+// DriftItem 主机实际状态与数据库推导出的期望状态之间的一项差异
+type DriftItem struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"` // 所在命名空间，为空表示主机
+	Name      string `json:"name"`                // 命名空间名、接口名、链名、路由目标或规则（iptables-save 中 -A 之后的部分）
+	Device    string `json:"device,omitempty"`    // 路由的出接口
+	Table     string `json:"table,omitempty"`     // 规则所在的表，或路由所在的路由表
+	IPv6      bool   `json:"ipv6,omitempty"`      // 链和规则所属的地址族
+	ServerID  uint   `json:"server_id,omitempty"` // 关联的服务器
+}
+
+// DriftReport 网络状态偏差报告
+type DriftReport struct {
+	Firewall   string      `json:"firewall"`   // 防火墙后端
+	Servers    int         `json:"servers"`    // 检查的服务器数量
+	Missing    []DriftItem `json:"missing"`    // 应存在但缺失的资源
+	Unexpected []DriftItem `json:"unexpected"` // 存在但不属于任何记录的资源
+}
+
+// Clean 报告中没有任何偏差
+func (r *DriftReport) Clean() bool {
+	return len(r.Missing) == 0 && len(r.Unexpected) == 0
+}
+
+// DetectDrift 根据数据库中的服务器、peer和共享网络推导出主机和各命名空间内应存在的命名空间、veth、
+// WireGuard接口、防火墙链和peer路由，与实际状态对比，列出缺失和多余的资源
+// 同时列出旧版本直接追加到内置链、不再由本系统维护的 iptables 规则
+func (s *UserNetworkService) DetectDrift() (*DriftReport, error) {
+	var servers []models.WireguardServer
+	if err := s.db.Preload("User").Order("id").Find(&servers).Error; err != nil {
+		return nil, fmt.Errorf("failed to load servers: %v", err)
+	}
+	var networkIDs []uint
+	if err := s.db.Model(&models.SharedNetwork{}).Order("id").Pluck("id", &networkIDs).Error; err != nil {
+		return nil, fmt.Errorf("failed to load shared networks: %v", err)
+	}
+
+	namespaces, err := s.netnsService.ListNamespaces()
+	if err != nil {
+		return nil, err
+	}
+	hostLinks, err := s.netnsService.ListHostLinks()
+	if err != nil {
+		return nil, err
+	}
+	liveNamespaces := stringSet(namespaces)
+	liveLinks := stringSet(hostLinks)
+
+	report := &DriftReport{
+		Firewall:   s.firewall.Name(),
+		Servers:    len(servers),
+		Missing:    []DriftItem{},
+		Unexpected: []DriftItem{},
+	}
+
+	expectedNamespaces := make(map[string]bool)
+	expectedLinks := make(map[string]bool)
+	expectedHostChains := map[bool]map[string]bool{false: {}, true: {}}
+	for _, c := range s.hostChains() {
+		expectedHostChains[c.ipv6][c.chain.Name] = true
+	}
+
+	// 1. 每个服务器的命名空间、veth和命名空间内的资源
+	for i := range servers {
+		server := &servers[i]
+		expectedNamespaces[server.Namespace] = true
+		vethHost, vethNs := s.vethNames(server.User.UserUID, server.WgInterface)
+		expectedLinks[vethHost] = true
+
+		// 禁用的服务器不对外开放端口
+		if server.Enabled {
+			chain := s.hostDNATChain(server).Name
+			expectedHostChains[false][chain] = true
+			if server.WgAddress6 != "" {
+				expectedHostChains[true][chain] = true
+			}
+		}
+
+		// 命名空间不存在时其中的接口、规则和路由都随之缺失，重建即可恢复
+		if !liveNamespaces[server.Namespace] {
+			report.Missing = append(report.Missing, DriftItem{Kind: DriftNamespace, Name: server.Namespace, ServerID: server.ID})
+			continue
+		}
+		if !liveLinks[vethHost] {
+			report.Missing = append(report.Missing, DriftItem{Kind: DriftLink, Name: vethHost, ServerID: server.ID})
+		}
+		if err := s.detectServerDrift(report, server, vethNs); err != nil {
+			return nil, err
+		}
+	}
+
+	// 2. 共享网络的中转命名空间
+	for _, id := range networkIDs {
+		hubNs := SharedNamespaceName(id)
+		expectedNamespaces[hubNs] = true
+		// 连接的成员不足两个时中转命名空间不存在
+		if liveNamespaces[hubNs] {
+			if err := s.detectChainDrift(report, hubNs, false, []string{SharedNetworkChain}, 0); err != nil {
+				return nil, err
+			}
+			s.detectLegacyRules(report, hubNs)
+		}
+	}
+
+	// 3. 主机上的链和旧版本遗留的规则
+	for _, ipv6 := range []bool{false, true} {
+		var expected []string
+		for name := range expectedHostChains[ipv6] {
+			expected = append(expected, name)
+		}
+		if err := s.detectChainDrift(report, "", ipv6, expected, 0); err != nil {
+			return nil, err
+		}
+	}
+	s.detectLegacyRules(report, "")
+
+	// 4. 不属于任何服务器的veth和命名空间
+	for _, name := range hostLinks {
+		if isVethLink(name) && !expectedLinks[name] {
+			report.Unexpected = append(report.Unexpected, DriftItem{Kind: DriftLink, Name: name})
+		}
+	}
+	for _, nsName := range namespaces {
+		managed := strings.HasPrefix(nsName, namespacePrefix) || strings.HasPrefix(nsName, sharedNamespacePrefix)
+		if managed && !expectedNamespaces[nsName] {
+			report.Unexpected = append(report.Unexpected, DriftItem{Kind: DriftNamespace, Name: nsName})
+		}
+	}
+
+	// 正在创建、记录尚未提交的服务器的资源不属于偏差
+	report.Unexpected = slices.DeleteFunc(report.Unexpected, s.provisioningResources().contains)
+
+	return report, nil
+}
+
+// detectServerDrift 检查服务器命名空间内的接口、防火墙链、peer路由和遗留规则
+func (s *UserNetworkService) detectServerDrift(report *DriftReport, server *models.WireguardServer, vethNs string) error {
+	links, err := s.netnsService.ListLinks(server.Namespace)
+	if err != nil {
+		return err
+	}
+	liveLinks := stringSet(links)
+
+	expectedLinks := []string{vethNs}
+	if server.Enabled {
+		expectedLinks = append(expectedLinks, server.WgInterface)
+	}
+	for _, name := range expectedLinks {
+		if !liveLinks[name] {
+			report.Missing = append(report.Missing, DriftItem{Kind: DriftLink, Namespace: server.Namespace, Name: name, ServerID: server.ID})
+		}
+	}
+
+	chains4 := []string{NamespaceForwardChain, NamespaceNATChain, NamespaceDNSChain, ACLChain, IsolationChain, PortForwardChain, PortForwardSNATChain}
+	if err := s.detectChainDrift(report, server.Namespace, false, chains4, server.ID); err != nil {
+		return err
+	}
+	var chains6 []string
+	if server.WgAddress6 != "" {
+		chains6 = []string{NamespaceForwardChain, ACLChain, IsolationChain}
+	}
+	if err := s.detectChainDrift(report, server.Namespace, true, chains6, server.ID); err != nil {
+		return err
+	}
+
+	// peer背后网段的路由（在服务器路由表中）只在接口运行时存在（只检查IPv4路由）
+	if server.Enabled && liveLinks[server.WgInterface] {
+		peers, err := s.loadPeers(server)
+		if err != nil {
+			return err
+		}
+		expected := make(map[string]bool)
+		for _, peer := range peers {
+			for _, prefix := range PeerRoutedSubnets(server, &peer) {
+				if prefix.Addr().Is4() {
+					expected[prefix.String()] = true
+				}
+			}
+		}
+
+		table := peerRouteTable(server)
+		routes, err := s.netnsService.ListDeviceRoutes(server.Namespace, table, server.WgInterface)
+		if err != nil {
+			return err
+		}
+		// 只核对IPv4路由
+		routes = slices.DeleteFunc(routes, func(route string) bool {
+			prefix, err := netip.ParsePrefix(route)
+			return err != nil || !prefix.Addr().Is4()
+		})
+		live := stringSet(routes)
+		for _, prefix := range sortedKeys(expected) {
+			if !live[prefix] {
+				report.Missing = append(report.Missing, DriftItem{Kind: DriftRoute, Namespace: server.Namespace,
+					Name: prefix, Device: server.WgInterface, Table: table, ServerID: server.ID})
+			}
+		}
+		for _, prefix := range routes {
+			if !expected[prefix] {
+				report.Unexpected = append(report.Unexpected, DriftItem{Kind: DriftRoute, Namespace: server.Namespace,
+					Name: prefix, Device: server.WgInterface, Table: table, ServerID: server.ID})
+			}
+		}
+	}
+
+	s.detectLegacyRules(report, server.Namespace)
+	return nil
+}
+
+// detectChainDrift 对比命名空间（nsName 为空表示主机）内应存在的链和实际存在的链
+func (s *UserNetworkService) detectChainDrift(report *DriftReport, nsName string, ipv6 bool, expected []string, serverID uint) error {
+	chains, err := s.firewall.ListChains(nsName, ipv6)
+	if err != nil {
+		return err
+	}
+	live := stringSet(chains)
+	wanted := stringSet(expected)
+
+	sort.Strings(expected)
+	for _, name := range expected {
+		if !live[name] {
+			report.Missing = append(report.Missing, DriftItem{Kind: DriftChain, Namespace: nsName, Name: name, IPv6: ipv6, ServerID: serverID})
+		}
+	}
+	for _, name := range chains {
+		if !wanted[name] {
+			report.Unexpected = append(report.Unexpected, DriftItem{Kind: DriftChain, Namespace: nsName, Name: name, IPv6: ipv6, ServerID: serverID})
+		}
+	}
+	return nil
+}
+
+// detectLegacyRules 列出旧版本直接追加到内置链的 iptables/ip6tables 规则（跳转到本系统链的规则除外）
+// 命名空间完全由本系统管理，其中的所有此类规则都是遗留的；主机上只列出涉及用户veth或地址池的规则
+// iptables 不可用时跳过
+func (s *UserNetworkService) detectLegacyRules(report *DriftReport, nsName string) {
+	for _, ipv6 := range []bool{false, true} {
+		binary := "iptables"
+		if ipv6 {
+			binary = "ip6tables"
+		}
+		output, err := s.netnsService.SaveRules(binary, nsName)
+		if err != nil {
+			continue
+		}
+
+		for _, rule := range parseSavedRules(output).rules {
+			if !builtinChains[rule.chain()] || strings.HasPrefix(rule.target(), managedChainPrefix) {
+				continue
+			}
+			if nsName == "" && !s.isLegacyHostRule(rule.spec) {
+				continue
+			}
+			report.Unexpected = append(report.Unexpected, DriftItem{Kind: DriftRule, Namespace: nsName,
+				Name: strings.Join(rule.spec, " "), Table: rule.table, IPv6: ipv6})
+		}
+	}
+}
+
+// isLegacyHostRule 主机上的规则是否由旧版本为用户网络添加：匹配用户veth接口，或地址属于veth/IPv6地址池
+func (s *UserNetworkService) isLegacyHostRule(spec []string) bool {
+	var pools []netip.Prefix
+	for _, pool := range []string{s.vethPool, s.ipv6Pool} {
+		if prefix, err := netip.ParsePrefix(pool); err == nil {
+			pools = append(pools, prefix)
+		}
+	}
+
+	for i := 0; i+1 < len(spec); i++ {
+		value := spec[i+1]
+		switch spec[i] {
+		case "-i", "-o":
+			if value == "veth+" || value == "vh-+" || isVethLink(value) {
+				return true
+			}
+		case "-s", "-d", "--to-destination":
+			addr, ok := ruleAddress(value)
+			if !ok {
+				continue
+			}
+			for _, pool := range pools {
+				if pool.Contains(addr) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// ruleAddress 解析规则中的地址参数（如 10.200.0.2/30、10.200.0.2:51820、[fd00::1]:51820）
+func ruleAddress(value string) (netip.Addr, bool) {
+	if prefix, err := netip.ParsePrefix(value); err == nil {
+		return prefix.Addr(), true
+	}
+	if addrPort, err := netip.ParseAddrPort(value); err == nil {
+		return addrPort.Addr(), true
+	}
+	addr, err := netip.ParseAddr(strings.Trim(value, "[]"))
+	return addr, err == nil
+}
+
+// isVethLink 是否为本系统创建的veth接口（主机端 veth-h-*/vh-*，命名空间端 veth-ns-*/vn-*）
+// 不能只按 veth 前缀判断，主机上其他程序（如 Docker）创建的veth同样以 veth 开头
+func isVethLink(name string) bool {
+	for _, prefix := range []string{"veth-h-", "veth-ns-", "vh-", "vn-"} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// FixDrift 按报告修复偏差：先删除多余的资源，再重新应用缺失资源所属的主机规则和服务器网络环境
+// 命名空间或veth缺失的服务器整体重建，其余服务器重新应用接口、规则和peer；最后重新连接共享网络
+func (s *UserNetworkService) FixDrift(report *DriftReport) error {
+	var errs []string
+
+	// 1. 删除多余的资源；报告生成后可能有服务器刚刚创建，删除前按登记表和数据库再次确认
+	claimed, err := s.claimedResources()
+	if err != nil {
+		return fmt.Errorf("failed to load servers: %v", err)
+	}
+	for _, item := range report.Unexpected {
+		if claimed.contains(item) {
+			continue
+		}
+		if err := s.removeDriftItem(item); err != nil {
+			errs = append(errs, fmt.Sprintf("remove %s %s: %v", item.Kind, item.Name, err))
+		}
+	}
+
+	// 2. 缺失的主机规则
+	var serverIDs []uint
+	rebuild := make(map[uint]bool)
+	hostMissing := false
+	for _, item := range report.Missing {
+		if item.ServerID == 0 {
+			hostMissing = true
+			continue
+		}
+		if _, ok := rebuild[item.ServerID]; !ok {
+			serverIDs = append(serverIDs, item.ServerID)
+			rebuild[item.ServerID] = false
+		}
+		if item.Kind == DriftNamespace || (item.Kind == DriftLink && isVethLink(item.Name)) {
+			rebuild[item.ServerID] = true
+		}
+	}
+	if hostMissing {
+		if err := s.applyHostFirewall(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	// 3. 缺失资源所属的服务器
+	for _, id := range serverIDs {
+		var server models.WireguardServer
+		if err := s.db.Preload("User").First(&server, id).Error; err != nil {
+			errs = append(errs, fmt.Sprintf("server %d: %v", id, err))
+			continue
+		}
+
+		var err error
+		if rebuild[id] {
+			// veth缺失时命名空间无法修补，删除后按数据库记录重建
+			s.netnsService.DeleteNamespace(server.Namespace)
+			err = s.RebuildUserNetwork(&server, server.User.UserUID)
+		} else {
+			err = s.EnsureUserNetwork(&server, server.User.UserUID)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("server %d (%s): %v", id, server.Namespace, err))
+		}
+	}
+
+	// 4. 重建的命名空间会丢失与中转命名空间的连接
+	if len(serverIDs) > 0 || hostMissing {
+		if err := s.ApplySharedNetworks(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// removeDriftItem 删除一项多余的资源
+func (s *UserNetworkService) removeDriftItem(item DriftItem) error {
+	switch item.Kind {
+	case DriftNamespace:
+		if strings.HasPrefix(item.Name, sharedNamespacePrefix) {
+			id, err := strconv.ParseUint(strings.TrimPrefix(item.Name, sharedNamespacePrefix), 10, 32)
+			if err != nil {
+				return fmt.Errorf("invalid shared namespace name")
+			}
+			return s.DestroySharedNetwork(uint(id))
+		}
+		return s.DestroyOrphanNamespace(item.Name)
+	case DriftLink:
+		if item.Namespace == "" {
+			return s.netnsService.DeleteHostLink(item.Name)
+		}
+		return s.netnsService.DeleteLink(item.Namespace, item.Name)
+	case DriftChain:
+		chain, ok := managedFirewallChain(item.Name)
+		if !ok {
+			return fmt.Errorf("unknown chain, remove it manually")
+		}
+		return s.firewall.DeleteChain(item.Namespace, item.IPv6, chain)
+	case DriftRoute:
+		table := item.Table
+		if table == "" {
+			table = "main"
+		}
+		return s.netnsService.DeleteTableRoutes(item.Namespace, table, item.Device, item.Name)
+	case DriftRule:
+		binary := "iptables"
+		if item.IPv6 {
+			binary = "ip6tables"
+		}
+		return s.netnsService.DeleteRule(binary, item.Namespace, item.Table, strings.Fields(item.Name))
+	}
+	return fmt.Errorf("unknown drift kind %s", item.Kind)
+}
+
+// stringSet 将字符串列表转换为集合
+func stringSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		set[value] = true
+	}
+	return set
+}
+
+// sortedKeys 返回集合中按字典序排列的元素
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
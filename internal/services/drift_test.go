@@ -0,0 +1,107 @@
+package services
+
+import "testing"
+
+// hasDriftItem 偏差列表中是否有指定类型、命名空间和名称的项
+func hasDriftItem(items []DriftItem, kind, nsName, name string) bool {
+	for _, item := range items {
+		if item.Kind == kind && item.Namespace == nsName && item.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDetectDriftClean(t *testing.T) {
+	s, _, _, user := newTestUserNetwork(t)
+	provisionTestServer(t, s, user, 0)
+
+	report, err := s.DetectDrift()
+	if err != nil {
+		t.Fatalf("DetectDrift: %v", err)
+	}
+	if !report.Clean() || report.Servers != 1 {
+		t.Errorf("report for a freshly provisioned server = %+v, want clean with 1 server", report)
+	}
+}
+
+func TestDetectDriftMissing(t *testing.T) {
+	s, backend, runner, user := newTestUserNetwork(t)
+	server := provisionTestServer(t, s, user, 0)
+	vethHost, vethNs := s.vethNames(testUserUID, server.WgInterface)
+
+	// 删除命名空间内的ACL链和主机端veth（命名空间一端随之删除）
+	if _, err := runner.Run("ip", "netns", "exec", server.Namespace, "iptables", "-X", ACLChain); err != nil {
+		t.Fatalf("delete chain: %v", err)
+	}
+	if err := backend.DeleteLink("", vethHost); err != nil {
+		t.Fatalf("delete veth: %v", err)
+	}
+
+	report, err := s.DetectDrift()
+	if err != nil {
+		t.Fatalf("DetectDrift: %v", err)
+	}
+	for _, want := range []DriftItem{
+		{Kind: DriftChain, Namespace: server.Namespace, Name: ACLChain},
+		{Kind: DriftLink, Name: vethHost},
+		{Kind: DriftLink, Namespace: server.Namespace, Name: vethNs},
+	} {
+		if !hasDriftItem(report.Missing, want.Kind, want.Namespace, want.Name) {
+			t.Errorf("missing items = %+v, want %s %s/%s", report.Missing, want.Kind, want.Namespace, want.Name)
+		}
+	}
+	if len(report.Unexpected) != 0 {
+		t.Errorf("unexpected items = %+v, want none", report.Unexpected)
+	}
+
+	// 命名空间整体缺失时只报告命名空间
+	if err := backend.DeleteNamespace(server.Namespace); err != nil {
+		t.Fatalf("delete namespace: %v", err)
+	}
+	report, err = s.DetectDrift()
+	if err != nil {
+		t.Fatalf("DetectDrift: %v", err)
+	}
+	if len(report.Missing) != 1 || !hasDriftItem(report.Missing, DriftNamespace, "", server.Namespace) {
+		t.Errorf("missing items = %+v, want only namespace %s", report.Missing, server.Namespace)
+	}
+}
+
+func TestDetectDriftUnexpectedNamespace(t *testing.T) {
+	s, backend, _, user := newTestUserNetwork(t)
+	provisionTestServer(t, s, user, 0)
+
+	// 不属于任何服务器的 wg_* 命名空间和其他程序的命名空间
+	for _, nsName := range []string{"wg_stray01", "docker-ns"} {
+		if err := backend.CreateNamespace(nsName); err != nil {
+			t.Fatalf("create namespace %s: %v", nsName, err)
+		}
+	}
+
+	// 正在创建、记录尚未提交的服务器
+	provisioning, err := s.ProvisionServer(user, 1)
+	if err != nil {
+		t.Fatalf("ProvisionServer: %v", err)
+	}
+	t.Cleanup(func() { s.FinishProvisioning(provisioning) })
+
+	report, err := s.DetectDrift()
+	if err != nil {
+		t.Fatalf("DetectDrift: %v", err)
+	}
+	if !hasDriftItem(report.Unexpected, DriftNamespace, "", "wg_stray01") {
+		t.Errorf("unexpected items = %+v, want namespace wg_stray01", report.Unexpected)
+	}
+	if hasDriftItem(report.Unexpected, DriftNamespace, "", "docker-ns") {
+		t.Error("namespace not managed by the backend was reported")
+	}
+	for _, item := range report.Unexpected {
+		if item.Namespace == provisioning.Namespace || item.Name == provisioning.Namespace {
+			t.Errorf("provisioning server reported as unexpected: %+v", item)
+		}
+	}
+	if len(report.Unexpected) != 1 {
+		t.Errorf("unexpected items = %+v, want only wg_stray01", report.Unexpected)
+	}
+}
@@ -0,0 +1,171 @@
+package services
+
+import (
+	"cloud-platform/internal/models"
+	"fmt"
+	"net/netip"
+	"time"
+)
+
+const (
+	// ExitRouteTable 命名空间内出口peer使用的路由表，表中只有一条经WireGuard接口的默认路由
+	ExitRouteTable = "200"
+	// exitSuppressPriority 主路由表（忽略默认路由）的规则优先级，保证访问用户网段和veth的流量不受出口peer影响
+	exitSuppressPriority = 1000
+	// exitSourcePriority 选中peer按源地址查询出口路由表的规则优先级
+	exitSourcePriority = 1001
+
+	// ExitPeerHandshakeTimeout 出口peer超过该时间没有握手视为不可用，选中peer的外网流量回退到服务器出口
+	ExitPeerHandshakeTimeout = 3 * time.Minute
+)
+
+// loadExitRouting 加载服务器的出口peer及使用它的peer（未设置出口peer或出口peer已不存在时返回nil）
+func (s *UserNetworkService) loadExitRouting(server *models.WireguardServer) (*models.WireguardPeer, []models.WireguardPeer, error) {
+	if server.ExitPeerID == nil {
+		return nil, nil, nil
+	}
+
+	peers, err := s.loadPeers(server)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var exit *models.WireguardPeer
+	var sources []models.WireguardPeer
+	for i := range peers {
+		if peers[i].ID == *server.ExitPeerID {
+			exit = &peers[i]
+		}
+	}
+	if exit == nil {
+		return nil, nil, nil
+	}
+	for _, peer := range peers {
+		if peer.UseExitPeer && peer.ID != exit.ID {
+			sources = append(sources, peer)
+		}
+	}
+	return exit, sources, nil
+}
+
+// ApplyExitRouting 按服务器的出口peer设置应用命名空间内的策略路由
+//   - 选中peer的源地址查询 ExitRouteTable，表中的默认路由经WireGuard接口交给出口peer（其 allowed-ips 包含 0.0.0.0/0）
+//   - 主路由表中除默认路由以外的路由优先，访问用户网段、peer背后的网段和veth的流量不受影响
+//   - 出口peer握手超时时清空该表，流量回退到服务器出口（veth MASQUERADE）
+//
+// 目前只对IPv4生效
+func (s *UserNetworkService) ApplyExitRouting(server *models.WireguardServer) error {
+	exit, sources, err := s.loadExitRouting(server)
+	if err != nil {
+		return err
+	}
+
+	var addresses []string
+	if exit != nil {
+		for _, peer := range sources {
+			addresses = append(addresses, peer.PeerAddress)
+		}
+	}
+
+	if err := s.netnsService.EnsureSuppressDefaultRule(server.Namespace, exitSuppressPriority, len(addresses) > 0); err != nil {
+		return err
+	}
+	if err := s.netnsService.EnsureSourceRules(server.Namespace, ExitRouteTable, exitSourcePriority, addresses); err != nil {
+		return err
+	}
+
+	_, err = s.UpdateExitRoute(server)
+	return err
+}
+
+// UpdateExitRoute 按出口peer的握手状态设置或清空出口路由表，返回出口peer当前是否在使用
+func (s *UserNetworkService) UpdateExitRoute(server *models.WireguardServer) (bool, error) {
+	active, err := s.ExitPeerActive(server)
+	if err != nil {
+		return false, err
+	}
+
+	dev := ""
+	if active {
+		dev = server.WgInterface
+	}
+	if err := s.netnsService.SetTableDefaultRoute(server.Namespace, ExitRouteTable, dev); err != nil {
+		return false, err
+	}
+	return active, nil
+}
+
+// ExitPeerActive 出口peer是否可用：服务器已启用、设置了出口peer且有peer使用它，并且出口peer最近完成过握手
+func (s *UserNetworkService) ExitPeerActive(server *models.WireguardServer) (bool, error) {
+	if !server.Enabled {
+		return false, nil
+	}
+
+	exit, sources, err := s.loadExitRouting(server)
+	if err != nil || exit == nil || len(sources) == 0 {
+		return false, err
+	}
+
+	stats, err := s.GetPeerStats(server)
+	if err != nil {
+		// 接口未运行
+		return false, nil
+	}
+	stat, ok := stats[exit.PublicKey]
+	if !ok || stat.LatestHandshake.IsZero() {
+		return false, nil
+	}
+	return time.Since(stat.LatestHandshake) < ExitPeerHandshakeTimeout, nil
+}
+
+// exitIsolationRules 启用出口peer时互访策略（deny/pairs）需要放行的流量：
+// 选中peer经出口peer访问外网的流量同样是 wg0 -> wg0，按目标地址（用户网段和peer背后网段之外）放行，回包由连接跟踪放行
+func (s *UserNetworkService) exitIsolationRules(server *models.WireguardServer) ([][]string, error) {
+	exit, sources, err := s.loadExitRouting(server)
+	if err != nil || exit == nil || len(sources) == 0 {
+		return nil, err
+	}
+
+	peers, err := s.loadPeers(server)
+	if err != nil {
+		return nil, err
+	}
+
+	var internal []netip.Prefix
+	if prefix, err := netip.ParsePrefix(server.WgAddress); err == nil {
+		internal = append(internal, prefix.Masked())
+	}
+	for i := range peers {
+		internal = append(internal, PeerRoutedSubnets(server, &peers[i])...)
+	}
+	external := excludePrefixes([]netip.Prefix{netip.MustParsePrefix("0.0.0.0/0")}, internal)
+
+	rules := [][]string{{"-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "RETURN"}}
+	for _, peer := range sources {
+		for _, prefix := range external {
+			rules = append(rules, []string{"-s", peer.PeerAddress + "/32", "-d", prefix.String(), "-j", "RETURN"})
+		}
+	}
+	return rules, nil
+}
+
+// ValidateExitPeer 校验出口peer设置：出口peer和使用它的peer必须属于服务器，出口peer不能使用自己
+func ValidateExitPeer(exitPeerID uint, sourceIDs []uint, peers []models.WireguardPeer) error {
+	owned := make(map[uint]bool, len(peers))
+	for _, peer := range peers {
+		owned[peer.ID] = true
+	}
+
+	if !owned[exitPeerID] {
+		return fmt.Errorf("exit peer %d not found", exitPeerID)
+	}
+	for _, id := range sourceIDs {
+		if !owned[id] {
+			return fmt.Errorf("peer %d not found", id)
+		}
+		if id == exitPeerID {
+			return fmt.Errorf("exit peer cannot route its own traffic through itself")
+		}
+	}
+	return nil
+}
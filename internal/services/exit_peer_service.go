@@ -0,0 +1,126 @@
+package services
+
+import (
+	"cloud-platform/internal/models"
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ExitPeerService 监视每个已配置出口peer的握手状态
+//
+// 出口peer的最近一次握手早于 ExitPeerHandshakeTimeout 时，经由它访问互联网的peer
+// 回退到服务器自身的出口；出口peer重新握手后立即切换回来
+type ExitPeerService struct {
+	db             *gorm.DB
+	networkService *UserNetworkService
+	interval       time.Duration
+	ctx            context.Context
+	cancel         context.CancelFunc
+	mu             sync.Mutex
+	active         map[uint]bool
+}
+
+// NewExitPeerService 创建出口peer监视服务实例
+func NewExitPeerService(db *gorm.DB, networkService *UserNetworkService, interval time.Duration) *ExitPeerService {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &ExitPeerService{
+		db:             db,
+		networkService: networkService,
+		interval:       interval,
+		ctx:            ctx,
+		cancel:         cancel,
+		active:         make(map[uint]bool),
+	}
+}
+
+// Start 按间隔定期检查出口peer
+func (s *ExitPeerService) Start() {
+	log.Printf("Starting exit peer service with interval: %v", s.interval)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.CheckExitPeers()
+		case <-s.ctx.Done():
+			log.Println("Exit peer service stopped")
+			return
+		}
+	}
+}
+
+// Stop 停止出口peer监视服务
+func (s *ExitPeerService) Stop() {
+	log.Println("Stopping exit peer service...")
+	s.cancel()
+}
+
+// CheckExitPeers 根据出口peer的最近一次握手，将每台服务器的出口路由表指向出口peer或将其清空
+func (s *ExitPeerService) CheckExitPeers() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var servers []models.WireguardServer
+	if err := s.db.Where("enabled = ? AND exit_peer_id IS NOT NULL", true).Find(&servers).Error; err != nil {
+		log.Printf("Exit peer: failed to load servers: %v", err)
+		return
+	}
+
+	seen := make(map[uint]bool, len(servers))
+	for i := range servers {
+		server := &servers[i]
+
+		active, ok, err := s.updateExitRoute(server)
+		if err != nil {
+			log.Printf("Exit peer: failed to update exit route for server %d: %v", server.ID, err)
+			seen[server.ID] = true
+			continue
+		}
+		if !ok {
+			continue
+		}
+		seen[server.ID] = true
+
+		if previous, ok := s.active[server.ID]; !ok || previous != active {
+			if active {
+				log.Printf("Exit peer: server %d routes internet traffic through peer %d", server.ID, *server.ExitPeerID)
+			} else if ok {
+				log.Printf("Exit peer: peer %d on server %d is stale, falling back to the server egress", *server.ExitPeerID, server.ID)
+			}
+		}
+		s.active[server.ID] = active
+	}
+
+	// 清除已移除出口peer或已被禁用的服务器的记录
+	for id := range s.active {
+		if !seen[id] {
+			delete(s.active, id)
+		}
+	}
+}
+
+// updateExitRoute 持有服务器的锁，按重新读取的记录更新出口路由表
+// 服务器已被删除、禁用或已移除出口peer时不修改网络，ok 为 false
+func (s *ExitPeerService) updateExitRoute(server *models.WireguardServer) (active, ok bool, err error) {
+	unlock, err := s.networkService.LockServer(server)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	defer unlock()
+
+	if !server.Enabled || server.ExitPeerID == nil {
+		return false, false, nil
+	}
+	active, err = s.networkService.UpdateExitRoute(server)
+	return active, err == nil, err
+}
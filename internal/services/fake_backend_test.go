@@ -0,0 +1,627 @@
+package services
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// FakeBackend 内存中的网络后端，模拟命名空间、接口、地址、路由、策略路由和 WireGuard 设备
+//
+// 与内核一致：重复创建返回 os.ErrExist，操作不存在的对象返回 os.ErrNotExist；
+// 删除接口时其上的路由一并删除，veth 对的两端一起删除，删除命名空间时其中的接口随之删除。
+// 可以通过 FailOn 为指定操作注入错误
+type FakeBackend struct {
+	mu         sync.Mutex
+	namespaces map[string]*fakeNamespace // "" 为主机
+	failures   map[string]error
+	onDelete   func(nsName string)
+}
+
+// fakeNamespace 一个网络命名空间中的状态
+type fakeNamespace struct {
+	links  map[string]*fakeLink
+	routes []Route
+	rules  []PolicyRule
+}
+
+// fakeLink 网络接口
+type fakeLink struct {
+	kind      string
+	up        bool
+	mtu       int
+	addresses []netip.Prefix
+	peerNs    string // veth 对端所在的命名空间
+	peerName  string
+	device    *wgtypes.Device // WireGuard 接口的状态
+}
+
+// NewFakeBackend 创建只有主机命名空间的内存网络后端
+func NewFakeBackend() *FakeBackend {
+	return &FakeBackend{
+		namespaces: map[string]*fakeNamespace{"": newFakeNamespace()},
+		failures:   make(map[string]error),
+	}
+}
+
+// NewFakeNetwork 创建相互关联的内存网络后端和命令执行器：
+// ip netns exec 只能进入后端中存在的命名空间，删除命名空间时其中的 iptables 规则一并删除
+func NewFakeNetwork() (*FakeBackend, *FakeRunner) {
+	backend := NewFakeBackend()
+	runner := NewFakeRunner()
+	runner.namespaceExists = backend.HasNamespace
+	backend.onDelete = runner.ForgetNamespace
+	return backend, runner
+}
+
+func newFakeNamespace() *fakeNamespace {
+	return &fakeNamespace{links: map[string]*fakeLink{"lo": {kind: "loopback"}}}
+}
+
+// FailOn 使操作 operation 返回 err，operation 的格式为 "<方法名> <命名空间>/<名称>"，
+// 如 "AddLink wg_a1b2c3d4/wg0"、"DeleteLink wg_a1b2c3d4/wg0"、"CreateNamespace /wg_a1b2c3d4"；err 为nil时恢复正常
+func (b *FakeBackend) FailOn(operation string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		delete(b.failures, operation)
+		return
+	}
+	b.failures[operation] = err
+}
+
+// HasNamespace 检查命名空间是否存在
+func (b *FakeBackend) HasNamespace(nsName string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.namespaces[nsName]
+	return ok && nsName != ""
+}
+
+// Running 检查命名空间中的 WireGuard 接口是否存在且已启动
+func (b *FakeBackend) Running(nsName, name string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ns, ok := b.namespaces[nsName]
+	if !ok {
+		return false
+	}
+	link, ok := ns.links[name]
+	return ok && link.device != nil && link.up
+}
+
+// Peers 返回 WireGuard 接口上的peer（公钥 -> 逗号分隔的 allowed-ips）
+func (b *FakeBackend) Peers(nsName, name string) map[string]string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	peers := make(map[string]string)
+	ns, ok := b.namespaces[nsName]
+	if !ok || ns.links[name] == nil || ns.links[name].device == nil {
+		return peers
+	}
+	for _, peer := range ns.links[name].device.Peers {
+		allowedIPs := make([]string, 0, len(peer.AllowedIPs))
+		for _, prefix := range peer.AllowedIPs {
+			allowedIPs = append(allowedIPs, prefix.String())
+		}
+		peers[peer.PublicKey.String()] = strings.Join(allowedIPs, ",")
+	}
+	return peers
+}
+
+// SetHandshake 模拟peer在 at 时刻完成握手
+func (b *FakeBackend) SetHandshake(nsName, name, publicKey string, at time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	link := b.namespaces[nsName].links[name]
+	for i := range link.device.Peers {
+		if link.device.Peers[i].PublicKey.String() == publicKey {
+			link.device.Peers[i].LastHandshakeTime = at
+		}
+	}
+}
+
+// Routes 返回命名空间中的全部路由
+func (b *FakeBackend) Routes(nsName string) []Route {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]Route{}, b.namespaces[nsName].routes...)
+}
+
+// Rules 返回命名空间中的全部策略路由规则
+func (b *FakeBackend) Rules(nsName string) []PolicyRule {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]PolicyRule{}, b.namespaces[nsName].rules...)
+}
+
+// Addresses 返回接口上的地址
+func (b *FakeBackend) Addresses(nsName, name string) []netip.Prefix {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]netip.Prefix{}, b.namespaces[nsName].links[name].addresses...)
+}
+
+// begin 加锁并检查注入的错误；返回错误时已解锁
+func (b *FakeBackend) begin(method, nsName, name string) error {
+	b.mu.Lock()
+	if err, ok := b.failures[fmt.Sprintf("%s %s/%s", method, nsName, name)]; ok {
+		b.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// namespace 查找命名空间（调用方需持有锁）
+func (b *FakeBackend) namespace(nsName string) (*fakeNamespace, error) {
+	ns, ok := b.namespaces[nsName]
+	if !ok {
+		return nil, fmt.Errorf("network namespace %s: %w", nsName, os.ErrNotExist)
+	}
+	return ns, nil
+}
+
+// link 查找接口（调用方需持有锁）
+func (b *FakeBackend) link(nsName, name string) (*fakeNamespace, *fakeLink, error) {
+	ns, err := b.namespace(nsName)
+	if err != nil {
+		return nil, nil, err
+	}
+	link, ok := ns.links[name]
+	if !ok {
+		return nil, nil, fmt.Errorf("link %s: %w", name, os.ErrNotExist)
+	}
+	return ns, link, nil
+}
+
+func (b *FakeBackend) CreateNamespace(name string) error {
+	if err := b.begin("CreateNamespace", "", name); err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+
+	if _, ok := b.namespaces[name]; ok {
+		return fmt.Errorf("network namespace %s: %w", name, os.ErrExist)
+	}
+	b.namespaces[name] = newFakeNamespace()
+	return nil
+}
+
+func (b *FakeBackend) DeleteNamespace(name string) error {
+	if err := b.begin("DeleteNamespace", "", name); err != nil {
+		return err
+	}
+	ns, err := b.namespace(name)
+	if err != nil || name == "" {
+		b.mu.Unlock()
+		return err
+	}
+	for linkName := range ns.links {
+		b.removeLink(name, linkName)
+	}
+	delete(b.namespaces, name)
+	onDelete := b.onDelete
+	b.mu.Unlock()
+
+	if onDelete != nil {
+		onDelete(name)
+	}
+	return nil
+}
+
+func (b *FakeBackend) ListNamespaces() ([]string, error) {
+	if err := b.begin("ListNamespaces", "", ""); err != nil {
+		return nil, err
+	}
+	defer b.mu.Unlock()
+
+	var names []string
+	for name := range b.namespaces {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (b *FakeBackend) AddLink(nsName string, link Link) error {
+	if err := b.begin("AddLink", nsName, link.Name); err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+
+	ns, err := b.namespace(nsName)
+	if err != nil {
+		return err
+	}
+	if _, ok := ns.links[link.Name]; ok {
+		return fmt.Errorf("link %s: %w", link.Name, os.ErrExist)
+	}
+
+	created := &fakeLink{kind: link.Kind, mtu: 1500}
+	switch link.Kind {
+	case LinkVeth:
+		peerNs := link.PeerNamespace
+		if peerNs == "" {
+			peerNs = nsName
+		}
+		peerNamespace, err := b.namespace(peerNs)
+		if err != nil {
+			return err
+		}
+		if _, ok := peerNamespace.links[link.PeerName]; ok {
+			return fmt.Errorf("link %s: %w", link.PeerName, os.ErrExist)
+		}
+		created.peerNs, created.peerName = peerNs, link.PeerName
+		peerNamespace.links[link.PeerName] = &fakeLink{kind: LinkVeth, mtu: 1500, peerNs: nsName, peerName: link.Name}
+	case LinkWireguard:
+		created.device = &wgtypes.Device{Name: link.Name, Type: wgtypes.LinuxKernel}
+	case LinkIfb:
+	default:
+		return fmt.Errorf("unsupported link type %q", link.Kind)
+	}
+	ns.links[link.Name] = created
+	return nil
+}
+
+func (b *FakeBackend) SetLinkUp(nsName, name string) error {
+	if err := b.begin("SetLinkUp", nsName, name); err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+
+	_, link, err := b.link(nsName, name)
+	if err != nil {
+		return err
+	}
+	link.up = true
+	return nil
+}
+
+func (b *FakeBackend) SetLinkMTU(nsName, name string, mtu int) error {
+	if err := b.begin("SetLinkMTU", nsName, name); err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+
+	_, link, err := b.link(nsName, name)
+	if err != nil {
+		return err
+	}
+	link.mtu = mtu
+	return nil
+}
+
+func (b *FakeBackend) DeleteLink(nsName, name string) error {
+	if err := b.begin("DeleteLink", nsName, name); err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+
+	if _, _, err := b.link(nsName, name); err != nil {
+		return err
+	}
+	b.removeLink(nsName, name)
+	return nil
+}
+
+// removeLink 删除接口及其上的路由，veth 的对端随之删除（调用方需持有锁）
+func (b *FakeBackend) removeLink(nsName, name string) {
+	ns := b.namespaces[nsName]
+	link, ok := ns.links[name]
+	if !ok {
+		return
+	}
+	delete(ns.links, name)
+
+	routes := ns.routes[:0]
+	for _, route := range ns.routes {
+		if route.Device != name {
+			routes = append(routes, route)
+		}
+	}
+	ns.routes = routes
+
+	if link.kind == LinkVeth && link.peerName != "" {
+		if _, ok := b.namespaces[link.peerNs]; ok {
+			b.removeLink(link.peerNs, link.peerName)
+		}
+	}
+}
+
+func (b *FakeBackend) ListLinks(nsName string) ([]string, error) {
+	if err := b.begin("ListLinks", nsName, ""); err != nil {
+		return nil, err
+	}
+	defer b.mu.Unlock()
+
+	ns, err := b.namespace(nsName)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(ns.links))
+	for name := range ns.links {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (b *FakeBackend) ReplaceAddress(nsName, device string, address netip.Prefix, noDAD bool) error {
+	if err := b.begin("ReplaceAddress", nsName, device); err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+
+	_, link, err := b.link(nsName, device)
+	if err != nil {
+		return err
+	}
+	for _, existing := range link.addresses {
+		if existing == address {
+			return nil
+		}
+	}
+	link.addresses = append(link.addresses, address)
+	return nil
+}
+
+// findRoute 按目标网段和路由表查找路由，device 不为空时还要求出接口一致（调用方需持有锁）
+func (ns *fakeNamespace) findRoute(route Route) int {
+	for i, existing := range ns.routes {
+		if existing.Destination == route.Destination && existing.Table == route.Table &&
+			(route.Device == "" || existing.Device == route.Device) {
+			return i
+		}
+	}
+	return -1
+}
+
+// checkRoute 校验路由的出接口存在，并规范化目标网段（调用方需持有锁）
+func (b *FakeBackend) checkRoute(nsName string, route *Route) (*fakeNamespace, error) {
+	ns, err := b.namespace(nsName)
+	if err != nil {
+		return nil, err
+	}
+	if route.Device != "" {
+		if _, ok := ns.links[route.Device]; !ok {
+			return nil, fmt.Errorf("link %s: %w", route.Device, os.ErrNotExist)
+		}
+	}
+	route.Destination = route.Destination.Masked()
+	return ns, nil
+}
+
+func (b *FakeBackend) AddRoute(nsName string, route Route) error {
+	if err := b.begin("AddRoute", nsName, route.Destination.String()); err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+
+	ns, err := b.checkRoute(nsName, &route)
+	if err != nil {
+		return err
+	}
+	if ns.findRoute(Route{Destination: route.Destination, Table: route.Table}) >= 0 {
+		return fmt.Errorf("route %s: %w", route.Destination, os.ErrExist)
+	}
+	ns.routes = append(ns.routes, route)
+	return nil
+}
+
+func (b *FakeBackend) ReplaceRoute(nsName string, route Route) error {
+	if err := b.begin("ReplaceRoute", nsName, route.Destination.String()); err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+
+	ns, err := b.checkRoute(nsName, &route)
+	if err != nil {
+		return err
+	}
+	if i := ns.findRoute(Route{Destination: route.Destination, Table: route.Table}); i >= 0 {
+		ns.routes[i] = route
+		return nil
+	}
+	ns.routes = append(ns.routes, route)
+	return nil
+}
+
+func (b *FakeBackend) DeleteRoute(nsName string, route Route) error {
+	if err := b.begin("DeleteRoute", nsName, route.Destination.String()); err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+
+	ns, err := b.checkRoute(nsName, &route)
+	if err != nil {
+		return err
+	}
+	i := ns.findRoute(route)
+	if i < 0 {
+		return fmt.Errorf("route %s: %w", route.Destination, os.ErrNotExist)
+	}
+	ns.routes = append(ns.routes[:i], ns.routes[i+1:]...)
+	return nil
+}
+
+func (b *FakeBackend) ListRoutes(nsName, device string, table int) ([]Route, error) {
+	if err := b.begin("ListRoutes", nsName, device); err != nil {
+		return nil, err
+	}
+	defer b.mu.Unlock()
+
+	ns, err := b.namespace(nsName)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := ns.links[device]; !ok {
+		return nil, fmt.Errorf("link %s: %w", device, os.ErrNotExist)
+	}
+	var routes []Route
+	for _, route := range ns.routes {
+		if route.Device == device && route.Table == table {
+			routes = append(routes, route)
+		}
+	}
+	return routes, nil
+}
+
+func (b *FakeBackend) AddPolicyRule(nsName string, rule PolicyRule) error {
+	if err := b.begin("AddPolicyRule", nsName, ""); err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+
+	ns, err := b.namespace(nsName)
+	if err != nil {
+		return err
+	}
+	for _, existing := range ns.rules {
+		if existing == rule {
+			return fmt.Errorf("rule %d: %w", rule.Priority, os.ErrExist)
+		}
+	}
+	ns.rules = append(ns.rules, rule)
+	return nil
+}
+
+func (b *FakeBackend) DeletePolicyRule(nsName string, rule PolicyRule) error {
+	if err := b.begin("DeletePolicyRule", nsName, ""); err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+
+	ns, err := b.namespace(nsName)
+	if err != nil {
+		return err
+	}
+	for i, existing := range ns.rules {
+		if existing == rule {
+			ns.rules = append(ns.rules[:i], ns.rules[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("rule %d: %w", rule.Priority, os.ErrNotExist)
+}
+
+func (b *FakeBackend) ListPolicyRules(nsName string) ([]PolicyRule, error) {
+	if err := b.begin("ListPolicyRules", nsName, ""); err != nil {
+		return nil, err
+	}
+	defer b.mu.Unlock()
+
+	ns, err := b.namespace(nsName)
+	if err != nil {
+		return nil, err
+	}
+	return append([]PolicyRule{}, ns.rules...), nil
+}
+
+// wireguardLink 查找 WireGuard 接口（调用方需持有锁）
+func (b *FakeBackend) wireguardLink(nsName, name string) (*fakeLink, error) {
+	_, link, err := b.link(nsName, name)
+	if err != nil {
+		return nil, err
+	}
+	if link.device == nil {
+		return nil, fmt.Errorf("link %s is not a wireguard interface: %w", name, os.ErrNotExist)
+	}
+	return link, nil
+}
+
+func (b *FakeBackend) ConfigureDevice(nsName, name string, cfg wgtypes.Config) error {
+	if err := b.begin("ConfigureDevice", nsName, name); err != nil {
+		return err
+	}
+	defer b.mu.Unlock()
+
+	link, err := b.wireguardLink(nsName, name)
+	if err != nil {
+		return err
+	}
+	device := link.device
+
+	if cfg.PrivateKey != nil {
+		device.PrivateKey = *cfg.PrivateKey
+		device.PublicKey = cfg.PrivateKey.PublicKey()
+	}
+	if cfg.ListenPort != nil {
+		device.ListenPort = *cfg.ListenPort
+	}
+	if cfg.FirewallMark != nil {
+		device.FirewallMark = *cfg.FirewallMark
+	}
+	if cfg.ReplacePeers {
+		device.Peers = nil
+	}
+
+	for _, peerConfig := range cfg.Peers {
+		index := -1
+		for i, peer := range device.Peers {
+			if peer.PublicKey == peerConfig.PublicKey {
+				index = i
+				break
+			}
+		}
+		if peerConfig.Remove {
+			if index >= 0 {
+				device.Peers = append(device.Peers[:index], device.Peers[index+1:]...)
+			}
+			continue
+		}
+		if index < 0 {
+			if peerConfig.UpdateOnly {
+				continue
+			}
+			device.Peers = append(device.Peers, wgtypes.Peer{PublicKey: peerConfig.PublicKey})
+			index = len(device.Peers) - 1
+		}
+
+		peer := &device.Peers[index]
+		if peerConfig.PresharedKey != nil {
+			peer.PresharedKey = *peerConfig.PresharedKey
+		}
+		if peerConfig.Endpoint != nil {
+			peer.Endpoint = peerConfig.Endpoint
+		}
+		if peerConfig.PersistentKeepaliveInterval != nil {
+			peer.PersistentKeepaliveInterval = *peerConfig.PersistentKeepaliveInterval
+		}
+		if peerConfig.ReplaceAllowedIPs {
+			peer.AllowedIPs = nil
+		}
+		peer.AllowedIPs = append(peer.AllowedIPs, peerConfig.AllowedIPs...)
+	}
+	return nil
+}
+
+func (b *FakeBackend) Device(nsName, name string) (*wgtypes.Device, error) {
+	if err := b.begin("Device", nsName, name); err != nil {
+		return nil, err
+	}
+	defer b.mu.Unlock()
+
+	link, err := b.wireguardLink(nsName, name)
+	if err != nil {
+		return nil, err
+	}
+
+	device := *link.device
+	device.Peers = make([]wgtypes.Peer, len(link.device.Peers))
+	for i, peer := range link.device.Peers {
+		peer.AllowedIPs = append([]net.IPNet{}, peer.AllowedIPs...)
+		device.Peers[i] = peer
+	}
+	return &device, nil
+}
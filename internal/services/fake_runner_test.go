@@ -0,0 +1,259 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// FakeRunner 内存中的命令执行器，用于在没有 root 权限的环境下测试网络生命周期
+//
+// 命名空间、接口、路由和 WireGuard 设备由 FakeBackend 模拟，FakeRunner 只模拟仍通过命令执行的部分：
+//   - ip netns exec（与 FakeBackend 关联时检查命名空间是否存在，见 NewFakeNetwork）
+//   - iptables/ip6tables 的 -C/-A/-I/-D/-F/-X（规则按命名空间、表、链分别记录）
+//   - iptables-restore/ip6tables-restore --noflush（替换声明的链）、iptables-save/ip6tables-save
+//
+// 其余命令（如 sysctl、tc、nft）默认执行成功，可以通过 Handle 注册自定义行为或注入错误
+type FakeRunner struct {
+	mu              sync.Mutex
+	calls           [][]string
+	handlers        map[string]FakeHandler
+	rules           map[string][]string // iptables 规则，键为 "命名空间|程序|表|链"
+	namespaceExists func(nsName string) bool
+}
+
+// FakeHandler 自定义命令处理函数，args 为完整的命令行（包含命令名）
+type FakeHandler func(args []string, input []byte) ([]byte, error)
+
+// NewFakeRunner 创建内存命令执行器，未与 FakeBackend 关联时 ip netns exec 不检查命名空间
+func NewFakeRunner() *FakeRunner {
+	return &FakeRunner{
+		handlers: make(map[string]FakeHandler),
+		rules:    make(map[string][]string),
+	}
+}
+
+// Handle 为以 prefix 开头的命令行（空格拼接）注册处理函数，优先于内置模拟
+// 多个前缀同时匹配时使用最长的前缀
+func (r *FakeRunner) Handle(prefix string, handler FakeHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.handlers[prefix] = handler
+}
+
+// Calls 返回已执行命令的副本
+func (r *FakeRunner) Calls() [][]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	calls := make([][]string, len(r.calls))
+	for i, call := range r.calls {
+		calls[i] = append([]string{}, call...)
+	}
+	return calls
+}
+
+// Rules 返回指定命名空间（空字符串表示主机）中某条链上的规则
+func (r *FakeRunner) Rules(nsName, binary, table, chain string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.rules[ruleKey(nsName, binary, table, chain)]...)
+}
+
+// Run 执行命令，返回合并后的输出
+func (r *FakeRunner) Run(name string, args ...string) ([]byte, error) {
+	return r.execute(nil, append([]string{name}, args...))
+}
+
+// RunWithInput 执行命令并提供标准输入
+func (r *FakeRunner) RunWithInput(input []byte, name string, args ...string) ([]byte, error) {
+	return r.execute(input, append([]string{name}, args...))
+}
+
+// execute 记录并分发命令
+func (r *FakeRunner) execute(input []byte, argv []string) ([]byte, error) {
+	r.mu.Lock()
+	r.calls = append(r.calls, argv)
+	handler := r.matchHandler(argv)
+	r.mu.Unlock()
+
+	if handler != nil {
+		return handler(argv, input)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.simulate("", argv, input)
+}
+
+// matchHandler 查找最长前缀匹配的自定义处理函数（调用方需持有锁）
+func (r *FakeRunner) matchHandler(argv []string) FakeHandler {
+	line := strings.Join(argv, " ")
+
+	var matched FakeHandler
+	matchedLen := -1
+	for prefix, handler := range r.handlers {
+		if strings.HasPrefix(line, prefix) && len(prefix) > matchedLen {
+			matched = handler
+			matchedLen = len(prefix)
+		}
+	}
+	return matched
+}
+
+// simulate 在 nsName 中模拟执行命令（调用方需持有锁）
+func (r *FakeRunner) simulate(nsName string, argv []string, input []byte) ([]byte, error) {
+	switch argv[0] {
+	case "ip":
+		if len(argv) >= 4 && argv[1] == "netns" && argv[2] == "exec" {
+			if r.namespaceExists != nil && !r.namespaceExists(argv[3]) {
+				return []byte(fmt.Sprintf("Cannot open network namespace \"%s\": No such file or directory", argv[3])), fmt.Errorf("exit status 1")
+			}
+			if len(argv) == 4 {
+				return nil, nil
+			}
+			return r.simulate(argv[3], argv[4:], input)
+		}
+		return nil, nil
+	case "iptables", "ip6tables":
+		return r.simulateIptables(nsName, argv[0], argv[1:])
+	case "iptables-restore", "ip6tables-restore":
+		return r.simulateIptablesRestore(nsName, strings.TrimSuffix(argv[0], "-restore"), input)
+	case "iptables-save", "ip6tables-save":
+		return []byte(r.simulateIptablesSave(nsName, strings.TrimSuffix(argv[0], "-save"))), nil
+	default:
+		return nil, nil
+	}
+}
+
+// simulateIptables 模拟 iptables/ip6tables 的 -C/-A/-I/-D/-F/-X
+func (r *FakeRunner) simulateIptables(nsName, binary string, args []string) ([]byte, error) {
+	table := "filter"
+	if len(args) >= 2 && args[0] == "-t" {
+		table = args[1]
+		args = args[2:]
+	}
+	if len(args) < 2 {
+		return nil, nil
+	}
+
+	key := ruleKey(nsName, binary, table, args[1])
+	rule := strings.Join(args[2:], " ")
+	index := -1
+	for i, existing := range r.rules[key] {
+		if existing == rule {
+			index = i
+			break
+		}
+	}
+
+	switch args[0] {
+	case "-C":
+		if index < 0 {
+			return []byte("iptables: Bad rule (does a matching rule exist in that chain?)."), fmt.Errorf("exit status 1")
+		}
+	case "-A":
+		r.rules[key] = append(r.rules[key], rule)
+	case "-I":
+		// 仅支持插入到链首（-I <链> [1] <规则>）
+		if len(args) > 2 && args[2] == "1" {
+			rule = strings.Join(args[3:], " ")
+		}
+		r.rules[key] = append([]string{rule}, r.rules[key]...)
+	case "-D":
+		if index < 0 {
+			return []byte("iptables: Bad rule (does a matching rule exist in that chain?)."), fmt.Errorf("exit status 1")
+		}
+		r.rules[key] = append(r.rules[key][:index], r.rules[key][index+1:]...)
+	case "-F":
+		if _, ok := r.rules[key]; ok {
+			r.rules[key] = nil
+		}
+	case "-X":
+		if _, ok := r.rules[key]; !ok {
+			return []byte("iptables: No chain/target/match by that name."), fmt.Errorf("exit status 1")
+		}
+		delete(r.rules, key)
+	}
+	return nil, nil
+}
+
+// simulateIptablesRestore 模拟 iptables-restore --noflush：清空输入中声明的链并按顺序追加规则
+func (r *FakeRunner) simulateIptablesRestore(nsName, binary string, input []byte) ([]byte, error) {
+	table := "filter"
+	scanner := bufio.NewScanner(bytes.NewReader(input))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "*"):
+			table = strings.TrimPrefix(line, "*")
+		case strings.HasPrefix(line, ":"):
+			chain := strings.Fields(strings.TrimPrefix(line, ":"))[0]
+			r.rules[ruleKey(nsName, binary, table, chain)] = nil
+		case strings.HasPrefix(line, "-A "):
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				return []byte(fmt.Sprintf("%s-restore: line failed: %s", binary, line)), fmt.Errorf("exit status 1")
+			}
+			key := ruleKey(nsName, binary, table, fields[1])
+			r.rules[key] = append(r.rules[key], strings.Join(fields[2:], " "))
+		}
+	}
+	return nil, nil
+}
+
+// simulateIptablesSave 按 iptables-save 的格式输出命名空间中的全部链和规则（调用方需持有锁）
+func (r *FakeRunner) simulateIptablesSave(nsName, binary string) string {
+	tables := make(map[string][]string)
+	prefix := nsName + "|" + binary + "|"
+	for key := range r.rules {
+		if rest, ok := strings.CutPrefix(key, prefix); ok {
+			table, chain, _ := strings.Cut(rest, "|")
+			tables[table] = append(tables[table], chain)
+		}
+	}
+
+	var names []string
+	for table := range tables {
+		names = append(names, table)
+	}
+	sort.Strings(names)
+
+	var out strings.Builder
+	for _, table := range names {
+		chains := tables[table]
+		sort.Strings(chains)
+		fmt.Fprintf(&out, "*%s\n", table)
+		for _, chain := range chains {
+			fmt.Fprintf(&out, ":%s - [0:0]\n", chain)
+		}
+		for _, chain := range chains {
+			for _, rule := range r.rules[ruleKey(nsName, binary, table, chain)] {
+				fmt.Fprintf(&out, "-A %s %s\n", chain, rule)
+			}
+		}
+		out.WriteString("COMMIT\n")
+	}
+	return out.String()
+}
+
+// ForgetNamespace 删除命名空间中的全部规则（命名空间被删除时由 FakeBackend 调用）
+func (r *FakeRunner) ForgetNamespace(nsName string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	prefix := nsName + "|"
+	for key := range r.rules {
+		if strings.HasPrefix(key, prefix) {
+			delete(r.rules, key)
+		}
+	}
+}
+
+// ruleKey 生成 iptables 规则的存储键
+func ruleKey(nsName, binary, table, chain string) string {
+	return strings.Join([]string{nsName, binary, table, chain}, "|")
+}
@@ -0,0 +1,464 @@
+package services
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// 防火墙后端
+const (
+	FirewallAuto     = "auto"     // nft 可用且主机 iptables FORWARD 链不丢弃流量时使用 nftables，否则使用 iptables
+	FirewallNftables = "nftables" // 每个命名空间和主机上使用独占的 nftables 表
+	FirewallIptables = "iptables" // 在内置链中跳转到自定义链（兼容旧内核和已有的 iptables 规则）
+)
+
+// nftTable 本系统在每个命名空间和主机上独占的 nftables 表（ip 和 ip6 地址族各一个）
+const nftTable = "wgmanager"
+
+// managedChainPrefix 本系统维护的链名前缀
+const managedChainPrefix = "WG_"
+
+// FirewallChain 本系统维护的一条规则链：链内规则每次整体替换，由内置链（Hook）按 Match 条件跳转
+type FirewallChain struct {
+	Table string   // filter/nat
+	Hook  string   // 跳转到该链的内置链：INPUT/FORWARD/PREROUTING/POSTROUTING
+	Name  string   // 链名（如 WG_ACL）
+	Match []string // 跳转条件（iptables 参数形式，如 "-i", "wg0"），为空表示所有流量
+	Last  bool     // 跳转规则放在内置链末尾（放行类规则需在过滤链之后匹配），默认插入到链首
+}
+
+// Firewall 防火墙后端
+// 规则统一使用 iptables 参数形式描述（如 "-s", "10.0.0.2/32", "-j", "DROP"），由后端翻译为各自的语法；
+// 每次应用都原子替换整条链，重复应用结果不变，规则不会堆积
+type Firewall interface {
+	// Name 后端名称（nftables/iptables）
+	Name() string
+	// ApplyChain 原子替换命名空间（nsName 为空表示主机）内链的全部规则，并确保内置链跳转到该链
+	ApplyChain(nsName string, ipv6 bool, chain FirewallChain, rules [][]string) error
+	// DeleteChain 删除链及内置链中到它的跳转（链不存在时忽略）
+	DeleteChain(nsName string, ipv6 bool, chain FirewallChain) error
+	// ListChains 列出命名空间（nsName 为空表示主机）内本系统维护的全部链名
+	ListChains(nsName string, ipv6 bool) ([]string, error)
+}
+
+// autoFirewall 缓存自动选择的后端（只检测一次）
+var autoFirewall struct {
+	once    sync.Once
+	backend string
+}
+
+// NewFirewall 按配置创建防火墙后端，auto 时按 detectFirewallBackend 的结果选择
+func NewFirewall(backend string, runner CommandRunner) Firewall {
+	legacy := &iptablesFirewall{netns: &NetnsService{runner: runner}}
+	switch backend {
+	case FirewallIptables:
+		return legacy
+	case FirewallNftables:
+		return &nftablesFirewall{runner: runner, legacy: legacy}
+	}
+
+	autoFirewall.once.Do(func() {
+		autoFirewall.backend = detectFirewallBackend(runner)
+		log.Printf("Firewall backend auto-selected: %s", autoFirewall.backend)
+	})
+	if autoFirewall.backend == FirewallNftables {
+		return &nftablesFirewall{runner: runner, legacy: legacy}
+	}
+	return legacy
+}
+
+// detectFirewallBackend 自动选择防火墙后端
+// nft 不可用时使用 iptables；主机 iptables FORWARD 链的默认策略为 DROP 时（如安装了 Docker）同样使用 iptables：
+// nftables 表中的 accept 只结束本表的匹配，被转发的流量仍会被 iptables 的 FORWARD 链丢弃
+func detectFirewallBackend(runner CommandRunner) string {
+	if _, err := runner.Run("nft", "--version"); err != nil {
+		return FirewallIptables
+	}
+	if output, err := runner.Run("iptables", "-S", "FORWARD"); err == nil && forwardPolicyDrops(string(output)) {
+		return FirewallIptables
+	}
+	return FirewallNftables
+}
+
+// forwardPolicyDrops iptables -S FORWARD 的输出中默认策略是否为 DROP
+func forwardPolicyDrops(output string) bool {
+	for _, line := range strings.Split(output, "\n") {
+		if fields := strings.Fields(line); len(fields) == 3 && fields[0] == "-P" && fields[1] == "FORWARD" {
+			return fields[2] == "DROP"
+		}
+	}
+	return false
+}
+
+// namespaceCommand 为命令加上 ip netns exec 前缀（nsName 为空时在主机上执行）
+func namespaceCommand(nsName string, args ...string) []string {
+	if nsName == "" {
+		return args
+	}
+	return append([]string{"ip", "netns", "exec", nsName}, args...)
+}
+
+// iptablesFirewall iptables/ip6tables 后端：自定义链通过 iptables-restore --noflush 原子替换
+type iptablesFirewall struct {
+	netns *NetnsService
+}
+
+func (f *iptablesFirewall) Name() string {
+	return FirewallIptables
+}
+
+func (f *iptablesFirewall) binary(ipv6 bool) string {
+	if ipv6 {
+		return "ip6tables"
+	}
+	return "iptables"
+}
+
+func (f *iptablesFirewall) ApplyChain(nsName string, ipv6 bool, chain FirewallChain, rules [][]string) error {
+	binary := f.binary(ipv6)
+	if err := f.netns.ReplaceChain(binary, nsName, chain.Table, chain.Name, rules); err != nil {
+		return err
+	}
+	if !chain.Last {
+		return f.netns.EnsureChainJump(binary, nsName, chain.Table, chain.Hook, chain.Name, chain.Match...)
+	}
+
+	jump := append(append([]string{}, chain.Match...), "-j", chain.Name)
+	if err := f.netns.appendFirewallRule(binary, nsName, chain.Table, chain.Hook, jump...); err != nil {
+		return fmt.Errorf("failed to add jump to chain %s: %v", chain.Name, err)
+	}
+	return nil
+}
+
+func (f *iptablesFirewall) DeleteChain(nsName string, ipv6 bool, chain FirewallChain) error {
+	binary := f.binary(ipv6)
+
+	// 删除所有跳转到该链的规则（跳转条件可能已随配置变化，不能只按当前的 Match 删除）
+	if output, err := f.netns.SaveRules(binary, nsName); err == nil {
+		for _, rule := range parseSavedRules(output).rules {
+			if rule.table == chain.Table && rule.target() == chain.Name {
+				f.netns.DeleteRule(binary, nsName, rule.table, rule.spec)
+			}
+		}
+	}
+
+	// 忽略错误：链可能不存在
+	for _, args := range [][]string{
+		{binary, "-t", chain.Table, "-F", chain.Name},
+		{binary, "-t", chain.Table, "-X", chain.Name},
+	} {
+		command := namespaceCommand(nsName, args...)
+		f.netns.runner.Run(command[0], command[1:]...)
+	}
+	return nil
+}
+
+func (f *iptablesFirewall) ListChains(nsName string, ipv6 bool) ([]string, error) {
+	output, err := f.netns.SaveRules(f.binary(ipv6), nsName)
+	if err != nil {
+		return nil, err
+	}
+
+	var chains []string
+	for name := range parseSavedRules(output).chains {
+		if strings.HasPrefix(name, managedChainPrefix) {
+			chains = append(chains, name)
+		}
+	}
+	sort.Strings(chains)
+	return chains, nil
+}
+
+// savedRules iptables-save 输出中的自定义链和规则
+type savedRules struct {
+	chains map[string]string // 链名 -> 所在表
+	rules  []savedRule
+}
+
+// savedRule iptables-save 输出中的一条 -A 规则
+type savedRule struct {
+	table string
+	spec  []string // -A 之后的部分：链名和匹配条件
+}
+
+// chain 规则所在的链
+func (r savedRule) chain() string {
+	return r.spec[0]
+}
+
+// target 规则的 -j 目标
+func (r savedRule) target() string {
+	for i := 1; i+1 < len(r.spec); i++ {
+		if r.spec[i] == "-j" {
+			return r.spec[i+1]
+		}
+	}
+	return ""
+}
+
+// parseSavedRules 解析 iptables-save 的输出（本系统生成的规则不包含带空格的参数，按空白分割即可）
+func parseSavedRules(output string) savedRules {
+	saved := savedRules{chains: make(map[string]string)}
+	table := ""
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "*"):
+			table = strings.TrimPrefix(line, "*")
+		case strings.HasPrefix(line, ":"):
+			if fields := strings.Fields(strings.TrimPrefix(line, ":")); len(fields) > 0 {
+				saved.chains[fields[0]] = table
+			}
+		case strings.HasPrefix(line, "-A "):
+			if fields := strings.Fields(strings.TrimPrefix(line, "-A ")); len(fields) > 0 {
+				saved.rules = append(saved.rules, savedRule{table: table, spec: fields})
+			}
+		}
+	}
+	return saved
+}
+
+// nftablesFirewall nftables 后端：规则集中在独占的 wgmanager 表中，每次通过一次 nft -f 事务提交
+type nftablesFirewall struct {
+	runner CommandRunner
+	legacy *iptablesFirewall // 从 iptables 后端迁移时删除同名的旧链
+}
+
+func (f *nftablesFirewall) Name() string {
+	return FirewallNftables
+}
+
+func (f *nftablesFirewall) family(ipv6 bool) string {
+	if ipv6 {
+		return "ip6"
+	}
+	return "ip"
+}
+
+func (f *nftablesFirewall) ApplyChain(nsName string, ipv6 bool, chain FirewallChain, rules [][]string) error {
+	family := f.family(ipv6)
+	baseChain, spec, err := nftBaseChain(chain.Table, chain.Hook)
+	if err != nil {
+		return err
+	}
+
+	var script strings.Builder
+	fmt.Fprintf(&script, "add table %s %s\n", family, nftTable)
+	fmt.Fprintf(&script, "add chain %s %s %s { %s }\n", family, nftTable, baseChain, spec)
+	fmt.Fprintf(&script, "add chain %s %s %s\n", family, nftTable, chain.Name)
+	fmt.Fprintf(&script, "flush chain %s %s %s\n", family, nftTable, chain.Name)
+	for _, rule := range rules {
+		expr, err := nftRule(rule)
+		if err != nil {
+			return fmt.Errorf("failed to translate rule for chain %s: %v", chain.Name, err)
+		}
+		fmt.Fprintf(&script, "add rule %s %s %s %s\n", family, nftTable, chain.Name, expr)
+	}
+
+	// 内置链中还没有跳转时添加（与 iptables 后端一致：默认插入到链首）
+	jumps := f.listJumps(nsName, family, baseChain)
+	_, jumped := jumps[chain.Name]
+	if !jumped {
+		expr, err := nftRule(append(append([]string{}, chain.Match...), "-j", chain.Name))
+		if err != nil {
+			return fmt.Errorf("failed to translate jump to chain %s: %v", chain.Name, err)
+		}
+		verb := "insert"
+		if chain.Last {
+			verb = "add"
+		}
+		fmt.Fprintf(&script, "%s rule %s %s %s %s\n", verb, family, nftTable, baseChain, expr)
+	}
+
+	if err := f.run(nsName, script.String()); err != nil {
+		return fmt.Errorf("failed to replace chain %s: %v", chain.Name, err)
+	}
+
+	// 首次在 nftables 中创建该链时，删除 iptables 后端遗留的同名链，避免旧规则继续生效
+	if !jumped {
+		f.legacy.DeleteChain(nsName, ipv6, chain)
+	}
+	return nil
+}
+
+func (f *nftablesFirewall) DeleteChain(nsName string, ipv6 bool, chain FirewallChain) error {
+	family := f.family(ipv6)
+	baseChain, _, err := nftBaseChain(chain.Table, chain.Hook)
+	if err != nil {
+		return err
+	}
+
+	handle, ok := f.listJumps(nsName, family, baseChain)[chain.Name]
+	if !ok {
+		return nil
+	}
+
+	var script strings.Builder
+	fmt.Fprintf(&script, "delete rule %s %s %s handle %s\n", family, nftTable, baseChain, handle)
+	fmt.Fprintf(&script, "delete chain %s %s %s\n", family, nftTable, chain.Name)
+	if err := f.run(nsName, script.String()); err != nil {
+		return fmt.Errorf("failed to delete chain %s: %v", chain.Name, err)
+	}
+	return nil
+}
+
+func (f *nftablesFirewall) ListChains(nsName string, ipv6 bool) ([]string, error) {
+	command := namespaceCommand(nsName, "nft", "list", "table", f.family(ipv6), nftTable)
+	output, err := f.runner.Run(command[0], command[1:]...)
+	if err != nil {
+		// 表不存在：还没有应用过任何规则
+		if strings.Contains(string(output), "No such file or directory") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list nftables table: %v, output: %s", err, string(output))
+	}
+
+	var chains []string
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "chain" && strings.HasPrefix(fields[1], managedChainPrefix) {
+			chains = append(chains, fields[1])
+		}
+	}
+	sort.Strings(chains)
+	return chains, nil
+}
+
+// listJumps 列出内置链中跳转规则的目标链及其规则句柄（表或链不存在时返回空）
+func (f *nftablesFirewall) listJumps(nsName, family, baseChain string) map[string]string {
+	jumps := make(map[string]string)
+	command := namespaceCommand(nsName, "nft", "-a", "list", "chain", family, nftTable, baseChain)
+	output, err := f.runner.Run(command[0], command[1:]...)
+	if err != nil {
+		return jumps
+	}
+
+	// 规则行形如：iifname "wg0" jump WG_ACL # handle 5
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		target, handle := "", ""
+		for i := 0; i+1 < len(fields); i++ {
+			switch fields[i] {
+			case "jump":
+				target = fields[i+1]
+			case "handle":
+				handle = fields[i+1]
+			}
+		}
+		if target != "" && handle != "" {
+			jumps[target] = handle
+		}
+	}
+	return jumps
+}
+
+// run 通过 nft -f - 一次提交脚本中的全部命令（nft 保证整体生效或整体失败）
+func (f *nftablesFirewall) run(nsName, script string) error {
+	command := namespaceCommand(nsName, "nft", "-f", "-")
+	if output, err := f.runner.RunWithInput([]byte(script), command[0], command[1:]...); err != nil {
+		return fmt.Errorf("%v, output: %s", err, string(output))
+	}
+	return nil
+}
+
+// nftBaseChain 返回内置链对应的 nftables 基础链名称和定义
+func nftBaseChain(table, hook string) (string, string, error) {
+	switch table + "/" + hook {
+	case "filter/INPUT":
+		return "input", "type filter hook input priority 0; policy accept;", nil
+	case "filter/FORWARD":
+		return "forward", "type filter hook forward priority 0; policy accept;", nil
+	case "nat/PREROUTING":
+		return "prerouting", "type nat hook prerouting priority -100; policy accept;", nil
+	case "nat/POSTROUTING":
+		return "postrouting", "type nat hook postrouting priority 100; policy accept;", nil
+	}
+	return "", "", fmt.Errorf("unsupported hook %s in table %s", hook, table)
+}
+
+// nftRule 将 iptables 参数形式的规则翻译为 nftables 规则表达式
+// 只支持本系统生成的规则用到的参数：-i/-o/-s/-d/-p/--dport/--sport/-m conntrack --ctstate 和 -j
+func nftRule(args []string) (string, error) {
+	var exprs []string
+	var protocol, verdict string
+	protocolUsed := false
+
+	for i := 0; i < len(args); i += 2 {
+		option := args[i]
+		if i+1 >= len(args) {
+			return "", fmt.Errorf("missing value for %s", option)
+		}
+		value := args[i+1]
+
+		switch option {
+		case "-m":
+			// 模块名不需要翻译，由后面的参数决定匹配内容
+		case "-i", "-o":
+			key := "iifname"
+			if option == "-o" {
+				key = "oifname"
+			}
+			// iptables 的 veth+ 通配对应 nftables 的 "veth*"
+			if strings.HasSuffix(value, "+") {
+				value = strings.TrimSuffix(value, "+") + "*"
+			}
+			exprs = append(exprs, fmt.Sprintf("%s %q", key, value))
+		case "-s", "-d":
+			key := "saddr"
+			if option == "-d" {
+				key = "daddr"
+			}
+			family := "ip"
+			if strings.Contains(value, ":") {
+				family = "ip6"
+			}
+			exprs = append(exprs, fmt.Sprintf("%s %s %s", family, key, value))
+		case "-p":
+			protocol = value
+			if protocol == "ipv6-icmp" {
+				protocol = "icmpv6"
+			}
+		case "--dport", "--sport":
+			if protocol != "tcp" && protocol != "udp" {
+				return "", fmt.Errorf("%s requires -p tcp or -p udp", option)
+			}
+			exprs = append(exprs, fmt.Sprintf("%s %s %s", protocol, strings.TrimPrefix(option, "--"), value))
+			protocolUsed = true
+		case "--ctstate":
+			if value == "DNAT" {
+				exprs = append(exprs, "ct status dnat")
+			} else {
+				exprs = append(exprs, "ct state "+strings.ToLower(value))
+			}
+		case "-j":
+			switch value {
+			case "ACCEPT", "DROP", "RETURN":
+				verdict = strings.ToLower(value)
+			case "MASQUERADE":
+				verdict = "masquerade"
+			case "DNAT", "SNAT":
+				// -j DNAT --to-destination <地址>
+				if i+3 >= len(args) {
+					return "", fmt.Errorf("missing address for %s", value)
+				}
+				verdict = strings.ToLower(value) + " to " + args[i+3]
+				i += 2
+			default:
+				verdict = "jump " + value
+			}
+		default:
+			return "", fmt.Errorf("unsupported argument %s", option)
+		}
+	}
+
+	if protocol != "" && !protocolUsed {
+		exprs = append(exprs, "meta l4proto "+protocol)
+	}
+	if verdict == "" {
+		return "", fmt.Errorf("rule has no target")
+	}
+	return strings.Join(append(exprs, verdict), " "), nil
+}
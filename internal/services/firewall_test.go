@@ -0,0 +1,100 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestNftRule(t *testing.T) {
+	tests := []struct {
+		name string
+		args string
+		want string
+	}{
+		{"accept all", "-j ACCEPT", "accept"},
+		{"input interface", "-i wg0 -j ACCEPT", `iifname "wg0" accept`},
+		{"interface wildcard", "-o veth+ -j DROP", `oifname "veth*" drop`},
+		{"ipv4 addresses", "-s 10.100.0.2/32 -d 10.100.0.0/24 -j DROP", "ip saddr 10.100.0.2/32 ip daddr 10.100.0.0/24 drop"},
+		{"ipv6 address", "-s fd00:100::2/128 -j RETURN", "ip6 saddr fd00:100::2/128 return"},
+		{"protocol only", "-p icmp -j ACCEPT", "meta l4proto icmp accept"},
+		{"icmpv6", "-p ipv6-icmp -j ACCEPT", "meta l4proto icmpv6 accept"},
+		{"destination port", "-p tcp --dport 22 -j ACCEPT", "tcp dport 22 accept"},
+		{"source port", "-p udp -m udp --sport 53 -j ACCEPT", "udp sport 53 accept"},
+		{"conntrack state", "-m conntrack --ctstate ESTABLISHED,RELATED -j ACCEPT", "ct state established,related accept"},
+		{"conntrack dnat", "-m conntrack --ctstate DNAT -j ACCEPT", "ct status dnat accept"},
+		{"masquerade", "-s 10.100.0.0/24 -o eth0 -j MASQUERADE", `ip saddr 10.100.0.0/24 oifname "eth0" masquerade`},
+		{"dnat", "-i eth0 -p tcp --dport 20000 -j DNAT --to-destination 10.200.0.2:20000",
+			`iifname "eth0" tcp dport 20000 dnat to 10.200.0.2:20000`},
+		{"snat", "-o veth0 -j SNAT --to-source 10.200.0.1", `oifname "veth0" snat to 10.200.0.1`},
+		{"jump", "-i wg0 -j WG_ACL", `iifname "wg0" jump WG_ACL`},
+	}
+
+	for _, tt := range tests {
+		got, err := nftRule(strings.Fields(tt.args))
+		if err != nil {
+			t.Errorf("%s: nftRule(%q): %v", tt.name, tt.args, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: nftRule(%q) = %q, want %q", tt.name, tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestNftRuleInvalid(t *testing.T) {
+	tests := []struct {
+		args    string
+		wantErr string
+	}{
+		{"-s 10.0.0.1", "rule has no target"},
+		{"-s", "missing value for -s"},
+		{"--dport 22 -j ACCEPT", "--dport requires -p tcp or -p udp"},
+		{"-p icmp --sport 1 -j ACCEPT", "--sport requires -p tcp or -p udp"},
+		{"-j", "missing value for -j"},
+		{"-j DNAT --to-destination", "missing address for DNAT"},
+		{"--comment x -j ACCEPT", "unsupported argument --comment"},
+	}
+
+	for _, tt := range tests {
+		if _, err := nftRule(strings.Fields(tt.args)); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("nftRule(%q) error = %v, want %q", tt.args, err, tt.wantErr)
+		}
+	}
+}
+
+func TestDetectFirewallBackend(t *testing.T) {
+	tests := []struct {
+		name       string
+		nftMissing bool
+		forward    string
+		forwardErr bool
+		want       string
+	}{
+		{"nft available", false, "-P FORWARD ACCEPT\n", false, FirewallNftables},
+		{"nft missing", true, "-P FORWARD ACCEPT\n", false, FirewallIptables},
+		{"forward policy drop", false, "-P FORWARD DROP\n-N DOCKER-USER\n-A FORWARD -j DOCKER-USER\n", false, FirewallIptables},
+		{"drop rule but accept policy", false, "-P FORWARD ACCEPT\n-A FORWARD -i eth1 -j DROP\n", false, FirewallNftables},
+		{"iptables missing", false, "", true, FirewallNftables},
+	}
+
+	for _, tt := range tests {
+		runner := NewFakeRunner()
+		runner.Handle("nft --version", func(args []string, input []byte) ([]byte, error) {
+			if tt.nftMissing {
+				return nil, fmt.Errorf("exec: \"nft\": executable file not found in $PATH")
+			}
+			return []byte("nftables v1.0.9 (Old Doc Yak #3)\n"), nil
+		})
+		runner.Handle("iptables -S FORWARD", func(args []string, input []byte) ([]byte, error) {
+			if tt.forwardErr {
+				return nil, fmt.Errorf("exec: \"iptables\": executable file not found in $PATH")
+			}
+			return []byte(tt.forward), nil
+		})
+
+		if got := detectFirewallBackend(runner); got != tt.want {
+			t.Errorf("%s: detectFirewallBackend = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
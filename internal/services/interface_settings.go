@@ -0,0 +1,127 @@
+package services
+
+import (
+	"cloud-platform/internal/models"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MinWireguardMTU 接口MTU下限（IPv6要求链路MTU不小于1280）
+	MinWireguardMTU = 1280
+	// MaxWireguardMTU 接口MTU上限
+	MaxWireguardMTU = 9000
+	// peerTablePriority 查询服务器路由表的规则优先级，早于出口peer的规则，访问peer背后网段的流量不经出口peer
+	peerTablePriority = 900
+)
+
+// ValidateMTU 校验接口MTU，0表示使用默认值 DefaultWireguardMTU
+func ValidateMTU(mtu int) error {
+	if mtu != 0 && (mtu < MinWireguardMTU || mtu > MaxWireguardMTU) {
+		return fmt.Errorf("mtu must be 0 (auto) or between %d and %d", MinWireguardMTU, MaxWireguardMTU)
+	}
+	return nil
+}
+
+// NormalizeRouteTable 校验并规范化存放peer路由的路由表，空字符串或 off 表示使用主路由表
+// 只接受数字表号，不能使用系统保留的表（253-255）和出口peer使用的表
+func NormalizeRouteTable(table string) (string, error) {
+	table = strings.TrimSpace(table)
+	if table == "" || table == "off" {
+		return "", nil
+	}
+
+	id, err := strconv.ParseUint(table, 10, 32)
+	if err != nil || id == 0 {
+		return "", fmt.Errorf("route table must be off or a table number between 1 and 4294967295")
+	}
+	if id >= 253 && id <= 255 {
+		return "", fmt.Errorf("route table %d is reserved by the system", id)
+	}
+	normalized := strconv.FormatUint(id, 10)
+	if normalized == ExitRouteTable {
+		return "", fmt.Errorf("route table %s is used for exit peer routing", ExitRouteTable)
+	}
+	return normalized, nil
+}
+
+// peerRouteTable 服务器存放peer背后网段路由的路由表（未设置时为主路由表）
+func peerRouteTable(server *models.WireguardServer) string {
+	if server.RouteTable == "" {
+		return "main"
+	}
+	return server.RouteTable
+}
+
+// NormalizeListenAddress 校验并规范化接受WireGuard连接的主机地址，空字符串表示所有地址
+func NormalizeListenAddress(address string) (string, error) {
+	address = strings.TrimSpace(address)
+	if address == "" {
+		return "", nil
+	}
+
+	addr, err := netip.ParseAddr(address)
+	if err != nil || addr.Zone() != "" || addr.IsUnspecified() || addr.IsMulticast() {
+		return "", fmt.Errorf("invalid listen address %q", address)
+	}
+	return addr.Unmap().String(), nil
+}
+
+// ApplyInterfaceSettings 重写配置文件，并将接口设置（MTU、FwMark、路由表、监听地址）的变化应用到运行中的接口
+//   - MTU 和 FwMark 直接修改运行中的接口，已有连接不受影响
+//   - 路由表变化时将peer背后网段的路由从旧表移到新表，并更新查询该表的策略路由规则
+//   - 监听地址变化时重新应用主机上的DNAT链
+//
+// previous 为修改前的服务器记录。禁用的服务器只更新配置文件，重新启用时生效
+func (s *UserNetworkService) ApplyInterfaceSettings(server, previous *models.WireguardServer, userUID string) error {
+	if _, err := s.writeServerConfig(server, userUID); err != nil {
+		return err
+	}
+	if !server.Enabled {
+		return nil
+	}
+
+	if server.ListenAddress != previous.ListenAddress {
+		if err := s.setupHostForwards(server); err != nil {
+			return err
+		}
+	}
+
+	if server.RouteTable != previous.RouteTable {
+		if err := s.removeAllPeerRoutes(previous); err != nil {
+			return err
+		}
+		if err := s.ensurePeerRoutes(server); err != nil {
+			return err
+		}
+	}
+
+	if server.MTU != previous.MTU {
+		mtu := server.MTU
+		if mtu == 0 {
+			mtu = DefaultWireguardMTU
+		}
+		if err := s.netnsService.SetLinkMTU(server.Namespace, server.WgInterface, mtu); err != nil {
+			return err
+		}
+	}
+	if server.FwMark != previous.FwMark {
+		if err := s.wireguardService.SetFwMark(server.Namespace, server.WgInterface, server.FwMark); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ClientEndpoint 客户端配置中的服务器端点：设置了监听地址时使用监听地址，否则使用全局的服务器公网地址
+func ClientEndpoint(server *models.WireguardServer, serverIP string) string {
+	host := serverIP
+	if server.ListenAddress != "" {
+		host = server.ListenAddress
+	}
+	// 使用 JoinHostPort 以兼容 IPv6 服务器地址（[addr]:port）
+	return net.JoinHostPort(host, strconv.Itoa(server.WgPort))
+}
@@ -0,0 +1,277 @@
+package services
+
+import (
+	"cloud-platform/internal/config"
+	"cloud-platform/internal/models"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/netip"
+
+	"gorm.io/gorm"
+)
+
+// ErrPoolExhausted 地址池或端口池已耗尽
+var ErrPoolExhausted = errors.New("pool exhausted")
+
+const (
+	vethSubnetBits = 30 // veth对子网大小（.1主机端，.2命名空间端）
+	wgSubnetBits   = 24 // 用户WireGuard网段大小
+	wgSubnet6Bits  = 64 // 用户WireGuard IPv6网段大小
+
+	allocateRetries = 3 // 并发分配发生唯一索引冲突时的重试次数
+)
+
+// NetworkAllocation 为一个WireGuard服务器分配的网络资源
+type NetworkAllocation struct {
+	VethSubnet string // veth /30 子网（CIDR格式）
+	WgSubnet   string // WireGuard /24 网段（CIDR格式）
+	WgSubnet6  string // WireGuard IPv6 /64 网段（CIDR格式，未启用IPv6时为空）
+	WgPort     int    // WireGuard监听端口
+}
+
+// IPAMService 持久化的子网与端口分配服务
+// 分配结果记录在数据库中，保证不同用户之间不会冲突
+type IPAMService struct {
+	db             *gorm.DB
+	vethPool       string
+	wgPool         string
+	ipv6Pool       string
+	sharedLinkPool string
+	portMin        int
+	portMax        int
+}
+
+// NewIPAMService 创建IPAM服务实例
+func NewIPAMService(db *gorm.DB, netCfg config.NetworkConfig) *IPAMService {
+	portMin, portMax := netCfg.GetPortRange()
+	return &IPAMService{
+		db:             db,
+		vethPool:       netCfg.GetVethSubnetPool(),
+		wgPool:         netCfg.GetWgSubnetPool(),
+		ipv6Pool:       netCfg.IPv6Pool,
+		sharedLinkPool: netCfg.GetSharedLinkPool(),
+		portMin:        portMin,
+		portMax:        portMax,
+	}
+}
+
+// AllocateServerNetwork 在一个事务中为服务器分配veth子网、WireGuard网段和监听端口
+// owner 为占用者标识，释放时使用
+func (s *IPAMService) AllocateServerNetwork(owner string) (*NetworkAllocation, error) {
+	var allocation *NetworkAllocation
+	var err error
+
+	for attempt := 0; attempt < allocateRetries; attempt++ {
+		err = s.db.Transaction(func(tx *gorm.DB) error {
+			vethSubnet, err := s.allocateSubnet(tx, models.PoolVethSubnet, s.vethPool, vethSubnetBits, owner)
+			if err != nil {
+				return err
+			}
+
+			wgSubnet, err := s.allocateSubnet(tx, models.PoolWireguardSubnet, s.wgPool, wgSubnetBits, owner)
+			if err != nil {
+				return err
+			}
+
+			// 配置了IPv6地址池时同时分配IPv6网段
+			wgSubnet6 := ""
+			if s.ipv6Pool != "" {
+				wgSubnet6, err = s.allocateSubnet(tx, models.PoolWireguardIPv6, s.ipv6Pool, wgSubnet6Bits, owner)
+				if err != nil {
+					return err
+				}
+			}
+
+			wgPort, err := s.allocatePort(tx, models.PoolWireguardPort, s.portMin, s.portMax, owner)
+			if err != nil {
+				return err
+			}
+
+			allocation = &NetworkAllocation{
+				VethSubnet: vethSubnet,
+				WgSubnet:   wgSubnet,
+				WgSubnet6:  wgSubnet6,
+				WgPort:     wgPort,
+			}
+			return nil
+		})
+
+		// 池耗尽无需重试；其他错误（如并发分配导致唯一索引冲突）重试
+		if err == nil || errors.Is(err, ErrPoolExhausted) {
+			break
+		}
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to allocate network resources: %w", err)
+	}
+	return allocation, nil
+}
+
+// ReserveSubnet 登记一个已在使用的子网（用于导入历史数据）
+// 子网已被同一占用者登记时直接返回，被其他占用者占用时返回错误
+func (s *IPAMService) ReserveSubnet(pool, subnet, owner string) error {
+	var existing models.IPAllocation
+	err := s.db.Where("pool = ? AND subnet = ?", pool, subnet).First(&existing).Error
+	if err == nil {
+		if existing.Owner != owner {
+			return fmt.Errorf("%s subnet %s is already allocated to %s", pool, subnet, existing.Owner)
+		}
+		return nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	return s.db.Create(&models.IPAllocation{Pool: pool, Subnet: subnet, Owner: owner}).Error
+}
+
+// ReservePort 登记一个已在使用的端口（用于导入历史数据）
+func (s *IPAMService) ReservePort(pool string, port int, owner string) error {
+	var existing models.PortAllocation
+	err := s.db.Where("port = ?", port).First(&existing).Error
+	if err == nil {
+		if existing.Owner != owner {
+			return fmt.Errorf("port %d is already allocated to %s", port, existing.Owner)
+		}
+		return nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	return s.db.Create(&models.PortAllocation{Pool: pool, Port: port, Owner: owner}).Error
+}
+
+// Release 释放占用者的所有子网和端口
+func (s *IPAMService) Release(owner string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("owner = ?", owner).Delete(&models.IPAllocation{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("owner = ?", owner).Delete(&models.PortAllocation{}).Error
+	})
+}
+
+// AllocatePort 从指定端口池中分配一个端口（如公网端口转发）
+// 在调用方的事务中执行时，分配结果随事务一起提交或回滚
+func (s *IPAMService) AllocatePort(pool string, portMin, portMax int, owner string) (int, error) {
+	return s.allocatePort(s.db, pool, portMin, portMax, owner)
+}
+
+// ReleasePort 释放占用者在指定端口池中的单个端口
+func (s *IPAMService) ReleasePort(pool string, port int, owner string) error {
+	return s.db.Where("pool = ? AND port = ? AND owner = ?", pool, port, owner).Delete(&models.PortAllocation{}).Error
+}
+
+// OwnerPorts 返回占用者在指定端口池中的全部端口
+func (s *IPAMService) OwnerPorts(pool, owner string) ([]int, error) {
+	var ports []int
+	err := s.db.Model(&models.PortAllocation{}).Where("pool = ? AND owner = ?", pool, owner).Order("port").Pluck("port", &ports).Error
+	return ports, err
+}
+
+// AllocateSharedLinkSubnet 从共享网络连接地址池中分配一个 /30 子网
+func (s *IPAMService) AllocateSharedLinkSubnet(owner string) (string, error) {
+	return s.allocateSubnet(s.db, models.PoolSharedLink, s.sharedLinkPool, vethSubnetBits, owner)
+}
+
+// OwnersWithPrefix 返回指定地址池中占用者标识以 prefix 开头的全部占用者
+func (s *IPAMService) OwnersWithPrefix(pool, prefix string) ([]string, error) {
+	var owners []string
+	err := s.db.Model(&models.IPAllocation{}).Where("pool = ? AND owner LIKE ?", pool, prefix+"%").
+		Distinct().Pluck("owner", &owners).Error
+	return owners, err
+}
+
+// allocateSubnet 从地址池中分配第一个未被占用的子网
+func (s *IPAMService) allocateSubnet(tx *gorm.DB, pool, poolCIDR string, bits int, owner string) (string, error) {
+	prefix, err := netip.ParsePrefix(poolCIDR)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s subnet pool %s: %v", pool, poolCIDR, err)
+	}
+	prefix = prefix.Masked()
+	if bits < prefix.Bits() || bits > prefix.Addr().BitLen() {
+		return "", fmt.Errorf("%s subnet pool %s cannot hold /%d subnets", pool, poolCIDR, bits)
+	}
+
+	var used []string
+	if err := tx.Model(&models.IPAllocation{}).Where("pool = ?", pool).Pluck("subnet", &used).Error; err != nil {
+		return "", err
+	}
+	usedSet := make(map[string]bool, len(used))
+	for _, subnet := range used {
+		usedSet[subnet] = true
+	}
+
+	// 子网数量过大时（如IPv6）只遍历前 2^24 个
+	sizeBits := bits - prefix.Bits()
+	if sizeBits > 24 {
+		sizeBits = 24
+	}
+	count := uint64(1) << sizeBits
+
+	for i := uint64(0); i < count; i++ {
+		candidate := nthSubnet(prefix, bits, i).String()
+		if usedSet[candidate] {
+			continue
+		}
+
+		if err := tx.Create(&models.IPAllocation{Pool: pool, Subnet: candidate, Owner: owner}).Error; err != nil {
+			return "", err
+		}
+		return candidate, nil
+	}
+
+	return "", fmt.Errorf("%w: %s subnet pool %s has no free /%d subnet", ErrPoolExhausted, pool, poolCIDR, bits)
+}
+
+// allocatePort 从端口池中分配第一个未被占用的端口
+func (s *IPAMService) allocatePort(tx *gorm.DB, pool string, portMin, portMax int, owner string) (int, error) {
+	var used []int
+	if err := tx.Model(&models.PortAllocation{}).Pluck("port", &used).Error; err != nil {
+		return 0, err
+	}
+	usedSet := make(map[int]bool, len(used))
+	for _, port := range used {
+		usedSet[port] = true
+	}
+
+	for port := portMin; port <= portMax; port++ {
+		if usedSet[port] {
+			continue
+		}
+
+		if err := tx.Create(&models.PortAllocation{Pool: pool, Port: port, Owner: owner}).Error; err != nil {
+			return 0, err
+		}
+		return port, nil
+	}
+
+	return 0, fmt.Errorf("%w: %s port pool %d-%d has no free port", ErrPoolExhausted, pool, portMin, portMax)
+}
+
+// nthSubnet 计算地址池中第n个指定大小的子网
+func nthSubnet(pool netip.Prefix, bits int, n uint64) netip.Prefix {
+	addrBits := pool.Addr().BitLen()
+	base := new(big.Int).SetBytes(pool.Masked().Addr().AsSlice())
+	offset := new(big.Int).Lsh(new(big.Int).SetUint64(n), uint(addrBits-bits))
+
+	addr, _ := netip.AddrFromSlice(new(big.Int).Add(base, offset).FillBytes(make([]byte, addrBits/8)))
+	return netip.PrefixFrom(addr, bits)
+}
+
+// subnetHost 返回子网中第n个主机地址，保留子网前缀长度（如 10.100.3.0/24, 1 -> 10.100.3.1/24）
+func subnetHost(subnet string, n uint64) (string, error) {
+	prefix, err := netip.ParsePrefix(subnet)
+	if err != nil {
+		return "", fmt.Errorf("invalid subnet %s: %v", subnet, err)
+	}
+
+	host := nthSubnet(netip.PrefixFrom(prefix.Masked().Addr(), prefix.Addr().BitLen()), prefix.Addr().BitLen(), n)
+	if !prefix.Contains(host.Addr()) {
+		return "", fmt.Errorf("host %d is out of subnet %s", n, subnet)
+	}
+	return netip.PrefixFrom(host.Addr(), prefix.Bits()).String(), nil
+}
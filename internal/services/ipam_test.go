@@ -0,0 +1,220 @@
+package services
+
+import (
+	"cloud-platform/internal/models"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestNthSubnet(t *testing.T) {
+	tests := []struct {
+		pool string
+		bits int
+		n    uint64
+		want string
+	}{
+		{"10.100.0.0/16", 24, 0, "10.100.0.0/24"},
+		{"10.100.0.0/16", 24, 3, "10.100.3.0/24"},
+		{"10.100.0.0/16", 24, 255, "10.100.255.0/24"},
+		{"10.200.0.0/16", 30, 1, "10.200.0.4/30"},
+		{"10.200.0.0/16", 30, 64, "10.200.1.0/30"},
+		// 地址池前缀中的主机位被忽略
+		{"10.100.7.1/16", 24, 2, "10.100.2.0/24"},
+		{"fd00:100::/48", 64, 0, "fd00:100::/64"},
+		{"fd00:100::/48", 64, 1, "fd00:100:0:1::/64"},
+		{"fd00:100::/48", 64, 0x1234, "fd00:100:0:1234::/64"},
+		{"fd00:100::/32", 64, 1 << 16, "fd00:100:1::/64"},
+	}
+
+	for _, tt := range tests {
+		got := nthSubnet(netip.MustParsePrefix(tt.pool), tt.bits, tt.n)
+		if got.String() != tt.want {
+			t.Errorf("nthSubnet(%s, /%d, %d) = %s, want %s", tt.pool, tt.bits, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestSubnetHost(t *testing.T) {
+	tests := []struct {
+		subnet  string
+		n       uint64
+		want    string
+		wantErr string
+	}{
+		{subnet: "10.100.3.0/24", n: 1, want: "10.100.3.1/24"},
+		{subnet: "10.100.3.0/24", n: 255, want: "10.100.3.255/24"},
+		{subnet: "10.200.0.4/30", n: 2, want: "10.200.0.6/30"},
+		{subnet: "fd00:100:0:1::/64", n: 1, want: "fd00:100:0:1::1/64"},
+		{subnet: "fd00:100:0:1::/64", n: 0x10000, want: "fd00:100:0:1::1:0/64"},
+		{subnet: "10.100.3.0/24", n: 256, wantErr: "out of subnet"},
+		{subnet: "10.200.0.4/30", n: 4, wantErr: "out of subnet"},
+		{subnet: "10.100.3.0", n: 1, wantErr: "invalid subnet"},
+	}
+
+	for _, tt := range tests {
+		got, err := subnetHost(tt.subnet, tt.n)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("subnetHost(%s, %d) error = %v, want %q", tt.subnet, tt.n, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("subnetHost(%s, %d) = %q, %v, want %q", tt.subnet, tt.n, got, err, tt.want)
+		}
+	}
+}
+
+// newTestIPAM 创建使用小地址池的IPAM服务：2个veth子网、2个WireGuard网段、2个共享网络连接子网、3个端口
+func newTestIPAM(t *testing.T) *IPAMService {
+	return &IPAMService{
+		db:             newTestDB(t),
+		vethPool:       "10.200.0.0/29",
+		wgPool:         "10.100.0.0/23",
+		ipv6Pool:       "fd00:100::/63",
+		sharedLinkPool: "10.101.0.0/29",
+		portMin:        51820,
+		portMax:        51822,
+	}
+}
+
+func TestAllocateServerNetwork(t *testing.T) {
+	ipam := newTestIPAM(t)
+
+	first, err := ipam.AllocateServerNetwork("wg_a/wg0")
+	if err != nil {
+		t.Fatalf("first allocation: %v", err)
+	}
+	want := NetworkAllocation{VethSubnet: "10.200.0.0/30", WgSubnet: "10.100.0.0/24", WgSubnet6: "fd00:100::/64", WgPort: 51820}
+	if *first != want {
+		t.Errorf("first allocation = %+v, want %+v", *first, want)
+	}
+
+	second, err := ipam.AllocateServerNetwork("wg_b/wg0")
+	if err != nil {
+		t.Fatalf("second allocation: %v", err)
+	}
+	want = NetworkAllocation{VethSubnet: "10.200.0.4/30", WgSubnet: "10.100.1.0/24", WgSubnet6: "fd00:100:0:1::/64", WgPort: 51821}
+	if *second != want {
+		t.Errorf("second allocation = %+v, want %+v", *second, want)
+	}
+
+	// 释放后子网和端口可以重新分配
+	if err := ipam.Release("wg_a/wg0"); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	third, err := ipam.AllocateServerNetwork("wg_c/wg0")
+	if err != nil {
+		t.Fatalf("allocation after release: %v", err)
+	}
+	if third.VethSubnet != "10.200.0.0/30" || third.WgSubnet != "10.100.0.0/24" || third.WgPort != 51820 {
+		t.Errorf("allocation after release = %+v, want the released resources", *third)
+	}
+}
+
+func TestAllocateServerNetworkExhausted(t *testing.T) {
+	ipam := newTestIPAM(t)
+	for _, owner := range []string{"wg_a/wg0", "wg_b/wg0"} {
+		if _, err := ipam.AllocateServerNetwork(owner); err != nil {
+			t.Fatalf("allocate %s: %v", owner, err)
+		}
+	}
+
+	_, err := ipam.AllocateServerNetwork("wg_c/wg0")
+	if !errors.Is(err, ErrPoolExhausted) {
+		t.Fatalf("allocation from exhausted pool: error = %v, want ErrPoolExhausted", err)
+	}
+	if !strings.Contains(err.Error(), "veth subnet pool 10.200.0.0/29 has no free /30 subnet") {
+		t.Errorf("error %q does not name the exhausted pool", err)
+	}
+	assertNoAllocations(t, ipam, "wg_c/wg0")
+}
+
+func TestAllocateServerNetworkPortsExhausted(t *testing.T) {
+	ipam := newTestIPAM(t)
+	ipam.vethPool = "10.200.0.0/24"
+	ipam.wgPool = "10.100.0.0/16"
+	ipam.ipv6Pool = ""
+	for _, owner := range []string{"wg_a/wg0", "wg_b/wg0", "wg_c/wg0"} {
+		if _, err := ipam.AllocateServerNetwork(owner); err != nil {
+			t.Fatalf("allocate %s: %v", owner, err)
+		}
+	}
+
+	_, err := ipam.AllocateServerNetwork("wg_d/wg0")
+	if !errors.Is(err, ErrPoolExhausted) {
+		t.Fatalf("allocation with no free port: error = %v, want ErrPoolExhausted", err)
+	}
+	if !strings.Contains(err.Error(), "port pool 51820-51822 has no free port") {
+		t.Errorf("error %q does not name the exhausted port pool", err)
+	}
+	// 子网在同一事务中分配，端口耗尽时一并回滚
+	assertNoAllocations(t, ipam, "wg_d/wg0")
+}
+
+func TestAllocatePortExhausted(t *testing.T) {
+	ipam := newTestIPAM(t)
+
+	port, err := ipam.AllocatePort(models.PoolPublicForward, 20000, 20000, "wg_a/wg0")
+	if err != nil || port != 20000 {
+		t.Fatalf("AllocatePort = %d, %v, want 20000", port, err)
+	}
+	if _, err := ipam.AllocatePort(models.PoolPublicForward, 20000, 20000, "wg_b/wg0"); !errors.Is(err, ErrPoolExhausted) {
+		t.Fatalf("AllocatePort from exhausted pool: error = %v, want ErrPoolExhausted", err)
+	}
+}
+
+func TestAllocateSharedLinkSubnet(t *testing.T) {
+	ipam := newTestIPAM(t)
+
+	// 共享网络连接使用独立的地址池，veth地址池耗尽不影响连接分配，反之亦然
+	for _, owner := range []string{"wg_a/wg0", "wg_b/wg0"} {
+		if _, err := ipam.AllocateServerNetwork(owner); err != nil {
+			t.Fatalf("allocate %s: %v", owner, err)
+		}
+	}
+	for i, want := range []string{"10.101.0.0/30", "10.101.0.4/30"} {
+		subnet, err := ipam.AllocateSharedLinkSubnet(fmt.Sprintf("wgshr_1/%d", i+1))
+		if err != nil || subnet != want {
+			t.Fatalf("AllocateSharedLinkSubnet = %q, %v, want %s", subnet, err, want)
+		}
+	}
+	if _, err := ipam.AllocateSharedLinkSubnet("wgshr_1/3"); !errors.Is(err, ErrPoolExhausted) || !strings.Contains(err.Error(), "shared subnet pool") {
+		t.Fatalf("allocation from exhausted shared link pool: error = %v, want ErrPoolExhausted", err)
+	}
+
+	// 释放后veth地址池可以重新分配，不会用到连接子网
+	if err := ipam.Release("wg_a/wg0"); err != nil {
+		t.Fatalf("release: %v", err)
+	}
+	allocation, err := ipam.AllocateServerNetwork("wg_c/wg0")
+	if err != nil || allocation.VethSubnet != "10.200.0.0/30" {
+		t.Fatalf("allocation after release = %+v, %v, want veth subnet 10.200.0.0/30", allocation, err)
+	}
+}
+
+func TestAllocateSubnetInvalidPool(t *testing.T) {
+	ipam := newTestIPAM(t)
+
+	if _, err := ipam.allocateSubnet(ipam.db, models.PoolVethSubnet, "10.200.0.0/31", vethSubnetBits, "x"); err == nil || errors.Is(err, ErrPoolExhausted) {
+		t.Errorf("pool smaller than a subnet: error = %v, want a configuration error", err)
+	}
+	if _, err := ipam.allocateSubnet(ipam.db, models.PoolVethSubnet, "not-a-cidr", vethSubnetBits, "x"); err == nil || errors.Is(err, ErrPoolExhausted) {
+		t.Errorf("invalid pool: error = %v, want a configuration error", err)
+	}
+}
+
+// assertNoAllocations 确认占用者没有任何子网或端口记录
+func assertNoAllocations(t *testing.T, ipam *IPAMService, owner string) {
+	t.Helper()
+
+	var subnets, ports int64
+	ipam.db.Model(&models.IPAllocation{}).Where("owner = ?", owner).Count(&subnets)
+	ipam.db.Model(&models.PortAllocation{}).Where("owner = ?", owner).Count(&ports)
+	if subnets != 0 || ports != 0 {
+		t.Errorf("%s kept %d subnets and %d ports after a failed allocation", owner, subnets, ports)
+	}
+}
@@ -0,0 +1,109 @@
+package services
+
+import (
+	"cloud-platform/internal/models"
+	"fmt"
+)
+
+// IsolationChain 命名空间内控制peer之间互访的自定义链，由 FORWARD 链首跳转（仅匹配 wg0 -> wg0 的流量）
+const IsolationChain = "WG_ISOLATION"
+
+// ApplyPeerIsolation 按服务器的互访策略原子替换命名空间内的 WG_ISOLATION 链
+//   - allow：链为空，peer之间可以自由互访
+//   - deny：丢弃所有peer之间的流量
+//   - pairs：只放行 WireguardPeerLink 中列出的peer对（双向），其余丢弃
+//
+// 设置了出口peer时，deny/pairs 都放行选中peer经出口peer访问外网的流量
+func (s *UserNetworkService) ApplyPeerIsolation(server *models.WireguardServer) error {
+	var rules4, rules6 [][]string
+
+	switch server.PeerIsolationMode() {
+	case models.PeerIsolationDeny:
+		rules4 = [][]string{{"-j", "DROP"}}
+		rules6 = [][]string{{"-j", "DROP"}}
+	case models.PeerIsolationPairs:
+		var err error
+		if rules4, rules6, err = s.compilePeerLinks(server); err != nil {
+			return err
+		}
+		rules4 = append(rules4, []string{"-j", "DROP"})
+		rules6 = append(rules6, []string{"-j", "DROP"})
+	}
+
+	// 使用出口peer的流量经 wg0 -> wg0 转发，在互访策略之前放行
+	if len(rules4) > 0 {
+		exitRules, err := s.exitIsolationRules(server)
+		if err != nil {
+			return err
+		}
+		rules4 = append(exitRules, rules4...)
+	}
+
+	return s.applyForwardChain(server, IsolationChain, rules4, rules6, "-i", server.WgInterface, "-o", server.WgInterface)
+}
+
+// ApplyPeerFirewall 重新应用peer相关的全部命名空间规则（互访策略、ACL和peer网段的转发放行）
+func (s *UserNetworkService) ApplyPeerFirewall(server *models.WireguardServer) error {
+	if err := s.ApplyPeerIsolation(server); err != nil {
+		return err
+	}
+	if err := s.ApplyACLs(server); err != nil {
+		return err
+	}
+
+	peers, err := s.loadPeers(server)
+	if err != nil {
+		return err
+	}
+	return s.applyNamespaceForwarding(server, peers)
+}
+
+// compilePeerLinks 将允许互访的peer对编译为双向放行规则
+func (s *UserNetworkService) compilePeerLinks(server *models.WireguardServer) (rules4, rules6 [][]string, err error) {
+	if server.ID == 0 {
+		return nil, nil, nil
+	}
+
+	var links []models.WireguardPeerLink
+	if err := s.db.Where("server_id = ?", server.ID).Order("id").Find(&links).Error; err != nil {
+		return nil, nil, fmt.Errorf("failed to load peer links: %v", err)
+	}
+
+	peers, err := s.loadPeers(server)
+	if err != nil {
+		return nil, nil, err
+	}
+	peerByID := make(map[uint]models.WireguardPeer, len(peers))
+	for _, peer := range peers {
+		peerByID[peer.ID] = peer
+	}
+
+	for _, link := range links {
+		a, okA := peerByID[link.PeerAID]
+		b, okB := peerByID[link.PeerBID]
+		if !okA || !okB {
+			continue
+		}
+
+		// 双向放行，peer背后的路由网段（站点到站点）与peer自身地址同等对待
+		a4, a6 := peerSources(server, &a)
+		b4, b6 := peerSources(server, &b)
+		rules4 = append(rules4, pairRules(a4, b4)...)
+		rules6 = append(rules6, pairRules(a6, b6)...)
+	}
+	return rules4, rules6, nil
+}
+
+// pairRules 生成两组地址之间双向放行的规则
+func pairRules(a, b []string) [][]string {
+	var rules [][]string
+	for _, sa := range a {
+		for _, sb := range b {
+			rules = append(rules,
+				[]string{"-s", sa, "-d", sb, "-j", "RETURN"},
+				[]string{"-s", sb, "-d", sa, "-j", "RETURN"},
+			)
+		}
+	}
+	return rules
+}
@@ -0,0 +1,133 @@
+package services
+
+import (
+	"cloud-platform/internal/models"
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// KeyRotationService 在密钥轮换的宽限期结束后停用peer的旧公钥
+//
+// 宽限期内旧密钥继续使用peer的地址，旧设备保持连接。新密钥完成握手或宽限期到期后，
+// 旧密钥即被停用并从接口上移除。任何一次 SyncPeers 同样会检查新密钥的握手，
+// 本服务保证在没有其他同步时也能及时切换
+type KeyRotationService struct {
+	db             *gorm.DB
+	networkService *UserNetworkService
+	interval       time.Duration
+	ctx            context.Context
+	cancel         context.CancelFunc
+	mu             sync.Mutex
+}
+
+// NewKeyRotationService 创建密钥轮换服务实例
+func NewKeyRotationService(db *gorm.DB, networkService *UserNetworkService, interval time.Duration) *KeyRotationService {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &KeyRotationService{
+		db:             db,
+		networkService: networkService,
+		interval:       interval,
+		ctx:            ctx,
+		cancel:         cancel,
+	}
+}
+
+// Start 按间隔定期检查进行中的密钥轮换
+func (s *KeyRotationService) Start() {
+	log.Printf("Starting key rotation service with interval: %v", s.interval)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.ProcessRotations()
+		case <-s.ctx.Done():
+			log.Println("Key rotation service stopped")
+			return
+		}
+	}
+}
+
+// Stop 停止密钥轮换服务
+func (s *KeyRotationService) Stop() {
+	log.Println("Stopping key rotation service...")
+	s.cancel()
+}
+
+// ProcessRotations 停用新密钥已完成握手或宽限期已结束的旧密钥，然后重新同步受影响的接口
+func (s *KeyRotationService) ProcessRotations() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var rotations []models.WireguardPeerKeyRotation
+	if err := s.db.Preload("Peer.Server.User").Where("retired_at IS NULL").Find(&rotations).Error; err != nil {
+		log.Printf("Key rotation: failed to load rotations: %v", err)
+		return
+	}
+
+	now := time.Now()
+	stats := make(map[uint]map[string]*models.WireguardPeerStats)
+	servers := make(map[uint]models.WireguardServer)
+
+	for i := range rotations {
+		rotation := &rotations[i]
+		server := rotation.Peer.Server
+
+		retire := !rotation.InGracePeriod(now)
+		if !retire && server.Enabled {
+			// 每个接口只读取一次运行中的peer状态
+			peerStats, ok := stats[server.ID]
+			if !ok {
+				var err error
+				if peerStats, err = s.networkService.GetPeerStats(&server); err != nil {
+					log.Printf("Key rotation: failed to get peer stats for server %d: %v", server.ID, err)
+				}
+				stats[server.ID] = peerStats
+			}
+
+			retire = newKeyHandshaked(rotation, peerStats)
+		}
+
+		if !retire {
+			continue
+		}
+
+		if err := s.db.Model(rotation).Update("retired_at", now).Error; err != nil {
+			log.Printf("Key rotation: failed to retire key of peer %d: %v", rotation.PeerID, err)
+			continue
+		}
+		servers[server.ID] = server
+	}
+
+	for _, server := range servers {
+		synced, err := s.syncServer(&server)
+		if err != nil {
+			log.Printf("Key rotation: failed to sync peers of server %d: %v", server.ID, err)
+			continue
+		}
+		if synced {
+			log.Printf("Key rotation: retired old peer keys on server %d", server.ID)
+		}
+	}
+}
+
+// syncServer 持有服务器的锁，按重新读取的记录同步服务器的peer，服务器已删除时返回 false
+func (s *KeyRotationService) syncServer(server *models.WireguardServer) (bool, error) {
+	unlock, err := s.networkService.LockServer(server)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	return true, s.networkService.SyncPeers(server, server.User.UserUID)
+}
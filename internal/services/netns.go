@@ -1,50 +1,50 @@
 package services
 
 import (
+	"errors"
 	"fmt"
-	"os/exec"
+	"net/netip"
+	"os"
+	"strconv"
 	"strings"
 )
 
 // NetnsService 网络命名空间服务
-type NetnsService struct{}
+// 命名空间、接口、地址和路由通过 NetworkBackend 直接操作内核，iptables/sysctl/tc 等命令通过 CommandRunner 执行
+type NetnsService struct {
+	backend NetworkBackend
+	runner  CommandRunner
+}
 
-// NewNetnsService 创建网络命名空间服务实例
-func NewNetnsService() *NetnsService {
-	return &NetnsService{}
+// NewNetnsService 使用指定的网络后端和命令执行器创建网络命名空间服务实例
+func NewNetnsService(backend NetworkBackend, runner CommandRunner) *NetnsService {
+	return &NetnsService{backend: backend, runner: runner}
 }
 
 // CreateNamespace 创建网络命名空间
 func (s *NetnsService) CreateNamespace(name string) error {
-	// 创建命名空间
-	cmd := exec.Command("ip", "netns", "add", name)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to create namespace %s: %v, output: %s", name, err, string(output))
+	if err := s.backend.CreateNamespace(name); err != nil {
+		return fmt.Errorf("failed to create namespace %s: %w", name, err)
 	}
 	return nil
 }
 
 // DeleteNamespace 删除网络命名空间
 func (s *NetnsService) DeleteNamespace(name string) error {
-	cmd := exec.Command("ip", "netns", "delete", name)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to delete namespace %s: %v, output: %s", name, err, string(output))
+	if err := s.backend.DeleteNamespace(name); err != nil {
+		return fmt.Errorf("failed to delete namespace %s: %w", name, err)
 	}
 	return nil
 }
 
 // NamespaceExists 检查命名空间是否存在
 func (s *NetnsService) NamespaceExists(name string) (bool, error) {
-	cmd := exec.Command("ip", "netns", "list")
-	output, err := cmd.CombinedOutput()
+	namespaces, err := s.ListNamespaces()
 	if err != nil {
-		return false, fmt.Errorf("failed to list namespaces: %v", err)
+		return false, err
 	}
-	
-	namespaces := strings.Split(string(output), "\n")
-	for _, ns := range namespaces {
-		// 命名空间列表格式为 "name (id: X)" 或 "name"
-		nsName := strings.TrimSpace(strings.Split(ns, " ")[0])
+
+	for _, nsName := range namespaces {
 		if nsName == name {
 			return true, nil
 		}
@@ -52,6 +52,15 @@ func (s *NetnsService) NamespaceExists(name string) (bool, error) {
 	return false, nil
 }
 
+// ListNamespaces 列出主机上所有网络命名空间名称
+func (s *NetnsService) ListNamespaces() ([]string, error) {
+	names, err := s.backend.ListNamespaces()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list namespaces: %w", err)
+	}
+	return names, nil
+}
+
 // CreateVethPair 创建veth对并配置网络连接
 // vethHost: 主机端接口名
 // vethNs: 命名空间端接口名
@@ -59,235 +68,548 @@ func (s *NetnsService) NamespaceExists(name string) (bool, error) {
 // nsIP: 命名空间内IP地址 (CIDR格式, 如 "10.200.1.2/24")
 // hostIP: 主机端IP地址 (CIDR格式, 如 "10.200.1.1/24")
 func (s *NetnsService) CreateVethPair(vethHost, vethNs, nsName, nsIP, hostIP string) error {
-	// 1. 创建veth对
-	cmd := exec.Command("ip", "link", "add", vethHost, "type", "veth", "peer", "name", vethNs)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to create veth pair: %v, output: %s", err, string(output))
+	hostAddr, err := netip.ParsePrefix(hostIP)
+	if err != nil {
+		return fmt.Errorf("invalid host veth address %s: %v", hostIP, err)
+	}
+	nsAddr, err := netip.ParsePrefix(nsIP)
+	if err != nil {
+		return fmt.Errorf("invalid namespace veth address %s: %v", nsIP, err)
 	}
 
-	// 2. 将vethNs移动到命名空间
-	cmd = exec.Command("ip", "link", "set", vethNs, "netns", nsName)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to move veth to namespace: %v, output: %s", err, string(output))
+	// 1. 创建veth对，命名空间端直接创建在命名空间内
+	if err := s.backend.AddLink("", Link{Name: vethHost, Kind: LinkVeth, PeerName: vethNs, PeerNamespace: nsName}); err != nil {
+		return fmt.Errorf("failed to create veth pair: %w", err)
 	}
 
-	// 3. 启动主机端接口
-	cmd = exec.Command("ip", "link", "set", vethHost, "up")
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to bring up host veth: %v, output: %s", err, string(output))
+	// 2. 启动主机端接口并配置IP
+	if err := s.backend.SetLinkUp("", vethHost); err != nil {
+		return fmt.Errorf("failed to bring up host veth: %w", err)
+	}
+	if err := s.backend.ReplaceAddress("", vethHost, hostAddr, false); err != nil {
+		return fmt.Errorf("failed to add IP to host veth: %w", err)
 	}
 
-	// 4. 配置主机端IP
-	cmd = exec.Command("ip", "addr", "add", hostIP, "dev", vethHost)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to add IP to host veth: %v, output: %s", err, string(output))
+	// 3. 在命名空间内启动lo和veth接口并配置IP
+	if err := s.backend.SetLinkUp(nsName, "lo"); err != nil {
+		return fmt.Errorf("failed to bring up lo in namespace: %w", err)
+	}
+	if err := s.backend.SetLinkUp(nsName, vethNs); err != nil {
+		return fmt.Errorf("failed to bring up veth in namespace: %w", err)
+	}
+	if err := s.backend.ReplaceAddress(nsName, vethNs, nsAddr, false); err != nil {
+		return fmt.Errorf("failed to add IP to namespace veth: %w", err)
 	}
 
-	// 5. 在命名空间内配置网络
-	// 5.1 启动lo接口
-	cmd = exec.Command("ip", "netns", "exec", nsName, "ip", "link", "set", "lo", "up")
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to bring up lo in namespace: %v, output: %s", err, string(output))
+	// 4. 设置默认路由 (使用主机端IP作为网关)
+	defaultRoute := Route{Destination: netip.MustParsePrefix("0.0.0.0/0"), Gateway: hostAddr.Addr(), Device: vethNs}
+	if err := s.backend.AddRoute(nsName, defaultRoute); err != nil {
+		return fmt.Errorf("failed to add default route in namespace: %w", err)
 	}
 
-	// 5.2 启动veth接口
-	cmd = exec.Command("ip", "netns", "exec", nsName, "ip", "link", "set", vethNs, "up")
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to bring up veth in namespace: %v, output: %s", err, string(output))
+	return nil
+}
+
+// EnableIPForwarding 在主机上启用IPv4转发，使命名空间能经外网接口访问外网
+// NAT和转发规则由防火墙后端维护（见 UserNetworkService.applyHostFirewall）
+func (s *NetnsService) EnableIPForwarding() error {
+	if output, err := s.runner.Run("sysctl", "-w", "net.ipv4.ip_forward=1"); err != nil {
+		return fmt.Errorf("failed to enable IP forwarding: %v, output: %s", err, string(output))
 	}
+	return nil
+}
 
-	// 5.3 配置IP地址
-	cmd = exec.Command("ip", "netns", "exec", nsName, "ip", "addr", "add", nsIP, "dev", vethNs)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to add IP to namespace veth: %v, output: %s", err, string(output))
+// appendFirewallRule 使用指定的 iptables/ip6tables 追加规则，规则已存在时不重复添加
+func (s *NetnsService) appendFirewallRule(binary, nsName, table, chain string, rule ...string) error {
+	base := []string{binary, "-t", table}
+	if nsName != "" {
+		base = append([]string{"ip", "netns", "exec", nsName}, base...)
 	}
 
-	// 5.4 设置默认路由 (使用主机端IP作为网关)
-	gateway := strings.Split(hostIP, "/")[0] // 提取IP地址部分
-	cmd = exec.Command("ip", "netns", "exec", nsName, "ip", "route", "add", "default", "via", gateway)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to add default route in namespace: %v, output: %s", err, string(output))
+	// 使用 -C 检查规则是否已存在
+	checkArgs := append(append(append([]string{}, base...), "-C", chain), rule...)
+	if _, err := s.runner.Run(checkArgs[0], checkArgs[1:]...); err == nil {
+		return nil
 	}
 
+	addArgs := append(append(append([]string{}, base...), "-A", chain), rule...)
+	if output, err := s.runner.Run(addArgs[0], addArgs[1:]...); err != nil {
+		return fmt.Errorf("%v, output: %s", err, string(output))
+	}
 	return nil
 }
 
-// EnableNAT 为命名空间启用NAT，使其能访问外网
-// nsSubnet: 命名空间子网 (CIDR格式, 如 "10.200.1.0/24")
-// outInterface: 出口网络接口 (如 "eth0")
-func (s *NetnsService) EnableNAT(nsSubnet, outInterface string) error {
-	// 启用IP转发
-	cmd := exec.Command("sysctl", "-w", "net.ipv4.ip_forward=1")
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to enable IP forwarding: %v, output: %s", err, string(output))
+// insertFirewallRule 将规则插入到链首，规则已存在时不重复添加
+// 用于必须先于其他规则匹配的跳转规则（如 ACL 链）
+func (s *NetnsService) insertFirewallRule(binary, nsName, table, chain string, rule ...string) error {
+	base := []string{binary, "-t", table}
+	if nsName != "" {
+		base = append([]string{"ip", "netns", "exec", nsName}, base...)
 	}
 
-	// 添加iptables NAT规则
-	cmd = exec.Command("iptables", "-t", "nat", "-A", "POSTROUTING", "-s", nsSubnet, "-o", outInterface, "-j", "MASQUERADE")
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to add NAT rule: %v, output: %s", err, string(output))
+	checkArgs := append(append(append([]string{}, base...), "-C", chain), rule...)
+	if _, err := s.runner.Run(checkArgs[0], checkArgs[1:]...); err == nil {
+		return nil
 	}
 
-	// 允许转发
-	cmd = exec.Command("iptables", "-A", "FORWARD", "-i", outInterface, "-o", "veth+", "-j", "ACCEPT")
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to add forward rule: %v, output: %s", err, string(output))
+	insertArgs := append(append(append([]string{}, base...), "-I", chain, "1"), rule...)
+	if output, err := s.runner.Run(insertArgs[0], insertArgs[1:]...); err != nil {
+		return fmt.Errorf("%v, output: %s", err, string(output))
 	}
+	return nil
+}
 
-	cmd = exec.Command("iptables", "-A", "FORWARD", "-o", outInterface, "-i", "veth+", "-j", "ACCEPT")
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to add forward rule: %v, output: %s", err, string(output))
+// ReplaceChain 原子替换命名空间内自定义链的全部规则（链不存在时自动创建）
+// 通过 iptables-restore --noflush 一次提交，只刷新该链，其他链的规则保持不变，
+// 替换过程中不存在规则部分生效的中间状态
+func (s *NetnsService) ReplaceChain(binary, nsName, table, chain string, rules [][]string) error {
+	var input strings.Builder
+	fmt.Fprintf(&input, "*%s\n:%s - [0:0]\n", table, chain)
+	for _, rule := range rules {
+		fmt.Fprintf(&input, "-A %s %s\n", chain, strings.Join(rule, " "))
 	}
+	input.WriteString("COMMIT\n")
 
+	args := []string{binary + "-restore", "--noflush"}
+	if nsName != "" {
+		args = append([]string{"ip", "netns", "exec", nsName}, args...)
+	}
+	if output, err := s.runner.RunWithInput([]byte(input.String()), args[0], args[1:]...); err != nil {
+		return fmt.Errorf("failed to replace chain %s: %v, output: %s", chain, err, string(output))
+	}
 	return nil
 }
 
-// SetupPortForwarding 设置端口转发，将主机端口转发到命名空间内的服务
-// outInterface: 外部网络接口 (如 "eth0")
-// externalPort: 外部端口
-// nsIP: 命名空间内的IP地址 (不带CIDR)
-// internalPort: 命名空间内的端口
-// protocol: 协议 ("tcp" 或 "udp")
-func (s *NetnsService) SetupPortForwarding(outInterface string, externalPort int, nsIP string, internalPort int, protocol string) error {
-	// 1. 允许外部访问该端口
-	cmd := exec.Command("iptables", "-A", "INPUT", "-i", outInterface, "-p", protocol, "--dport", fmt.Sprintf("%d", externalPort), "-j", "ACCEPT")
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to add INPUT rule: %v, output: %s", err, string(output))
+// EnsureChainJump 确保在 fromChain 链首跳转到自定义链 chain
+// match 为跳转条件（如 "-i", "wg0"）
+func (s *NetnsService) EnsureChainJump(binary, nsName, table, fromChain, chain string, match ...string) error {
+	rule := append(append([]string{}, match...), "-j", chain)
+	if err := s.insertFirewallRule(binary, nsName, table, fromChain, rule...); err != nil {
+		return fmt.Errorf("failed to add jump to chain %s: %v", chain, err)
 	}
+	return nil
+}
+
+// 命名空间与主机之间的IPv6仅使用固定的链路本地地址互通
+// 用户IPv6网段通过路由直接到达主机，由主机统一做NAT66，命名空间内不再做IPv6 NAT
+const (
+	vethHostLinkLocal = "fe80::1"
+	vethNsLinkLocal   = "fe80::2"
+)
 
-	// 2. 设置DNAT规则，将外部端口流量转发到命名空间内部IP和端口
-	cmd = exec.Command("iptables", "-t", "nat", "-A", "PREROUTING", "-i", outInterface, "-p", protocol, "--dport", fmt.Sprintf("%d", externalPort), "-j", "DNAT", "--to-destination", fmt.Sprintf("%s:%d", nsIP, internalPort))
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to add DNAT rule: %v, output: %s", err, string(output))
+// EnableIPv6 为命名空间配置IPv6转发：链路本地地址和双向路由（主机侧NAT66由防火墙后端维护）
+// vethHost/vethNs: veth对两端接口名
+// wgSubnet6: 用户的IPv6网段 (CIDR格式, 如 "fd00:100:0:1::/64")
+// outInterface: 主机外网接口，IPv6转发是主机全局设置，开启后内核默认不再接受该接口上的路由通告（RA），
+// 因此先将其 accept_ra 从1改为2，通过SLAAC/RA获得的默认路由不会丢失（为0时保持静态配置不变）
+// 地址和路由都以替换方式设置，重复调用是安全的
+func (s *NetnsService) EnableIPv6(vethHost, vethNs, nsName, wgSubnet6, outInterface string) error {
+	subnet, err := netip.ParsePrefix(wgSubnet6)
+	if err != nil {
+		return fmt.Errorf("invalid IPv6 subnet %s: %v", wgSubnet6, err)
 	}
 
-	// 3. 允许转发到命名空间
-	cmd = exec.Command("iptables", "-A", "FORWARD", "-i", outInterface, "-p", protocol, "--dport", fmt.Sprintf("%d", internalPort), "-d", nsIP, "-j", "ACCEPT")
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to add FORWARD rule: %v, output: %s", err, string(output))
+	if outInterface != "" {
+		if err := s.keepAcceptingRA(outInterface); err != nil {
+			return err
+		}
 	}
 
-	// 4. 允许从命名空间返回的流量
-	cmd = exec.Command("iptables", "-A", "FORWARD", "-o", outInterface, "-p", protocol, "--sport", fmt.Sprintf("%d", internalPort), "-s", nsIP, "-j", "ACCEPT")
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to add FORWARD return rule: %v, output: %s", err, string(output))
+	// 启用IPv6转发
+	if output, err := s.runner.Run("sysctl", "-w", "net.ipv6.conf.all.forwarding=1"); err != nil {
+		return fmt.Errorf("failed to enable IPv6 forwarding: %v, output: %s", err, string(output))
+	}
+
+	hostLinkLocal := netip.MustParseAddr(vethHostLinkLocal)
+	nsLinkLocal := netip.MustParseAddr(vethNsLinkLocal)
+
+	// 1. veth两端配置固定的链路本地地址
+	if err := s.backend.ReplaceAddress("", vethHost, netip.PrefixFrom(hostLinkLocal, 64), true); err != nil {
+		return fmt.Errorf("failed to configure IPv6 address on %s: %w", vethHost, err)
+	}
+	if err := s.backend.ReplaceAddress(nsName, vethNs, netip.PrefixFrom(nsLinkLocal, 64), true); err != nil {
+		return fmt.Errorf("failed to configure IPv6 address on %s/%s: %w", nsName, vethNs, err)
+	}
+
+	// 2. 命名空间IPv6默认路由指向主机
+	if err := s.backend.ReplaceRoute(nsName, Route{Destination: netip.MustParsePrefix("::/0"), Gateway: hostLinkLocal, Device: vethNs}); err != nil {
+		return fmt.Errorf("failed to add IPv6 default route in namespace: %w", err)
+	}
+
+	// 3. 主机上用户IPv6网段的路由指向命名空间
+	if err := s.backend.ReplaceRoute("", Route{Destination: subnet.Masked(), Gateway: nsLinkLocal, Device: vethHost}); err != nil {
+		return fmt.Errorf("failed to add IPv6 route for %s: %w", wgSubnet6, err)
 	}
 
 	return nil
 }
 
-// RemovePortForwarding 删除端口转发规则
-func (s *NetnsService) RemovePortForwarding(outInterface string, externalPort int, nsIP string, internalPort int, protocol string) error {
-	// 删除规则（忽略错误）
-	exec.Command("iptables", "-D", "INPUT", "-i", outInterface, "-p", protocol, "--dport", fmt.Sprintf("%d", externalPort), "-j", "ACCEPT").CombinedOutput()
-	exec.Command("iptables", "-t", "nat", "-D", "PREROUTING", "-i", outInterface, "-p", protocol, "--dport", fmt.Sprintf("%d", externalPort), "-j", "DNAT", "--to-destination", fmt.Sprintf("%s:%d", nsIP, internalPort)).CombinedOutput()
-	exec.Command("iptables", "-D", "FORWARD", "-i", outInterface, "-p", protocol, "--dport", fmt.Sprintf("%d", internalPort), "-d", nsIP, "-j", "ACCEPT").CombinedOutput()
-	exec.Command("iptables", "-D", "FORWARD", "-o", outInterface, "-p", protocol, "--sport", fmt.Sprintf("%d", internalPort), "-s", nsIP, "-j", "ACCEPT").CombinedOutput()
+// keepAcceptingRA 使主机接口在开启IPv6转发后继续接受路由通告：accept_ra 为1时改为2
+func (s *NetnsService) keepAcceptingRA(iface string) error {
+	// sysctl 键中的点是分隔符，VLAN接口名（如 eth0.100）中的点需要写成斜杠
+	key := "net.ipv6.conf." + strings.ReplaceAll(iface, ".", "/") + ".accept_ra"
+	output, err := s.runner.Run("sysctl", "-n", key)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v, output: %s", key, err, string(output))
+	}
+	if strings.TrimSpace(string(output)) != "1" {
+		return nil
+	}
+	if output, err := s.runner.Run("sysctl", "-w", key+"=2"); err != nil {
+		return fmt.Errorf("failed to set %s: %v, output: %s", key, err, string(output))
+	}
 	return nil
 }
 
 // ExecInNamespace 在指定命名空间中执行命令
 func (s *NetnsService) ExecInNamespace(nsName string, command []string) (string, error) {
 	args := append([]string{"netns", "exec", nsName}, command...)
-	cmd := exec.Command("ip", args...)
-	output, err := cmd.CombinedOutput()
+	output, err := s.runner.Run("ip", args...)
 	if err != nil {
 		return "", fmt.Errorf("failed to exec command in namespace %s: %v, output: %s", nsName, err, string(output))
 	}
 	return string(output), nil
 }
 
-// AddRouteForPeer 为peer的allowedIPs添加路由规则
-// 确保命名空间内访问这些IP时通过WireGuard接口
-func (s *NetnsService) AddRouteForPeer(nsName, wgInterface, allowedIPs string) error {
-	// allowedIPs 可能包含多个网段，用逗号分隔
-	ipRanges := strings.Split(allowedIPs, ",")
-	
-	for _, ipRange := range ipRanges {
-		ipRange = strings.TrimSpace(ipRange)
-		if ipRange == "" {
-			continue
+// AddTableRoutes 在命名空间内的路由表 table（main 为主路由表）中添加（或替换）经WireGuard接口的路由
+// allowedIPs 为逗号分隔的网段列表
+func (s *NetnsService) AddTableRoutes(nsName, table, wgInterface, allowedIPs string) error {
+	tableID, err := routeTableID(table)
+	if err != nil {
+		return err
+	}
+	prefixes, err := parsePrefixList(allowedIPs)
+	if err != nil {
+		return err
+	}
+
+	for _, prefix := range prefixes {
+		if err := s.backend.ReplaceRoute(nsName, Route{Destination: prefix, Device: wgInterface, Table: tableID}); err != nil {
+			return fmt.Errorf("failed to add route for %s to table %s: %w", prefix, table, err)
 		}
-		
-		// 添加路由：目标网段通过WireGuard接口
-		cmd := exec.Command("ip", "netns", "exec", nsName, "ip", "route", "add", ipRange, "dev", wgInterface)
-		if output, err := cmd.CombinedOutput(); err != nil {
-			// 如果路由已存在，忽略错误
-			if !strings.Contains(string(output), "File exists") {
-				return fmt.Errorf("failed to add route for %s: %v, output: %s", ipRange, err, string(output))
-			}
+	}
+	return nil
+}
+
+// DeleteTableRoutes 删除路由表 table 中经WireGuard接口到 allowedIPs 的路由
+func (s *NetnsService) DeleteTableRoutes(nsName, table, wgInterface, allowedIPs string) error {
+	tableID, err := routeTableID(table)
+	if err != nil {
+		return err
+	}
+	prefixes, err := parsePrefixList(allowedIPs)
+	if err != nil {
+		return err
+	}
+
+	for _, prefix := range prefixes {
+		// 删除路由，路由或接口不存在时忽略
+		if err := s.backend.DeleteRoute(nsName, Route{Destination: prefix, Device: wgInterface, Table: tableID}); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to delete route for %s from table %s: %w", prefix, table, err)
 		}
 	}
-	
+
 	return nil
 }
 
-// DeleteRouteForPeer 删除peer的allowedIPs路由规则
-func (s *NetnsService) DeleteRouteForPeer(nsName, wgInterface, allowedIPs string) error {
-	ipRanges := strings.Split(allowedIPs, ",")
-	
-	for _, ipRange := range ipRanges {
-		ipRange = strings.TrimSpace(ipRange)
-		if ipRange == "" {
+// routeTableID 解析路由表编号（main 为主路由表）
+func routeTableID(table string) (int, error) {
+	if table == "main" {
+		return 0, nil
+	}
+	id, err := strconv.Atoi(table)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("invalid route table %q", table)
+	}
+	return id, nil
+}
+
+// EnsureSourceRules 使命名空间内查询路由表 table 的策略路由规则恰好为 sources 中的源地址（优先级 priority）
+// 只增删有差异的规则，已存在的规则保持不变，避免替换过程中流量短暂走错路由
+func (s *NetnsService) EnsureSourceRules(nsName, table string, priority int, sources []string) error {
+	tableID, err := routeTableID(table)
+	if err != nil {
+		return err
+	}
+	rules, err := s.backend.ListPolicyRules(nsName)
+	if err != nil {
+		return fmt.Errorf("failed to list ip rules: %w", err)
+	}
+
+	existing := make(map[netip.Prefix]PolicyRule)
+	for _, rule := range rules {
+		if rule.Table == tableID && rule.Source.IsValid() {
+			existing[rule.Source] = rule
+		}
+	}
+
+	wanted := make(map[netip.Prefix]bool, len(sources))
+	for _, source := range sources {
+		prefixes, err := parsePrefixList(source)
+		if err != nil || len(prefixes) != 1 {
+			return fmt.Errorf("invalid rule source %q", source)
+		}
+		prefix := prefixes[0]
+		wanted[prefix] = true
+		if _, ok := existing[prefix]; ok {
 			continue
 		}
-		
-		// 删除路由
-		cmd := exec.Command("ip", "netns", "exec", nsName, "ip", "route", "del", ipRange, "dev", wgInterface)
-		if output, err := cmd.CombinedOutput(); err != nil {
-			// 如果路由不存在，忽略错误
-			if !strings.Contains(string(output), "No such process") && !strings.Contains(string(output), "not found") {
-				return fmt.Errorf("failed to delete route for %s: %v, output: %s", ipRange, err, string(output))
-			}
+		if err := s.backend.AddPolicyRule(nsName, PolicyRule{Priority: priority, Source: prefix, Table: tableID}); err != nil {
+			return fmt.Errorf("failed to add ip rule for %s: %w", source, err)
+		}
+	}
+
+	for prefix, rule := range existing {
+		if !wanted[prefix] {
+			s.backend.DeletePolicyRule(nsName, rule)
 		}
 	}
-	
 	return nil
 }
 
-// AddIptablesRuleForPeer 为peer添加iptables规则（如果需要NAT或转发控制）
-func (s *NetnsService) AddIptablesRuleForPeer(nsName, allowedIPs string) error {
-	ipRanges := strings.Split(allowedIPs, ",")
-	
-	for _, ipRange := range ipRanges {
-		ipRange = strings.TrimSpace(ipRange)
-		if ipRange == "" {
+// EnsureLookupRule 在指定优先级添加查询路由表 table 的策略路由规则（不限源地址），table 为空时删除该优先级的规则
+// 表中没有匹配的路由时继续匹配后续规则
+func (s *NetnsService) EnsureLookupRule(nsName, table string, priority int, ipv6 bool) error {
+	rules, err := s.backend.ListPolicyRules(nsName)
+	if err != nil {
+		return fmt.Errorf("failed to list ip rules: %w", err)
+	}
+
+	tableID := 0
+	if table != "" {
+		if tableID, err = routeTableID(table); err != nil {
+			return err
+		}
+	}
+	exists := false
+	for _, rule := range rules {
+		if rule.Priority != priority || rule.IPv6 != ipv6 {
 			continue
 		}
-		
-		// 允许转发到该网段
-		cmd := exec.Command("ip", "netns", "exec", nsName, "iptables", "-A", "FORWARD", "-d", ipRange, "-j", "ACCEPT")
-		if output, err := cmd.CombinedOutput(); err != nil {
-			return fmt.Errorf("failed to add iptables forward rule for %s: %v, output: %s", ipRange, err, string(output))
+		if rule.Table == tableID && !rule.Source.IsValid() && !rule.SuppressDefault {
+			exists = true
+			continue
 		}
-		
-		// 允许从该网段转发回来
-		cmd = exec.Command("ip", "netns", "exec", nsName, "iptables", "-A", "FORWARD", "-s", ipRange, "-j", "ACCEPT")
-		if output, err := cmd.CombinedOutput(); err != nil {
-			return fmt.Errorf("failed to add iptables forward rule for %s: %v, output: %s", ipRange, err, string(output))
+		// 表号变化后删除查询旧表的规则
+		s.backend.DeletePolicyRule(nsName, rule)
+	}
+
+	if table != "" && !exists {
+		if err := s.backend.AddPolicyRule(nsName, PolicyRule{Priority: priority, Table: tableID, IPv6: ipv6}); err != nil {
+			return fmt.Errorf("failed to add ip rule for table %s: %w", table, err)
 		}
 	}
-	
 	return nil
 }
 
-// DeleteIptablesRuleForPeer 删除peer的iptables规则
-func (s *NetnsService) DeleteIptablesRuleForPeer(nsName, allowedIPs string) error {
-	ipRanges := strings.Split(allowedIPs, ",")
-	
-	for _, ipRange := range ipRanges {
-		ipRange = strings.TrimSpace(ipRange)
-		if ipRange == "" {
-			continue
+// EnsureSuppressDefaultRule 在指定优先级添加（或删除）"lookup main suppress_prefixlength 0" 规则：
+// 主路由表中除默认路由以外的路由（用户网段、peer背后的网段、veth）优先于后续的策略路由表
+func (s *NetnsService) EnsureSuppressDefaultRule(nsName string, priority int, enabled bool) error {
+	rules, err := s.backend.ListPolicyRules(nsName)
+	if err != nil {
+		return fmt.Errorf("failed to list ip rules: %w", err)
+	}
+	exists := false
+	for _, rule := range rules {
+		if rule.Priority == priority {
+			exists = true
+			break
 		}
-		
-		// 删除转发规则（忽略错误）
-		cmd := exec.Command("ip", "netns", "exec", nsName, "iptables", "-D", "FORWARD", "-d", ipRange, "-j", "ACCEPT")
-		cmd.CombinedOutput()
-		
-		cmd = exec.Command("ip", "netns", "exec", nsName, "iptables", "-D", "FORWARD", "-s", ipRange, "-j", "ACCEPT")
-		cmd.CombinedOutput()
-	}
-	
+	}
+
+	rule := PolicyRule{Priority: priority, SuppressDefault: true}
+	switch {
+	case enabled && !exists:
+		if err := s.backend.AddPolicyRule(nsName, rule); err != nil {
+			return fmt.Errorf("failed to add suppress rule: %w", err)
+		}
+	case !enabled && exists:
+		s.backend.DeletePolicyRule(nsName, rule)
+	}
+	return nil
+}
+
+// SetTableDefaultRoute 设置（或清空）命名空间内路由表 table 的默认路由
+// dev 为空时删除该表的默认路由，查询该表的流量回退到后续规则（主路由表）
+func (s *NetnsService) SetTableDefaultRoute(nsName, table, dev string) error {
+	tableID, err := routeTableID(table)
+	if err != nil {
+		return err
+	}
+	route := Route{Destination: netip.MustParsePrefix("0.0.0.0/0"), Device: dev, Table: tableID}
+
+	if dev == "" {
+		if err := s.backend.DeleteRoute(nsName, route); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to clear table %s: %w", table, err)
+		}
+		return nil
+	}
+
+	if err := s.backend.ReplaceRoute(nsName, route); err != nil {
+		return fmt.Errorf("failed to set default route in table %s: %w", table, err)
+	}
+	return nil
+}
+
+// EnableForwarding 启用命名空间内的IPv4转发（ipv6 为 true 时同时启用IPv6转发）
+func (s *NetnsService) EnableForwarding(nsName string, ipv6 bool) error {
+	if err := s.backend.SetLinkUp(nsName, "lo"); err != nil {
+		return fmt.Errorf("failed to bring up lo in namespace: %w", err)
+	}
+	settings := []string{"net.ipv4.ip_forward=1"}
+	if ipv6 {
+		settings = append(settings, "net.ipv6.conf.all.forwarding=1")
+	}
+	for _, setting := range settings {
+		if output, err := s.runner.Run("ip", "netns", "exec", nsName, "sysctl", "-w", setting); err != nil {
+			return fmt.Errorf("failed to enable forwarding in namespace %s: %v, output: %s", nsName, err, string(output))
+		}
+	}
+	return nil
+}
+
+// CreateNamespaceLink 在两个命名空间之间直接创建veth对并配置地址（CIDR格式）
+// 接口在命名空间内创建，名称只需在各自命名空间内唯一，不占用主机上的接口名
+func (s *NetnsService) CreateNamespaceLink(nsA, ifA, addrA, nsB, ifB, addrB string) error {
+	if err := s.backend.AddLink(nsA, Link{Name: ifA, Kind: LinkVeth, PeerName: ifB, PeerNamespace: nsB}); err != nil {
+		return fmt.Errorf("failed to create link %s/%s <-> %s/%s: %w", nsA, ifA, nsB, ifB, err)
+	}
+
+	for _, end := range [][3]string{{nsA, ifA, addrA}, {nsB, ifB, addrB}} {
+		address, err := netip.ParsePrefix(end[2])
+		if err != nil {
+			return fmt.Errorf("invalid address %s: %v", end[2], err)
+		}
+		if err := s.backend.ReplaceAddress(end[0], end[1], address, false); err != nil {
+			return fmt.Errorf("failed to add IP to %s/%s: %w", end[0], end[1], err)
+		}
+		if err := s.backend.SetLinkUp(end[0], end[1]); err != nil {
+			return fmt.Errorf("failed to bring up %s/%s: %w", end[0], end[1], err)
+		}
+	}
+	return nil
+}
+
+// CreateIfbLink 在命名空间内创建并启动 ifb 接口（用于入站限速）
+func (s *NetnsService) CreateIfbLink(nsName, ifName string) error {
+	if err := s.backend.AddLink(nsName, Link{Name: ifName, Kind: LinkIfb}); err != nil {
+		return fmt.Errorf("failed to create ifb %s/%s: %w", nsName, ifName, err)
+	}
+	if err := s.backend.SetLinkUp(nsName, ifName); err != nil {
+		return fmt.Errorf("failed to bring up %s/%s: %w", nsName, ifName, err)
+	}
+	return nil
+}
+
+// ListLinks 列出命名空间内的网络接口名称
+func (s *NetnsService) ListLinks(nsName string) ([]string, error) {
+	names, err := s.backend.ListLinks(nsName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list links in namespace %s: %w", nsName, err)
+	}
+	return names, nil
+}
+
+// ListHostLinks 列出主机上的全部网络接口名称
+func (s *NetnsService) ListHostLinks() ([]string, error) {
+	names, err := s.backend.ListLinks("")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list host links: %w", err)
+	}
+	return names, nil
+}
+
+// DeleteHostLink 删除主机上的网络接口（veth对的另一端由内核一并删除）
+func (s *NetnsService) DeleteHostLink(ifName string) error {
+	if err := s.backend.DeleteLink("", ifName); err != nil {
+		return fmt.Errorf("failed to delete link %s: %w", ifName, err)
+	}
+	return nil
+}
+
+// DeleteLink 删除命名空间内的网络接口（veth对的另一端由内核一并删除）
+func (s *NetnsService) DeleteLink(nsName, ifName string) error {
+	if err := s.backend.DeleteLink(nsName, ifName); err != nil {
+		return fmt.Errorf("failed to delete link %s/%s: %w", nsName, ifName, err)
+	}
+	return nil
+}
+
+// SetLinkMTU 修改命名空间内网络接口的MTU
+func (s *NetnsService) SetLinkMTU(nsName, ifName string, mtu int) error {
+	if err := s.backend.SetLinkMTU(nsName, ifName, mtu); err != nil {
+		return fmt.Errorf("failed to set mtu of %s/%s: %w", nsName, ifName, err)
+	}
+	return nil
+}
+
+// EnsureDeviceRoutes 使命名空间内经接口 dev、网关 via 的静态路由恰好为 prefixes
+// 只增删有差异的路由，接口地址对应的直连路由不受影响
+func (s *NetnsService) EnsureDeviceRoutes(nsName, dev, via string, prefixes []string) error {
+	gateway, err := netip.ParseAddr(via)
+	if err != nil {
+		return fmt.Errorf("invalid gateway %s: %v", via, err)
+	}
+	routes, err := s.ListDeviceRoutes(nsName, "main", dev)
+	if err != nil {
+		return err
+	}
+
+	wanted := make(map[string]bool, len(prefixes))
+	for _, item := range prefixes {
+		parsed, err := parsePrefixList(item)
+		if err != nil || len(parsed) != 1 {
+			return fmt.Errorf("invalid route %q", item)
+		}
+		prefix := parsed[0]
+		wanted[prefix.String()] = true
+		if err := s.backend.ReplaceRoute(nsName, Route{Destination: prefix, Gateway: gateway, Device: dev}); err != nil {
+			return fmt.Errorf("failed to add route %s via %s: %w", prefix, via, err)
+		}
+	}
+
+	for _, route := range routes {
+		if !wanted[route] {
+			s.backend.DeleteRoute(nsName, Route{Destination: netip.MustParsePrefix(route), Device: dev})
+		}
+	}
+	return nil
+}
+
+// ListDeviceRoutes 列出命名空间内路由表 table（main 为主路由表）中经 dev 的静态路由目标
+// （CIDR格式，不包括内核自动添加的直连路由）
+func (s *NetnsService) ListDeviceRoutes(nsName, table, dev string) ([]string, error) {
+	tableID, err := routeTableID(table)
+	if err != nil {
+		return nil, err
+	}
+	routes, err := s.backend.ListRoutes(nsName, dev, tableID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list routes on %s: %w", dev, err)
+	}
+
+	prefixes := make([]string, 0, len(routes))
+	for _, route := range routes {
+		prefixes = append(prefixes, route.Destination.String())
+	}
+	return prefixes, nil
+}
+
+// SaveRules 导出 iptables/ip6tables 的全部规则（iptables-save 格式，nsName 为空表示主机）
+func (s *NetnsService) SaveRules(binary, nsName string) (string, error) {
+	command := namespaceCommand(nsName, binary+"-save")
+	output, err := s.runner.Run(command[0], command[1:]...)
+	if err != nil {
+		return "", fmt.Errorf("failed to save %s rules: %v, output: %s", binary, err, string(output))
+	}
+	return string(output), nil
+}
+
+// DeleteRule 删除一条规则，spec 为 iptables-save 中 -A 之后的部分（链名和匹配条件）
+func (s *NetnsService) DeleteRule(binary, nsName, table string, spec []string) error {
+	command := namespaceCommand(nsName, append([]string{binary, "-t", table, "-D"}, spec...)...)
+	if output, err := s.runner.Run(command[0], command[1:]...); err != nil {
+		return fmt.Errorf("failed to delete rule %s: %v, output: %s", strings.Join(spec, " "), err, string(output))
+	}
 	return nil
 }
@@ -0,0 +1,47 @@
+package services
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestKeepAcceptingRA(t *testing.T) {
+	tests := []struct {
+		iface   string
+		current string
+		wantSet string // 为空表示不修改
+	}{
+		{"eth0", "1", "net.ipv6.conf.eth0.accept_ra=2"},
+		{"eth0.100", "1", "net.ipv6.conf.eth0/100.accept_ra=2"},
+		// 已经接受RA或者是静态配置时保持不变
+		{"eth0", "2", ""},
+		{"eth0", "0", ""},
+	}
+
+	for _, tt := range tests {
+		runner := NewFakeRunner()
+		runner.Handle("sysctl -n", func(args []string, input []byte) ([]byte, error) {
+			return []byte(tt.current + "\n"), nil
+		})
+		s := NewNetnsService(NewFakeBackend(), runner)
+
+		if err := s.keepAcceptingRA(tt.iface); err != nil {
+			t.Fatalf("keepAcceptingRA(%s): %v", tt.iface, err)
+		}
+
+		var set []string
+		for _, call := range runner.Calls() {
+			if slices.Equal(call[:2], []string{"sysctl", "-w"}) {
+				set = append(set, strings.Join(call[2:], " "))
+			}
+		}
+		var want []string
+		if tt.wantSet != "" {
+			want = []string{tt.wantSet}
+		}
+		if !slices.Equal(set, want) {
+			t.Errorf("%s with accept_ra=%s: sysctl -w calls = %q, want %q", tt.iface, tt.current, set, want)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package services
+
+import (
+	"cloud-platform/internal/models"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// 命名空间内的基础规则链
+const (
+	// NamespaceForwardChain 放行 WireGuard 接口和peer背后网段的转发，由 FORWARD 链末尾跳转（在ACL、互访策略之后匹配）
+	NamespaceForwardChain = "WG_FORWARD"
+	// NamespaceNATChain 对从veth出去的 WireGuard 网段流量做 MASQUERADE，由 POSTROUTING 链末尾跳转
+	NamespaceNATChain = "WG_NAT"
+	// NamespaceDNSChain 将发往 WireGuard 接口地址53端口的查询DNAT到内置DNS服务器，由 PREROUTING 链首跳转
+	NamespaceDNSChain = "WG_DNS"
+)
+
+// 主机上的规则链
+const (
+	// HostForwardChain 放行用户veth与外网接口之间的转发
+	HostForwardChain = "WG_FORWARD"
+	// HostNATChain 对用户命名空间访问外网的流量做 MASQUERADE（IPv4 为veth地址池，IPv6 为用户IPv6地址池）
+	HostNATChain = "WG_NAT"
+	// HostInputChain 放行命名空间发往内置DNS服务器的查询
+	HostInputChain = "WG_INPUT"
+	// hostDNATChainPrefix 每个服务器一条，将 WireGuard 端口和公网转发端口DNAT到命名空间
+	hostDNATChainPrefix = "WG_DNAT_"
+)
+
+// vethPatterns 主机上用户veth接口名的通配（第一个服务器为 veth-h-*，其余服务器为 vh-*）
+var vethPatterns = []string{"veth+", "vh-+"}
+
+// firewallChainRules 一条链及其在某个地址族下的完整规则
+type firewallChainRules struct {
+	ipv6  bool
+	chain FirewallChain
+	rules [][]string
+}
+
+// applyHostFirewall 应用主机上与具体服务器无关的规则：IP转发、NAT、veth与外网接口之间的转发以及内置DNS的放行
+// 规则只依赖配置，重复应用结果不变
+func (s *UserNetworkService) applyHostFirewall() error {
+	if err := s.netnsService.EnableIPForwarding(); err != nil {
+		return err
+	}
+
+	for _, c := range s.hostChains() {
+		if err := s.firewall.ApplyChain("", c.ipv6, c.chain, c.rules); err != nil {
+			return fmt.Errorf("failed to apply host firewall: %v", err)
+		}
+	}
+	return nil
+}
+
+// hostChains 主机上与具体服务器无关的链（配置了IPv6地址池时同时包含IPv6的转发和NAT66）
+func (s *UserNetworkService) hostChains() []firewallChainRules {
+	var forward, input [][]string
+	for _, veth := range vethPatterns {
+		forward = append(forward,
+			[]string{"-i", s.outInterface, "-o", veth, "-j", "ACCEPT"},
+			[]string{"-i", veth, "-o", s.outInterface, "-j", "ACCEPT"})
+		if s.dnsCfg.Enabled {
+			port := strconv.Itoa(s.dnsCfg.GetListenPort())
+			for _, protocol := range []string{"udp", "tcp"} {
+				input = append(input, []string{"-i", veth, "-p", protocol, "--dport", port, "-j", "ACCEPT"})
+			}
+		}
+	}
+
+	forwardChain, _ := managedFirewallChain(HostForwardChain)
+	natChain, _ := managedFirewallChain(HostNATChain)
+	natChain.Match = []string{"-o", s.outInterface}
+	inputChain, _ := managedFirewallChain(HostInputChain)
+
+	chains := []firewallChainRules{
+		{false, forwardChain, forward},
+		{false, natChain, [][]string{{"-s", s.vethPool, "-j", "MASQUERADE"}}},
+		{false, inputChain, input},
+	}
+	if s.ipv6Pool != "" {
+		chains = append(chains,
+			firewallChainRules{true, forwardChain, forward},
+			firewallChainRules{true, natChain, [][]string{{"-s", s.ipv6Pool, "-j", "MASQUERADE"}}})
+	}
+	return chains
+}
+
+// managedFirewallChain 按链名返回本系统维护的链所在的表、内置链和跳转位置（跳转条件由调用方补充）
+// 用于删除不再需要的链（如已删除服务器的DNAT链），链名未知时返回 false
+func managedFirewallChain(name string) (FirewallChain, bool) {
+	switch {
+	case name == NamespaceForwardChain, name == ACLChain, name == IsolationChain, name == SharedNetworkChain:
+		return FirewallChain{Table: "filter", Hook: "FORWARD", Name: name, Last: name == NamespaceForwardChain}, true
+	case name == HostInputChain:
+		return FirewallChain{Table: "filter", Hook: "INPUT", Name: name, Last: true}, true
+	case name == NamespaceNATChain:
+		return FirewallChain{Table: "nat", Hook: "POSTROUTING", Name: name, Last: true}, true
+	case name == PortForwardSNATChain:
+		return FirewallChain{Table: "nat", Hook: "POSTROUTING", Name: name}, true
+	case name == NamespaceDNSChain, name == PortForwardChain, strings.HasPrefix(name, hostDNATChainPrefix):
+		return FirewallChain{Table: "nat", Hook: "PREROUTING", Name: name}, true
+	}
+	return FirewallChain{}, false
+}
+
+// hostDNATChain 服务器在主机 nat 表中的DNAT链（按命名空间命名，链名不超过28个字符）
+func (s *UserNetworkService) hostDNATChain(server *models.WireguardServer) FirewallChain {
+	key := strings.ReplaceAll(strings.TrimPrefix(server.Namespace, namespacePrefix), "-", "_")
+	return FirewallChain{Table: "nat", Hook: "PREROUTING", Name: hostDNATChainPrefix + key, Match: []string{"-i", s.outInterface}}
+}
+
+// setupHostForwards 按数据库中的端口转发记录应用服务器在主机上的DNAT规则（WireGuard端口和公网转发端口）
+func (s *UserNetworkService) setupHostForwards(server *models.WireguardServer) error {
+	var forwards []models.PortForward
+	if server.ID != 0 {
+		if err := s.db.Where("server_id = ?", server.ID).Order("id").Find(&forwards).Error; err != nil {
+			return fmt.Errorf("failed to load port forwards: %v", err)
+		}
+	}
+	return s.applyHostForwards(server, forwards)
+}
+
+// applyHostForwards 原子替换服务器在主机上的DNAT链：WireGuard端口（双栈时同时转发IPv6）和公网转发端口
+// 设置了监听地址时，WireGuard端口只转发发往该地址的流量（另一地址族不转发）
+func (s *UserNetworkService) applyHostForwards(server *models.WireguardServer, forwards []models.PortForward) error {
+	nsIP := s.namespaceIPAddr(server)
+	wgPort := strconv.Itoa(server.WgPort)
+
+	var listen4, listen6 []string
+	if server.ListenAddress != "" {
+		if addr, err := netip.ParseAddr(server.ListenAddress); err == nil && addr.Is6() {
+			listen6 = []string{"-d", server.ListenAddress}
+		} else {
+			listen4 = []string{"-d", server.ListenAddress}
+		}
+	}
+
+	var rules4 [][]string
+	if listen6 == nil {
+		rules4 = append(rules4, append(listen4, "-p", "udp", "--dport", wgPort, "-j", "DNAT", "--to-destination", nsIP+":"+wgPort))
+	}
+	for _, forward := range forwards {
+		publicPort := strconv.Itoa(forward.PublicPort)
+		rules4 = append(rules4, []string{"-p", forward.Protocol, "--dport", publicPort,
+			"-j", "DNAT", "--to-destination", nsIP + ":" + publicPort})
+	}
+
+	chain := s.hostDNATChain(server)
+	if err := s.firewall.ApplyChain("", false, chain, rules4); err != nil {
+		return fmt.Errorf("failed to setup port forwarding: %v", err)
+	}
+
+	if server.WgAddress6 != "" {
+		var rules6 [][]string
+		if listen4 == nil {
+			rules6 = append(rules6, append(listen6, "-p", "udp", "--dport", wgPort,
+				"-j", "DNAT", "--to-destination", "["+addressWithoutPrefix(server.WgAddress6)+"]:"+wgPort))
+		}
+		if err := s.firewall.ApplyChain("", true, chain, rules6); err != nil {
+			s.firewall.DeleteChain("", false, chain)
+			return fmt.Errorf("failed to setup IPv6 port forwarding: %v", err)
+		}
+	}
+	return nil
+}
+
+// removeHostForwards 删除服务器在主机上的DNAT链，外部流量无法再到达命名空间（端口分配保留）
+func (s *UserNetworkService) removeHostForwards(server *models.WireguardServer) {
+	chain := s.hostDNATChain(server)
+	s.firewall.DeleteChain("", false, chain)
+	if server.WgAddress6 != "" {
+		s.firewall.DeleteChain("", true, chain)
+	}
+}
+
+// applyNamespaceNAT 应用命名空间内的NAT规则：WireGuard网段经veth出去时做 MASQUERADE，
+// 启用内置DNS时将发往 WireGuard 接口地址53端口的查询DNAT到主机侧veth地址上的DNS服务器
+// 查询经过 MASQUERADE 后以veth地址为源地址到达主机，DNS服务器据此区分用户
+func (s *UserNetworkService) applyNamespaceNAT(server *models.WireguardServer, userUID string) error {
+	_, vethNs := s.vethNames(userUID, server.WgInterface)
+	wgPrefix, err := netip.ParsePrefix(server.WgAddress)
+	if err != nil {
+		return fmt.Errorf("invalid wireguard address %s: %v", server.WgAddress, err)
+	}
+
+	natChain := FirewallChain{Table: "nat", Hook: "POSTROUTING", Name: NamespaceNATChain, Match: []string{"-o", vethNs}, Last: true}
+	if err := s.firewall.ApplyChain(server.Namespace, false, natChain,
+		[][]string{{"-s", wgPrefix.Masked().String(), "-j", "MASQUERADE"}}); err != nil {
+		return err
+	}
+
+	var dnsRules [][]string
+	if s.dnsCfg.Enabled {
+		_, hostIP, _, err := s.vethAddresses(server)
+		if err != nil {
+			return err
+		}
+		target := addressWithoutPrefix(hostIP) + ":" + strconv.Itoa(s.dnsCfg.GetListenPort())
+		for _, protocol := range []string{"udp", "tcp"} {
+			dnsRules = append(dnsRules, []string{"-d", addressWithoutPrefix(server.WgAddress), "-p", protocol, "--dport", "53",
+				"-j", "DNAT", "--to-destination", target})
+		}
+	}
+	dnsChain := FirewallChain{Table: "nat", Hook: "PREROUTING", Name: NamespaceDNSChain, Match: []string{"-i", server.WgInterface}}
+	return s.firewall.ApplyChain(server.Namespace, false, dnsChain, dnsRules)
+}
+
+// applyNamespaceForwarding 原子替换命名空间内的 WG_FORWARD 链：放行 WireGuard 接口的转发，
+// 以及peer背后路由网段（站点到站点）的双向转发
+func (s *UserNetworkService) applyNamespaceForwarding(server *models.WireguardServer, peers []models.WireguardPeer) error {
+	base := [][]string{
+		{"-i", server.WgInterface, "-j", "ACCEPT"},
+		{"-o", server.WgInterface, "-j", "ACCEPT"},
+	}
+	rules4 := append([][]string{}, base...)
+	rules6 := append([][]string{}, base...)
+	for _, peer := range peers {
+		for _, prefix := range PeerRoutedSubnets(server, &peer) {
+			rules := [][]string{
+				{"-d", prefix.String(), "-j", "ACCEPT"},
+				{"-s", prefix.String(), "-j", "ACCEPT"},
+			}
+			if prefix.Addr().Is4() {
+				rules4 = append(rules4, rules...)
+			} else {
+				rules6 = append(rules6, rules...)
+			}
+		}
+	}
+
+	chain := FirewallChain{Table: "filter", Hook: "FORWARD", Name: NamespaceForwardChain, Last: true}
+	if err := s.firewall.ApplyChain(server.Namespace, false, chain, rules4); err != nil {
+		return err
+	}
+	if server.WgAddress6 == "" {
+		return nil
+	}
+	return s.firewall.ApplyChain(server.Namespace, true, chain, rules6)
+}
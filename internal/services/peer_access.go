@@ -0,0 +1,164 @@
+package services
+
+import (
+	"cloud-platform/internal/models"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	minutesPerDay  = 24 * 60
+	minutesPerWeek = 7 * minutesPerDay
+)
+
+// weekdayNames 访问时间段中使用的星期缩写
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// accessWindow 每周重复的访问时间段，以一周内的分钟数表示（从周日0点起），跨过午夜时 end 大于当天结束
+type accessWindow struct {
+	start int
+	end   int
+}
+
+// contains 时间 t（本地时区）是否落在时间段内，周六跨到周日的时间段同样生效
+func (w accessWindow) contains(t time.Time) bool {
+	minute := int(t.Weekday())*minutesPerDay + t.Hour()*60 + t.Minute()
+	return (minute >= w.start && minute < w.end) ||
+		(minute+minutesPerWeek >= w.start && minute+minutesPerWeek < w.end)
+}
+
+// NormalizeAccessSchedule 校验并规范化peer的访问时间段，空字符串表示不限制
+// 格式为分号分隔的 "<星期> <HH:MM>-<HH:MM>"，星期可以是 *、单个缩写（mon）、逗号分隔的列表或范围（mon-fri）；
+// 结束时间早于开始时间表示跨过午夜，时间按服务器本地时区计算
+func NormalizeAccessSchedule(schedule string) (string, error) {
+	if _, err := parseAccessSchedule(schedule); err != nil {
+		return "", err
+	}
+
+	var entries []string
+	for _, entry := range strings.Split(schedule, ";") {
+		if fields := strings.Fields(strings.ToLower(entry)); len(fields) > 0 {
+			entries = append(entries, strings.Join(fields, " "))
+		}
+	}
+	return strings.Join(entries, "; "), nil
+}
+
+// parseAccessSchedule 解析访问时间段（格式见 NormalizeAccessSchedule）
+func parseAccessSchedule(schedule string) ([]accessWindow, error) {
+	var windows []accessWindow
+	for _, entry := range strings.Split(schedule, ";") {
+		fields := strings.Fields(strings.ToLower(entry))
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid access window %q: expected \"<days> <HH:MM>-<HH:MM>\"", strings.TrimSpace(entry))
+		}
+
+		days, err := parseWeekdays(fields[0])
+		if err != nil {
+			return nil, err
+		}
+
+		startText, endText, ok := strings.Cut(fields[1], "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid time range %q: expected HH:MM-HH:MM", fields[1])
+		}
+		start, err := parseClock(startText)
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseClock(endText)
+		if err != nil {
+			return nil, err
+		}
+		if start == end {
+			return nil, fmt.Errorf("invalid time range %q: start and end must differ", fields[1])
+		}
+		// 结束时间早于开始时间：时间段跨过午夜，延续到第二天
+		if end < start {
+			end += minutesPerDay
+		}
+
+		for _, day := range days {
+			offset := int(day) * minutesPerDay
+			windows = append(windows, accessWindow{start: offset + start, end: offset + end})
+		}
+	}
+	return windows, nil
+}
+
+// parseWeekdays 解析星期：*、逗号分隔的缩写或范围（范围可以跨过周末，如 fri-mon）
+func parseWeekdays(text string) ([]time.Weekday, error) {
+	if text == "*" {
+		return []time.Weekday{time.Sunday, time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday}, nil
+	}
+
+	var days []time.Weekday
+	for _, part := range strings.Split(text, ",") {
+		fromText, toText, isRange := strings.Cut(part, "-")
+		from, ok := weekdayNames[fromText]
+		if !ok {
+			return nil, fmt.Errorf("invalid weekday %q: must be one of sun, mon, tue, wed, thu, fri, sat", fromText)
+		}
+		to := from
+		if isRange {
+			if to, ok = weekdayNames[toText]; !ok {
+				return nil, fmt.Errorf("invalid weekday %q: must be one of sun, mon, tue, wed, thu, fri, sat", toText)
+			}
+		}
+		for day := from; ; day = (day + 1) % 7 {
+			days = append(days, day)
+			if day == to {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// parseClock 解析 HH:MM（允许 24:00 表示当天结束），返回当天的分钟数
+func parseClock(text string) (int, error) {
+	hourText, minuteText, ok := strings.Cut(text, ":")
+	hour, hourErr := strconv.Atoi(hourText)
+	minute, minuteErr := strconv.Atoi(minuteText)
+	if !ok || hourErr != nil || minuteErr != nil || len(minuteText) != 2 ||
+		hour < 0 || hour > 24 || minute < 0 || minute > 59 || (hour == 24 && minute != 0) {
+		return 0, fmt.Errorf("invalid time %q: expected HH:MM", text)
+	}
+	return hour*60 + minute, nil
+}
+
+// PeerAccessStatus 按过期时间和访问时间段计算peer在 now 时刻的访问状态
+func PeerAccessStatus(peer *models.WireguardPeer, now time.Time) string {
+	if peer.ExpiresAt != nil && !now.Before(*peer.ExpiresAt) {
+		return models.PeerAccessExpired
+	}
+	if peer.AccessSchedule == "" {
+		return models.PeerAccessActive
+	}
+
+	// 保存时已校验，解析失败的记录视为不限制
+	windows, err := parseAccessSchedule(peer.AccessSchedule)
+	if err != nil || len(windows) == 0 {
+		return models.PeerAccessActive
+	}
+	local := now.In(time.Local)
+	for _, window := range windows {
+		if window.contains(local) {
+			return models.PeerAccessActive
+		}
+	}
+	return models.PeerAccessOutsideWindow
+}
@@ -0,0 +1,117 @@
+package services
+
+import (
+	"cloud-platform/internal/models"
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// PeerAccessService 执行peer的过期时间和每周访问时间段
+//
+// 已过期或不在访问时间段内的peer不写入服务器配置，重新同步接口时即被移除，
+// 时间段开始后再重新加入。服务记录每个peer的访问状态，并重新同步peer状态发生变化的服务器
+type PeerAccessService struct {
+	db             *gorm.DB
+	networkService *UserNetworkService
+	interval       time.Duration
+	ctx            context.Context
+	cancel         context.CancelFunc
+	mu             sync.Mutex
+}
+
+// NewPeerAccessService 创建peer访问控制服务实例
+func NewPeerAccessService(db *gorm.DB, networkService *UserNetworkService, interval time.Duration) *PeerAccessService {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &PeerAccessService{
+		db:             db,
+		networkService: networkService,
+		interval:       interval,
+		ctx:            ctx,
+		cancel:         cancel,
+	}
+}
+
+// Start 按间隔定期检查peer的访问状态
+func (s *PeerAccessService) Start() {
+	log.Printf("Starting peer access service with interval: %v", s.interval)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.CheckPeerAccess()
+		case <-s.ctx.Done():
+			log.Println("Peer access service stopped")
+			return
+		}
+	}
+}
+
+// Stop 停止peer访问控制服务
+func (s *PeerAccessService) Stop() {
+	log.Println("Stopping peer access service...")
+	s.cancel()
+}
+
+// CheckPeerAccess 更新设置了过期时间或访问时间段的peer的访问状态，
+// 并重新同步有peer跨过时间边界的服务器
+func (s *PeerAccessService) CheckPeerAccess() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var peers []models.WireguardPeer
+	if err := s.db.Preload("Server.User").
+		Where("expires_at IS NOT NULL OR access_schedule <> '' OR access_status <> ?", models.PeerAccessActive).
+		Find(&peers).Error; err != nil {
+		log.Printf("Peer access: failed to load peers: %v", err)
+		return
+	}
+
+	now := time.Now()
+	changed := make(map[uint]models.WireguardServer)
+	for i := range peers {
+		peer := &peers[i]
+		status := PeerAccessStatus(peer, now)
+		if status == peer.AccessStatus {
+			continue
+		}
+
+		if err := s.db.Model(peer).Update("access_status", status).Error; err != nil {
+			log.Printf("Peer access: failed to update status of peer %d: %v", peer.ID, err)
+			continue
+		}
+		log.Printf("Peer access: peer %d on server %d is now %s", peer.ID, peer.ServerID, status)
+		changed[peer.ServerID] = peer.Server
+	}
+
+	for _, server := range changed {
+		if err := s.syncServer(&server); err != nil {
+			log.Printf("Peer access: failed to sync peers for server %d: %v", server.ID, err)
+		}
+	}
+}
+
+// syncServer 持有服务器的锁，按重新读取的记录同步服务器的peer
+// 已删除的服务器跳过，已禁用的服务器在重新启用时加载当前的peer
+func (s *PeerAccessService) syncServer(server *models.WireguardServer) error {
+	unlock, err := s.networkService.LockServer(server)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if !server.Enabled {
+		return nil
+	}
+	return s.networkService.SyncPeers(server, server.User.UserUID)
+}
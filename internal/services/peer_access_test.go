@@ -0,0 +1,202 @@
+package services
+
+import (
+	"cloud-platform/internal/models"
+	"strings"
+	"testing"
+	"time"
+)
+
+// at 返回 2026-10-11（周日）起那一周中 day 的 clock 时刻（HH:MM，本地时区）
+func at(t *testing.T, day time.Weekday, clock string) time.Time {
+	t.Helper()
+	parsed, err := time.Parse("15:04", clock)
+	if err != nil {
+		t.Fatalf("invalid clock %q: %v", clock, err)
+	}
+	return time.Date(2026, 10, 11+int(day), parsed.Hour(), parsed.Minute(), 0, 0, time.Local)
+}
+
+func TestParseAccessSchedule(t *testing.T) {
+	tests := []struct {
+		schedule string
+		want     []accessWindow
+	}{
+		{"", nil},
+		{" ; ", nil},
+		{"mon 09:00-18:00", []accessWindow{{1*minutesPerDay + 540, 1*minutesPerDay + 1080}}},
+		{"sun 00:00-24:00", []accessWindow{{0, minutesPerDay}}},
+		{"wed 22:00-24:00", []accessWindow{{3*minutesPerDay + 1320, 4 * minutesPerDay}}},
+		// 结束时间早于开始时间：延续到第二天
+		{"tue 22:00-06:00", []accessWindow{{2*minutesPerDay + 1320, 3*minutesPerDay + 360}}},
+		// 周六跨过午夜：结束时间超出一周
+		{"sat 22:00-02:00", []accessWindow{{6*minutesPerDay + 1320, 7*minutesPerDay + 120}}},
+		{"fri-mon 10:00-11:00", []accessWindow{
+			{5*minutesPerDay + 600, 5*minutesPerDay + 660},
+			{6*minutesPerDay + 600, 6*minutesPerDay + 660},
+			{0*minutesPerDay + 600, 0*minutesPerDay + 660},
+			{1*minutesPerDay + 600, 1*minutesPerDay + 660},
+		}},
+		{"mon,wed 08:30-09:00; sat 12:00-13:00", []accessWindow{
+			{1*minutesPerDay + 510, 1*minutesPerDay + 540},
+			{3*minutesPerDay + 510, 3*minutesPerDay + 540},
+			{6*minutesPerDay + 720, 6*minutesPerDay + 780},
+		}},
+		{"MON-Tue 9:05-9:10", []accessWindow{
+			{1*minutesPerDay + 545, 1*minutesPerDay + 550},
+			{2*minutesPerDay + 545, 2*minutesPerDay + 550},
+		}},
+	}
+
+	for _, tt := range tests {
+		got, err := parseAccessSchedule(tt.schedule)
+		if err != nil {
+			t.Errorf("parseAccessSchedule(%q): %v", tt.schedule, err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("parseAccessSchedule(%q) = %v, want %v", tt.schedule, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("parseAccessSchedule(%q)[%d] = %v, want %v", tt.schedule, i, got[i], tt.want[i])
+			}
+		}
+	}
+
+	if days, err := parseAccessSchedule("* 09:00-10:00"); err != nil || len(days) != 7 {
+		t.Errorf("parseAccessSchedule(\"*\") = %d windows, %v, want one per weekday", len(days), err)
+	}
+}
+
+func TestParseAccessScheduleInvalid(t *testing.T) {
+	tests := []struct {
+		schedule string
+		wantErr  string
+	}{
+		{"mon", "invalid access window"},
+		{"mon 09:00 18:00", "invalid access window"},
+		{"monday 09:00-18:00", "invalid weekday"},
+		{"mon-xyz 09:00-18:00", "invalid weekday"},
+		{"mon 09:00", "invalid time range"},
+		{"mon 09:00-09:00", "start and end must differ"},
+		{"mon 25:00-26:00", "invalid time"},
+		{"mon 24:30-01:00", "invalid time"},
+		{"mon 09:60-10:00", "invalid time"},
+		{"mon 9:5-10:00", "invalid time"},
+		{"mon 09:00-18:00; tue", "invalid access window"},
+	}
+
+	for _, tt := range tests {
+		if _, err := parseAccessSchedule(tt.schedule); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("parseAccessSchedule(%q) error = %v, want %q", tt.schedule, err, tt.wantErr)
+		}
+	}
+}
+
+func TestAccessWindowContains(t *testing.T) {
+	tests := []struct {
+		schedule string
+		day      time.Weekday
+		clock    string
+		want     bool
+	}{
+		{"mon 09:00-18:00", time.Monday, "09:00", true},
+		{"mon 09:00-18:00", time.Monday, "17:59", true},
+		{"mon 09:00-18:00", time.Monday, "18:00", false},
+		{"mon 09:00-18:00", time.Monday, "08:59", false},
+		{"mon 09:00-18:00", time.Tuesday, "10:00", false},
+
+		// 24:00 表示当天结束
+		{"wed 22:00-24:00", time.Wednesday, "23:59", true},
+		{"wed 22:00-24:00", time.Thursday, "00:00", false},
+		{"sun 00:00-24:00", time.Sunday, "00:00", true},
+		{"sun 00:00-24:00", time.Saturday, "23:59", false},
+
+		// 跨过午夜的时间段延续到第二天
+		{"tue 22:00-06:00", time.Tuesday, "21:59", false},
+		{"tue 22:00-06:00", time.Tuesday, "23:30", true},
+		{"tue 22:00-06:00", time.Wednesday, "05:59", true},
+		{"tue 22:00-06:00", time.Wednesday, "06:00", false},
+		{"tue 22:00-06:00", time.Monday, "23:30", false},
+
+		// 周六跨到周日
+		{"sat 22:00-02:00", time.Saturday, "22:00", true},
+		{"sat 22:00-02:00", time.Sunday, "00:00", true},
+		{"sat 22:00-02:00", time.Sunday, "01:59", true},
+		{"sat 22:00-02:00", time.Sunday, "02:00", false},
+		{"sat 22:00-02:00", time.Saturday, "01:00", false},
+
+		// 跨过周末的星期范围
+		{"fri-mon 10:00-11:00", time.Friday, "10:30", true},
+		{"fri-mon 10:00-11:00", time.Saturday, "10:30", true},
+		{"fri-mon 10:00-11:00", time.Sunday, "10:30", true},
+		{"fri-mon 10:00-11:00", time.Monday, "10:30", true},
+		{"fri-mon 10:00-11:00", time.Tuesday, "10:30", false},
+		{"fri-mon 10:00-11:00", time.Thursday, "10:30", false},
+		{"fri-mon 22:00-02:00", time.Tuesday, "01:00", true},
+		{"fri-mon 22:00-02:00", time.Friday, "01:00", false},
+	}
+
+	for _, tt := range tests {
+		windows, err := parseAccessSchedule(tt.schedule)
+		if err != nil {
+			t.Fatalf("parseAccessSchedule(%q): %v", tt.schedule, err)
+		}
+		now := at(t, tt.day, tt.clock)
+		got := false
+		for _, window := range windows {
+			got = got || window.contains(now)
+		}
+		if got != tt.want {
+			t.Errorf("%q at %s %s: contains = %v, want %v", tt.schedule, tt.day, tt.clock, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeAccessSchedule(t *testing.T) {
+	tests := []struct {
+		schedule string
+		want     string
+	}{
+		{"", ""},
+		{"  MON-FRI   09:00-18:00 ;; Sat 10:00-14:00 ; ", "mon-fri 09:00-18:00; sat 10:00-14:00"},
+		{"* 22:00-06:00", "* 22:00-06:00"},
+	}
+	for _, tt := range tests {
+		if got, err := NormalizeAccessSchedule(tt.schedule); err != nil || got != tt.want {
+			t.Errorf("NormalizeAccessSchedule(%q) = %q, %v, want %q", tt.schedule, got, err, tt.want)
+		}
+	}
+
+	if _, err := NormalizeAccessSchedule("mon 18:00-18:00"); err == nil {
+		t.Error("NormalizeAccessSchedule accepted an empty time range")
+	}
+}
+
+func TestPeerAccessStatus(t *testing.T) {
+	now := at(t, time.Saturday, "23:00")
+	past, future := now.Add(-time.Minute), now.Add(time.Minute)
+
+	tests := []struct {
+		name string
+		peer models.WireguardPeer
+		want string
+	}{
+		{"unrestricted", models.WireguardPeer{}, models.PeerAccessActive},
+		{"not yet expired", models.WireguardPeer{ExpiresAt: &future}, models.PeerAccessActive},
+		{"expired", models.WireguardPeer{ExpiresAt: &past}, models.PeerAccessExpired},
+		{"expires now", models.WireguardPeer{ExpiresAt: &now}, models.PeerAccessExpired},
+		{"inside window", models.WireguardPeer{AccessSchedule: "sat 22:00-02:00"}, models.PeerAccessActive},
+		{"outside window", models.WireguardPeer{AccessSchedule: "mon-fri 09:00-18:00"}, models.PeerAccessOutsideWindow},
+		{"expiry wins over window", models.WireguardPeer{ExpiresAt: &past, AccessSchedule: "* 00:00-24:00"}, models.PeerAccessExpired},
+		{"invalid schedule", models.WireguardPeer{AccessSchedule: "someday"}, models.PeerAccessActive},
+	}
+
+	for _, tt := range tests {
+		if got := PeerAccessStatus(&tt.peer, now); got != tt.want {
+			t.Errorf("%s: PeerAccessStatus = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package services
+
+import (
+	"cloud-platform/internal/config"
+	"cloud-platform/internal/models"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// PortForwardChain 命名空间 nat 表中将公网端口DNAT到peer的自定义链，由 PREROUTING 链首跳转
+	PortForwardChain = "WG_PORTFWD"
+	// PortForwardSNATChain 对转发到peer的连接做源地址转换的自定义链，由 POSTROUTING 链首跳转（仅匹配 wg0 出口）
+	// peer的回包发往服务器的WireGuard地址，无论客户端使用哪种路由模式都会经隧道返回
+	PortForwardSNATChain = "WG_PORTFWD_SNAT"
+)
+
+// NormalizePortForward 校验并规范化端口转发：协议转为小写（默认tcp），目标端口必须在 1-65535 之间
+func NormalizePortForward(forward *models.PortForward) error {
+	forward.Protocol = strings.ToLower(strings.TrimSpace(forward.Protocol))
+	if forward.Protocol == "" {
+		forward.Protocol = models.PortForwardTCP
+	}
+	if forward.Protocol != models.PortForwardTCP && forward.Protocol != models.PortForwardUDP {
+		return fmt.Errorf("invalid protocol %q: must be tcp or udp", forward.Protocol)
+	}
+
+	if forward.TargetPort < 1 || forward.TargetPort > 65535 {
+		return fmt.Errorf("invalid target port %d", forward.TargetPort)
+	}
+	return nil
+}
+
+// PortForwardQuota 用户可使用的公网端口数量：优先使用管理员为用户单独设置的配额
+func PortForwardQuota(user *models.User, cfg config.PortForwardConfig) int {
+	if user.PortForwardQuota != nil {
+		return *user.PortForwardQuota
+	}
+	return cfg.GetQuota()
+}
+
+// AllocatePublicPort 从公网端口池中为服务器分配一个端口
+// 在事务中调用时，保存端口转发记录失败会随事务一起回滚
+func (s *UserNetworkService) AllocatePublicPort(server *models.WireguardServer) (int, error) {
+	if !s.portForwardCfg.Enabled() {
+		return 0, fmt.Errorf("port forwarding is not enabled")
+	}
+	return s.ipam.AllocatePort(models.PoolPublicForward, s.portForwardCfg.PortStart, s.portForwardCfg.PortEnd,
+		allocationOwner(server.Namespace, server.WgInterface))
+}
+
+// ApplyPortForwards 按数据库中的端口转发记录重新应用服务器的全部端口转发规则
+//   - 命名空间内：原子替换 WG_PORTFWD / WG_PORTFWD_SNAT 链
+//   - 主机上：原子替换服务器的DNAT链（WireGuard端口和全部公网端口，服务器禁用时删除）
+//   - 已没有对应记录的公网端口（如peer被删除后级联删除的转发）：释放端口
+func (s *UserNetworkService) ApplyPortForwards(server *models.WireguardServer) error {
+	var forwards []models.PortForward
+	if server.ID != 0 {
+		if err := s.db.Where("server_id = ?", server.ID).Order("id").Find(&forwards).Error; err != nil {
+			return fmt.Errorf("failed to load port forwards: %v", err)
+		}
+	}
+
+	peers, err := s.loadPeers(server)
+	if err != nil {
+		return err
+	}
+	peerByID := make(map[uint]models.WireguardPeer, len(peers))
+	for _, peer := range peers {
+		peerByID[peer.ID] = peer
+	}
+
+	nsIP := s.namespaceIPAddr(server)
+	var dnatRules, snatRules [][]string
+	active := make(map[int]bool, len(forwards))
+	for _, forward := range forwards {
+		active[forward.PublicPort] = true
+
+		peer, ok := peerByID[forward.PeerID]
+		if !ok {
+			continue
+		}
+		publicPort, targetPort := strconv.Itoa(forward.PublicPort), strconv.Itoa(forward.TargetPort)
+		dnatRules = append(dnatRules, []string{"-d", nsIP + "/32", "-p", forward.Protocol, "--dport", publicPort,
+			"-j", "DNAT", "--to-destination", peer.PeerAddress + ":" + targetPort})
+		snatRules = append(snatRules, []string{"-d", peer.PeerAddress + "/32", "-p", forward.Protocol, "--dport", targetPort,
+			"-m", "conntrack", "--ctstate", "DNAT", "-j", "MASQUERADE"})
+	}
+
+	// 1. 命名空间内的DNAT和SNAT
+	dnatChain := FirewallChain{Table: "nat", Hook: "PREROUTING", Name: PortForwardChain}
+	if err := s.firewall.ApplyChain(server.Namespace, false, dnatChain, dnatRules); err != nil {
+		return err
+	}
+	snatChain := FirewallChain{Table: "nat", Hook: "POSTROUTING", Name: PortForwardSNATChain, Match: []string{"-o", server.WgInterface}}
+	if err := s.firewall.ApplyChain(server.Namespace, false, snatChain, snatRules); err != nil {
+		return err
+	}
+
+	// 2. 释放已删除的端口转发占用的公网端口（主机规则在第3步整体替换）
+	owner := allocationOwner(server.Namespace, server.WgInterface)
+	ports, err := s.ipam.OwnerPorts(models.PoolPublicForward, owner)
+	if err != nil {
+		return fmt.Errorf("failed to load public ports: %v", err)
+	}
+	for _, port := range ports {
+		if active[port] {
+			continue
+		}
+		if err := s.ipam.ReleasePort(models.PoolPublicForward, port, owner); err != nil {
+			return fmt.Errorf("failed to release public port %d: %v", port, err)
+		}
+	}
+
+	// 3. 主机上的DNAT（与 WireGuard 端口相同，服务器禁用期间不对外开放）
+	if !server.Enabled {
+		s.removeHostForwards(server)
+		return nil
+	}
+	return s.applyHostForwards(server, forwards)
+}
@@ -0,0 +1,105 @@
+package services
+
+import (
+	"cloud-platform/internal/models"
+	"sync"
+)
+
+// provisioningRegistry 正在创建、记录尚未提交到数据库的服务器网络
+//
+// ProvisionServer 在创建命名空间之前登记，调用方在服务器记录提交（或创建失败、网络已清理）后
+// 通过 FinishProvisioning 注销。对账服务和偏差修复不会删除登记中的命名空间、veth和主机DNAT链，
+// 避免在记录提交之前将其当作孤立资源删除。处理请求时每次都会创建新的 UserNetworkService，
+// 因此登记表在进程内共享
+type provisioningRegistry struct {
+	mu         sync.Mutex
+	namespaces map[string]string // 命名空间 -> 主机侧veth
+}
+
+var provisioning = &provisioningRegistry{namespaces: make(map[string]string)}
+
+func (r *provisioningRegistry) add(nsName, vethHost string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.namespaces[nsName] = vethHost
+}
+
+func (r *provisioningRegistry) remove(nsName string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.namespaces, nsName)
+}
+
+// snapshot 返回当前登记的命名空间及其主机侧veth
+func (r *provisioningRegistry) snapshot() map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	namespaces := make(map[string]string, len(r.namespaces))
+	for nsName, vethHost := range r.namespaces {
+		namespaces[nsName] = vethHost
+	}
+	return namespaces
+}
+
+// FinishProvisioning 服务器记录已提交到数据库（或创建失败、网络已清理）后调用，
+// 此后该服务器的命名空间按数据库记录参与对账
+func (s *UserNetworkService) FinishProvisioning(server *models.WireguardServer) {
+	provisioning.remove(server.Namespace)
+}
+
+// claimedResources 属于服务器（正在创建或已有记录）的命名空间、主机侧veth和主机DNAT链
+type claimedResources struct {
+	namespaces map[string]bool
+	links      map[string]bool
+	chains     map[string]bool
+}
+
+// claim 将服务器的资源标记为已占用
+func (c *claimedResources) claim(s *UserNetworkService, server *models.WireguardServer, vethHost string) {
+	c.namespaces[server.Namespace] = true
+	c.links[vethHost] = true
+	c.chains[s.hostDNATChain(server).Name] = true
+}
+
+// contains 多余的资源是否属于某个服务器；只检查主机上的资源和用户命名空间，其他资源不受创建过程影响
+func (c *claimedResources) contains(item DriftItem) bool {
+	if item.Namespace != "" {
+		return false
+	}
+	switch item.Kind {
+	case DriftNamespace:
+		return c.namespaces[item.Name]
+	case DriftLink:
+		return c.links[item.Name]
+	case DriftChain:
+		return c.chains[item.Name]
+	}
+	return false
+}
+
+// claimedResources 删除多余资源前再次确认其不属于任何服务器：先读取登记表，再查询数据库
+//
+// 多余资源在检测时已经存在，而登记先于创建、注销晚于记录提交，
+// 因此属于刚创建的服务器的资源此时要么仍在登记表中，要么已能在数据库中查到
+func (s *UserNetworkService) claimedResources() (*claimedResources, error) {
+	claimed := s.provisioningResources()
+
+	var servers []models.WireguardServer
+	if err := s.db.Preload("User").Find(&servers).Error; err != nil {
+		return nil, err
+	}
+	for i := range servers {
+		vethHost, _ := s.vethNames(servers[i].User.UserUID, servers[i].WgInterface)
+		claimed.claim(s, &servers[i], vethHost)
+	}
+	return claimed, nil
+}
+
+// provisioningResources 正在创建、记录尚未提交的服务器占用的资源
+func (s *UserNetworkService) provisioningResources() *claimedResources {
+	claimed := &claimedResources{namespaces: map[string]bool{}, links: map[string]bool{}, chains: map[string]bool{}}
+	for nsName, vethHost := range provisioning.snapshot() {
+		claimed.claim(s, &models.WireguardServer{Namespace: nsName}, vethHost)
+	}
+	return claimed
+}
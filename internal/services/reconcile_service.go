@@ -0,0 +1,156 @@
+package services
+
+import (
+	"cloud-platform/internal/models"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ReconcileService 定期核对主机上的网络状态与数据库记录
+//
+// 主机重启后命名空间、veth对、防火墙规则和运行中的peer全部丢失，而数据库中仍保留着这些记录。
+// 核对时重建缺失的资源，并删除不再属于任何服务器的命名空间（正在创建的服务器见 provisioningRegistry）
+type ReconcileService struct {
+	db             *gorm.DB
+	networkService *UserNetworkService
+	interval       time.Duration
+	ctx            context.Context
+	cancel         context.CancelFunc
+	mu             sync.Mutex
+}
+
+// NewReconcileService 创建状态核对服务实例
+func NewReconcileService(db *gorm.DB, networkService *UserNetworkService, interval time.Duration) *ReconcileService {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &ReconcileService{
+		db:             db,
+		networkService: networkService,
+		interval:       interval,
+		ctx:            ctx,
+		cancel:         cancel,
+	}
+}
+
+// Start 启动后立即核对一次，之后按间隔定期核对
+func (s *ReconcileService) Start() {
+	log.Printf("Starting reconcile service with interval: %v", s.interval)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	// 启动时立即核对
+	s.Reconcile()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.Reconcile()
+		case <-s.ctx.Done():
+			log.Println("Reconcile service stopped")
+			return
+		}
+	}
+}
+
+// Stop 停止状态核对服务
+func (s *ReconcileService) Stop() {
+	log.Println("Stopping reconcile service...")
+	s.cancel()
+}
+
+// Reconcile 将每条 WireguardServer/WireguardPeer 记录与实际状态对比，
+// 重建缺失的资源并删除孤立的命名空间
+func (s *ReconcileService) Reconcile() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var servers []models.WireguardServer
+	if err := s.db.Preload("User").Find(&servers).Error; err != nil {
+		log.Printf("Reconcile: failed to load wireguard servers: %v", err)
+		return
+	}
+
+	liveNamespaces, err := s.networkService.ListUserNamespaces()
+	if err != nil {
+		log.Printf("Reconcile: failed to list namespaces: %v", err)
+		return
+	}
+
+	live := make(map[string]bool)
+	for _, nsName := range liveNamespaces {
+		live[nsName] = true
+	}
+
+	expected := make(map[string]bool)
+	rebuilt, repaired := 0, 0
+	for i := range servers {
+		server := &servers[i]
+		expected[server.Namespace] = true
+
+		switch err := s.reconcileServer(server, live[server.Namespace]); {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			// 核对期间服务器已被删除，网络由删除请求清理
+		case err != nil:
+			log.Printf("Reconcile: %v", err)
+		case !live[server.Namespace]:
+			rebuilt++
+		default:
+			repaired++
+		}
+	}
+
+	// 重新连接共享网络：成员命名空间重建后，与中转命名空间之间的连接随之丢失
+	if err := s.networkService.ApplySharedNetworks(); err != nil {
+		log.Printf("Reconcile: failed to apply shared networks: %v", err)
+	}
+
+	// 删除没有对应服务器记录的命名空间；删除前再次确认，跳过正在创建、记录尚未提交的服务器
+	claimed, err := s.networkService.claimedResources()
+	if err != nil {
+		log.Printf("Reconcile: failed to load wireguard servers: %v", err)
+		return
+	}
+	removed := 0
+	for _, nsName := range liveNamespaces {
+		if expected[nsName] || claimed.namespaces[nsName] {
+			continue
+		}
+		if err := s.networkService.DestroyOrphanNamespace(nsName); err != nil {
+			log.Printf("Reconcile: failed to remove orphan namespace %s: %v", nsName, err)
+			continue
+		}
+		removed++
+	}
+
+	log.Printf("Reconcile finished: %d servers checked, %d rebuilt, %d orphan namespaces removed",
+		repaired+rebuilt, rebuilt, removed)
+}
+
+// reconcileServer 持有服务器的锁，按重新读取的记录重建（命名空间不存在时）或修复服务器的网络
+// 避免与同时修改该服务器的请求交错，或按过期的启用状态重建刚被禁用、删除的服务器
+func (s *ReconcileService) reconcileServer(server *models.WireguardServer, live bool) error {
+	unlock, err := s.networkService.LockServer(server)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if !live {
+		// 命名空间已不存在（如主机重启）：按数据库记录重建
+		if err := s.networkService.RebuildUserNetwork(server, server.User.UserUID); err != nil {
+			return fmt.Errorf("failed to rebuild network for server %d (%s): %v", server.ID, server.Namespace, err)
+		}
+		return nil
+	}
+
+	if err := s.networkService.EnsureUserNetwork(server, server.User.UserUID); err != nil {
+		return fmt.Errorf("failed to repair network for server %d (%s): %v", server.ID, server.Namespace, err)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func TestReconcileKeepsProvisioningNamespace(t *testing.T) {
+	s, backend, runner, user := newTestUserNetwork(t)
+	reconcile := NewReconcileService(s.db, s, time.Hour)
+
+	// 命名空间已创建但记录尚未提交：对账和偏差修复都不能将其当作孤立资源删除
+	server, err := s.ProvisionServer(user, 0)
+	if err != nil {
+		t.Fatalf("ProvisionServer: %v", err)
+	}
+	t.Cleanup(func() { s.FinishProvisioning(server) })
+
+	reconcile.Reconcile()
+	if !backend.HasNamespace(server.Namespace) {
+		t.Fatal("reconcile removed a namespace whose server record is not committed yet")
+	}
+	report, err := s.DetectDrift()
+	if err != nil {
+		t.Fatalf("DetectDrift: %v", err)
+	}
+	if len(report.Unexpected) != 0 {
+		t.Errorf("unexpected items while provisioning = %+v", report.Unexpected)
+	}
+
+	// 报告生成于记录提交之前：提交并注销后，按旧报告修复时再次确认，不会删除
+	stale := []DriftItem{{Kind: DriftNamespace, Name: server.Namespace}}
+	vethHost, _ := s.vethNames(testUserUID, server.WgInterface)
+	stale = append(stale, DriftItem{Kind: DriftLink, Name: vethHost},
+		DriftItem{Kind: DriftChain, Name: s.hostDNATChain(server).Name, Table: "nat"})
+	if err := s.db.Create(server).Error; err != nil {
+		t.Fatalf("save server: %v", err)
+	}
+	s.FinishProvisioning(server)
+	if err := s.FixDrift(&DriftReport{Unexpected: stale, Missing: []DriftItem{}}); err != nil {
+		t.Fatalf("FixDrift: %v", err)
+	}
+	if !backend.HasNamespace(server.Namespace) || !backend.Running(server.Namespace, server.WgInterface) {
+		t.Fatal("stale drift report removed a committed server's network")
+	}
+	if _, exists := hostForwardRules(s, runner, server); !exists {
+		t.Fatal("stale drift report removed a committed server's DNAT chain")
+	}
+
+	reconcile.Reconcile()
+	if !backend.HasNamespace(server.Namespace) {
+		t.Fatal("reconcile removed a committed server's namespace")
+	}
+}
+
+func TestReconcileRemovesOrphanNamespace(t *testing.T) {
+	s, backend, _, user := newTestUserNetwork(t)
+	reconcile := NewReconcileService(s.db, s, time.Hour)
+
+	// 创建后没有保存记录（如进程在提交前退出）：注销后按孤立命名空间删除
+	server, err := s.ProvisionServer(user, 0)
+	if err != nil {
+		t.Fatalf("ProvisionServer: %v", err)
+	}
+	s.FinishProvisioning(server)
+
+	reconcile.Reconcile()
+	if backend.HasNamespace(server.Namespace) {
+		t.Error("orphan namespace was not removed")
+	}
+}
+
+func TestReconcileServerWaitsForLock(t *testing.T) {
+	s, backend, _, user := newTestUserNetwork(t)
+	reconcile := NewReconcileService(s.db, s, time.Hour)
+	server := provisionTestServer(t, s, user, 0)
+	stale := *server
+
+	// 请求持有锁期间禁用服务器：对账等待锁释放，按重新读取的记录保持接口停止
+	unlock, err := s.LockServer(server)
+	if err != nil {
+		t.Fatalf("LockServer: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		current := stale
+		done <- reconcile.reconcileServer(&current, true)
+	}()
+
+	if err := s.DisableUserNetwork(server, testUserUID); err != nil {
+		t.Fatalf("DisableUserNetwork: %v", err)
+	}
+	if err := s.db.Model(server).Update("enabled", false).Error; err != nil {
+		t.Fatalf("disable server: %v", err)
+	}
+	select {
+	case <-done:
+		t.Fatal("reconcile ran while the server was locked")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+
+	if err := <-done; err != nil {
+		t.Fatalf("reconcileServer: %v", err)
+	}
+	if backend.Running(server.Namespace, server.WgInterface) {
+		t.Error("reconcile restarted the interface of a server disabled while it waited")
+	}
+
+	// 记录已删除、命名空间已清理的服务器不会被重建
+	if err := s.db.Delete(server).Error; err != nil {
+		t.Fatalf("delete server: %v", err)
+	}
+	if err := s.DestroyUserNetwork(server, testUserUID); err != nil {
+		t.Fatalf("DestroyUserNetwork: %v", err)
+	}
+	current := stale
+	if err := reconcile.reconcileServer(&current, false); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("reconcileServer for a deleted server = %v, want %v", err, gorm.ErrRecordNotFound)
+	}
+	if backend.HasNamespace(server.Namespace) {
+		t.Error("reconcile rebuilt the namespace of a deleted server")
+	}
+}
@@ -0,0 +1,36 @@
+package services
+
+import (
+	"bytes"
+	"os/exec"
+)
+
+// CommandRunner 外部命令执行器
+// NetnsService 和防火墙后端通过它调用 iptables/nft/sysctl/tc，命名空间、接口和路由则走 NetworkBackend。
+// 生产环境使用 ExecRunner，测试中替换为 FakeRunner（见 fake_runner_test.go），无需 root 权限即可走通整个网络生命周期
+type CommandRunner interface {
+	// Run 执行命令，返回合并后的标准输出和标准错误
+	Run(name string, args ...string) ([]byte, error)
+	// RunWithInput 执行命令并将 input 写入标准输入，返回合并后的标准输出和标准错误
+	RunWithInput(input []byte, name string, args ...string) ([]byte, error)
+}
+
+// ExecRunner 基于 os/exec 的命令执行器
+type ExecRunner struct{}
+
+// NewExecRunner 创建基于 os/exec 的命令执行器
+func NewExecRunner() *ExecRunner {
+	return &ExecRunner{}
+}
+
+// Run 执行命令，返回合并后的标准输出和标准错误
+func (r *ExecRunner) Run(name string, args ...string) ([]byte, error) {
+	return exec.Command(name, args...).CombinedOutput()
+}
+
+// RunWithInput 执行命令并将 input 写入标准输入
+func (r *ExecRunner) RunWithInput(input []byte, name string, args ...string) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = bytes.NewReader(input)
+	return cmd.CombinedOutput()
+}
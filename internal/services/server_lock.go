@@ -0,0 +1,47 @@
+package services
+
+import (
+	"cloud-platform/internal/models"
+	"sync"
+)
+
+// serverLockRegistry 每台服务器一把互斥锁，串行化对同一服务器网络的修改
+//
+// 请求处理（peer增删改、启用禁用、删除、密钥轮换、接口设置等）和后台服务（对账、peer访问控制、
+// 密钥轮换、出口peer）都会重写服务器的配置文件、接口和防火墙链。两者并发时，后完成的一方可能按
+// 过期的记录覆盖前者的结果，例如重新启用刚被禁用的接口，或重建刚被删除的服务器的命名空间。
+// 与 provisioningRegistry 相同，处理请求时每次都会创建新的 UserNetworkService，因此锁在进程内共享
+type serverLockRegistry struct {
+	mu    sync.Mutex
+	locks map[uint]*sync.Mutex
+}
+
+var serverLocks = &serverLockRegistry{locks: make(map[uint]*sync.Mutex)}
+
+// get 返回服务器的锁，第一次使用时创建
+func (r *serverLockRegistry) get(serverID uint) *sync.Mutex {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	lock, ok := r.locks[serverID]
+	if !ok {
+		lock = &sync.Mutex{}
+		r.locks[serverID] = lock
+	}
+	return lock
+}
+
+// LockServer 获取服务器的锁，并在锁内重新读取服务器记录（包括所属用户）覆盖 server
+// 加锁前读取的记录可能已经过期（已被禁用或删除），调用方应按重新读取的记录修改网络。
+// 返回释放锁的函数；服务器已被删除时不持有锁，返回 gorm.ErrRecordNotFound
+func (s *UserNetworkService) LockServer(server *models.WireguardServer) (func(), error) {
+	lock := serverLocks.get(server.ID)
+	lock.Lock()
+
+	var current models.WireguardServer
+	if err := s.db.Preload("User").First(&current, server.ID).Error; err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	*server = current
+	return lock.Unlock, nil
+}
@@ -0,0 +1,347 @@
+package services
+
+import (
+	"cloud-platform/internal/models"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+const (
+	// sharedNamespacePrefix 共享网络中转命名空间名称前缀
+	sharedNamespacePrefix = "wgshr_"
+	// SharedNetworkChain 中转命名空间内只放行成员选中peer之间流量的自定义链，由 FORWARD 链首跳转
+	SharedNetworkChain = "WG_SHARED"
+)
+
+// SharedNamespaceName 共享网络的中转命名空间名称
+func SharedNamespaceName(networkID uint) string {
+	return sharedNamespacePrefix + strconv.FormatUint(uint64(networkID), 10)
+}
+
+// sharedHubInterface 中转命名空间内连接成员的接口名
+func sharedHubInterface(memberID uint) string {
+	return "m" + strconv.FormatUint(uint64(memberID), 10)
+}
+
+// sharedMemberInterface 成员命名空间内连接中转命名空间的接口名
+func sharedMemberInterface(networkID uint) string {
+	return "wgs" + strconv.FormatUint(uint64(networkID), 10)
+}
+
+// sharedLinkOwner 成员连接子网的IPAM占用者标识
+func sharedLinkOwner(networkID, memberID uint) string {
+	return SharedNamespaceName(networkID) + "/" + sharedHubInterface(memberID)
+}
+
+// sharedLinkAddresses 成员连接子网中中转端（.1）和成员端（.2）的地址（CIDR格式）
+func sharedLinkAddresses(member *models.SharedNetworkMember) (hubIP, memberIP string, err error) {
+	if hubIP, err = subnetHost(member.LinkSubnet, 1); err != nil {
+		return "", "", fmt.Errorf("invalid link subnet for shared network member %d: %v", member.ID, err)
+	}
+	if memberIP, err = subnetHost(member.LinkSubnet, 2); err != nil {
+		return "", "", fmt.Errorf("invalid link subnet for shared network member %d: %v", member.ID, err)
+	}
+	return hubIP, memberIP, nil
+}
+
+// AllocateSharedLink 为加入共享网络的成员从连接地址池（与主机veth地址池分开）分配连接中转命名空间的 /30 子网
+// 在事务中调用时，分配结果随事务一起提交或回滚
+func (s *UserNetworkService) AllocateSharedLink(member *models.SharedNetworkMember) error {
+	subnet, err := s.ipam.AllocateSharedLinkSubnet(sharedLinkOwner(member.NetworkID, member.ID))
+	if err != nil {
+		return err
+	}
+	member.LinkSubnet = subnet
+	return nil
+}
+
+// ReleaseSharedLink 释放成员的连接子网
+func (s *UserNetworkService) ReleaseSharedLink(member *models.SharedNetworkMember) error {
+	return s.ipam.Release(sharedLinkOwner(member.NetworkID, member.ID))
+}
+
+// SharedNetworkPrefixes peer经共享网络可以访问的网段：peer被选中的共享网络中其他已加入成员的WireGuard网段
+// 加入 subnet/exclude_private 模式的客户端 AllowedIPs（是否放行由中转命名空间按选中的peer控制）
+// 共享网络只支持IPv4，成员的IPv6网段不会返回
+func (s *UserNetworkService) SharedNetworkPrefixes(peer *models.WireguardPeer) ([]netip.Prefix, error) {
+	var servers []models.WireguardServer
+	err := s.db.Model(&models.WireguardServer{}).
+		Joins("JOIN shared_network_members ON shared_network_members.server_id = wireguard_servers.id").
+		Where("shared_network_members.status = ?", models.SharedNetworkStatusJoined).
+		Where("shared_network_members.network_id IN (?)", s.db.Model(&models.SharedNetworkPeer{}).Select("network_id").Where("peer_id = ?", peer.ID)).
+		Where("wireguard_servers.id <> ?", peer.ServerID).
+		Find(&servers).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to load shared networks: %v", err)
+	}
+
+	var prefixes []netip.Prefix
+	for _, server := range servers {
+		if prefix, err := netip.ParsePrefix(server.WgAddress); err == nil && prefix.Addr().Is4() {
+			prefixes = append(prefixes, prefix.Masked())
+		}
+	}
+	return dedupePrefixes(prefixes), nil
+}
+
+// ApplySharedNetwork 按数据库中的成员和选中的peer重新应用共享网络
+//   - 中转命名空间：为每个已加入的成员建立到其命名空间的veth连接，添加到成员WireGuard网段的路由，
+//     WG_SHARED 链只放行不同成员选中peer之间的流量（按入接口校验来源，防止伪造地址）
+//   - 成员命名空间：添加经连接到其他成员WireGuard网段的路由
+//   - 没有已加入的成员时删除中转命名空间
+//
+// 共享网络只支持IPv4：中转命名空间不开启IPv6转发，连接、路由和 WG_SHARED 链都只使用IPv4地址，
+// 选中的peer的IPv6地址无法经共享网络访问。
+// 成员命名空间不存在（如正在重建）时跳过该成员，由对账服务在重建后重新应用
+func (s *UserNetworkService) ApplySharedNetwork(networkID uint) error {
+	var members []models.SharedNetworkMember
+	if err := s.db.Preload("Server").Where("network_id = ? AND status = ?", networkID, models.SharedNetworkStatusJoined).
+		Order("id").Find(&members).Error; err != nil {
+		return fmt.Errorf("failed to load shared network members: %v", err)
+	}
+
+	var selected []models.SharedNetworkPeer
+	if err := s.db.Preload("Peer").Where("network_id = ?", networkID).Find(&selected).Error; err != nil {
+		return fmt.Errorf("failed to load shared network peers: %v", err)
+	}
+
+	var joined []models.SharedNetworkMember
+	for _, member := range members {
+		if member.Joined() && member.Server != nil && member.LinkSubnet != "" {
+			joined = append(joined, member)
+		}
+	}
+
+	// 已离开或服务器已删除的成员不再占用连接子网
+	hubNs := SharedNamespaceName(networkID)
+	if err := s.releaseStaleSharedLinks(networkID, joined); err != nil {
+		return err
+	}
+
+	hubExists, err := s.netnsService.NamespaceExists(hubNs)
+	if err != nil {
+		return err
+	}
+	if len(joined) == 0 {
+		if hubExists {
+			return s.netnsService.DeleteNamespace(hubNs)
+		}
+		return nil
+	}
+
+	// 1. 中转命名空间
+	if !hubExists {
+		if err := s.netnsService.CreateNamespace(hubNs); err != nil {
+			return err
+		}
+	}
+	if err := s.netnsService.EnableForwarding(hubNs, false); err != nil {
+		return err
+	}
+
+	// 2. 成员连接（成员命名空间不存在时跳过）
+	links, err := s.netnsService.ListLinks(hubNs)
+	if err != nil {
+		return err
+	}
+	liveLinks := make(map[string]bool, len(links))
+	for _, link := range links {
+		liveLinks[link] = true
+	}
+
+	var connected []models.SharedNetworkMember
+	wantedLinks := make(map[string]bool, len(joined))
+	for _, member := range joined {
+		exists, err := s.netnsService.NamespaceExists(member.Server.Namespace)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+
+		hubIf := sharedHubInterface(member.ID)
+		wantedLinks[hubIf] = true
+		if !liveLinks[hubIf] {
+			hubIP, memberIP, err := sharedLinkAddresses(&member)
+			if err != nil {
+				return err
+			}
+			if err := s.netnsService.CreateNamespaceLink(hubNs, hubIf, hubIP, member.Server.Namespace, sharedMemberInterface(networkID), memberIP); err != nil {
+				return err
+			}
+		}
+		connected = append(connected, member)
+	}
+
+	// 已离开的成员：删除连接（成员命名空间一端由内核一并删除）
+	for _, link := range links {
+		if strings.HasPrefix(link, "m") && !wantedLinks[link] {
+			s.netnsService.DeleteLink(hubNs, link)
+		}
+	}
+
+	// 3. 路由
+	for _, member := range connected {
+		hubIP, memberIP, err := sharedLinkAddresses(&member)
+		if err != nil {
+			return err
+		}
+
+		memberSubnet, err := netip.ParsePrefix(member.Server.WgAddress)
+		if err != nil {
+			return fmt.Errorf("invalid wireguard address %s: %v", member.Server.WgAddress, err)
+		}
+		if err := s.netnsService.EnsureDeviceRoutes(hubNs, sharedHubInterface(member.ID), addressWithoutPrefix(memberIP),
+			[]string{memberSubnet.Masked().String()}); err != nil {
+			return err
+		}
+
+		var others []string
+		for _, other := range connected {
+			if other.ID == member.ID {
+				continue
+			}
+			if otherSubnet, err := netip.ParsePrefix(other.Server.WgAddress); err == nil {
+				others = append(others, otherSubnet.Masked().String())
+			}
+		}
+		if err := s.netnsService.EnsureDeviceRoutes(member.Server.Namespace, sharedMemberInterface(networkID), addressWithoutPrefix(hubIP), others); err != nil {
+			return err
+		}
+	}
+
+	// 4. 只放行不同成员选中的peer之间的流量
+	peersByServer := make(map[uint][]string)
+	for _, entry := range selected {
+		peersByServer[entry.Peer.ServerID] = append(peersByServer[entry.Peer.ServerID], entry.Peer.PeerAddress+"/32")
+	}
+
+	var rules [][]string
+	for _, a := range connected {
+		for _, b := range connected {
+			if a.ID == b.ID {
+				continue
+			}
+			for _, source := range peersByServer[a.Server.ID] {
+				for _, destination := range peersByServer[b.Server.ID] {
+					rules = append(rules, []string{"-i", sharedHubInterface(a.ID), "-o", sharedHubInterface(b.ID),
+						"-s", source, "-d", destination, "-j", "ACCEPT"})
+				}
+			}
+		}
+	}
+	rules = append(rules, []string{"-j", "DROP"})
+
+	return s.firewall.ApplyChain(hubNs, false, FirewallChain{Table: "filter", Hook: "FORWARD", Name: SharedNetworkChain}, rules)
+}
+
+// DestroySharedNetwork 删除共享网络的中转命名空间并释放所有成员的连接子网
+// 成员命名空间内的连接接口随中转命名空间一并删除，其上的路由随之消失
+func (s *UserNetworkService) DestroySharedNetwork(networkID uint) error {
+	hubNs := SharedNamespaceName(networkID)
+	exists, err := s.netnsService.NamespaceExists(hubNs)
+	if err != nil {
+		return err
+	}
+	if exists {
+		if err := s.netnsService.DeleteNamespace(hubNs); err != nil {
+			return err
+		}
+	}
+	return s.releaseStaleSharedLinks(networkID, nil)
+}
+
+// ApplySharedNetworks 重新应用所有共享网络，并删除已没有对应记录的中转命名空间
+// 用于对账：成员命名空间重建后连接会丢失
+func (s *UserNetworkService) ApplySharedNetworks() error {
+	var networkIDs []uint
+	if err := s.db.Model(&models.SharedNetwork{}).Order("id").Pluck("id", &networkIDs).Error; err != nil {
+		return fmt.Errorf("failed to load shared networks: %v", err)
+	}
+
+	expected := make(map[string]bool, len(networkIDs))
+	var errs []string
+	for _, id := range networkIDs {
+		expected[SharedNamespaceName(id)] = true
+		if err := s.ApplySharedNetwork(id); err != nil {
+			errs = append(errs, fmt.Sprintf("shared network %d: %v", id, err))
+		}
+	}
+
+	namespaces, err := s.netnsService.ListNamespaces()
+	if err != nil {
+		return err
+	}
+	for _, nsName := range namespaces {
+		if !strings.HasPrefix(nsName, sharedNamespacePrefix) || expected[nsName] {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimPrefix(nsName, sharedNamespacePrefix), 10, 32)
+		if err != nil {
+			continue
+		}
+		if err := s.DestroySharedNetwork(uint(id)); err != nil {
+			errs = append(errs, fmt.Sprintf("orphan shared network %d: %v", id, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// PeerSharedNetworks 选中了peer的共享网络
+// 选中记录随peer级联删除，删除peer时需要在删除之前获取
+func (s *UserNetworkService) PeerSharedNetworks(peer *models.WireguardPeer) ([]uint, error) {
+	var networkIDs []uint
+	if err := s.db.Model(&models.SharedNetworkPeer{}).Where("peer_id = ?", peer.ID).Order("network_id").
+		Pluck("network_id", &networkIDs).Error; err != nil {
+		return nil, fmt.Errorf("failed to load shared networks: %v", err)
+	}
+	return networkIDs, nil
+}
+
+// ApplySharedNetworksByID 重新应用指定的共享网络
+// 中转命名空间的规则只依赖选中peer的地址和成员接入的服务器，只有选中的peer被删除、
+// 或成员的服务器被删除时才需要调用，其他peer的变化不影响共享网络
+func (s *UserNetworkService) ApplySharedNetworksByID(networkIDs []uint) error {
+	for _, id := range networkIDs {
+		if err := s.ApplySharedNetwork(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseStaleSharedLinks 释放不属于 members 的连接子网
+func (s *UserNetworkService) releaseStaleSharedLinks(networkID uint, members []models.SharedNetworkMember) error {
+	wanted := make(map[string]bool, len(members))
+	for _, member := range members {
+		if member.LinkSubnet != "" {
+			wanted[sharedLinkOwner(networkID, member.ID)] = true
+		}
+	}
+
+	// 旧版本的连接子网分配在veth地址池中，同样需要释放
+	var owners []string
+	for _, pool := range []string{models.PoolSharedLink, models.PoolVethSubnet} {
+		poolOwners, err := s.ipam.OwnersWithPrefix(pool, SharedNamespaceName(networkID)+"/")
+		if err != nil {
+			return fmt.Errorf("failed to load shared network links: %v", err)
+		}
+		owners = append(owners, poolOwners...)
+	}
+	for _, owner := range owners {
+		if wanted[owner] {
+			continue
+		}
+		if err := s.ipam.Release(owner); err != nil {
+			return fmt.Errorf("failed to release shared network link %s: %v", owner, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package services
+
+import (
+	"cloud-platform/internal/models"
+	"net/netip"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// joinTestSharedNetwork 将服务器作为已加入的成员接入共享网络，并选中 peers
+func joinTestSharedNetwork(t *testing.T, s *UserNetworkService, network *models.SharedNetwork, server *models.WireguardServer, peers ...*models.WireguardPeer) {
+	t.Helper()
+	now := time.Now()
+	member := &models.SharedNetworkMember{NetworkID: network.ID, UserID: server.UserID, ServerID: &server.ID,
+		Status: models.SharedNetworkStatusJoined, JoinedAt: &now}
+	if err := s.db.Create(member).Error; err != nil {
+		t.Fatalf("create member: %v", err)
+	}
+	if err := s.AllocateSharedLink(member); err != nil {
+		t.Fatalf("AllocateSharedLink: %v", err)
+	}
+	if err := s.db.Save(member).Error; err != nil {
+		t.Fatalf("save member: %v", err)
+	}
+	for _, peer := range peers {
+		if err := s.db.Create(&models.SharedNetworkPeer{NetworkID: network.ID, PeerID: peer.ID}).Error; err != nil {
+			t.Fatalf("select peer: %v", err)
+		}
+	}
+}
+
+// sharedRulesMention 中转命名空间的 WG_SHARED 链中是否有涉及 address 的规则
+func sharedRulesMention(runner *FakeRunner, networkID uint, address string) bool {
+	return slices.ContainsFunc(runner.Rules(SharedNamespaceName(networkID), "iptables", "filter", SharedNetworkChain), func(rule string) bool {
+		return strings.Contains(rule, address+"/32")
+	})
+}
+
+func TestSharedNetworkPeerChanges(t *testing.T) {
+	s, _, runner, alice := newTestUserNetwork(t)
+	bob := &models.User{UserUID: "e5f6a7b8", Email: "bob@example.com", PasswordHash: "x", Name: "bob"}
+	if err := s.db.Create(bob).Error; err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	serverA := provisionTestServer(t, s, alice, 0)
+	serverB := provisionTestServer(t, s, bob, 0)
+
+	selected := createTestPeer(t, s, serverA, "10.100.0.2")
+	other := createTestPeer(t, s, serverA, "10.100.0.3")
+	remote := createTestPeer(t, s, serverB, netip.MustParsePrefix(serverB.WgAddress).Addr().Next().String())
+
+	network := &models.SharedNetwork{Name: "team", OwnerID: alice.ID}
+	if err := s.db.Create(network).Error; err != nil {
+		t.Fatalf("create shared network: %v", err)
+	}
+	joinTestSharedNetwork(t, s, network, serverA, selected)
+	joinTestSharedNetwork(t, s, network, serverB, remote)
+	if err := s.ApplySharedNetwork(network.ID); err != nil {
+		t.Fatalf("ApplySharedNetwork: %v", err)
+	}
+	if !sharedRulesMention(runner, network.ID, selected.PeerAddress) || !sharedRulesMention(runner, network.ID, remote.PeerAddress) {
+		t.Fatalf("shared rules missing selected peers: %v", runner.Rules(SharedNamespaceName(network.ID), "iptables", "filter", SharedNetworkChain))
+	}
+
+	// 共享网络只支持IPv4：双栈成员只返回IPv4网段，中转命名空间没有IPv6规则
+	if err := s.db.Model(serverB).Update("wg_address6", "fd00:200::1/64").Error; err != nil {
+		t.Fatalf("enable IPv6: %v", err)
+	}
+	if err := s.ApplySharedNetwork(network.ID); err != nil {
+		t.Fatalf("ApplySharedNetwork with IPv6 member: %v", err)
+	}
+	wantPrefixes := []netip.Prefix{netip.MustParsePrefix(serverB.WgAddress).Masked()}
+	if prefixes, err := s.SharedNetworkPrefixes(selected); err != nil || !slices.Equal(prefixes, wantPrefixes) {
+		t.Errorf("SharedNetworkPrefixes = %v, %v; want %v", prefixes, err, wantPrefixes)
+	}
+	if rules := runner.Rules(SharedNamespaceName(network.ID), "ip6tables", "filter", SharedNetworkChain); len(rules) != 0 {
+		t.Errorf("shared network has IPv6 rules: %v", rules)
+	}
+
+	// 只有选中的peer属于共享网络
+	if ids, err := s.PeerSharedNetworks(other); err != nil || len(ids) != 0 {
+		t.Errorf("PeerSharedNetworks(unselected) = %v, %v; want none", ids, err)
+	}
+	ids, err := s.PeerSharedNetworks(selected)
+	if err != nil || !slices.Equal(ids, []uint{network.ID}) {
+		t.Fatalf("PeerSharedNetworks(selected) = %v, %v; want [%d]", ids, err, network.ID)
+	}
+
+	// 同步peer不再重新应用共享网络
+	applied := func() int {
+		return len(slices.DeleteFunc(runner.Calls(), func(argv []string) bool {
+			return !slices.Contains(argv, SharedNamespaceName(network.ID))
+		}))
+	}
+	before := applied()
+	if err := s.SyncPeers(serverA, testUserUID); err != nil {
+		t.Fatalf("SyncPeers: %v", err)
+	}
+	if calls := applied(); calls != before {
+		t.Errorf("SyncPeers touched the shared network namespace (%d commands)", calls-before)
+	}
+
+	// 删除选中的peer后按删除前记下的共享网络重新应用（测试数据库未启用外键，手动删除选中记录）
+	if err := s.db.Where("peer_id = ?", selected.ID).Delete(&models.SharedNetworkPeer{}).Error; err != nil {
+		t.Fatalf("delete selection: %v", err)
+	}
+	if err := s.db.Delete(selected).Error; err != nil {
+		t.Fatalf("delete peer: %v", err)
+	}
+	if err := s.SyncPeers(serverA, testUserUID); err != nil {
+		t.Fatalf("SyncPeers after delete: %v", err)
+	}
+	if err := s.ApplySharedNetworksByID(ids); err != nil {
+		t.Fatalf("ApplySharedNetworksByID: %v", err)
+	}
+	if sharedRulesMention(runner, network.ID, selected.PeerAddress) {
+		t.Errorf("shared rules still allow deleted peer %s", selected.PeerAddress)
+	}
+}
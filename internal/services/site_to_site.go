@@ -0,0 +1,107 @@
+package services
+
+import (
+	"cloud-platform/internal/models"
+	"fmt"
+	"net/netip"
+)
+
+// PeerRoutedSubnets peer背后的路由网段（站点到站点）：peer的 AllowedIPs 中除默认路由和
+// 用户WireGuard网段以外的网段。这些网段写入服务器侧该peer的 allowed-ips，
+// 命名空间内访问它们的流量经隧道交给该peer转发；无法解析时返回空
+func PeerRoutedSubnets(server *models.WireguardServer, peer *models.WireguardPeer) []netip.Prefix {
+	prefixes, err := parsePrefixList(peer.AllowedIPs)
+	if err != nil {
+		return nil
+	}
+
+	var wgSubnets []netip.Prefix
+	for _, address := range []string{server.WgAddress, server.WgAddress6} {
+		if prefix, err := netip.ParsePrefix(address); err == nil {
+			wgSubnets = append(wgSubnets, prefix.Masked())
+		}
+	}
+
+	var routed []netip.Prefix
+	for _, prefix := range prefixes {
+		// 默认路由表示peer可以访问所有地址，不是peer背后的网段
+		if prefix.Bits() == 0 {
+			continue
+		}
+		if overlapsAny(prefix, wgSubnets) {
+			continue
+		}
+		routed = append(routed, prefix)
+	}
+	return dedupePrefixes(routed)
+}
+
+// ValidateRoutedSubnets 校验peer的 AllowedIPs 格式，并确认其路由网段与同一服务器上其他peer的路由网段不重叠
+// （WireGuard按 allowed-ips 选择peer，重叠的网段只会生效在其中一个peer上）
+func ValidateRoutedSubnets(server *models.WireguardServer, peer *models.WireguardPeer, peers []models.WireguardPeer) error {
+	if _, err := parsePrefixList(peer.AllowedIPs); err != nil {
+		return fmt.Errorf("invalid allowed IPs: %v", err)
+	}
+
+	routed := PeerRoutedSubnets(server, peer)
+	for _, other := range peers {
+		if other.ID == peer.ID {
+			continue
+		}
+		for _, otherPrefix := range PeerRoutedSubnets(server, &other) {
+			for _, prefix := range routed {
+				if !prefix.Overlaps(otherPrefix) {
+					continue
+				}
+				if other.Comment != "" {
+					return fmt.Errorf("subnet %s overlaps %s routed by peer %d (%s)", prefix, otherPrefix, other.ID, other.Comment)
+				}
+				return fmt.Errorf("subnet %s overlaps %s routed by peer %d", prefix, otherPrefix, other.ID)
+			}
+		}
+	}
+	return nil
+}
+
+// peerServerAllowedIPs 服务器侧该peer的 allowed-ips：peer自身地址（双栈时包含IPv6地址）加上其背后的路由网段，
+// 出口peer另外包含 0.0.0.0/0
+func peerServerAllowedIPs(server *models.WireguardServer, peer *models.WireguardPeer) string {
+	allowedIPs := peer.PeerAddress + "/32"
+	if peer.PeerAddress6 != "" {
+		allowedIPs += ", " + peer.PeerAddress6 + "/128"
+	}
+	if routed := PeerRoutedSubnets(server, peer); len(routed) > 0 {
+		allowedIPs += ", " + joinPrefixes(routed)
+	}
+	// 出口peer承接其他peer的外网流量（只在出口路由表中有默认路由，主路由表不受影响）
+	if server.ExitPeerID != nil && *server.ExitPeerID == peer.ID {
+		allowedIPs += ", 0.0.0.0/0"
+	}
+	return allowedIPs
+}
+
+// peerSources peer作为流量来源时的地址（IPv4和IPv6分开）：peer自身地址和其背后的路由网段
+func peerSources(server *models.WireguardServer, peer *models.WireguardPeer) (sources4, sources6 []string) {
+	sources4 = []string{peer.PeerAddress + "/32"}
+	if peer.PeerAddress6 != "" {
+		sources6 = []string{peer.PeerAddress6 + "/128"}
+	}
+	for _, prefix := range PeerRoutedSubnets(server, peer) {
+		if prefix.Addr().Is4() {
+			sources4 = append(sources4, prefix.String())
+		} else {
+			sources6 = append(sources6, prefix.String())
+		}
+	}
+	return sources4, sources6
+}
+
+// overlapsAny 判断网段是否与列表中的任一网段重叠
+func overlapsAny(prefix netip.Prefix, list []netip.Prefix) bool {
+	for _, other := range list {
+		if prefix.Overlaps(other) {
+			return true
+		}
+	}
+	return false
+}
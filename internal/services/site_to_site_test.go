@@ -0,0 +1,140 @@
+package services
+
+import (
+	"cloud-platform/internal/models"
+	"net/netip"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestPeerRoutedSubnets(t *testing.T) {
+	server := &models.WireguardServer{WgAddress: "10.100.0.1/24", WgAddress6: "fd00:100::1/64"}
+
+	tests := []struct {
+		allowedIPs string
+		want       string
+	}{
+		{"10.100.0.2/32", ""},
+		{"10.100.0.2/32, fd00:100::2/128", ""},
+		{"10.100.0.2/32, 192.168.1.0/24", "192.168.1.0/24"},
+		{"10.100.0.2/32, 192.168.1.7/24, fd00:200::/64", "192.168.1.0/24, fd00:200::/64"},
+		// 默认路由和与用户网段重叠的网段不是peer背后的网段
+		{"0.0.0.0/0, ::/0", ""},
+		{"10.100.0.0/16, 172.16.0.0/12", "172.16.0.0/12"},
+		{"not-a-cidr", ""},
+	}
+
+	for _, tt := range tests {
+		peer := &models.WireguardPeer{PeerAddress: "10.100.0.2", AllowedIPs: tt.allowedIPs}
+		if got := joinPrefixes(PeerRoutedSubnets(server, peer)); got != tt.want {
+			t.Errorf("PeerRoutedSubnets(%q) = %q, want %q", tt.allowedIPs, got, tt.want)
+		}
+	}
+}
+
+func TestValidateRoutedSubnets(t *testing.T) {
+	server := &models.WireguardServer{WgAddress: "10.100.0.1/24", WgAddress6: "fd00:100::1/64"}
+	peers := []models.WireguardPeer{
+		{ID: 1, PeerAddress: "10.100.0.2", AllowedIPs: "10.100.0.2/32, 192.168.1.0/24", Comment: "office"},
+		{ID: 2, PeerAddress: "10.100.0.3", AllowedIPs: "10.100.0.3/32, fd00:200::/64"},
+		{ID: 3, PeerAddress: "10.100.0.4", AllowedIPs: "10.100.0.4/32"},
+	}
+
+	tests := []struct {
+		name       string
+		id         uint
+		allowedIPs string
+		wantErr    string
+	}{
+		{name: "disjoint subnet", id: 3, allowedIPs: "10.100.0.4/32, 192.168.2.0/24"},
+		{name: "same peer keeps its subnet", id: 1, allowedIPs: "10.100.0.2/32, 192.168.1.0/25"},
+		{name: "only tunnel addresses", id: 3, allowedIPs: "10.100.0.4/32, 0.0.0.0/0"},
+		{name: "identical subnet", id: 3, allowedIPs: "10.100.0.4/32, 192.168.1.0/24", wantErr: "overlaps 192.168.1.0/24 routed by peer 1 (office)"},
+		{name: "subnet inside another", id: 3, allowedIPs: "192.168.1.128/25", wantErr: "routed by peer 1"},
+		{name: "subnet covering another", id: 3, allowedIPs: "192.168.0.0/16", wantErr: "routed by peer 1"},
+		{name: "ipv6 overlap without comment", id: 3, allowedIPs: "fd00:200::/48", wantErr: "overlaps fd00:200::/64 routed by peer 2"},
+		{name: "new peer", id: 0, allowedIPs: "10.100.0.9/32, 192.168.1.1", wantErr: "routed by peer 1"},
+		{name: "invalid cidr", id: 3, allowedIPs: "10.100.0.4/33", wantErr: "invalid allowed IPs"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peer := &models.WireguardPeer{ID: tt.id, AllowedIPs: tt.allowedIPs}
+			err := ValidateRoutedSubnets(server, peer, peers)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("ValidateRoutedSubnets(%q) = %v, want nil", tt.allowedIPs, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ValidateRoutedSubnets(%q) = %v, want %q", tt.allowedIPs, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// hasRoute 命名空间内的路由表 table 中是否有经 dev 到 destination 的路由
+func hasRoute(routes []Route, destination, dev string, table int) bool {
+	return slices.ContainsFunc(routes, func(route Route) bool {
+		return route.Destination == netip.MustParsePrefix(destination) && route.Device == dev && route.Table == table
+	})
+}
+
+func TestPeerRouteTable(t *testing.T) {
+	s, backend, _, user := newTestUserNetwork(t)
+	server := provisionTestServer(t, s, user, 0)
+	peer := createTestPeer(t, s, server, "10.100.0.2")
+	if err := s.db.Model(peer).Update("allowed_ips", "10.100.0.2/32, 192.168.1.0/24").Error; err != nil {
+		t.Fatalf("update peer: %v", err)
+	}
+	peer.AllowedIPs = "10.100.0.2/32, 192.168.1.0/24"
+
+	// 设置路由表后路由从主路由表移到该表，并添加查询该表的规则，接口不重启
+	backend.FailOn("DeleteLink "+server.Namespace+"/wg0", syscall.EIO)
+	if err := s.SyncPeers(server, testUserUID); err != nil {
+		t.Fatalf("SyncPeers: %v", err)
+	}
+	previous := *server
+	server.RouteTable = "100"
+	if err := s.ApplyInterfaceSettings(server, &previous, testUserUID); err != nil {
+		t.Fatalf("ApplyInterfaceSettings: %v", err)
+	}
+	routes := backend.Routes(server.Namespace)
+	if !hasRoute(routes, "192.168.1.0/24", "wg0", 100) || hasRoute(routes, "192.168.1.0/24", "wg0", 0) {
+		t.Errorf("routes = %+v, want 192.168.1.0/24 only in table 100", routes)
+	}
+	lookup := PolicyRule{Priority: peerTablePriority, Table: 100}
+	if rules := backend.Rules(server.Namespace); !slices.Contains(rules, lookup) {
+		t.Errorf("rules = %+v, want %+v", rules, lookup)
+	}
+
+	// 删除peer的网段时从该表删除路由
+	if err := s.RemovePeerRoutes(server, peer); err != nil {
+		t.Fatalf("RemovePeerRoutes: %v", err)
+	}
+	if routes := backend.Routes(server.Namespace); hasRoute(routes, "192.168.1.0/24", "wg0", 100) {
+		t.Errorf("routes after RemovePeerRoutes = %+v, want no route to 192.168.1.0/24", routes)
+	}
+
+	// 恢复为主路由表时删除规则
+	if err := s.SyncPeers(server, testUserUID); err != nil {
+		t.Fatalf("SyncPeers: %v", err)
+	}
+	previous = *server
+	server.RouteTable = ""
+	if err := s.ApplyInterfaceSettings(server, &previous, testUserUID); err != nil {
+		t.Fatalf("ApplyInterfaceSettings: %v", err)
+	}
+	routes = backend.Routes(server.Namespace)
+	if !hasRoute(routes, "192.168.1.0/24", "wg0", 0) || hasRoute(routes, "192.168.1.0/24", "wg0", 100) {
+		t.Errorf("routes = %+v, want 192.168.1.0/24 only in the main table", routes)
+	}
+	for _, rule := range backend.Rules(server.Namespace) {
+		if rule.Priority == peerTablePriority {
+			t.Errorf("lookup rule %+v left after switching back to the main table", rule)
+		}
+	}
+}
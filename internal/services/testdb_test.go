@@ -0,0 +1,51 @@
+package services
+
+import (
+	"cloud-platform/internal/models"
+	_ "cloud-platform/internal/secrets" // 注册加密字段的序列化器
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// newTestDB 创建独立的内存SQLite数据库并建表（与 database.Migrate 使用相同的模型）
+func newTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	dsn := fmt.Sprintf("file:%s?mode=memory&cache=shared", strings.NewReplacer("/", "_", " ", "_").Replace(t.Name()))
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("open test database: %v", err)
+	}
+
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatalf("open test database: %v", err)
+	}
+	// 共享缓存的内存数据库在最后一个连接关闭时销毁
+	sqlDB.SetMaxOpenConns(1)
+	t.Cleanup(func() { sqlDB.Close() })
+
+	if err := db.AutoMigrate(
+		&models.User{},
+		&models.WireguardServer{},
+		&models.WireguardPeer{},
+		&models.IPAllocation{},
+		&models.PortAllocation{},
+		&models.WireguardPeerKeyRotation{},
+		&models.WireguardACL{},
+		&models.WireguardPeerLink{},
+		&models.DNSRecord{},
+		&models.PortForward{},
+		&models.SharedNetwork{},
+		&models.SharedNetworkMember{},
+		&models.SharedNetworkPeer{},
+	); err != nil {
+		t.Fatalf("migrate test database: %v", err)
+	}
+	return db
+}
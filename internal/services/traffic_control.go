@@ -0,0 +1,132 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// TrafficControlService 流量控制服务（基于 tc 在命名空间内限速）
+//
+// 下载方向（服务器 -> peer）：在 WireGuard 接口的 egress 上挂载 HTB 队列
+// 上传方向（peer -> 服务器）：将 WireGuard 接口的 ingress 流量重定向到 IFB 设备，再在 IFB 的 egress 上挂载 HTB 队列
+type TrafficControlService struct {
+	netnsService *NetnsService
+}
+
+// NewTrafficControlService 创建流量控制服务实例，IFB设备和 tc 命令都经由 netnsService 操作
+func NewTrafficControlService(netnsService *NetnsService) *TrafficControlService {
+	return &TrafficControlService{
+		netnsService: netnsService,
+	}
+}
+
+// ifbName 获取WireGuard接口对应的IFB设备名称
+func (s *TrafficControlService) ifbName(wgInterface string) string {
+	return fmt.Sprintf("ifb-%s", wgInterface)
+}
+
+// ApplyRateLimit 在命名空间内为WireGuard接口设置速率限制
+// downloadRate/uploadRate 单位为 Mbps，0 表示不限速
+func (s *TrafficControlService) ApplyRateLimit(nsName, wgInterface string, downloadRate, uploadRate int) error {
+	if downloadRate < 0 || uploadRate < 0 {
+		return fmt.Errorf("rate limit must not be negative")
+	}
+
+	// 先清理旧的限速规则，保证重复调用结果一致
+	if err := s.ClearRateLimit(nsName, wgInterface); err != nil {
+		return err
+	}
+
+	// 1. 下载限速：wg接口的出方向
+	if downloadRate > 0 {
+		if err := s.addHTB(nsName, wgInterface, downloadRate); err != nil {
+			return fmt.Errorf("failed to apply download rate limit: %v", err)
+		}
+	}
+
+	// 2. 上传限速：wg接口的入方向，经由IFB设备整形
+	if uploadRate > 0 {
+		if err := s.applyIngressLimit(nsName, wgInterface, uploadRate); err != nil {
+			s.ClearRateLimit(nsName, wgInterface)
+			return fmt.Errorf("failed to apply upload rate limit: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// ClearRateLimit 清除命名空间内WireGuard接口的所有限速规则
+func (s *TrafficControlService) ClearRateLimit(nsName, wgInterface string) error {
+	ifb := s.ifbName(wgInterface)
+
+	commands := [][]string{
+		{"tc", "qdisc", "del", "dev", wgInterface, "root"},
+		{"tc", "qdisc", "del", "dev", wgInterface, "ingress"},
+	}
+
+	for _, command := range commands {
+		if _, err := s.netnsService.ExecInNamespace(nsName, command); err != nil && !isTcNotFoundError(err) {
+			return fmt.Errorf("failed to clear rate limit: %v", err)
+		}
+	}
+
+	if err := s.netnsService.DeleteLink(nsName, ifb); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to clear rate limit: %v", err)
+	}
+	return nil
+}
+
+// addHTB 在指定设备的出方向上添加HTB限速队列
+func (s *TrafficControlService) addHTB(nsName, device string, rateMbps int) error {
+	rate := fmt.Sprintf("%dmbit", rateMbps)
+
+	commands := [][]string{
+		{"tc", "qdisc", "replace", "dev", device, "root", "handle", "1:", "htb", "default", "10"},
+		{"tc", "class", "replace", "dev", device, "parent", "1:", "classid", "1:10", "htb", "rate", rate, "ceil", rate},
+	}
+
+	for _, command := range commands {
+		if _, err := s.netnsService.ExecInNamespace(nsName, command); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applyIngressLimit 将wg接口的入方向流量重定向到IFB设备并限速
+func (s *TrafficControlService) applyIngressLimit(nsName, wgInterface string, rateMbps int) error {
+	ifb := s.ifbName(wgInterface)
+
+	// 1. 创建并启动IFB设备
+	if err := s.netnsService.CreateIfbLink(nsName, ifb); err != nil {
+		return err
+	}
+
+	commands := [][]string{
+		// 2. wg接口挂载ingress队列，并把所有入流量重定向到IFB
+		{"tc", "qdisc", "add", "dev", wgInterface, "handle", "ffff:", "ingress"},
+		{"tc", "filter", "add", "dev", wgInterface, "parent", "ffff:", "protocol", "all", "prio", "1",
+			"u32", "match", "u32", "0", "0", "action", "mirred", "egress", "redirect", "dev", ifb},
+	}
+
+	for _, command := range commands {
+		if _, err := s.netnsService.ExecInNamespace(nsName, command); err != nil {
+			return err
+		}
+	}
+
+	// 3. 在IFB出方向上限速
+	return s.addHTB(nsName, ifb, rateMbps)
+}
+
+// isTcNotFoundError 判断是否为"规则/设备不存在"类错误（清理时可忽略）
+func isTcNotFoundError(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "No such file or directory") ||
+		strings.Contains(msg, "Cannot find device") ||
+		strings.Contains(msg, "Cannot delete qdisc with handle of zero") ||
+		strings.Contains(msg, "Invalid handle")
+}
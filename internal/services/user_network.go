@@ -1,127 +1,644 @@
 package services
 
 import (
+	"cloud-platform/internal/config"
 	"cloud-platform/internal/models"
 	"fmt"
-	"hash/fnv"
+	"net/netip"
+	"strconv"
 	"strings"
+	"time"
+
+	"gorm.io/gorm"
 )
 
+// namespacePrefix 用户命名空间名称前缀
+const namespacePrefix = "wg_"
+
 // UserNetworkService 用户网络配置服务
 type UserNetworkService struct {
 	netnsService     *NetnsService
 	wireguardService *WireguardService
-	baseSubnet       string // 基础子网 (如 "10.200")
-	basePort         int    // WireGuard起始端口 (如 51820)
+	trafficControl   *TrafficControlService
+	ipam             *IPAMService
+	firewall         Firewall
+	db               *gorm.DB
 	outInterface     string // 外网接口 (如 "eth0")
+	vethPool         string // veth子网地址池，主机侧对其做 MASQUERADE
+	ipv6Pool         string // 用户IPv6地址池，为空表示不启用IPv6
+	dnsCfg           config.DNSConfig
+	portForwardCfg   config.PortForwardConfig
 }
 
-// NewUserNetworkService 创建用户网络配置服务
-func NewUserNetworkService(configDir, baseSubnet string, basePort int, outInterface string) *UserNetworkService {
+// NewUserNetworkService 创建用户网络配置服务，命名空间和接口经 netlink/wgctrl 直接操作
+func NewUserNetworkService(db *gorm.DB, netCfg config.NetworkConfig) *UserNetworkService {
+	return NewUserNetworkServiceWithBackend(db, netCfg, NewNetlinkBackend(), NewExecRunner())
+}
+
+// NewUserNetworkServiceWithBackend 使用指定的网络后端和命令执行器创建用户网络服务实例
+// 所有底层服务共享同一个后端和执行器，生命周期测试（user_network_test.go）传入内存实现，无需 root 权限
+func NewUserNetworkServiceWithBackend(db *gorm.DB, netCfg config.NetworkConfig, backend NetworkBackend, runner CommandRunner) *UserNetworkService {
+	netnsService := NewNetnsService(backend, runner)
 	return &UserNetworkService{
-		netnsService:     NewNetnsService(),
-		wireguardService: NewWireguardService(configDir),
-		baseSubnet:       baseSubnet,
-		basePort:         basePort,
-		outInterface:     outInterface,
+		netnsService:     netnsService,
+		wireguardService: NewWireguardService(netCfg.ConfigDir, backend),
+		trafficControl:   NewTrafficControlService(netnsService),
+		ipam:             NewIPAMService(db, netCfg),
+		firewall:         NewFirewall(netCfg.GetFirewall(), runner),
+		db:               db,
+		outInterface:     netCfg.OutInterface,
+		vethPool:         netCfg.GetVethSubnetPool(),
+		ipv6Pool:         netCfg.IPv6Pool,
+		dnsCfg:           netCfg.DNS,
+		portForwardCfg:   netCfg.PortForward,
 	}
 }
 
-// ProvisionUserNetwork 为用户配置完整的网络环境
+// ProvisionUserNetwork 为用户配置完整的网络环境（用户的第一个服务器）
 // 返回 WireguardServer 对象，调用方负责保存到数据库
 func (s *UserNetworkService) ProvisionUserNetwork(user *models.User) (*models.WireguardServer, error) {
-	// 1. 生成配置参数（基于UserUID）
-	nsName := s.generateNamespaceName(user.UserUID)
-	wgInterface := "wg0"
-	
-	// 使用UserUID的哈希值生成端口和子网ID（避免冲突）
-	userHash := s.hashUserUID(user.UserUID)
-	wgPort := s.basePort + (userHash % 10000) // 限制在10000个端口范围内
-	vethHost := fmt.Sprintf("veth-h-%s", user.UserUID[:6])
-	vethNs := fmt.Sprintf("veth-ns-%s", user.UserUID[:6])
-	
-	// IP地址分配
-	// 为每个用户分配独立的网段（使用哈希值的低8位作为子网ID）
-	userSubnetID := (userHash % 254) + 1 // 1-254，避免0和255
-	
+	return s.ProvisionServer(user, 0)
+}
+
+// ProvisionServer 为用户创建第 index 个WireGuard服务器（接口 wg<index>），每个服务器使用独立的命名空间
+// 返回 WireguardServer 对象，调用方负责保存到数据库，并在提交后调用 FinishProvisioning
+func (s *UserNetworkService) ProvisionServer(user *models.User, index int) (_ *models.WireguardServer, err error) {
+	// 1. 生成配置参数（基于UserUID和服务器序号）
+	nsName := s.generateNamespaceName(user.UserUID, index)
+	wgInterface := fmt.Sprintf("wg%d", index)
+	owner := allocationOwner(nsName, wgInterface)
+
+	// 记录提交前对账服务不能将命名空间当作孤立资源删除；创建失败时网络已清理，直接注销
+	vethHost, _ := s.vethNames(user.UserUID, wgInterface)
+	provisioning.add(nsName, vethHost)
+	defer func() {
+		if err != nil {
+			provisioning.remove(nsName)
+		}
+	}()
+
+	// 2. 从地址池中分配veth子网、WireGuard网段和监听端口（持久化，保证不冲突）
+	allocation, err := s.ipam.AllocateServerNetwork(owner)
+	if err != nil {
+		return nil, err
+	}
+
+	// WireGuard 使用独立的子网（默认 10.100.X.0/24），服务器占用第一个地址
+	wgIP, err := subnetHost(allocation.WgSubnet, 1)
+	if err != nil {
+		s.ipam.Release(owner)
+		return nil, err
+	}
+
+	// 双栈：IPv6网段同样由服务器占用第一个地址
+	wgIP6 := ""
+	if allocation.WgSubnet6 != "" {
+		if wgIP6, err = subnetHost(allocation.WgSubnet6, 1); err != nil {
+			s.ipam.Release(owner)
+			return nil, err
+		}
+	}
+
+	// 3. 生成WireGuard密钥
+	privateKey, publicKey, err := s.wireguardService.GenerateKeys()
+	if err != nil {
+		s.ipam.Release(owner)
+		return nil, fmt.Errorf("failed to generate wireguard keys: %v", err)
+	}
+
+	// 4. 创建 WireguardServer 对象
+	wgServer := &models.WireguardServer{
+		UserID:       user.ID,
+		Namespace:    nsName,
+		WgInterface:  wgInterface,
+		WgPort:       allocation.WgPort,
+		WgPublicKey:  publicKey,
+		WgPrivateKey: privateKey,
+		WgAddress:    wgIP,
+		WgAddress6:   wgIP6,
+		VethSubnet:   allocation.VethSubnet,
+		Enabled:      true,
+	}
+
+	// 5. 按服务器配置搭建网络环境
+	if err := s.setupUserNetwork(wgServer, user.UserUID); err != nil {
+		s.ipam.Release(owner)
+		return nil, err
+	}
+
+	return wgServer, nil
+}
+
+// ServerQuota 用户可创建的WireGuard服务器数量：优先使用管理员为用户单独设置的配额
+func ServerQuota(user *models.User, cfg config.NetworkConfig) int {
+	if user.ServerQuota != nil {
+		return *user.ServerQuota
+	}
+	return cfg.GetServerQuota()
+}
+
+// NextServerIndex 返回用户下一个服务器可用的最小序号（接口 wg<序号>）
+func (s *UserNetworkService) NextServerIndex(userID uint) (int, error) {
+	var interfaces []string
+	if err := s.db.Model(&models.WireguardServer{}).Where("user_id = ?", userID).Pluck("wg_interface", &interfaces).Error; err != nil {
+		return 0, err
+	}
+
+	used := make(map[int]bool, len(interfaces))
+	for _, wgInterface := range interfaces {
+		if index, err := strconv.Atoi(strings.TrimPrefix(wgInterface, "wg")); err == nil {
+			used[index] = true
+		}
+	}
+
+	index := 0
+	for used[index] {
+		index++
+	}
+	return index, nil
+}
+
+// RebuildUserNetwork 按数据库中已有的服务器记录重建用户网络环境（不重新生成密钥）
+// 用于主机重启后命名空间丢失的场景，配置文件中包含数据库里的全部peer
+func (s *UserNetworkService) RebuildUserNetwork(server *models.WireguardServer, userUID string) error {
+	if err := s.setupUserNetwork(server, userUID); err != nil {
+		return err
+	}
+
+	// 服务器处于禁用状态：网络环境保留，但停止接口
+	if !server.Enabled {
+		return s.DisableUserNetwork(server, userUID)
+	}
+
+	return s.ensurePeerRoutes(server)
+}
+
+// EnsureUserNetwork 检查已存在的命名空间，补齐缺失的接口、规则和peer
+func (s *UserNetworkService) EnsureUserNetwork(server *models.WireguardServer, userUID string) error {
+	// 1. 主机和命名空间内的NAT规则（重启后丢失，规则链整体替换，重复应用不会堆积）
+	if err := s.applyHostFirewall(); err != nil {
+		return err
+	}
+	if err := s.applyNamespaceNAT(server, userUID); err != nil {
+		return fmt.Errorf("failed to apply namespace NAT: %v", err)
+	}
+	if err := s.enableIPv6(server, userUID); err != nil {
+		return err
+	}
+
+	if err := s.netnsService.EnableForwarding(server.Namespace, server.WgAddress6 != ""); err != nil {
+		return err
+	}
+
+	// 2. 禁用的服务器确保接口处于停止状态
+	if !server.Enabled {
+		if s.wireguardService.InterfaceRunning(server.Namespace, server.WgInterface) {
+			return s.DisableUserNetwork(server, userUID)
+		}
+		return nil
+	}
+
+	// 3. 接口不存在时重新启动（会同时重新应用限速）
+	if !s.wireguardService.InterfaceRunning(server.Namespace, server.WgInterface) {
+		if err := s.RestartUserWireguard(server, userUID); err != nil {
+			return fmt.Errorf("failed to restart wireguard: %v", err)
+		}
+	}
+
+	// 4. 同步peer（同时重新应用转发规则和端口转发）
+	return s.SyncPeers(server, userUID)
+}
+
+// SyncPeers 将数据库中的peer同步到配置文件和运行中的WireGuard接口
+// 配置文件原子重写后按同一份配置同步接口：缺失的peer会被添加，不属于数据库记录的peer会被移除
+func (s *UserNetworkService) SyncPeers(server *models.WireguardServer, userUID string) error {
+	wgConfig, err := s.writeServerConfig(server, userUID)
+	if err != nil {
+		return err
+	}
+
+	// 互访策略和ACL规则依赖peer地址，peer变化后需要重新编译；命名空间在禁用期间保留，规则同样保持最新
+	if err := s.ApplyPeerFirewall(server); err != nil {
+		return err
+	}
+	// 端口转发的目标是peer地址，peer删除后需要清理级联删除的转发
+	if err := s.ApplyPortForwards(server); err != nil {
+		return err
+	}
+
+	// 禁用的服务器接口未运行，只更新配置文件，重新启用时生效
+	if !server.Enabled {
+		return nil
+	}
+
+	if err := s.wireguardService.SyncConfig(server.Namespace, wgConfig); err != nil {
+		return err
+	}
+	if err := s.retireHandedOverRotations(server, wgConfig); err != nil {
+		return err
+	}
+
+	return s.ensurePeerRoutes(server)
+}
+
+// ensurePeerRoutes 为peer的额外网段补齐命名空间内的路由，并应用出口peer的策略路由
+// 转发规则不随接口重启丢失，由 ApplyPeerFirewall 维护
+func (s *UserNetworkService) ensurePeerRoutes(server *models.WireguardServer) error {
+	peers, err := s.loadPeers(server)
+	if err != nil {
+		return err
+	}
+
+	// peer自身IP由WireGuard处理，peer背后的路由网段需要额外的路由
+	// 指定了路由表时路由只添加到该表，并由优先于出口peer规则的策略路由规则查询该表
+	table := peerRouteTable(server)
+	for _, peer := range peers {
+		routed := joinPrefixes(PeerRoutedSubnets(server, &peer))
+		if routed == "" {
+			continue
+		}
+		if err := s.netnsService.AddTableRoutes(server.Namespace, table, server.WgInterface, routed); err != nil {
+			return err
+		}
+	}
+	if err := s.netnsService.EnsureLookupRule(server.Namespace, server.RouteTable, peerTablePriority, false); err != nil {
+		return err
+	}
+	ipv6Table := ""
+	if server.WgAddress6 != "" {
+		ipv6Table = server.RouteTable
+	}
+	if err := s.netnsService.EnsureLookupRule(server.Namespace, ipv6Table, peerTablePriority, true); err != nil {
+		return err
+	}
+
+	// 出口peer的策略路由同样依赖接口和peer地址
+	return s.ApplyExitRouting(server)
+}
+
+// GetPeerStats 获取服务器接口上所有peer的实时状态（按公钥索引）
+func (s *UserNetworkService) GetPeerStats(server *models.WireguardServer) (map[string]*models.WireguardPeerStats, error) {
+	return s.wireguardService.GetPeerStatsMap(server.Namespace, server.WgInterface)
+}
+
+// GetServerStats 获取服务器接口及其全部peer的详细统计
+func (s *UserNetworkService) GetServerStats(server *models.WireguardServer) (*models.WireguardServerStats, error) {
+	return s.wireguardService.GetDetailedStats(server.Namespace, server.WgInterface)
+}
+
+// GeneratePeerKeys 为peer生成WireGuard密钥对
+func (s *UserNetworkService) GeneratePeerKeys() (privateKey, publicKey string, err error) {
+	return s.wireguardService.GenerateKeys()
+}
+
+// GeneratePresharedKey 为peer生成预共享密钥
+func (s *UserNetworkService) GeneratePresharedKey() (string, error) {
+	return s.wireguardService.GeneratePresharedKey()
+}
+
+// RemovePeerRoutes 删除命名空间内（服务器使用的路由表中）到peer背后路由网段的路由
+// 在peer删除或其网段变化前调用；新网段的路由由 SyncPeers 补齐
+func (s *UserNetworkService) RemovePeerRoutes(server *models.WireguardServer, peer *models.WireguardPeer) error {
+	routed := joinPrefixes(PeerRoutedSubnets(server, peer))
+	if routed == "" {
+		return nil
+	}
+	return s.netnsService.DeleteTableRoutes(server.Namespace, peerRouteTable(server), server.WgInterface, routed)
+}
+
+// removeAllPeerRoutes 删除服务器全部peer背后网段的路由（修改路由表前按旧设置调用）
+func (s *UserNetworkService) removeAllPeerRoutes(server *models.WireguardServer) error {
+	peers, err := s.loadPeers(server)
+	if err != nil {
+		return err
+	}
+	for _, peer := range peers {
+		if err := s.RemovePeerRoutes(server, &peer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadPeers 从数据库加载服务器的全部peer（新建尚未入库的服务器没有peer）
+func (s *UserNetworkService) loadPeers(server *models.WireguardServer) ([]models.WireguardPeer, error) {
+	var peers []models.WireguardPeer
+	if server.ID == 0 {
+		return peers, nil
+	}
+	if err := s.db.Where("server_id = ?", server.ID).Order("id").Find(&peers).Error; err != nil {
+		return nil, fmt.Errorf("failed to load peers: %v", err)
+	}
+	return peers, nil
+}
+
+// loadGraceRotations 加载仍处于宽限期的peer密钥轮换记录，按peer ID索引
+// 新公钥已在接口上完成握手的轮换不再返回（地址转给新公钥），只读取不修改记录，
+// 接口同步成功后由 retireHandedOverRotations 停用
+func (s *UserNetworkService) loadGraceRotations(server *models.WireguardServer, peers []models.WireguardPeer) (map[uint]models.WireguardPeerKeyRotation, error) {
+	rotations := make(map[uint]models.WireguardPeerKeyRotation)
+	if len(peers) == 0 {
+		return rotations, nil
+	}
+
+	peerIDs := make([]uint, 0, len(peers))
+	for _, peer := range peers {
+		peerIDs = append(peerIDs, peer.ID)
+	}
+
+	var records []models.WireguardPeerKeyRotation
+	if err := s.db.Where("peer_id IN ? AND retired_at IS NULL AND grace_until > ?", peerIDs, time.Now()).
+		Order("id").Find(&records).Error; err != nil {
+		return nil, fmt.Errorf("failed to load key rotations: %v", err)
+	}
+
+	// 同一个peer存在多条记录时以最新的一条为准
+	for _, record := range records {
+		rotations[record.PeerID] = record
+	}
+
+	// 新公钥完成握手后停用旧公钥，peer地址随之转给新公钥，新设备不必等到宽限期结束才能通信
+	if len(rotations) == 0 || !server.Enabled {
+		return rotations, nil
+	}
+	stats, err := s.GetPeerStats(server)
+	if err != nil {
+		// 接口尚未启动（如正在创建或重建），没有握手信息
+		return rotations, nil
+	}
+	for peerID, rotation := range rotations {
+		if newKeyHandshaked(&rotation, stats) {
+			delete(rotations, peerID)
+		}
+	}
+	return rotations, nil
+}
+
+// retireHandedOverRotations 接口按 wgConfig 同步成功后，停用地址已转给新公钥的轮换记录：
+// 新公钥在配置中而旧公钥已不在配置中（见 loadGraceRotations）
+func (s *UserNetworkService) retireHandedOverRotations(server *models.WireguardServer, wgConfig *WireguardConfig) error {
+	keys := make(map[string]bool, len(wgConfig.Peers))
+	for _, peer := range wgConfig.Peers {
+		keys[peer.PublicKey] = true
+	}
+
+	var records []models.WireguardPeerKeyRotation
+	if err := s.db.Where("retired_at IS NULL AND grace_until > ?", time.Now()).
+		Where("peer_id IN (?)", s.db.Model(&models.WireguardPeer{}).Select("id").Where("server_id = ?", server.ID)).
+		Find(&records).Error; err != nil {
+		return fmt.Errorf("failed to load key rotations: %v", err)
+	}
+
+	var retired []uint
+	for _, record := range records {
+		if keys[record.NewPublicKey] && !keys[record.OldPublicKey] {
+			retired = append(retired, record.ID)
+		}
+	}
+	if len(retired) == 0 {
+		return nil
+	}
+	if err := s.db.Model(&models.WireguardPeerKeyRotation{}).Where("id IN ?", retired).
+		Update("retired_at", time.Now()).Error; err != nil {
+		return fmt.Errorf("failed to retire key rotations: %v", err)
+	}
+	return nil
+}
+
+// newKeyHandshaked 轮换后的新公钥是否已完成握手
+func newKeyHandshaked(rotation *models.WireguardPeerKeyRotation, stats map[string]*models.WireguardPeerStats) bool {
+	stat, ok := stats[rotation.NewPublicKey]
+	return ok && stat.LatestHandshake.After(rotation.CreatedAt)
+}
+
+// writeServerConfig 根据服务器记录和数据库中的peer生成接口配置，并原子重写WireGuard配置文件
+func (s *UserNetworkService) writeServerConfig(server *models.WireguardServer, userUID string) (*WireguardConfig, error) {
+	peers, err := s.loadPeers(server)
+	if err != nil {
+		return nil, err
+	}
+
+	rotations, err := s.loadGraceRotations(server, peers)
+	if err != nil {
+		return nil, err
+	}
+
+	wgConfig := &WireguardConfig{
+		InterfaceName: server.WgInterface,
+		ListenPort:    server.WgPort,
+		PrivateKey:    server.WgPrivateKey,
+		PublicKey:     server.WgPublicKey,
+		Address:       server.WgAddress,
+		Address6:      server.WgAddress6,
+		MTU:           server.MTU,
+		FwMark:        server.FwMark,
+	}
+
+	now := time.Now()
+	for _, peer := range peers {
+		// 已过期或不在访问时间段内的peer不写入配置，同步后从接口移除（由 PeerAccessService 在状态变化时同步）
+		if PeerAccessStatus(&peer, now) != models.PeerAccessActive {
+			continue
+		}
+
+		// 服务器侧 allowed-ips 是 peer 自身地址（双栈时包含IPv6地址）和其背后的路由网段（站点到站点）
+		allowedIPs := peerServerAllowedIPs(server, &peer)
+
+		// 密钥轮换宽限期内：旧公钥继续持有peer地址，保证旧设备不断线；
+		// 新公钥先不分配 allowed-ips（握手不受影响），同步时发现新公钥已握手则地址转给新公钥、旧公钥移除
+		if rotation, ok := rotations[peer.ID]; ok {
+			wgConfig.Peers = append(wgConfig.Peers, WireguardPeerConfig{
+				PublicKey:           rotation.OldPublicKey,
+				PresharedKey:        rotation.OldPresharedKey,
+				AllowedIPs:          allowedIPs,
+				Endpoint:            peer.Endpoint,
+				PersistentKeepalive: peer.PersistentKeepalive,
+				Comment:             peer.Comment + " (rotating out)",
+			})
+			allowedIPs = ""
+		}
+
+		wgConfig.Peers = append(wgConfig.Peers, WireguardPeerConfig{
+			PublicKey:           peer.PublicKey,
+			PresharedKey:        peer.PresharedKey,
+			AllowedIPs:          allowedIPs,
+			Endpoint:            peer.Endpoint,
+			PersistentKeepalive: peer.PersistentKeepalive,
+			Comment:             peer.Comment,
+		})
+	}
+
+	if _, err := s.wireguardService.CreateConfig(userUID, wgConfig); err != nil {
+		return nil, fmt.Errorf("failed to create wireguard config: %v", err)
+	}
+	return wgConfig, nil
+}
+
+// setupUserNetwork 按服务器配置创建命名空间、veth、NAT、WireGuard接口和端口转发
+// 任一步骤失败都会清理已创建的资源
+func (s *UserNetworkService) setupUserNetwork(server *models.WireguardServer, userUID string) error {
+	nsName := server.Namespace
+	vethHost, vethNs := s.vethNames(userUID, server.WgInterface)
+
 	// veth 对使用 /30 子网（只需要2个IP：.1给主机，.2给命名空间）
-	vethSubnet := fmt.Sprintf("%s.%d.0/30", s.baseSubnet, userSubnetID)
-	hostIP := fmt.Sprintf("%s.%d.1/30", s.baseSubnet, userSubnetID)
-	nsIP := fmt.Sprintf("%s.%d.2/30", s.baseSubnet, userSubnetID)
-	
-	// WireGuard 使用独立的子网（10.100.X.0/24），避免与 veth 冲突
-	wgIP := fmt.Sprintf("10.100.%d.1/24", userSubnetID)
-
-	// 2. 创建网络命名空间
+	_, hostIP, nsIP, err := s.vethAddresses(server)
+	if err != nil {
+		return err
+	}
+
+	// 1. 创建网络命名空间
 	if err := s.netnsService.CreateNamespace(nsName); err != nil {
-		return nil, fmt.Errorf("failed to create namespace: %v", err)
+		return fmt.Errorf("failed to create namespace: %v", err)
 	}
 
-	// 3. 创建veth对并配置网络
+	// 2. 创建veth对并配置网络
 	if err := s.netnsService.CreateVethPair(vethHost, vethNs, nsName, nsIP, hostIP); err != nil {
 		// 失败时清理命名空间
 		s.netnsService.DeleteNamespace(nsName)
-		return nil, fmt.Errorf("failed to create veth pair: %v", err)
+		return fmt.Errorf("failed to create veth pair: %v", err)
+	}
+
+	// 2.1 启用命名空间内的IP转发
+	if err := s.netnsService.EnableForwarding(nsName, server.WgAddress6 != ""); err != nil {
+		s.netnsService.DeleteNamespace(nsName)
+		return err
 	}
 
-	// 4. 启用NAT
-	if err := s.netnsService.EnableNAT(vethSubnet, s.outInterface); err != nil {
+	// 3. 启用NAT（主机侧规则与服务器无关，命名空间内对 WireGuard 网段做 MASQUERADE）
+	if err := s.applyHostFirewall(); err != nil {
 		// 失败时清理
 		s.netnsService.DeleteNamespace(nsName)
-		return nil, fmt.Errorf("failed to enable NAT: %v", err)
+		return err
+	}
+	if err := s.applyNamespaceNAT(server, userUID); err != nil {
+		s.netnsService.DeleteNamespace(nsName)
+		return fmt.Errorf("failed to apply namespace NAT: %v", err)
 	}
 
-	// 5. 生成WireGuard密钥
-	privateKey, publicKey, err := s.wireguardService.GenerateKeys()
+	// 3.1 配置IPv6（双栈服务器）
+	if err := s.enableIPv6(server, userUID); err != nil {
+		s.netnsService.DeleteNamespace(nsName)
+		return err
+	}
+
+	// 4. 创建WireGuard配置（包含数据库中已有的peer）
+	wgConfig, err := s.writeServerConfig(server, userUID)
 	if err != nil {
 		s.netnsService.DeleteNamespace(nsName)
-		return nil, fmt.Errorf("failed to generate wireguard keys: %v", err)
+		return err
 	}
 
-	// 6. 创建WireGuard配置
-	wgConfig := &WireguardConfig{
-		InterfaceName: wgInterface,
-		ListenPort:    wgPort,
-		PrivateKey:    privateKey,
-		PublicKey:     publicKey,
-		Address:       wgIP,
-		VethInterface: vethNs,         // 命名空间内的 veth 接口名称
-		OutInterface:  s.outInterface, // 外网接口（用于NAT到外网）
+	// 4.1 应用peer互访策略和ACL规则（在接口启动前生效，避免出现不受限制的窗口）
+	if err := s.ApplyPeerFirewall(server); err != nil {
+		s.netnsService.DeleteNamespace(nsName)
+		return fmt.Errorf("failed to apply peer firewall rules: %v", err)
 	}
 
-	configPath, err := s.wireguardService.CreateConfig(user.UserUID, wgConfig)
-	if err != nil {
+	// 5. 在命名空间中启动WireGuard
+	if err := s.wireguardService.StartWireguard(nsName, wgConfig); err != nil {
 		s.netnsService.DeleteNamespace(nsName)
-		return nil, fmt.Errorf("failed to create wireguard config: %v", err)
+		return fmt.Errorf("failed to start wireguard: %v", err)
 	}
 
-	// 7. 在命名空间中启动WireGuard
-	if err := s.wireguardService.StartWireguardInNamespace(nsName, configPath); err != nil {
+	// 6. 设置端口转发：将主机的 WireGuard 端口转发到命名空间内，重建时同时恢复用户的公网端口转发
+	if err := s.ApplyPortForwards(server); err != nil {
+		s.removeHostForwards(server)
+		s.wireguardService.StopWireguard(nsName, server.WgInterface)
 		s.netnsService.DeleteNamespace(nsName)
-		return nil, fmt.Errorf("failed to start wireguard: %v", err)
+		return fmt.Errorf("failed to setup port forwarding: %v", err)
 	}
 
-	// 8. 设置端口转发：将主机的 WireGuard 端口转发到命名空间内
-	// 提取命名空间内的IP地址（去掉CIDR）
-	nsIPAddr := strings.Split(nsIP, "/")[0]
-	if err := s.netnsService.SetupPortForwarding(s.outInterface, wgPort, nsIPAddr, wgPort, "udp"); err != nil {
-		s.wireguardService.StopWireguardInNamespace(nsName, configPath)
+	// 7. 应用速率限制（新建服务器默认不限速，重建时恢复原有限速）
+	if err := s.ApplyRateLimit(server); err != nil {
+		s.removeHostForwards(server)
+		s.wireguardService.StopWireguard(nsName, server.WgInterface)
 		s.netnsService.DeleteNamespace(nsName)
-		return nil, fmt.Errorf("failed to setup port forwarding: %v", err)
+		return fmt.Errorf("failed to apply rate limit: %v", err)
 	}
 
-	// 9. 创建 WireguardServer 对象
-	wgServer := &models.WireguardServer{
-		UserID:       user.ID,
-		Namespace:    nsName,
-		WgInterface:  wgInterface,
-		WgPort:       wgPort,
-		WgPublicKey:  publicKey,
-		WgPrivateKey: privateKey,
-		WgAddress:    wgIP,
+	return nil
+}
+
+// ApplyRateLimit 按服务器记录中的速率设置应用tc限速
+func (s *UserNetworkService) ApplyRateLimit(server *models.WireguardServer) error {
+	return s.trafficControl.ApplyRateLimit(server.Namespace, server.WgInterface, server.DownloadRate, server.UploadRate)
+}
+
+// RestartUserWireguard 按数据库记录重建用户命名空间内的WireGuard接口
+// 删除接口会同时删除其上的tc规则和路由，因此重建后需要重新应用限速和peer路由
+func (s *UserNetworkService) RestartUserWireguard(server *models.WireguardServer, userUID string) error {
+	wgConfig, err := s.writeServerConfig(server, userUID)
+	if err != nil {
+		return err
 	}
 
-	return wgServer, nil
+	// 忽略停止错误（接口可能本来就未运行）
+	s.wireguardService.StopWireguard(server.Namespace, server.WgInterface)
+
+	if err := s.wireguardService.StartWireguard(server.Namespace, wgConfig); err != nil {
+		return err
+	}
+
+	if err := s.ApplyRateLimit(server); err != nil {
+		return fmt.Errorf("failed to apply rate limit: %v", err)
+	}
+
+	if err := s.ensurePeerRoutes(server); err != nil {
+		return fmt.Errorf("failed to restore peer routes: %v", err)
+	}
+
+	return nil
+}
+
+// RotateServerKeys 轮换用户WireGuard接口的服务器密钥对
+// 重写配置文件并重启接口，更新数据库中的密钥，并将该服务器下所有peer的配置标记为需要重新下载
+// 任一步骤失败都会恢复旧密钥
+func (s *UserNetworkService) RotateServerKeys(server *models.WireguardServer, userUID string) error {
+	privateKey, publicKey, err := s.wireguardService.GenerateKeys()
+	if err != nil {
+		return err
+	}
+
+	oldPrivateKey, oldPublicKey, oldRotatedAt := server.WgPrivateKey, server.WgPublicKey, server.KeysRotatedAt
+	restore := func() {
+		server.WgPrivateKey, server.WgPublicKey, server.KeysRotatedAt = oldPrivateKey, oldPublicKey, oldRotatedAt
+		s.writeServerConfig(server, userUID)
+		if server.Enabled {
+			s.RestartUserWireguard(server, userUID)
+		}
+	}
+
+	// 1. 使用新密钥重写配置文件
+	server.WgPrivateKey, server.WgPublicKey = privateKey, publicKey
+	if _, err := s.writeServerConfig(server, userUID); err != nil {
+		restore()
+		return err
+	}
+
+	// 2. 重启接口使新私钥生效（禁用的服务器在重新启用时使用新配置）
+	if server.Enabled {
+		if err := s.RestartUserWireguard(server, userUID); err != nil {
+			restore()
+			return fmt.Errorf("failed to restart wireguard: %v", err)
+		}
+	}
+
+	// 3. 保存新密钥，并标记所有peer需要重新下载配置
+	now := time.Now()
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		// 使用结构体更新，保证私钥经过序列化器加密
+		server.KeysRotatedAt = &now
+		if err := tx.Model(server).Select("wg_private_key", "wg_public_key", "keys_rotated_at").Updates(server).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.WireguardPeer{}).Where("server_id = ?", server.ID).Update("config_outdated", true).Error
+	})
+	if err != nil {
+		restore()
+		return fmt.Errorf("failed to save rotated keys: %v", err)
+	}
+
+	return nil
 }
 
 // DestroyUserNetwork 销毁用户的网络环境
@@ -130,38 +647,180 @@ func (s *UserNetworkService) DestroyUserNetwork(server *models.WireguardServer,
 		return nil // 没有配置过网络环境
 	}
 
-	// 1. 计算命名空间内的IP地址（用于删除端口转发规则）
-	userHash := s.hashUserUID(userUID)
-	userSubnetID := (userHash % 254) + 1
-	nsIPAddr := fmt.Sprintf("%s.%d.2", s.baseSubnet, userSubnetID)
+	// 1. 删除主机上的端口转发规则（命名空间内的规则随命名空间一起删除）
+	s.removeHostForwards(server)
 
-	// 2. 删除端口转发规则
-	s.netnsService.RemovePortForwarding(s.outInterface, server.WgPort, nsIPAddr, server.WgPort, "udp")
+	// 2. 停止WireGuard（忽略停止错误，继续清理）
+	s.wireguardService.StopWireguard(server.Namespace, server.WgInterface)
+
+	// 3. 删除命名空间 (会自动清理其中的网络接口)
+	nsErr := s.netnsService.DeleteNamespace(server.Namespace)
+
+	// 4. 释放子网和端口（服务器记录会被调用方删除，无论命名空间是否删除成功都需要释放）
+	if err := s.ipam.Release(allocationOwner(server.Namespace, server.WgInterface)); err != nil {
+		return fmt.Errorf("failed to release network allocation: %v", err)
+	}
+
+	if nsErr != nil {
+		return fmt.Errorf("failed to delete namespace: %v", nsErr)
+	}
+
+	return nil
+}
 
-	// 3. 停止WireGuard
-	configPath := s.wireguardService.GetConfigPath(userUID, server.WgInterface)
-	// 忽略停止错误，继续清理
-	s.wireguardService.StopWireguardInNamespace(server.Namespace, configPath)
+// DisableUserNetwork 停用用户的WireGuard服务（保留命名空间、密钥和配置文件）
+// 删除端口转发规则并停止命名空间内的WireGuard接口，使其不再接受任何流量
+func (s *UserNetworkService) DisableUserNetwork(server *models.WireguardServer, userUID string) error {
+	// 1. 删除端口转发规则，外部流量无法再到达命名空间
+	s.removeHostForwards(server)
 
-	// 4. 删除命名空间 (会自动清理其中的网络接口)
-	if err := s.netnsService.DeleteNamespace(server.Namespace); err != nil {
-		return fmt.Errorf("failed to delete namespace: %v", err)
+	// 2. 停止WireGuard接口
+	if err := s.wireguardService.StopWireguard(server.Namespace, server.WgInterface); err != nil {
+		// 恢复端口转发，保持状态一致
+		s.setupHostForwards(server)
+		return err
 	}
 
 	return nil
 }
 
-// generateNamespaceName 生成命名空间名称（基于UserUID）
-func (s *UserNetworkService) generateNamespaceName(userUID string) string {
+// EnableUserNetwork 重新启用用户的WireGuard服务
+// 使用已有的配置文件和密钥启动接口，并恢复端口转发和速率限制
+func (s *UserNetworkService) EnableUserNetwork(server *models.WireguardServer, userUID string) error {
+	// 1. 启动WireGuard接口并重新应用限速
+	if err := s.RestartUserWireguard(server, userUID); err != nil {
+		return err
+	}
+
+	// 2. 恢复 WireGuard 端口和公网端口的转发（命名空间内的规则在禁用期间保留）
+	if err := s.setupHostForwards(server); err != nil {
+		s.wireguardService.StopWireguard(server.Namespace, server.WgInterface)
+		return err
+	}
+
+	return nil
+}
+
+// enableIPv6 为双栈服务器配置命名空间IPv6路由（未分配IPv6网段时跳过，主机侧NAT66见 applyHostFirewall）
+func (s *UserNetworkService) enableIPv6(server *models.WireguardServer, userUID string) error {
+	if server.WgAddress6 == "" {
+		return nil
+	}
+
+	wgPrefix6, err := netip.ParsePrefix(server.WgAddress6)
+	if err != nil {
+		return fmt.Errorf("invalid wireguard IPv6 address %s: %v", server.WgAddress6, err)
+	}
+
+	vethHost, vethNs := s.vethNames(userUID, server.WgInterface)
+	if err := s.netnsService.EnableIPv6(vethHost, vethNs, server.Namespace, wgPrefix6.Masked().String(), s.outInterface); err != nil {
+		return fmt.Errorf("failed to enable IPv6: %v", err)
+	}
+	return nil
+}
+
+// addressWithoutPrefix 去掉地址的CIDR前缀长度（如 "fd00::1/64" -> "fd00::1"）
+func addressWithoutPrefix(address string) string {
+	return strings.Split(address, "/")[0]
+}
+
+// ListUserNamespaces 列出主机上所有由本系统管理的用户命名空间（wg_ 前缀）
+func (s *UserNetworkService) ListUserNamespaces() ([]string, error) {
+	namespaces, err := s.netnsService.ListNamespaces()
+	if err != nil {
+		return nil, err
+	}
+
+	var userNamespaces []string
+	for _, nsName := range namespaces {
+		if strings.HasPrefix(nsName, namespacePrefix) {
+			userNamespaces = append(userNamespaces, nsName)
+		}
+	}
+	return userNamespaces, nil
+}
+
+// DestroyOrphanNamespace 删除数据库中没有对应记录的命名空间
+// 命名空间删除时其中的WireGuard接口和veth对会被内核一并清理
+func (s *UserNetworkService) DestroyOrphanNamespace(nsName string) error {
+	if !strings.HasPrefix(nsName, namespacePrefix) {
+		return fmt.Errorf("refusing to delete unmanaged namespace %s", nsName)
+	}
+	return s.netnsService.DeleteNamespace(nsName)
+}
+
+// namespaceIPAddr 计算命名空间内veth的IP地址（不带CIDR）
+func (s *UserNetworkService) namespaceIPAddr(server *models.WireguardServer) string {
+	_, _, nsIP, err := s.vethAddresses(server)
+	if err != nil {
+		return ""
+	}
+	return strings.Split(nsIP, "/")[0]
+}
+
+// vethNames 生成veth对的主机端和命名空间端接口名
+// 第一个服务器（wg0）沿用原有命名，其余服务器带上接口序号（接口名不超过15个字符）
+func (s *UserNetworkService) vethNames(userUID, wgInterface string) (vethHost, vethNs string) {
+	if wgInterface == "wg0" {
+		return fmt.Sprintf("veth-h-%s", userUID[:6]), fmt.Sprintf("veth-ns-%s", userUID[:6])
+	}
+	index := strings.TrimPrefix(wgInterface, "wg")
+	return fmt.Sprintf("vh-%s-%s", userUID, index), fmt.Sprintf("vn-%s-%s", userUID, index)
+}
+
+// vethAddresses 根据服务器分配的veth子网计算主机端IP和命名空间端IP（CIDR格式）
+func (s *UserNetworkService) vethAddresses(server *models.WireguardServer) (vethSubnet, hostIP, nsIP string, err error) {
+	vethSubnet = server.VethSubnet
+	if hostIP, err = subnetHost(vethSubnet, 1); err != nil {
+		return "", "", "", fmt.Errorf("invalid veth subnet for server %s: %v", server.Namespace, err)
+	}
+	if nsIP, err = subnetHost(vethSubnet, 2); err != nil {
+		return "", "", "", fmt.Errorf("invalid veth subnet for server %s: %v", server.Namespace, err)
+	}
+	return vethSubnet, hostIP, nsIP, nil
+}
+
+// generateNamespaceName 生成命名空间名称（基于UserUID和服务器序号）
+func (s *UserNetworkService) generateNamespaceName(userUID string, index int) string {
 	// 使用UserUID直接作为命名空间名称的一部分
 	// UserUID是8字符的十六进制字符串，天然符合命名规则
-	return fmt.Sprintf("wg_%s", userUID)
+	if index == 0 {
+		return namespacePrefix + userUID
+	}
+	return fmt.Sprintf("%s%s-%d", namespacePrefix, userUID, index)
 }
 
-// hashUserUID 对UserUID进行哈希，用于生成端口号和子网ID
-func (s *UserNetworkService) hashUserUID(userUID string) int {
-	h := fnv.New32a()
-	h.Write([]byte(userUID))
-	return int(h.Sum32())
+// allocationOwner 生成IPAM占用者标识（命名空间/接口名）
+func allocationOwner(nsName, wgInterface string) string {
+	return nsName + "/" + wgInterface
 }
 
+// ReserveExistingAllocation 将已存在的服务器使用的子网和端口登记到IPAM
+// 用于导入旧版本（基于UserUID哈希分配）创建的服务器，避免新分配与其冲突
+func (s *UserNetworkService) ReserveExistingAllocation(server *models.WireguardServer) error {
+	owner := allocationOwner(server.Namespace, server.WgInterface)
+
+	if err := s.ipam.ReserveSubnet(models.PoolVethSubnet, server.VethSubnet, owner); err != nil {
+		return err
+	}
+
+	wgPrefix, err := netip.ParsePrefix(server.WgAddress)
+	if err != nil {
+		return fmt.Errorf("invalid wireguard address %s: %v", server.WgAddress, err)
+	}
+	if err := s.ipam.ReserveSubnet(models.PoolWireguardSubnet, wgPrefix.Masked().String(), owner); err != nil {
+		return err
+	}
+
+	if server.WgAddress6 != "" {
+		wgPrefix6, err := netip.ParsePrefix(server.WgAddress6)
+		if err != nil {
+			return fmt.Errorf("invalid wireguard IPv6 address %s: %v", server.WgAddress6, err)
+		}
+		if err := s.ipam.ReserveSubnet(models.PoolWireguardIPv6, wgPrefix6.Masked().String(), owner); err != nil {
+			return err
+		}
+	}
+
+	return s.ipam.ReservePort(models.PoolWireguardPort, server.WgPort, owner)
+}
@@ -0,0 +1,340 @@
+package services
+
+import (
+	"cloud-platform/internal/config"
+	"cloud-platform/internal/models"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const testUserUID = "a1b2c3d4"
+
+// newTestUserNetwork 创建使用内存数据库、FakeBackend 和 FakeRunner 的用户网络服务，以及一个测试用户
+func newTestUserNetwork(t *testing.T) (*UserNetworkService, *FakeBackend, *FakeRunner, *models.User) {
+	t.Helper()
+
+	db := newTestDB(t)
+	user := &models.User{UserUID: testUserUID, Email: "alice@example.com", PasswordHash: "x", Name: "alice"}
+	if err := db.Create(user).Error; err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	netCfg := config.NetworkConfig{
+		ConfigDir:    t.TempDir(),
+		BaseSubnet:   "10.200",
+		BasePort:     51820,
+		OutInterface: "eth0",
+		Firewall:     FirewallIptables,
+	}
+	backend, runner := NewFakeNetwork()
+	return NewUserNetworkServiceWithBackend(db, netCfg, backend, runner), backend, runner, user
+}
+
+// provisionTestServer 创建服务器并保存到数据库
+func provisionTestServer(t *testing.T, s *UserNetworkService, user *models.User, index int) *models.WireguardServer {
+	t.Helper()
+	server, err := s.ProvisionServer(user, index)
+	if err != nil {
+		t.Fatalf("ProvisionServer(%d): %v", index, err)
+	}
+	if err := s.db.Create(server).Error; err != nil {
+		t.Fatalf("save server: %v", err)
+	}
+	s.FinishProvisioning(server)
+	return server
+}
+
+// createTestPeer 在服务器下创建使用 address 的peer
+func createTestPeer(t *testing.T, s *UserNetworkService, server *models.WireguardServer, address string) *models.WireguardPeer {
+	t.Helper()
+	_, publicKey, err := s.wireguardService.GenerateKeys()
+	if err != nil {
+		t.Fatalf("generate peer keys: %v", err)
+	}
+	peer := &models.WireguardPeer{ServerID: server.ID, PublicKey: publicKey, PeerAddress: address, AllowedIPs: address + "/32"}
+	if err := s.db.Create(peer).Error; err != nil {
+		t.Fatalf("create peer: %v", err)
+	}
+	return peer
+}
+
+// hostForwardRules 返回主机上服务器DNAT链中的规则，链不存在时 exists 为 false
+func hostForwardRules(s *UserNetworkService, runner *FakeRunner, server *models.WireguardServer) (rules []string, exists bool) {
+	chain := s.hostDNATChain(server)
+	output, _ := runner.Run("iptables-save")
+	return runner.Rules("", "iptables", chain.Table, chain.Name), strings.Contains(string(output), ":"+chain.Name+" ")
+}
+
+func TestProvisionServer(t *testing.T) {
+	s, backend, runner, user := newTestUserNetwork(t)
+
+	server := provisionTestServer(t, s, user, 0)
+	if server.Namespace != "wg_"+testUserUID || server.WgInterface != "wg0" || !server.Enabled {
+		t.Errorf("server = %s/%s enabled=%v, want wg_%s/wg0 enabled", server.Namespace, server.WgInterface, server.Enabled, testUserUID)
+	}
+	if server.VethSubnet != "10.200.0.0/30" || server.WgAddress != "10.100.0.1/24" || server.WgPort != 51820 {
+		t.Errorf("allocation = %s, %s, %d, want 10.200.0.0/30, 10.100.0.1/24, 51820", server.VethSubnet, server.WgAddress, server.WgPort)
+	}
+	if server.WgPrivateKey == "" || server.WgPublicKey == "" {
+		t.Error("server keys were not generated")
+	}
+
+	if !backend.HasNamespace(server.Namespace) {
+		t.Errorf("namespace %s was not created", server.Namespace)
+	}
+	if !backend.Running(server.Namespace, "wg0") {
+		t.Error("wg0 is not running in the namespace")
+	}
+
+	// 配置文件包含服务器私钥
+	content, err := os.ReadFile(s.wireguardService.GetConfigPath(testUserUID, "wg0"))
+	if err != nil {
+		t.Fatalf("read server config: %v", err)
+	}
+	if !strings.Contains(string(content), server.WgPrivateKey) || !strings.Contains(string(content), "ListenPort = 51820") {
+		t.Errorf("server config missing private key or listen port:\n%s", content)
+	}
+
+	// 主机上 WireGuard 端口转发到命名空间，命名空间内对 WireGuard 网段做 MASQUERADE
+	rules, _ := hostForwardRules(s, runner, server)
+	wantForward := "-p udp --dport 51820 -j DNAT --to-destination 10.200.0.2:51820"
+	if len(rules) != 1 || rules[0] != wantForward {
+		t.Errorf("host DNAT rules = %q, want [%q]", rules, wantForward)
+	}
+	if rules := runner.Rules(server.Namespace, "iptables", "nat", NamespaceNATChain); len(rules) != 1 || rules[0] != "-s 10.100.0.0/24 -j MASQUERADE" {
+		t.Errorf("namespace NAT rules = %q", rules)
+	}
+	if rules := runner.Rules("", "iptables", "nat", HostNATChain); len(rules) != 1 || rules[0] != "-s 10.200.0.0/16 -j MASQUERADE" {
+		t.Errorf("host NAT rules = %q", rules)
+	}
+
+	// 第二个服务器使用独立的命名空间和新分配的网段、端口
+	second := provisionTestServer(t, s, user, 1)
+	if second.Namespace != "wg_"+testUserUID+"-1" || second.WgInterface != "wg1" {
+		t.Errorf("second server = %s/%s", second.Namespace, second.WgInterface)
+	}
+	if second.VethSubnet == server.VethSubnet || second.WgAddress == server.WgAddress || second.WgPort == server.WgPort {
+		t.Errorf("second server reuses the allocation: %s, %s, %d", second.VethSubnet, second.WgAddress, second.WgPort)
+	}
+	if !backend.Running(second.Namespace, "wg1") {
+		t.Error("wg1 is not running in the second namespace")
+	}
+}
+
+func TestProvisionServerRollback(t *testing.T) {
+	s, backend, _, user := newTestUserNetwork(t)
+	nsName := "wg_" + testUserUID
+	backend.FailOn("AddLink "+nsName+"/wg0", syscall.EPERM)
+
+	if _, err := s.ProvisionServer(user, 0); err == nil || !strings.Contains(err.Error(), "failed to start wireguard") {
+		t.Fatalf("ProvisionServer error = %v, want wireguard start failure", err)
+	}
+	if backend.HasNamespace(nsName) {
+		t.Error("namespace was not removed after the failure")
+	}
+
+	// 失败时释放了分配，重试得到相同的网段和端口
+	allocation, err := s.ipam.AllocateServerNetwork("wg_other/wg0")
+	if err != nil {
+		t.Fatalf("allocate after rollback: %v", err)
+	}
+	if allocation.VethSubnet != "10.200.0.0/30" || allocation.WgSubnet != "10.100.0.0/24" || allocation.WgPort != 51820 {
+		t.Errorf("allocation after rollback = %+v, want the first subnets and port", *allocation)
+	}
+}
+
+func TestSyncPeers(t *testing.T) {
+	s, backend, _, user := newTestUserNetwork(t)
+	server := provisionTestServer(t, s, user, 0)
+
+	first := createTestPeer(t, s, server, "10.100.0.2")
+	second := createTestPeer(t, s, server, "10.100.0.3")
+	past := time.Now().Add(-time.Hour)
+	expired := createTestPeer(t, s, server, "10.100.0.4")
+	if err := s.db.Model(expired).Update("expires_at", &past).Error; err != nil {
+		t.Fatalf("expire peer: %v", err)
+	}
+
+	if err := s.SyncPeers(server, testUserUID); err != nil {
+		t.Fatalf("SyncPeers: %v", err)
+	}
+	peers := backend.Peers(server.Namespace, "wg0")
+	if len(peers) != 2 || peers[first.PublicKey] != "10.100.0.2/32" || peers[second.PublicKey] != "10.100.0.3/32" {
+		t.Errorf("interface peers = %v, want the two active peers", peers)
+	}
+
+	// 删除的peer从接口移除
+	if err := s.db.Delete(first).Error; err != nil {
+		t.Fatalf("delete peer: %v", err)
+	}
+	if err := s.SyncPeers(server, testUserUID); err != nil {
+		t.Fatalf("SyncPeers after delete: %v", err)
+	}
+	peers = backend.Peers(server.Namespace, "wg0")
+	if _, ok := peers[first.PublicKey]; ok || len(peers) != 1 {
+		t.Errorf("interface peers after delete = %v, want only %s", peers, second.PublicKey)
+	}
+
+	// 配置文件与接口保持一致
+	content, err := os.ReadFile(s.wireguardService.GetConfigPath(testUserUID, "wg0"))
+	if err != nil {
+		t.Fatalf("read server config: %v", err)
+	}
+	if strings.Contains(string(content), first.PublicKey) || !strings.Contains(string(content), second.PublicKey) {
+		t.Errorf("server config not rewritten:\n%s", content)
+	}
+}
+
+func TestSyncPeersKeyRotation(t *testing.T) {
+	s, backend, _, user := newTestUserNetwork(t)
+	server := provisionTestServer(t, s, user, 0)
+	peer := createTestPeer(t, s, server, "10.100.0.2")
+	oldKey := peer.PublicKey
+
+	// 轮换密钥，宽限期内旧公钥继续持有peer地址
+	_, newKey, err := s.wireguardService.GenerateKeys()
+	if err != nil {
+		t.Fatalf("generate keys: %v", err)
+	}
+	rotation := &models.WireguardPeerKeyRotation{PeerID: peer.ID, OldPublicKey: oldKey, NewPublicKey: newKey, GraceUntil: time.Now().Add(time.Hour)}
+	if err := s.db.Create(rotation).Error; err != nil {
+		t.Fatalf("create rotation: %v", err)
+	}
+	if err := s.db.Model(peer).Update("public_key", newKey).Error; err != nil {
+		t.Fatalf("update peer key: %v", err)
+	}
+	if err := s.SyncPeers(server, testUserUID); err != nil {
+		t.Fatalf("SyncPeers: %v", err)
+	}
+	peers := backend.Peers(server.Namespace, "wg0")
+	if peers[oldKey] != "10.100.0.2/32" || peers[newKey] != "" || len(peers) != 2 {
+		t.Fatalf("interface peers during grace = %v, want the address on the old key", peers)
+	}
+
+	// 新公钥完成握手后，同步失败时轮换记录保持不变
+	backend.SetHandshake(server.Namespace, "wg0", newKey, time.Now().Add(time.Minute))
+	backend.FailOn("ConfigureDevice "+server.Namespace+"/wg0", syscall.EIO)
+	if err := s.SyncPeers(server, testUserUID); err == nil {
+		t.Fatal("SyncPeers succeeded with a failing device")
+	}
+	if err := s.db.First(rotation, rotation.ID).Error; err != nil || rotation.RetiredAt != nil {
+		t.Errorf("rotation retired although the interface was not synced: %v", err)
+	}
+
+	// 下一次同步成功后地址转给新公钥，移除旧公钥并停用轮换记录
+	backend.FailOn("ConfigureDevice "+server.Namespace+"/wg0", nil)
+	if err := s.SyncPeers(server, testUserUID); err != nil {
+		t.Fatalf("SyncPeers after handshake: %v", err)
+	}
+	peers = backend.Peers(server.Namespace, "wg0")
+	if peers[newKey] != "10.100.0.2/32" || len(peers) != 1 {
+		t.Errorf("interface peers after handshake = %v, want only the new key with the peer address", peers)
+	}
+	if err := s.db.First(rotation, rotation.ID).Error; err != nil || rotation.RetiredAt == nil {
+		t.Errorf("rotation not retired after handshake: %v", err)
+	}
+}
+
+func TestDisableEnableUserNetwork(t *testing.T) {
+	s, backend, runner, user := newTestUserNetwork(t)
+	server := provisionTestServer(t, s, user, 0)
+	peer := createTestPeer(t, s, server, "10.100.0.2")
+	if err := s.SyncPeers(server, testUserUID); err != nil {
+		t.Fatalf("SyncPeers: %v", err)
+	}
+
+	if err := s.DisableUserNetwork(server, testUserUID); err != nil {
+		t.Fatalf("DisableUserNetwork: %v", err)
+	}
+	server.Enabled = false
+	if backend.Running(server.Namespace, "wg0") {
+		t.Error("wg0 still running after disable")
+	}
+	if _, exists := hostForwardRules(s, runner, server); exists {
+		t.Error("host DNAT chain still exists after disable")
+	}
+	// 命名空间和其中的规则保留
+	if !backend.HasNamespace(server.Namespace) {
+		t.Error("namespace removed by disable")
+	}
+	if rules := runner.Rules(server.Namespace, "iptables", "nat", NamespaceNATChain); len(rules) != 1 {
+		t.Errorf("namespace NAT rules after disable = %q", rules)
+	}
+
+	// 禁用期间同步peer只更新配置文件
+	added := createTestPeer(t, s, server, "10.100.0.3")
+	if err := s.SyncPeers(server, testUserUID); err != nil {
+		t.Fatalf("SyncPeers while disabled: %v", err)
+	}
+	if backend.Running(server.Namespace, "wg0") {
+		t.Error("SyncPeers started the interface of a disabled server")
+	}
+
+	server.Enabled = true
+	if err := s.EnableUserNetwork(server, testUserUID); err != nil {
+		t.Fatalf("EnableUserNetwork: %v", err)
+	}
+	if !backend.Running(server.Namespace, "wg0") {
+		t.Fatal("wg0 not running after enable")
+	}
+	peers := backend.Peers(server.Namespace, "wg0")
+	if len(peers) != 2 || peers[peer.PublicKey] != "10.100.0.2/32" || peers[added.PublicKey] != "10.100.0.3/32" {
+		t.Errorf("interface peers after enable = %v", peers)
+	}
+	if rules, exists := hostForwardRules(s, runner, server); !exists || len(rules) != 1 {
+		t.Errorf("host DNAT rules after enable = %q", rules)
+	}
+}
+
+func TestDisableUserNetworkRestoresForwards(t *testing.T) {
+	s, backend, runner, user := newTestUserNetwork(t)
+	server := provisionTestServer(t, s, user, 0)
+	backend.FailOn("DeleteLink "+server.Namespace+"/wg0", syscall.EBUSY)
+
+	if err := s.DisableUserNetwork(server, testUserUID); err == nil {
+		t.Fatal("DisableUserNetwork succeeded although the interface could not be deleted")
+	}
+	if rules, exists := hostForwardRules(s, runner, server); !exists || len(rules) != 1 {
+		t.Errorf("host DNAT rules after failed disable = %q, want the WireGuard port restored", rules)
+	}
+}
+
+func TestDestroyUserNetwork(t *testing.T) {
+	s, backend, runner, user := newTestUserNetwork(t)
+	server := provisionTestServer(t, s, user, 0)
+
+	if err := s.DestroyUserNetwork(server, testUserUID); err != nil {
+		t.Fatalf("DestroyUserNetwork: %v", err)
+	}
+	if backend.HasNamespace(server.Namespace) {
+		t.Error("namespace still exists after destroy")
+	}
+	if backend.Running(server.Namespace, "wg0") {
+		t.Error("wg0 still running after destroy")
+	}
+	if _, exists := hostForwardRules(s, runner, server); exists {
+		t.Error("host DNAT chain still exists after destroy")
+	}
+
+	// 网段和端口已释放，可以重新分配
+	if err := s.db.Delete(server).Error; err != nil {
+		t.Fatalf("delete server: %v", err)
+	}
+	again := provisionTestServer(t, s, user, 0)
+	if again.VethSubnet != server.VethSubnet || again.WgAddress != server.WgAddress || again.WgPort != server.WgPort {
+		t.Errorf("reprovisioned allocation = %s, %s, %d, want the released %s, %s, %d",
+			again.VethSubnet, again.WgAddress, again.WgPort, server.VethSubnet, server.WgAddress, server.WgPort)
+	}
+
+	// 没有配置过网络环境的服务器直接跳过
+	calls := len(runner.Calls())
+	if err := s.DestroyUserNetwork(&models.WireguardServer{}, testUserUID); err != nil || len(runner.Calls()) != calls {
+		t.Errorf("DestroyUserNetwork without namespace = %v, %d commands", err, len(runner.Calls())-calls)
+	}
+	if namespaces, _ := backend.ListNamespaces(); len(namespaces) != 1 {
+		t.Errorf("namespaces after destroy = %v, want only the reprovisioned one", namespaces)
+	}
+}
@@ -2,62 +2,87 @@ package services
 
 import (
 	"cloud-platform/internal/models"
+	"encoding/base64"
 	"fmt"
+	"net"
+	"net/netip"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 // WireguardService WireGuard服务
+// 接口和peer通过 NetworkBackend 直接配置，配置文件只用于持久化和排查
 type WireguardService struct {
 	configDir string
+	backend   NetworkBackend
 }
 
-// NewWireguardService 创建WireGuard服务实例
-func NewWireguardService(configDir string) *WireguardService {
+// NewWireguardService 使用指定的网络后端创建WireGuard服务实例
+func NewWireguardService(configDir string, backend NetworkBackend) *WireguardService {
 	return &WireguardService{
 		configDir: configDir,
+		backend:   backend,
 	}
 }
 
 // WireguardConfig WireGuard配置
 type WireguardConfig struct {
-	InterfaceName string // 接口名称 (如 wg0)
-	ListenPort    int    // 监听端口
-	PrivateKey    string // 私钥
-	PublicKey     string // 公钥
-	Address       string // 接口IP地址 (CIDR格式)
-	VethInterface string // veth接口名称 (命名空间内的接口，如 veth-ns-xxx)
-	OutInterface  string // 外网接口名称 (如 eth0)，用于NAT到外网
+	InterfaceName string                // 接口名称 (如 wg0)
+	ListenPort    int                   // 监听端口
+	PrivateKey    string                // 私钥
+	PublicKey     string                // 公钥
+	Address       string                // 接口IP地址 (CIDR格式)
+	Address6      string                // 接口IPv6地址 (CIDR格式，为空表示仅IPv4)
+	MTU           int                   // 接口MTU（0表示使用 DefaultWireguardMTU）
+	FwMark        uint32                // 加密报文的防火墙标记（0表示不标记）
+	Peers         []WireguardPeerConfig // 持久化到配置文件中的peer
+}
+
+// WireguardPeerConfig 服务器配置文件中的 [Peer] 段
+type WireguardPeerConfig struct {
+	PublicKey           string // peer公钥
+	PresharedKey        string // 预共享密钥（可选）
+	AllowedIPs          string // 服务器侧的 allowed-ips（如 peer 自身的 /32 地址，为空表示不路由任何地址）
+	Endpoint            string // peer端点（可选）
+	PersistentKeepalive int    // 保活间隔（秒，0表示关闭）
+	Comment             string // 备注，写入配置文件注释
 }
 
 // GenerateKeys 生成WireGuard密钥对
 func (s *WireguardService) GenerateKeys() (privateKey, publicKey string, err error) {
-	// 生成私钥
-	cmd := exec.Command("wg", "genkey")
-	privOutput, err := cmd.Output()
+	key, err := wgtypes.GeneratePrivateKey()
 	if err != nil {
 		return "", "", fmt.Errorf("failed to generate private key: %v", err)
 	}
-	privateKey = strings.TrimSpace(string(privOutput))
+	return key.String(), key.PublicKey().String(), nil
+}
 
-	// 从私钥生成公钥
-	cmd = exec.Command("wg", "pubkey")
-	cmd.Stdin = strings.NewReader(privateKey)
-	pubOutput, err := cmd.Output()
-	if err != nil {
-		return "", "", fmt.Errorf("failed to generate public key: %v", err)
+// ValidateWireguardKey 校验WireGuard密钥格式（32字节数据的base64编码）
+func ValidateWireguardKey(key string) error {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(decoded) != 32 {
+		return fmt.Errorf("key must be 32 bytes encoded in base64")
 	}
-	publicKey = strings.TrimSpace(string(pubOutput))
+	return nil
+}
 
-	return privateKey, publicKey, nil
+// GeneratePresharedKey 生成WireGuard预共享密钥（PSK）
+func (s *WireguardService) GeneratePresharedKey() (string, error) {
+	key, err := wgtypes.GenerateKey()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate preshared key: %v", err)
+	}
+	return key.String(), nil
 }
 
 // CreateConfig 创建WireGuard配置文件
+// 文件使用 wg-quick 格式，便于排查和手动恢复；接口本身由 StartWireguard 按同一份配置直接创建
 func (s *WireguardService) CreateConfig(username string, config *WireguardConfig) (string, error) {
 	// 确保配置目录存在
 	userConfigDir := filepath.Join(s.configDir, username)
@@ -68,121 +93,270 @@ func (s *WireguardService) CreateConfig(username string, config *WireguardConfig
 	// 配置文件路径
 	configPath := filepath.Join(userConfigDir, fmt.Sprintf("%s.conf", config.InterfaceName))
 
+	// 双栈时接口同时配置IPv4和IPv6地址
+	address := config.Address
+	if config.Address6 != "" {
+		address += ", " + config.Address6
+	}
+
 	// 生成配置内容
-	// PostUp/PostDown 规则：
-	// 0. 启用 IP 转发（命名空间内）
-	// 1. 允许 WireGuard 流量通过 veth 接口转发
-	// 2. 允许 veth 流量通过外网接口转发（访问外网）
-	// 3. 对外网流量进行 NAT
+	// 转发和NAT规则由防火墙后端维护（接口重建不影响规则），PostUp 只启用命名空间内的IP转发
+	// peer路由由管理程序维护（peer背后的网段、服务器路由表、出口peer路由表），不按 AllowedIPs 添加路由
 	configContent := fmt.Sprintf(`[Interface]
 PrivateKey = %s
 Address = %s
 ListenPort = %d
 SaveConfig = false
-
-# PostUp 规则：
-# 0. 启用 IP 转发（关键：必须在命名空间内启用）
-PostUp = sysctl -w net.ipv4.ip_forward=1
-# 1. WireGuard <-> veth 转发
-PostUp = iptables -A FORWARD -i %%i -o %s -j ACCEPT
-PostUp = iptables -A FORWARD -i %s -o %%i -j ACCEPT
-# 2. veth <-> 外网接口转发（关键：允许访问外网）
-PostUp = iptables -A FORWARD -i %s -o %s -j ACCEPT
-PostUp = iptables -A FORWARD -i %s -o %s -j ACCEPT
-# 3. NAT规则：关键 - 对 WireGuard 网段通过 veth 出去的流量进行 MASQUERADE
-PostUp = iptables -t nat -A POSTROUTING -s %s -o %s -j MASQUERADE
-# 4. NAT规则：对通过外网接口出去的流量进行MASQUERADE
-PostUp = iptables -t nat -A POSTROUTING -o %s -j MASQUERADE
-
-# PostDown 规则：清理上述规则
-PostDown = iptables -D FORWARD -i %%i -o %s -j ACCEPT
-PostDown = iptables -D FORWARD -i %s -o %%i -j ACCEPT
-PostDown = iptables -D FORWARD -i %s -o %s -j ACCEPT
-PostDown = iptables -D FORWARD -i %s -o %s -j ACCEPT
-PostDown = iptables -t nat -D POSTROUTING -s %s -o %s -j MASQUERADE
-PostDown = iptables -t nat -D POSTROUTING -o %s -j MASQUERADE
+Table = off
 `,
 		config.PrivateKey,
-		config.Address,
+		address,
 		config.ListenPort,
-		// PostUp
-		config.VethInterface,
-		config.VethInterface,
-		config.VethInterface, config.OutInterface,
-		config.OutInterface, config.VethInterface,
-		config.Address, config.VethInterface, // NAT for WireGuard subnet
-		config.OutInterface,
-		// PostDown
-		config.VethInterface,
-		config.VethInterface,
-		config.VethInterface, config.OutInterface,
-		config.OutInterface, config.VethInterface,
-		config.Address, config.VethInterface, // NAT for WireGuard subnet
-		config.OutInterface,
 	)
+	if config.MTU > 0 {
+		configContent += fmt.Sprintf("MTU = %d\n", config.MTU)
+	}
+	if config.FwMark != 0 {
+		configContent += fmt.Sprintf("FwMark = 0x%x\n", config.FwMark)
+	}
 
-	// 写入配置文件
-	if err := os.WriteFile(configPath, []byte(configContent), 0600); err != nil {
+	configContent += `
+# 启用 IP 转发（关键：必须在命名空间内启用）
+PostUp = sysctl -w net.ipv4.ip_forward=1
+`
+
+	if config.Address6 != "" {
+		configContent += "PostUp = sysctl -w net.ipv6.conf.all.forwarding=1\n"
+	}
+
+	// 追加 [Peer] 段，保证接口重建后peer不会丢失
+	for _, peer := range config.Peers {
+		configContent += "\n[Peer]\n"
+		if peer.Comment != "" {
+			configContent += fmt.Sprintf("# %s\n", strings.ReplaceAll(peer.Comment, "\n", " "))
+		}
+		configContent += fmt.Sprintf("PublicKey = %s\n", peer.PublicKey)
+		if peer.PresharedKey != "" {
+			configContent += fmt.Sprintf("PresharedKey = %s\n", peer.PresharedKey)
+		}
+		if peer.AllowedIPs != "" {
+			configContent += fmt.Sprintf("AllowedIPs = %s\n", peer.AllowedIPs)
+		}
+		if peer.Endpoint != "" {
+			configContent += fmt.Sprintf("Endpoint = %s\n", peer.Endpoint)
+		}
+		if peer.PersistentKeepalive > 0 {
+			configContent += fmt.Sprintf("PersistentKeepalive = %d\n", peer.PersistentKeepalive)
+		}
+	}
+
+	// 原子写入配置文件：先写临时文件再重命名，避免中途失败留下不完整的配置
+	if err := writeFileAtomic(configPath, []byte(configContent), 0600); err != nil {
 		return "", fmt.Errorf("failed to write config file: %v", err)
 	}
 
 	return configPath, nil
 }
 
-// StartWireguardInNamespace 在命名空间中启动WireGuard
-func (s *WireguardService) StartWireguardInNamespace(nsName, configPath string) error {
-	// 在命名空间中启动WireGuard
-	cmd := exec.Command("ip", "netns", "exec", nsName, "wg-quick", "up", configPath)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to start wireguard in namespace: %v, output: %s", err, string(output))
+// SyncConfig 将配置中的接口和peer设置同步到运行中的接口（与 wg syncconf 一致，不中断已有连接）
+func (s *WireguardService) SyncConfig(nsName string, config *WireguardConfig) error {
+	desired, err := config.deviceConfig()
+	if err != nil {
+		return err
+	}
+	device, err := s.backend.Device(nsName, config.InterfaceName)
+	if err != nil {
+		return fmt.Errorf("failed to read wireguard interface: %w", err)
+	}
+	if err := s.backend.ConfigureDevice(nsName, config.InterfaceName, syncConfig(device, desired)); err != nil {
+		return fmt.Errorf("failed to sync wireguard config: %w", err)
 	}
 	return nil
 }
 
-// StopWireguardInNamespace 在命名空间中停止WireGuard
-func (s *WireguardService) StopWireguardInNamespace(nsName, configPath string) error {
-	cmd := exec.Command("ip", "netns", "exec", nsName, "wg-quick", "down", configPath)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to stop wireguard in namespace: %v, output: %s", err, string(output))
+// deviceConfig 将配置转换为完整的接口配置：私钥、监听端口、防火墙标记和全部peer
+// peer 的 allowed-ips、预共享密钥和保活间隔按配置完整设置，未设置的字段被清除
+func (c *WireguardConfig) deviceConfig() (wgtypes.Config, error) {
+	privateKey, err := wgtypes.ParseKey(c.PrivateKey)
+	if err != nil {
+		return wgtypes.Config{}, fmt.Errorf("invalid private key: %v", err)
 	}
-	return nil
+	port := c.ListenPort
+	mark := int(c.FwMark)
+	cfg := wgtypes.Config{PrivateKey: &privateKey, ListenPort: &port, FirewallMark: &mark}
+
+	for _, peer := range c.Peers {
+		publicKey, err := wgtypes.ParseKey(peer.PublicKey)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid peer key %q", peer.PublicKey)
+		}
+		presharedKey := wgtypes.Key{}
+		if peer.PresharedKey != "" {
+			if presharedKey, err = wgtypes.ParseKey(peer.PresharedKey); err != nil {
+				return cfg, fmt.Errorf("invalid preshared key for peer %s", peer.PublicKey)
+			}
+		}
+		allowedIPs, err := parsePrefixList(peer.AllowedIPs)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid allowed-ips for peer %s: %v", peer.PublicKey, err)
+		}
+		keepalive := time.Duration(peer.PersistentKeepalive) * time.Second
+
+		peerConfig := wgtypes.PeerConfig{
+			PublicKey:                   publicKey,
+			PresharedKey:                &presharedKey,
+			PersistentKeepaliveInterval: &keepalive,
+			ReplaceAllowedIPs:           true,
+			AllowedIPs:                  make([]net.IPNet, 0, len(allowedIPs)),
+		}
+		for _, prefix := range allowedIPs {
+			peerConfig.AllowedIPs = append(peerConfig.AllowedIPs, net.IPNet{
+				IP:   net.IP(prefix.Addr().AsSlice()),
+				Mask: net.CIDRMask(prefix.Bits(), prefix.Addr().BitLen()),
+			})
+		}
+		if peer.Endpoint != "" {
+			if peerConfig.Endpoint, err = net.ResolveUDPAddr("udp", peer.Endpoint); err != nil {
+				return cfg, fmt.Errorf("failed to resolve endpoint %q: %v", peer.Endpoint, err)
+			}
+		}
+		cfg.Peers = append(cfg.Peers, peerConfig)
+	}
+	return cfg, nil
+}
+
+// syncConfig 计算与 wg syncconf 相同效果的配置：设置配置中的全部 peer，删除接口上多余的 peer，
+// 已有 peer 的会话和握手状态保持不变
+func syncConfig(device *wgtypes.Device, desired wgtypes.Config) wgtypes.Config {
+	wanted := make(map[wgtypes.Key]bool, len(desired.Peers))
+	for _, peer := range desired.Peers {
+		wanted[peer.PublicKey] = true
+	}
+
+	cfg := desired
+	cfg.ReplacePeers = false
+	cfg.Peers = append([]wgtypes.PeerConfig{}, desired.Peers...)
+	for _, peer := range device.Peers {
+		if !wanted[peer.PublicKey] {
+			cfg.Peers = append(cfg.Peers, wgtypes.PeerConfig{PublicKey: peer.PublicKey, Remove: true})
+		}
+	}
+	return cfg
 }
 
-// GetWireguardStatus 获取WireGuard状态
-func (s *WireguardService) GetWireguardStatus(nsName, interfaceName string) (string, error) {
-	cmd := exec.Command("ip", "netns", "exec", nsName, "wg", "show", interfaceName)
-	output, err := cmd.CombinedOutput()
+// writeFileAtomic 原子写入文件（同目录临时文件 + rename）
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
 	if err != nil {
-		return "", fmt.Errorf("failed to get wireguard status: %v, output: %s", err, string(output))
+		return err
 	}
-	return string(output), nil
+	tmpPath := tmp.Name()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Chmod(tmpPath, perm); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
 }
 
-// AddPeer 添加WireGuard peer
-func (s *WireguardService) AddPeer(nsName, interfaceName, peerPublicKey, allowedIPs, endpoint string) error {
-	args := []string{"netns", "exec", nsName, "wg", "set", interfaceName, "peer", peerPublicKey, "allowed-ips", allowedIPs}
-	if endpoint != "" {
-		args = append(args, "endpoint", endpoint)
+// DefaultWireguardMTU 未设置MTU时接口使用的MTU（与 wg-quick 在1500字节链路上的计算结果一致）
+const DefaultWireguardMTU = 1420
+
+// StartWireguard 在命名空间中创建并启动WireGuard接口：配置密钥、端口和全部peer，设置地址和MTU
+// 命名空间内的IP转发由调用方启用（见 NetnsService.EnableForwarding），任一步骤失败时删除接口
+func (s *WireguardService) StartWireguard(nsName string, config *WireguardConfig) error {
+	deviceConfig, err := config.deviceConfig()
+	if err != nil {
+		return err
 	}
-	
-	cmd := exec.Command("ip", args...)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to add peer: %v, output: %s", err, string(output))
+	var addresses []netip.Prefix
+	for _, address := range []string{config.Address, config.Address6} {
+		if address == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(address)
+		if err != nil {
+			return fmt.Errorf("invalid interface address %s: %v", address, err)
+		}
+		addresses = append(addresses, prefix)
+	}
+
+	if err := s.backend.AddLink(nsName, Link{Name: config.InterfaceName, Kind: LinkWireguard}); err != nil {
+		return fmt.Errorf("failed to start wireguard in namespace: %w", err)
+	}
+	if err := s.configureInterface(nsName, config, deviceConfig, addresses); err != nil {
+		s.backend.DeleteLink(nsName, config.InterfaceName)
+		return fmt.Errorf("failed to start wireguard in namespace: %w", err)
 	}
 	return nil
 }
 
-// RemovePeer 移除WireGuard peer
-func (s *WireguardService) RemovePeer(nsName, interfaceName, peerPublicKey string) error {
-	cmd := exec.Command("ip", "netns", "exec", nsName, "wg", "set", interfaceName, "peer", peerPublicKey, "remove")
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to remove peer: %v, output: %s", err, string(output))
+// configureInterface 配置新创建的WireGuard接口并启动
+func (s *WireguardService) configureInterface(nsName string, config *WireguardConfig, deviceConfig wgtypes.Config, addresses []netip.Prefix) error {
+	deviceConfig.ReplacePeers = true
+	if err := s.backend.ConfigureDevice(nsName, config.InterfaceName, deviceConfig); err != nil {
+		return err
+	}
+	for _, address := range addresses {
+		if err := s.backend.ReplaceAddress(nsName, config.InterfaceName, address, false); err != nil {
+			return err
+		}
+	}
+	mtu := config.MTU
+	if mtu == 0 {
+		mtu = DefaultWireguardMTU
+	}
+	if err := s.backend.SetLinkMTU(nsName, config.InterfaceName, mtu); err != nil {
+		return err
+	}
+	return s.backend.SetLinkUp(nsName, config.InterfaceName)
+}
+
+// StopWireguard 删除命名空间中的WireGuard接口
+func (s *WireguardService) StopWireguard(nsName, interfaceName string) error {
+	if err := s.backend.DeleteLink(nsName, interfaceName); err != nil {
+		return fmt.Errorf("failed to stop wireguard in namespace: %w", err)
 	}
 	return nil
 }
 
+// SetFwMark 修改运行中接口的防火墙标记（0表示取消标记）
+func (s *WireguardService) SetFwMark(nsName, interfaceName string, fwMark uint32) error {
+	mark := int(fwMark)
+	if err := s.backend.ConfigureDevice(nsName, interfaceName, wgtypes.Config{FirewallMark: &mark}); err != nil {
+		return fmt.Errorf("failed to set fwmark: %w", err)
+	}
+	return nil
+}
+
+// InterfaceRunning 检查命名空间中的WireGuard接口是否存在
+func (s *WireguardService) InterfaceRunning(nsName, interfaceName string) bool {
+	_, err := s.backend.Device(nsName, interfaceName)
+	return err == nil
+}
+
 // GenerateClientConfig 生成客户端配置
-func (s *WireguardService) GenerateClientConfig(serverPublicKey, serverEndpoint, clientPrivateKey, clientAddress, allowedIPs string) string {
+func (s *WireguardService) GenerateClientConfig(serverPublicKey, serverEndpoint, clientPrivateKey, presharedKey, clientAddress, allowedIPs string) string {
+	pskLine := ""
+	if presharedKey != "" {
+		pskLine = fmt.Sprintf("PresharedKey = %s\n", presharedKey)
+	}
+
 	return fmt.Sprintf(`[Interface]
 PrivateKey = %s
 Address = %s
@@ -190,13 +364,14 @@ DNS = 8.8.8.8
 
 [Peer]
 PublicKey = %s
-Endpoint = %s
+%sEndpoint = %s
 AllowedIPs = %s
 PersistentKeepalive = 25
 `,
 		clientPrivateKey,
 		clientAddress,
 		serverPublicKey,
+		pskLine,
 		serverEndpoint,
 		allowedIPs,
 	)
@@ -209,79 +384,53 @@ func (s *WireguardService) GetConfigPath(username, interfaceName string) string
 
 // GetDetailedStats 获取详细的WireGuard统计信息
 func (s *WireguardService) GetDetailedStats(nsName, interfaceName string) (*models.WireguardServerStats, error) {
-	cmd := exec.Command("ip", "netns", "exec", nsName, "wg", "show", interfaceName, "dump")
-	output, err := cmd.CombinedOutput()
+	device, err := s.backend.Device(nsName, interfaceName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get wireguard stats: %v, output: %s", err, string(output))
+		return nil, fmt.Errorf("failed to get wireguard stats: %w", err)
 	}
-
-	return s.parseWireguardDump(string(output), interfaceName)
+	return deviceStats(device), nil
 }
 
-// parseWireguardDump 解析 wg show dump 输出
-// 输出格式：
-// 第一行：interface private-key public-key listen-port fwmark
-// 后续行：public-key preshared-key endpoint allowed-ips latest-handshake transfer-rx transfer-tx persistent-keepalive
-func (s *WireguardService) parseWireguardDump(output, interfaceName string) (*models.WireguardServerStats, error) {
-	lines := strings.Split(strings.TrimSpace(output), "\n")
-	if len(lines) == 0 {
-		return nil, fmt.Errorf("empty output")
-	}
-
+// deviceStats 将接口状态转换为统计信息，没有端点和 allowed-ips 的peer显示为 (none)
+func deviceStats(device *wgtypes.Device) *models.WireguardServerStats {
 	stats := &models.WireguardServerStats{
-		Interface: interfaceName,
-		Peers:     []models.WireguardPeerStats{},
-	}
-
-	// 解析第一行（接口信息）
-	interfaceFields := strings.Fields(lines[0])
-	if len(interfaceFields) >= 4 {
-		stats.PublicKey = interfaceFields[2]
-		if port, err := strconv.Atoi(interfaceFields[3]); err == nil {
-			stats.ListenPort = port
-		}
+		Interface:  device.Name,
+		PublicKey:  device.PublicKey.String(),
+		ListenPort: device.ListenPort,
+		Peers:      []models.WireguardPeerStats{},
 	}
 
-	// 解析peers信息
-	for i := 1; i < len(lines); i++ {
-		fields := strings.Fields(lines[i])
-		if len(fields) < 8 {
-			continue
-		}
-
+	for _, peer := range device.Peers {
 		peerStats := models.WireguardPeerStats{
-			PublicKey:  fields[0],
-			Endpoint:   fields[2],
-			AllowedIPs: fields[3],
+			PublicKey:           peer.PublicKey.String(),
+			Endpoint:            "(none)",
+			AllowedIPs:          "(none)",
+			TransferRx:          peer.ReceiveBytes,
+			TransferTx:          peer.TransmitBytes,
+			PersistentKeepalive: int(peer.PersistentKeepaliveInterval / time.Second),
 		}
-
-		// 解析最后握手时间
-		if handshake, err := strconv.ParseInt(fields[4], 10, 64); err == nil && handshake > 0 {
-			peerStats.LatestHandshake = time.Unix(handshake, 0)
+		// 内核对从未握手的peer返回 Unix 时间 0
+		if peer.LastHandshakeTime.Unix() > 0 {
+			peerStats.LatestHandshake = peer.LastHandshakeTime
 		}
-
-		// 解析接收字节数
-		if rx, err := strconv.ParseInt(fields[5], 10, 64); err == nil {
-			peerStats.TransferRx = rx
-			stats.TotalRx += rx
+		if peer.Endpoint != nil {
+			peerStats.Endpoint = peer.Endpoint.String()
 		}
-
-		// 解析发送字节数
-		if tx, err := strconv.ParseInt(fields[6], 10, 64); err == nil {
-			peerStats.TransferTx = tx
-			stats.TotalTx += tx
-		}
-
-		// 解析persistent keepalive
-		if keepalive, err := strconv.Atoi(fields[7]); err == nil {
-			peerStats.PersistentKeepalive = keepalive
+		if len(peer.AllowedIPs) > 0 {
+			allowedIPs := make([]string, 0, len(peer.AllowedIPs))
+			for _, prefix := range peer.AllowedIPs {
+				allowedIPs = append(allowedIPs, prefix.String())
+			}
+			peerStats.AllowedIPs = strings.Join(allowedIPs, ",")
 		}
 
+		stats.TotalRx += peer.ReceiveBytes
+		stats.TotalTx += peer.TransmitBytes
 		stats.Peers = append(stats.Peers, peerStats)
 	}
 
 	stats.PeerCount = len(stats.Peers)
-	return stats, nil
+	return stats
 }
 
 // GetPeerStatsMap 获取peer统计信息的映射（以公钥为key）
@@ -7,12 +7,21 @@ import (
 	"cloud-platform/internal/services"
 	"fmt"
 	"log"
+	"os"
 	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
 func main() {
+	// Maintenance sub-commands (e.g. generate-master-key, reencrypt)
+	if len(os.Args) > 1 {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			log.Fatalf("%v", err)
+		}
+		return
+	}
+
 	// Load configuration
 	if err := config.LoadConfig("config.yaml"); err != nil {
 		log.Fatalf("Failed to load config: %v", err)
@@ -27,6 +36,33 @@ func main() {
 	monitoringService := services.NewMonitoringService(database.DB, 10*time.Second)
 	go monitoringService.Start()
 
+	// Start reconcile service (rebuild namespaces, interfaces and peers from the database at boot)
+	networkService := services.NewUserNetworkService(database.DB, config.AppConfig.Network)
+	reconcileInterval := time.Duration(config.AppConfig.Network.ReconcileInterval) * time.Second
+	if reconcileInterval <= 0 {
+		reconcileInterval = 5 * time.Minute
+	}
+	reconcileService := services.NewReconcileService(database.DB, networkService, reconcileInterval)
+	go reconcileService.Start()
+
+	// Start key rotation service (retire old peer keys once their grace period is over)
+	keyRotationService := services.NewKeyRotationService(database.DB, networkService, 15*time.Second)
+	go keyRotationService.Start()
+
+	// Start exit peer service (fall back to the server egress while an exit peer is stale)
+	exitPeerService := services.NewExitPeerService(database.DB, networkService, 30*time.Second)
+	go exitPeerService.Start()
+
+	// Start peer access service (remove expired peers and toggle peers at access window boundaries)
+	peerAccessService := services.NewPeerAccessService(database.DB, networkService, 30*time.Second)
+	go peerAccessService.Start()
+
+	// Start built-in DNS server (peer names and custom records for every user namespace)
+	if config.AppConfig.Network.DNS.Enabled {
+		dnsServer := services.NewDNSServer(database.DB, config.AppConfig.Network.DNS)
+		go dnsServer.Start()
+	}
+
 	// Setup Gin
 	r := gin.Default()
 
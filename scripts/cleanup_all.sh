@@ -80,7 +80,7 @@ echo ""
 echo "===== 清理完成 ====="
 echo ""
 echo "系统已完全重置。现在可以："
-echo "  1. 重新运行: sudo go run main.go"
+echo "  1. 重新运行: sudo go run ."
 echo "  2. 系统会自动创建默认管理员"
 echo "  3. 管理员邮箱: admin@platform.com"
 echo "  4. 默认密码: password"